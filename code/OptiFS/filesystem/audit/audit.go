@@ -0,0 +1,223 @@
+// Package audit keeps an append-only log of security-relevant events: denied and privileged
+// accesses, changes of mode and ownership, deletions and administrative actions. Each event is a
+// line of JSON (NDJSON), and the log is rotated when it grows too big.
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"filesystem/logging"
+	"filesystem/persist"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var logger = logging.For(logging.Audit)
+
+// The kinds of event
+const (
+	Access  = "access"  // a permission check
+	Chmod   = "chmod"   // a change of mode
+	Chown   = "chown"   // a change of owner or group
+	Delete  = "delete"  // a file or directory being removed
+	Control = "control" // a command sent to the control socket
+	Admin   = "admin"   // an administrative action outside the control socket, e.g. changing the sysadmin
+)
+
+// The outcomes of an event
+const (
+	Allowed  = "allowed"  // permitted by the normal permissions
+	Denied   = "denied"   // refused
+	Bypassed = "bypassed" // only permitted because the caller is the sysadmin, an admin or has a delegated role
+	Failed   = "failed"   // permitted, but failed for another reason
+)
+
+// Event is a line of the audit log
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"event"`
+	Op      string    `json:"op,omitempty"` // what was attempted, e.g. read, unlink or the control command
+	UID     uint32    `json:"uid"`
+	GID     uint32    `json:"gid"`
+	PID     uint32    `json:"pid"`
+	Path    string    `json:"path,omitempty"` // relative to the root of the filesystem
+	Outcome string    `json:"outcome"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Options decide where the audit log is written and what goes in it
+type Options struct {
+	File      string   // no audit log if empty
+	MaxSize   int64    // bytes, the log is rotated before it grows past this (never if 0)
+	Keep      int      // how many rotated logs are kept, as <file>.1 (the newest) to <file>.<keep>
+	DataPaths []string // subtrees (relative to the root of the filesystem) where every access is audited, not just denials
+}
+
+var mu sync.Mutex
+var options Options
+var file *os.File
+var size int64
+
+// The root of the underlying filesystem, event paths are relative to it
+var rootPath string
+
+// Sets the root of the underlying filesystem, so events can show paths as users see them
+func SetRootPath(path string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rootPath = path
+}
+
+// Starts, changes or (with no file) stops the audit log. The new file is opened before the old one
+// is closed, so nothing is lost if it fails.
+func Configure(o Options) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var newFile *os.File
+	var newSize int64
+	if o.File != "" {
+		var err error
+		if newFile, newSize, err = open(o.File); err != nil {
+			return err
+		}
+	}
+	if file != nil {
+		file.Close()
+	}
+
+	file, size = newFile, newSize
+	options = o
+	options.DataPaths = make([]string, len(o.DataPaths))
+	for i, path := range o.DataPaths {
+		options.DataPaths[i] = filepath.Clean(path)
+	}
+	return nil
+}
+
+// Stops the audit log
+func Close() error {
+	return Configure(Options{})
+}
+
+// Checks if there's an audit log, so callers can skip working out events nobody will see
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return file != nil
+}
+
+// Checks if every access to 'path' (on the underlying filesystem) should be audited
+func AuditsData(path string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if file == nil {
+		return false
+	}
+	relative := persist.RelativePath(rootPath, path)
+	for _, subtree := range options.DataPaths {
+		if subtree == "/" || relative == subtree || strings.HasPrefix(relative, subtree+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Records an event by the caller in 'ctx', 'e.Path' is on the underlying filesystem
+func RecordContext(ctx context.Context, e Event) {
+	if caller, ok := fuse.FromContext(ctx); ok {
+		e.UID, e.GID, e.PID = caller.Uid, caller.Gid, caller.Pid
+	}
+	if e.Path != "" {
+		mu.Lock()
+		e.Path = persist.RelativePath(rootPath, e.Path)
+		mu.Unlock()
+	}
+	Record(e)
+}
+
+// Records an event, which already has the caller and the path as users see it
+func Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("Couldn't encode audit event", "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if file == nil {
+		return
+	}
+	if options.MaxSize > 0 && size > 0 && size+int64(len(line)) > options.MaxSize {
+		if err := rotate(); err != nil {
+			logger.Error("Couldn't rotate the audit log", "file", options.File, "err", err)
+		}
+	}
+
+	n, err := file.Write(line)
+	size += int64(n)
+	if err != nil {
+		logger.Error("Couldn't write to the audit log", "file", options.File, "err", err)
+	}
+}
+
+// Opens the audit log for appending, only the user running OptiFS can read it
+func open(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, st.Size(), nil
+}
+
+// Moves <file> to <file>.1, <file>.1 to <file>.2 and so on, dropping the oldest, then starts a new
+// <file>. If anything fails, the current file is kept. The mutex must be held.
+func rotate() error {
+	logger.Info("Rotating the audit log", "file", options.File)
+
+	// the open file follows its renames, so it's only closed once the new one is open
+	if options.Keep <= 0 {
+		if err := os.Remove(options.File); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := options.Keep - 1; i >= 1; i-- {
+			err := os.Rename(fmt.Sprintf("%v.%d", options.File, i), fmt.Sprintf("%v.%d", options.File, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(options.File, options.File+".1"); err != nil {
+			return err
+		}
+	}
+
+	newFile, newSize, err := open(options.File)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	file, size = newFile, newSize
+	return nil
+}
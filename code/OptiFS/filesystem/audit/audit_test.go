@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Reads every event in an audit log
+func readEvents(t *testing.T, path string) []Event {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Expected a line of JSON, got %v", scanner.Text())
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// Unit test for RecordContext and AuditsData in audit.go
+func TestRecordContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	SetRootPath("/data")
+	defer SetRootPath("")
+	if err := Configure(Options{File: path, DataPaths: []string{"/finance/"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	ctx := fuse.NewContext(context.Background(), &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 100}, Pid: 42})
+	RecordContext(ctx, Event{Type: Access, Op: "write", Path: "/data/finance/q1", Outcome: Denied})
+	RecordContext(ctx, Event{Type: Delete, Op: "rmdir", Path: "/data", Outcome: Failed})
+
+	events := readEvents(t, path)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %v", events)
+	}
+	e := events[0]
+	if e.UID != 1000 || e.GID != 100 || e.PID != 42 || e.Path != "/finance/q1" || e.Outcome != Denied || e.Time.IsZero() {
+		t.Errorf("Expected the caller and a path relative to the root, got %+v", e)
+	}
+	if events[1].Path != "/" {
+		t.Errorf("Expected the root to be /, got %v", events[1].Path)
+	}
+
+	testCases := []struct {
+		path     string
+		expected bool
+	}{
+		{"/data/finance", true},
+		{"/data/finance/q1/report", true},
+		{"/data/financed", false},
+		{"/data/scratch", false},
+	}
+	for _, tc := range testCases {
+		if got := AuditsData(tc.path); got != tc.expected {
+			t.Errorf("Expected AuditsData(%v) to be %v, got %v", tc.path, tc.expected, got)
+		}
+	}
+
+	// nothing is recorded, or audited, once the log is closed
+	Close()
+	Record(Event{Type: Control, Outcome: Allowed})
+	if AuditsData("/data/finance") || len(readEvents(t, path)) != 2 {
+		t.Errorf("Expected nothing to be audited after closing")
+	}
+}
+
+// Unit test for rotating the audit log in audit.go
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// a fixed time, so every event is the same size
+	event := Event{Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Type: Control, Op: "status", Outcome: Allowed}
+	line, _ := json.Marshal(event)
+	// each file has room for two events
+	if err := Configure(Options{File: path, MaxSize: int64(2*(len(line)+1) + 1), Keep: 2}); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	for i := 0; i < 7; i++ {
+		Record(event)
+	}
+
+	// 7 events: 1 in the log, 2 in each of .1 and .2, and the 2 oldest dropped
+	for file, expected := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		if got := len(readEvents(t, file)); got != expected {
+			t.Errorf("Expected %v events in %v, got %v", expected, file, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated logs to be kept")
+	}
+}
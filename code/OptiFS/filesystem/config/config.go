@@ -0,0 +1,323 @@
+// This file contains the configuration file of OptiFS, and how it's loaded and validated
+
+package config
+
+import (
+	"filesystem/logging"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is everything that can be set in the configuration file, each section matches
+// a table in the TOML file
+type Config struct {
+	Mount       MountConfig       `toml:"mount"`
+	Persistence PersistenceConfig `toml:"persistence"`
+	Control     ControlConfig     `toml:"control"`
+	Dedup       DedupConfig       `toml:"dedup"`
+	Logging     LoggingConfig     `toml:"logging"`
+	Metrics     MetricsConfig     `toml:"metrics"`
+	Audit       AuditConfig       `toml:"audit"`
+	Versions    VersionsConfig    `toml:"versions"`
+	Trash       TrashConfig       `toml:"trash"`
+	Quota       QuotaConfig       `toml:"quota"`
+	Tier        TierConfig        `toml:"tier"`
+}
+
+// MountConfig decides where and how the filesystem is mounted
+type MountConfig struct {
+	Point      string   `toml:"point"`       // the mount point
+	Underlying string   `toml:"underlying"`  // the underlying filesystem
+	Debug      bool     `toml:"debug"`       // low-level logging from the FUSE bindings
+	ReadOnly   bool     `toml:"read_only"`   // nothing can change the filesystem, and nothing is saved
+	AllowOther bool     `toml:"allow_other"` // let users other than the one mounting access it
+	Options    []string `toml:"options"`     // extra mount options, passed to the kernel
+	Atime      string   `toml:"atime"`       // strictatime, relatime or noatime
+	Statfs     string   `toml:"statfs"`      // physical or logical, how df reports used and free space
+}
+
+// PersistenceConfig decides how the metadata of the filesystem is saved
+type PersistenceConfig struct {
+	Enabled        bool   `toml:"enabled"`
+	Save           string `toml:"save"`            // where the hashmaps and sysadmin info are saved
+	Interval       int    `toml:"interval"`        // seconds between automatic saves
+	IntegrityCheck bool   `toml:"integrity_check"` // check the saved metadata against the underlying filesystem when mounting
+}
+
+// ControlConfig configures the control socket and shutting down
+type ControlConfig struct {
+	Socket          string `toml:"socket"`           // where the control socket is created, the save location by default
+	ShutdownTimeout int    `toml:"shutdown_timeout"` // seconds to wait for operations to finish when shutting down
+}
+
+// DedupConfig decides which files are de-duplicated
+type DedupConfig struct {
+	Enabled bool        `toml:"enabled"`
+	MinSize int64       `toml:"min_size"` // files smaller than this (in bytes) are never de-duplicated
+	Rules   []DedupRule `toml:"rule"`     // override the policy for subtrees of the filesystem
+}
+
+// DedupRule overrides the de-duplication policy for everything under a directory,
+// anything it doesn't set is inherited
+type DedupRule struct {
+	Path    string `toml:"path"` // relative to the root of the filesystem, e.g. "/scratch"
+	Enabled *bool  `toml:"enabled"`
+	MinSize *int64 `toml:"min_size"`
+}
+
+// LoggingConfig decides where logs go, and how much is logged
+type LoggingConfig struct {
+	File   string `toml:"file"`   // logs are appended to this file, standard error if empty
+	Format string `toml:"format"` // text or json
+	Level  string `toml:"level"`  // a level for every subsystem, and/or subsystem=level pairs, e.g. "warn,vfs=debug"
+}
+
+// The configuration used when there's no configuration file, matching the defaults of the flags
+func Defaults() *Config {
+	return &Config{
+		Mount:       MountConfig{AllowOther: true, Atime: "relatime", Statfs: "physical"},
+		Persistence: PersistenceConfig{Enabled: true, Interval: 30, IntegrityCheck: true},
+		Control:     ControlConfig{ShutdownTimeout: 10},
+		Dedup:       DedupConfig{Enabled: true},
+		Logging:     LoggingConfig{Format: "text", Level: "info"},
+		Audit:       AuditConfig{MaxSizeMB: 100, Keep: 5},
+		Trash:       TrashConfig{Days: 30},
+		Quota:       QuotaConfig{Charging: "first", GraceDays: 7},
+		Tier:        TierConfig{Days: 30},
+	}
+}
+
+// Loads the configuration file at 'path' on top of the defaults, then validates it
+func Load(path string) (*Config, error) {
+	cfg := Defaults()
+
+	meta, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read configuration file {%v}: %v", path, err)
+	}
+
+	// A misspelt setting would otherwise be silently ignored
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("unknown settings in {%v}: %v", path, strings.Join(keys, ", "))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration file {%v}: %v", path, err)
+	}
+	cfg.resolvePaths(path)
+	return cfg, nil
+}
+
+// Checks the configuration makes sense
+func (c *Config) Validate() error {
+	switch c.Mount.Atime {
+	case "strictatime", "relatime", "noatime":
+	default:
+		return fmt.Errorf("mount.atime must be strictatime, relatime or noatime, not {%v}", c.Mount.Atime)
+	}
+	switch c.Mount.Statfs {
+	case "physical", "logical":
+	default:
+		return fmt.Errorf("mount.statfs must be physical or logical, not {%v}", c.Mount.Statfs)
+	}
+	switch c.Logging.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("logging.format must be text or json, not {%v}", c.Logging.Format)
+	}
+	if _, _, err := logging.ParseLevels(c.Logging.Level); err != nil {
+		return fmt.Errorf("logging.level: %v", err)
+	}
+	if c.Audit.MaxSizeMB < 0 {
+		return fmt.Errorf("audit.max_size_mb can't be negative, not {%v}", c.Audit.MaxSizeMB)
+	}
+	if c.Audit.Keep < 0 {
+		return fmt.Errorf("audit.keep can't be negative, not {%v}", c.Audit.Keep)
+	}
+	for i, dataPath := range c.Audit.DataPaths {
+		if !strings.HasPrefix(dataPath, "/") {
+			return fmt.Errorf("audit.data_paths: path must start with /, not {%v}", dataPath)
+		}
+		c.Audit.DataPaths[i] = path.Clean(dataPath)
+	}
+	if c.Persistence.Interval <= 0 {
+		return fmt.Errorf("persistence.interval must be positive, not {%v}", c.Persistence.Interval)
+	}
+	if c.Control.ShutdownTimeout < 0 {
+		return fmt.Errorf("control.shutdown_timeout can't be negative, not {%v}", c.Control.ShutdownTimeout)
+	}
+	if c.Trash.Days < 0 {
+		return fmt.Errorf("trash.days can't be negative, not {%v}", c.Trash.Days)
+	}
+	switch c.Quota.Charging {
+	case "first", "split", "full":
+	default:
+		return fmt.Errorf("quota.charging must be first, split or full, not {%v}", c.Quota.Charging)
+	}
+	if c.Quota.GraceDays < 0 {
+		return fmt.Errorf("quota.grace_days can't be negative, not {%v}", c.Quota.GraceDays)
+	}
+	if c.Tier.Days < 0 {
+		return fmt.Errorf("tier.days can't be negative, not {%v}", c.Tier.Days)
+	}
+	if c.Dedup.MinSize < 0 {
+		return fmt.Errorf("dedup.min_size can't be negative, not {%v}", c.Dedup.MinSize)
+	}
+
+	seen := make(map[string]bool)
+	for i, rule := range c.Dedup.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("dedup rule %d: path must start with /, not {%v}", i, rule.Path)
+		}
+		cleaned := path.Clean(rule.Path)
+		if seen[cleaned] {
+			return fmt.Errorf("dedup rule %d: {%v} already has a rule", i, rule.Path)
+		}
+		seen[cleaned] = true
+		c.Dedup.Rules[i].Path = cleaned
+
+		if rule.MinSize != nil && *rule.MinSize < 0 {
+			return fmt.Errorf("dedup rule %d: min_size can't be negative, not {%v}", i, *rule.MinSize)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for i, rule := range c.Versions.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("versions rule %d: path must start with /, not {%v}", i, rule.Path)
+		}
+		cleaned := path.Clean(rule.Path)
+		if seen[cleaned] {
+			return fmt.Errorf("versions rule %d: {%v} already has a rule", i, rule.Path)
+		}
+		seen[cleaned] = true
+		c.Versions.Rules[i].Path = cleaned
+
+		if rule.Keep < 0 {
+			return fmt.Errorf("versions rule %d: keep can't be negative, not {%v}", i, rule.Keep)
+		}
+		if rule.Days < 0 {
+			return fmt.Errorf("versions rule %d: days can't be negative, not {%v}", i, rule.Days)
+		}
+	}
+	return nil
+}
+
+// Makes the paths in the configuration absolute, relative to the directory of the configuration file
+func (c *Config) resolvePaths(configPath string) {
+	dir := filepath.Dir(configPath)
+	for _, p := range []*string{&c.Mount.Point, &c.Mount.Underlying, &c.Persistence.Save, &c.Control.Socket, &c.Logging.File, &c.Audit.File, &c.Tier.ColdDir} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+}
+
+// Lists the settings that differ between the configurations but can't change without a remount
+func (c *Config) FixedChanges(newer *Config) []string {
+	var changed []string
+	if c.Mount.Point != newer.Mount.Point || c.Mount.Underlying != newer.Mount.Underlying {
+		changed = append(changed, "mount.point/mount.underlying")
+	}
+	if c.Mount.Debug != newer.Mount.Debug || c.Mount.AllowOther != newer.Mount.AllowOther ||
+		!reflect.DeepEqual(c.Mount.Options, newer.Mount.Options) {
+		changed = append(changed, "mount.debug/mount.allow_other/mount.options")
+	}
+	if c.Mount.ReadOnly != newer.Mount.ReadOnly {
+		changed = append(changed, "mount.read_only")
+	}
+	if c.Persistence.Enabled != newer.Persistence.Enabled || c.Persistence.Save != newer.Persistence.Save {
+		changed = append(changed, "persistence.enabled/persistence.save")
+	}
+	if c.Control.Socket != newer.Control.Socket {
+		changed = append(changed, "control.socket")
+	}
+	if c.Metrics.Listen != newer.Metrics.Listen {
+		changed = append(changed, "metrics.listen")
+	}
+	if c.Tier.ColdDir != newer.Tier.ColdDir {
+		changed = append(changed, "tier.cold_dir")
+	}
+	return changed
+}
+
+// Copies the settings that can't change without a remount from 'older', so the configuration
+// describes what's actually in effect
+func (c *Config) KeepFixed(older *Config) {
+	c.Mount.Point, c.Mount.Underlying = older.Mount.Point, older.Mount.Underlying
+	c.Mount.Debug, c.Mount.AllowOther, c.Mount.Options = older.Mount.Debug, older.Mount.AllowOther, older.Mount.Options
+	c.Mount.ReadOnly = older.Mount.ReadOnly
+	c.Persistence.Enabled, c.Persistence.Save = older.Persistence.Enabled, older.Persistence.Save
+	c.Control.Socket = older.Control.Socket
+	c.Metrics.Listen = older.Metrics.Listen
+	c.Tier.ColdDir = older.Tier.ColdDir
+}
+
+// MetricsConfig decides where the metrics are served
+type MetricsConfig struct {
+	Listen string `toml:"listen"` // the address of the HTTP listener, e.g. "127.0.0.1:9180", no metrics if empty
+}
+
+// AuditConfig decides where security-relevant events are recorded, and how much is recorded
+type AuditConfig struct {
+	File      string   `toml:"file"`        // the audit log, no auditing if empty
+	MaxSizeMB int64    `toml:"max_size_mb"` // the audit log is rotated before it grows past this
+	Keep      int      `toml:"keep"`        // how many rotated audit logs are kept
+	DataPaths []string `toml:"data_paths"`  // subtrees where every access is recorded, not just denials
+}
+
+// VersionsConfig decides which files have their previous versions kept, and for how long
+type VersionsConfig struct {
+	Rules []VersionsRule `toml:"rule"` // no versions are kept outside the subtrees with rules
+}
+
+// VersionsRule decides how many versions are kept of the files in a subtree of the filesystem. A
+// version is kept while it's one of the newest 'Keep', or it's younger than 'Days'.
+type VersionsRule struct {
+	Path string `toml:"path"` // relative to the root of the filesystem, e.g. "/projects"
+	Keep int    `toml:"keep"` // 0 for no limit by count
+	Days int    `toml:"days"` // 0 for no limit by age, with keep also 0 no versions are kept
+}
+
+// TrashConfig decides if deleted files and directories are kept in the trash, and for how long
+type TrashConfig struct {
+	Enabled bool `toml:"enabled"`
+	Days    int  `toml:"days"` // how many days deleted nodes are kept, 0 until they're purged
+}
+
+// QuotaConfig decides how usage is charged for quotas, the limits themselves are set through the control socket
+type QuotaConfig struct {
+	Charging  string `toml:"charging"`   // first, split or full, who is charged for content several files share
+	GraceDays int    `toml:"grace_days"` // how many days usage can stay over a soft limit
+}
+
+// TierConfig decides where content nobody has read for a while is moved to, and when
+type TierConfig struct {
+	ColdDir  string `toml:"cold_dir"`  // the directory the cold tier is kept in, empty for no cold tier
+	Days     int    `toml:"days"`      // how many days content can go unread before it's moved, 0 to never move it
+	ReadCold bool   `toml:"read_cold"` // whether files opened only for reading are read from the cold tier, rather than recalled
+}
+
+// Gets the logging options from the configuration, which must be valid
+func (c *Config) LoggingOptions() logging.Options {
+	level, levels, _ := logging.ParseLevels(c.Logging.Level)
+	return logging.Options{Format: c.Logging.Format, Level: level, Levels: levels}
+}
+
+// Opens the log file, if one is configured
+func (c *Config) OpenLogFile() (*os.File, error) {
+	if c.Logging.File == "" {
+		return nil, nil
+	}
+	return os.OpenFile(c.Logging.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Writes a configuration file to a temporary directory, returning its path
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "optifs.toml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Unit tests for Load in config.go
+func TestLoad(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		err      string // part of the expected error, empty if it should load
+	}{
+		{"empty file uses defaults", "", ""},
+		{"full file", `
+[mount]
+point = "mnt"
+underlying = "/data"
+options = ["ro"]
+atime = "noatime"
+
+[persistence]
+interval = 60
+
+[[dedup.rule]]
+path = "/scratch/"
+enabled = false
+`, ""},
+		{"unknown setting", "[mount]\natim = \"noatime\"", "unknown settings"},
+		{"invalid atime", "[mount]\natime = \"sometimes\"", "mount.atime"},
+		{"invalid statfs", "[mount]\nstatfs = \"compressed\"", "mount.statfs"},
+		{"invalid interval", "[persistence]\ninterval = 0", "persistence.interval"},
+		{"relative audit data path", "[audit]\ndata_paths = [\"finance\"]", "audit.data_paths"},
+		{"invalid audit keep", "[audit]\nkeep = -1", "audit.keep"},
+		{"invalid log format", "[logging]\nformat = \"xml\"", "logging.format"},
+		{"invalid log level", "[logging]\nlevel = \"warn,fuse=debug\"", "unknown subsystem"},
+		{"relative rule path", "[[dedup.rule]]\npath = \"scratch\"", "must start with /"},
+		{"duplicate rule path", "[[dedup.rule]]\npath = \"/a\"\n[[dedup.rule]]\npath = \"/a/\"", "already has a rule"},
+		{"relative versions path", "[[versions.rule]]\npath = \"projects\"\nkeep = 5", "versions rule 0: path must start with /"},
+		{"duplicate versions path", "[[versions.rule]]\npath = \"/a\"\n[[versions.rule]]\npath = \"/a/\"", "versions rule 1: {/a/} already has a rule"},
+		{"negative versions keep", "[[versions.rule]]\npath = \"/a\"\nkeep = -1", "keep can't be negative"},
+		{"negative versions days", "[[versions.rule]]\npath = \"/a\"\ndays = -7", "days can't be negative"},
+		{"negative trash days", "[trash]\nenabled = true\ndays = -1", "trash.days can't be negative"},
+		{"invalid quota charging", "[quota]\ncharging = \"owner\"", "quota.charging must be first, split or full"},
+		{"negative quota grace", "[quota]\ngrace_days = -1", "quota.grace_days can't be negative"},
+		{"negative tier days", "[tier]\ndays = -1", "tier.days can't be negative"},
+		{"not TOML", "[mount", "couldn't read"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tc.contents))
+			if tc.err == "" && err != nil {
+				t.Errorf("Expected to load, got %v", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("Expected an error containing {%v}, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+// Unit test for the values Load reads in config.go
+func TestLoadValues(t *testing.T) {
+	path := writeConfig(t, `
+[mount]
+point = "mnt"
+atime = "noatime"
+
+[dedup]
+min_size = 4096
+
+[[dedup.rule]]
+path = "/scratch/"
+enabled = false
+
+[[versions.rule]]
+path = "/projects/"
+keep = 10
+days = 30
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Relative to the configuration file
+	if cfg.Mount.Point != filepath.Join(filepath.Dir(path), "mnt") {
+		t.Errorf("Expected mount point next to the configuration file, got %v", cfg.Mount.Point)
+	}
+	// Unset values keep their defaults
+	if !cfg.Mount.AllowOther || !cfg.Persistence.Enabled || cfg.Persistence.Interval != 30 || !cfg.Dedup.Enabled ||
+		cfg.Trash.Enabled || cfg.Trash.Days != 30 || cfg.Quota.Charging != "first" || cfg.Quota.GraceDays != 7 ||
+		cfg.Tier.ColdDir != "" || cfg.Tier.Days != 30 || cfg.Tier.ReadCold {
+		t.Errorf("Expected defaults to be kept, got %+v", cfg)
+	}
+	if cfg.Mount.Atime != "noatime" || cfg.Dedup.MinSize != 4096 {
+		t.Errorf("Expected values from the file, got %+v", cfg)
+	}
+
+	if len(cfg.Dedup.Rules) != 1 {
+		t.Fatalf("Expected one rule, got %v", len(cfg.Dedup.Rules))
+	}
+	rule := cfg.Dedup.Rules[0]
+	if rule.Path != "/scratch" || rule.Enabled == nil || *rule.Enabled || rule.MinSize != nil {
+		t.Errorf("Expected a cleaned rule that only sets enabled, got %+v", rule)
+	}
+	if !reflect.DeepEqual(cfg.Versions.Rules, []VersionsRule{{Path: "/projects", Keep: 10, Days: 30}}) {
+		t.Errorf("Expected a cleaned versions rule, got %+v", cfg.Versions.Rules)
+	}
+}
+
+// Unit test for FixedChanges and KeepFixed in config.go
+func TestFixedChanges(t *testing.T) {
+	older := Defaults()
+	newer := Defaults()
+	newer.Mount.Atime = "noatime"
+	newer.Persistence.Interval = 5
+	newer.Tier.Days = 90
+	if changed := older.FixedChanges(newer); len(changed) != 0 {
+		t.Errorf("Expected settings that can be reloaded to be allowed, got %v", changed)
+	}
+
+	newer.Mount.Options = []string{"ro"}
+	newer.Mount.ReadOnly = true
+	newer.Control.Socket = "/tmp/other.sock"
+	newer.Metrics.Listen = "127.0.0.1:9180"
+	newer.Tier.ColdDir = "/mnt/cold"
+	expected := []string{"mount.debug/mount.allow_other/mount.options", "mount.read_only", "control.socket", "metrics.listen", "tier.cold_dir"}
+	if changed := older.FixedChanges(newer); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected %v, got %v", expected, changed)
+	}
+
+	newer.KeepFixed(older)
+	if changed := older.FixedChanges(newer); len(changed) != 0 {
+		t.Errorf("Expected fixed settings to be kept, got %v", changed)
+	}
+	if newer.Mount.Atime != "noatime" || newer.Persistence.Interval != 5 || newer.Tier.Days != 90 {
+		t.Errorf("Expected settings that can be reloaded to be left alone, got %+v", newer)
+	}
+}
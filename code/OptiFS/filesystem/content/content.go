@@ -0,0 +1,193 @@
+// Package content is a store of file contents kept outside the filesystem, for snapshots and old
+// versions of files. Each content is kept once, named by its hash, however many snapshots and versions
+// have it, and is removed when none of them do.
+
+package content
+
+import (
+	"encoding/hex"
+	"errors"
+	"filesystem/hashing"
+	"filesystem/logging"
+	"filesystem/tier"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var logger = logging.For(logging.Snapshot)
+
+// Returned when content is added but there's nowhere to keep it
+var errUnavailable = errors.New("the content store isn't set up, or is read-only")
+
+// Referencer gets the hashes of every content something still needs
+type Referencer func() [][64]byte
+
+var storeDir string // empty until the store is set up
+var writable bool   // false for read-only mounts, nothing is stored or removed
+var referencers []Referencer
+var referencersLock sync.Mutex
+
+// Held (for reading) while content is being added and recorded, so it isn't swept in between
+var sweepLock sync.RWMutex
+
+// Keeps content in 'dir', creating it when something is first stored. Nothing is stored or removed
+// unless it's 'canWrite'.
+func Setup(dir string, canWrite bool) {
+	storeDir, writable = dir, canWrite
+}
+
+// Registers something that keeps content, so what it references isn't swept
+func Register(r Referencer) {
+	referencersLock.Lock()
+	defer referencersLock.Unlock()
+
+	referencers = append(referencers, r)
+}
+
+// Stops the content store being swept until the returned function is called. Anything storing content
+// holds it until it has recorded the hashes of what it stored.
+func Hold() func() {
+	sweepLock.RLock()
+	return sweepLock.RUnlock
+}
+
+// Gets the path of the content with 'hash'
+func Path(hash [64]byte) string {
+	return filepath.Join(storeDir, hex.EncodeToString(hash[:]))
+}
+
+// Checks if the content with 'hash' is already stored
+func Has(hash [64]byte) bool {
+	if storeDir == "" {
+		return false
+	}
+	_, err := os.Stat(Path(hash))
+	return err == nil
+}
+
+// Stores 'data', unless it's already there, returning its hash
+func Put(data []byte) ([64]byte, error) {
+	if storeDir == "" || !writable {
+		return [64]byte{}, errUnavailable
+	}
+
+	hash := hashing.HashContents(data, 0)
+	contentPath := Path(hash)
+	if Has(hash) {
+		return hash, nil
+	}
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		return hash, err
+	}
+
+	// Written to a temporary file first, so a half-written content is never taken as a whole one
+	file, err := os.CreateTemp(storeDir, ".tmp-*")
+	if err != nil {
+		return hash, err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return hash, err
+	}
+	if err := file.Close(); err != nil {
+		return hash, err
+	}
+	return hash, os.Rename(file.Name(), contentPath)
+}
+
+// Stores the content read from 'r', streaming it rather than reading it into memory, returning its hash
+// and size. If it's already there, the copy is thrown away.
+func Copy(r io.Reader) ([64]byte, int64, error) {
+	var hash [64]byte
+	if storeDir == "" || !writable {
+		return hash, 0, errUnavailable
+	}
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		return hash, 0, err
+	}
+
+	// Its hash isn't known until it's all been read, so it's named once it's written
+	file, err := os.CreateTemp(storeDir, ".tmp-*")
+	if err != nil {
+		return hash, 0, err
+	}
+	defer os.Remove(file.Name())
+
+	hasher := hashing.NewHasher()
+	size, err := io.Copy(io.MultiWriter(file, hasher), r)
+	if err != nil {
+		file.Close()
+		return hash, size, err
+	}
+	if err := file.Close(); err != nil {
+		return hash, size, err
+	}
+	copy(hash[:], hasher.Sum(nil))
+	if Has(hash) {
+		return hash, size, nil
+	}
+	return hash, size, os.Rename(file.Name(), Path(hash))
+}
+
+// Stores the content of the regular file at 'nodePath' (on the underlying filesystem), from the cold tier
+// if that's where it is. Content OptiFS already has the hash of is only copied if it isn't stored yet,
+// and anything copied is streamed. Returns its hash, and its size if it was copied (-1 if it wasn't).
+func KeepFile(nodePath string) ([64]byte, int64, error) {
+	file, hash, release, err := tier.OpenRead(nodePath)
+	if err != nil {
+		return [64]byte{}, -1, err
+	}
+	defer release()
+	defer file.Close()
+
+	if hash != ([64]byte{}) && Has(hash) {
+		return hash, -1, nil
+	}
+	return Copy(file)
+}
+
+// Removes every content nothing references, returning how many bytes were freed
+func Sweep() (int64, error) {
+	if storeDir == "" || !writable {
+		return 0, nil
+	}
+
+	sweepLock.Lock()
+	defer sweepLock.Unlock()
+
+	kept := make(map[string]bool)
+	referencersLock.Lock()
+	for _, referencer := range referencers {
+		for _, hash := range referencer() {
+			kept[hex.EncodeToString(hash[:])] = true
+		}
+	}
+	referencersLock.Unlock()
+
+	entries, err := os.ReadDir(storeDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var freed int64
+	for _, entry := range entries {
+		if kept[entry.Name()] {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			freed += info.Size()
+		}
+		if err := os.Remove(filepath.Join(storeDir, entry.Name())); err != nil {
+			return freed, err
+		}
+	}
+	logger.Debug("Swept content store", "freed_bytes", freed)
+	return freed, nil
+}
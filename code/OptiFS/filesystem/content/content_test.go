@@ -0,0 +1,150 @@
+package content
+
+import (
+	"filesystem/hashing"
+	"filesystem/metadata"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Counts the contents in the store
+func count(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// Unit test for Put and Path in content.go
+func TestPut(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "content")
+
+	Setup(dir, false)
+	if _, err := Put([]byte("data")); err == nil {
+		t.Errorf("Expected storing in a read-only store to fail")
+	}
+
+	Setup(dir, true)
+	hash, err := Put([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(Path(hash)); err != nil || string(data) != "data" {
+		t.Errorf("Expected the content at its path, got {%s} (%v)", data, err)
+	}
+
+	// The same content is only kept once
+	again, err := Put([]byte("data"))
+	if err != nil || again != hash {
+		t.Errorf("Expected the same hash, got %x (%v)", again, err)
+	}
+	Put([]byte("other"))
+	if n := count(t, dir); n != 2 {
+		t.Errorf("Expected 2 contents, without temporary files, got %v", n)
+	}
+}
+
+// Unit test for Copy and Has in content.go
+func TestCopy(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "content")
+
+	Setup(dir, false)
+	if _, _, err := Copy(strings.NewReader("data")); err == nil {
+		t.Errorf("Expected storing in a read-only store to fail")
+	}
+
+	Setup(dir, true)
+	expected := hashing.HashContents([]byte("streamed"), 0)
+	if Has(expected) {
+		t.Errorf("Expected the content not to be stored yet")
+	}
+	hash, size, err := Copy(strings.NewReader("streamed"))
+	if err != nil || hash != expected || size != int64(len("streamed")) {
+		t.Fatalf("Expected %x and %v bytes, got %x and %v (%v)", expected, len("streamed"), hash, size, err)
+	}
+	if data, err := os.ReadFile(Path(hash)); err != nil || string(data) != "streamed" || !Has(hash) {
+		t.Errorf("Expected the content at its path, got {%s} (%v)", data, err)
+	}
+
+	// The same content is only kept once, whether it's copied or put
+	if again, _, err := Copy(strings.NewReader("streamed")); err != nil || again != hash {
+		t.Errorf("Expected the same hash, got %x (%v)", again, err)
+	}
+	if put, err := Put([]byte("streamed")); err != nil || put != hash {
+		t.Errorf("Expected the same hash, got %x (%v)", put, err)
+	}
+	if n := count(t, dir); n != 1 {
+		t.Errorf("Expected 1 content, without temporary files, got %v", n)
+	}
+}
+
+// Unit test for KeepFile in content.go
+func TestKeepFile(t *testing.T) {
+	dir, root := filepath.Join(t.TempDir(), "content"), t.TempDir()
+	Setup(dir, true)
+
+	// A file OptiFS doesn't know is copied
+	unknown := filepath.Join(root, "unknown")
+	os.WriteFile(unknown, []byte("unknown"), 0644)
+	hash, size, err := KeepFile(unknown)
+	if err != nil || hash != hashing.HashContents([]byte("unknown"), 0) || size != int64(len("unknown")) {
+		t.Errorf("Expected the file to be copied, got %x and %v bytes (%v)", hash, size, err)
+	}
+
+	// A file whose content is known and stored isn't read again
+	known := filepath.Join(root, "known")
+	os.WriteFile(known, []byte("KNOWN"), 0644)
+	stored, _ := Put([]byte("known"))
+	ref, fileMetadata := metadata.CreateRegularFileMetadata(metadata.CreateRegularFileMapEntry(stored))
+	fileMetadata.Path = known
+	metadata.StoreRegFileInfo(known, &fs.StableAttr{}, 0100644, stored, ref)
+	defer metadata.RemoveNodeInfo(known)
+	defer metadata.RemoveRegularFileMetadata(stored, ref)
+	if hash, size, err := KeepFile(known); err != nil || hash != stored || size != -1 {
+		t.Errorf("Expected the stored content to be used, got %x and %v bytes (%v)", hash, size, err)
+	}
+	if n := count(t, dir); n != 2 {
+		t.Errorf("Expected 2 contents, got %v", n)
+	}
+}
+
+// Unit test for Sweep and Register in content.go
+func TestSweep(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "content")
+	Setup(dir, true)
+
+	kept, _ := Put([]byte("kept"))
+	Put([]byte("unreferenced"))
+	var references [][64]byte
+	Register(func() [][64]byte { return references })
+
+	// Nothing is removed from a read-only store
+	Setup(dir, false)
+	if freed, err := Sweep(); err != nil || freed != 0 || count(t, dir) != 2 {
+		t.Errorf("Expected a read-only store to be left alone, freed %v (%v)", freed, err)
+	}
+
+	Setup(dir, true)
+	references = [][64]byte{kept}
+	freed, err := Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != int64(len("unreferenced")) || count(t, dir) != 1 {
+		t.Errorf("Expected only the unreferenced content to be removed, freed %v with %v left", freed, count(t, dir))
+	}
+	if _, err := os.Stat(Path(kept)); err != nil {
+		t.Errorf("Expected the referenced content to be kept, got %v", err)
+	}
+
+	// A store nothing has been put in yet has nothing to sweep
+	Setup(filepath.Join(t.TempDir(), "missing"), true)
+	if freed, err := Sweep(); err != nil || freed != 0 {
+		t.Errorf("Expected nothing to sweep, freed %v (%v)", freed, err)
+	}
+}
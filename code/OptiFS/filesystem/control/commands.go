@@ -0,0 +1,515 @@
+// This file contains the commands the control socket understands
+
+package control
+
+import (
+	"errors"
+	"filesystem/logging"
+	"filesystem/metadata"
+	"filesystem/permissions"
+	"filesystem/quota"
+	"filesystem/snapshot"
+	"filesystem/tier"
+	"filesystem/trash"
+	"filesystem/vfs"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Environment describes the running instance the default commands operate on
+type Environment struct {
+	MountPoint  string
+	Underlying  string
+	SaveDir     string
+	Persistence bool         // false if the instance was started with -rm-persistence
+	ReadOnly    bool         // true if the instance was mounted with -ro, it never saves
+	Started     time.Time    // when the filesystem was mounted
+	Reload      func() error // re-reads the configuration of the instance
+}
+
+// Registers status, save, fsck, maintenance, sysadmin, role, dedup-stats, report, snapshot, trash, quota, project, tier, log-level and reload-config on the server
+func RegisterDefaultCommands(server *Server, env Environment) {
+	server.Handle("status", func(args []string) (string, error) {
+		return status(env), nil
+	})
+	server.Handle("save", func(args []string) (string, error) {
+		return save(env)
+	})
+	server.Handle("fsck", func(args []string) (string, error) {
+		// users can carry on reading, but only the sysadmin can write while the metadata is repaired
+		if !vfs.SetMaintenance(true) {
+			defer vfs.SetMaintenance(false)
+		}
+		removed := metadata.InsureIntegrity()
+		missing := tier.Check()
+		return fmt.Sprintf("integrity check complete, %d stale node(s) removed, %d cold content(s) missing", removed, missing), nil
+	})
+	server.Handle("maintenance", func(args []string) (string, error) {
+		return maintenance(args)
+	})
+	server.Handle("sysadmin", func(args []string) (string, error) {
+		return sysadmin(env, args)
+	})
+	server.Handle("role", func(args []string) (string, error) {
+		return role(env, args)
+	})
+	server.Handle("dedup-stats", func(args []string) (string, error) {
+		return metadata.GetDedupStatistics().String(), nil
+	})
+	server.Handle("report", func(args []string) (string, error) {
+		return report(args)
+	})
+	server.Handle("snapshot", func(args []string) (string, error) {
+		return snapshotCommand(env, args)
+	})
+	server.Handle("trash", func(args []string) (string, error) {
+		return trashCommand(env, args)
+	})
+	server.Handle("quota", func(args []string) (string, error) {
+		return quotaCommand(env, args)
+	})
+	server.Handle("project", func(args []string) (string, error) {
+		return projectCommand(env, args)
+	})
+	server.Handle("tier", func(args []string) (string, error) {
+		if len(args) != 1 || args[0] != "move" {
+			return "", errors.New("usage: tier move")
+		}
+		return fmt.Sprintf("moved %d content(s) to the cold tier", tier.Move()), nil
+	})
+	server.Handle("log-level", func(args []string) (string, error) {
+		return logLevel(args)
+	})
+	server.Handle("reload-config", func(args []string) (string, error) {
+		if env.Reload == nil {
+			return "", errors.New("this instance has no configuration to reload")
+		}
+		if err := env.Reload(); err != nil {
+			return "", err
+		}
+		return "configuration reloaded", nil
+	})
+}
+
+// Describes the state of the instance
+func status(env Environment) string {
+	files, dirs := metadata.CountNodes()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "mount point:   %v\n", env.MountPoint)
+	fmt.Fprintf(&b, "underlying:    %v\n", env.Underlying)
+	fmt.Fprintf(&b, "uptime:        %v\n", time.Since(env.Started).Round(time.Second))
+	current := permissions.GetSysadmin()
+	fmt.Fprintf(&b, "sysadmin:      uid %d, gid %d\n", current.UID, current.GID)
+	if env.Persistence {
+		fmt.Fprintf(&b, "save location: %v\n", env.SaveDir)
+	} else {
+		fmt.Fprintf(&b, "save location: none (persistence disabled)\n")
+	}
+	fmt.Fprintf(&b, "atime:         %v\n", metadata.GetAtimeMode())
+	fmt.Fprintf(&b, "mode:          %v\n", mode(env))
+	fmt.Fprintf(&b, "files:         %d\n", files)
+	fmt.Fprintf(&b, "directories:   %d", dirs)
+	return b.String()
+}
+
+// Describes what can change the filesystem
+func mode(env Environment) string {
+	switch {
+	case env.ReadOnly:
+		return "read-only"
+	case vfs.InMaintenance():
+		return "maintenance (only the sysadmin can write)"
+	}
+	return "read-write"
+}
+
+// Handles "maintenance on|off"
+func maintenance(args []string) (string, error) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return "", errors.New("usage: maintenance on|off")
+	}
+
+	on := args[0] == "on"
+	vfs.SetMaintenance(on)
+	if on {
+		return "maintenance mode on, only the sysadmin can write", nil
+	}
+	return "maintenance mode off", nil
+}
+
+// Saves the persistent stores and the sysadmin now, rather than waiting for the next interval
+func save(env Environment) (string, error) {
+	if !env.Persistence {
+		return "", errors.New("persistence is disabled for this instance")
+	}
+	if env.ReadOnly {
+		return "", errors.New("this instance is mounted read-only")
+	}
+
+	if err := metadata.SavePersistantStorage(env.SaveDir); err != nil {
+		return "", fmt.Errorf("couldn't save persistent storage: %v", err)
+	}
+	if err := permissions.SaveSysadmin(env.SaveDir); err != nil {
+		return "", fmt.Errorf("couldn't save sysadmin info: %v", err)
+	}
+	if err := permissions.SaveRoles(env.SaveDir); err != nil {
+		return "", fmt.Errorf("couldn't save roles: %v", err)
+	}
+	return fmt.Sprintf("saved to %v", env.SaveDir), nil
+}
+
+// Handles "sysadmin set uid|gid <id>"
+func sysadmin(env Environment, args []string) (string, error) {
+	if len(args) != 3 || args[0] != "set" {
+		return "", errors.New("usage: sysadmin set uid|gid <id>")
+	}
+
+	var errno syscall.Errno
+	switch args[1] {
+	case "uid":
+		errno = permissions.ChangeSysadminUID(args[2])
+	case "gid":
+		errno = permissions.ChangeSysadminGID(args[2])
+	default:
+		return "", errors.New("usage: sysadmin set uid|gid <id>")
+	}
+	if errno != fs.OK {
+		return "", fmt.Errorf("couldn't change sysadmin %v to {%v}: %v", args[1], args[2], errno)
+	}
+
+	// Group membership of the old/new sysadmin may be cached
+	permissions.InvalidateGroupCache()
+
+	if env.Persistence && !env.ReadOnly {
+		if err := permissions.SaveSysadmin(env.SaveDir); err != nil {
+			return "", fmt.Errorf("sysadmin changed, but couldn't be saved: %v", err)
+		}
+	}
+	current := permissions.GetSysadmin()
+	return fmt.Sprintf("sysadmin is now uid %d, gid %d", current.UID, current.GID), nil
+}
+
+// Handles "report duplicates [-json]"
+func report(args []string) (string, error) {
+	if len(args) < 1 || args[0] != "duplicates" || len(args) > 2 || (len(args) == 2 && args[1] != "-json") {
+		return "", errors.New("usage: report duplicates [-json]")
+	}
+
+	var b strings.Builder
+	if err := metadata.WriteDuplicateReport(&b, metadata.DuplicateGroups(), len(args) == 2); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// Handles "snapshot create|delete <name>", "snapshot list" and "snapshot restore <name> <path> [<dest>]"
+func snapshotCommand(env Environment, args []string) (string, error) {
+	usage := errors.New("usage: snapshot create|delete <name> | snapshot list | snapshot restore <name> <path> [<dest>]")
+	if len(args) < 1 {
+		return "", usage
+	}
+
+	if args[0] == "list" && len(args) == 1 {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%-24s %-25s %-10s %s", "name", "created", "nodes", "bytes")
+		for _, snap := range snapshot.List() {
+			fmt.Fprintf(&b, "\n%-24s %-25s %-10d %d", snap.Name, snap.Created.Format(time.RFC3339), len(snap.Nodes), snap.Size())
+		}
+		return b.String(), nil
+	}
+
+	// Everything else changes the filesystem or the save location
+	if env.ReadOnly {
+		return "", errors.New("this instance is mounted read-only")
+	}
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		snap, err := snapshot.Create(args[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("created snapshot {%v} of %d node(s)", snap.Name, len(snap.Nodes)), nil
+
+	case args[0] == "delete" && len(args) == 2:
+		freed, err := snapshot.Delete(args[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("deleted snapshot {%v}, %d byte(s) freed", args[1], freed), nil
+
+	case args[0] == "restore" && (len(args) == 3 || len(args) == 4):
+		dest := ""
+		if len(args) == 4 {
+			dest = args[3]
+		}
+		restored, err := snapshot.Restore(args[1], args[2], env.MountPoint, dest)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("restored %d node(s) from snapshot {%v}", restored, args[1]), nil
+	}
+	return "", usage
+}
+
+// Handles "trash list [<uid>]", "trash restore <id> [<dest>]" and "trash purge <id>|all|uid <uid>"
+func trashCommand(env Environment, args []string) (string, error) {
+	usage := errors.New("usage: trash list [<uid>] | trash restore <id> [<dest>] | trash purge <id>|all|uid <uid>")
+	if len(args) < 1 {
+		return "", usage
+	}
+
+	if args[0] == "list" && len(args) <= 2 {
+		var uid *uint32
+		if len(args) == 2 {
+			parsed, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid uid {%v}", args[1])
+			}
+			uid = new(uint32)
+			*uid = uint32(parsed)
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "%-8s %-8s %-25s %-12s %s", "id", "uid", "deleted", "bytes", "path")
+		for _, entry := range trash.List(uid) {
+			entryPath := entry.Path
+			if entry.IsDir {
+				entryPath += "/"
+			}
+			fmt.Fprintf(&b, "\n%-8d %-8d %-25s %-12d %s", entry.ID, entry.UID, entry.Deleted.Format(time.RFC3339), entry.Size, entryPath)
+		}
+		return b.String(), nil
+	}
+
+	// Everything else changes the filesystem
+	if env.ReadOnly {
+		return "", errors.New("this instance is mounted read-only")
+	}
+	switch {
+	case args[0] == "restore" && (len(args) == 2 || len(args) == 3):
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid id {%v}", args[1])
+		}
+		dest := ""
+		if len(args) == 3 {
+			dest = args[2]
+		}
+		entry, err := trash.Restore(id, dest)
+		if err != nil {
+			return "", err
+		}
+		if dest == "" {
+			dest = entry.Path
+		}
+		return fmt.Sprintf("restored {%v} to {%v}", entry.Path, dest), nil
+
+	case args[0] == "purge" && (len(args) == 2 || (len(args) == 3 && args[1] == "uid")):
+		var entries []*trash.Entry
+		switch {
+		case args[1] == "all":
+			entries = trash.List(nil)
+		case args[1] == "uid":
+			uid, err := strconv.ParseUint(args[2], 10, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid uid {%v}", args[2])
+			}
+			owner := uint32(uid)
+			entries = trash.List(&owner)
+		default:
+			id, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("invalid id {%v}", args[1])
+			}
+			entries = []*trash.Entry{{ID: id}}
+		}
+
+		var freed int64
+		for _, entry := range entries {
+			size, err := trash.Purge(entry.ID)
+			if err != nil {
+				return "", err
+			}
+			freed += size
+		}
+		return fmt.Sprintf("purged %d node(s), %d byte(s) freed", len(entries), freed), nil
+	}
+	return "", usage
+}
+
+// Handles "quota list", "quota show <owner>", "quota set <owner> <resource> <soft> <hard>" and "quota remove <owner>"
+func quotaCommand(env Environment, args []string) (string, error) {
+	usage := errors.New("usage: quota list | quota show <owner> | quota set <owner> inodes|logical|physical <soft> <hard> | quota remove <owner>, where <owner> is uid:<id>, gid:<id> or project:<id>")
+	if len(args) < 1 {
+		return "", usage
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return fmt.Sprintf("charging: %v, grace period: %v\n%v", metadata.GetChargingMode(), quota.GetGrace(), quota.Describe(quota.List(), time.Now())), nil
+
+	case args[0] == "show" && len(args) == 2:
+		owner, err := quota.ParseOwner(args[1])
+		if err != nil {
+			return "", err
+		}
+		return quota.Describe([]quota.Status{quota.Get(owner)}, time.Now()), nil
+
+	case args[0] == "set" && len(args) == 5:
+		if env.ReadOnly {
+			return "", errors.New("this instance is mounted read-only")
+		}
+		owner, err := quota.ParseOwner(args[1])
+		if err != nil {
+			return "", err
+		}
+		r, err := quota.ParseResource(args[2])
+		if err != nil {
+			return "", err
+		}
+		var limit quota.Limit
+		if limit.Soft, err = quota.ParseAmount(args[3]); err != nil {
+			return "", err
+		}
+		if limit.Hard, err = quota.ParseAmount(args[4]); err != nil {
+			return "", err
+		}
+		if err := quota.Set(owner, r, limit); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("set %v quota of {%v} to %d soft, %d hard", r, owner, limit.Soft, limit.Hard), nil
+
+	case args[0] == "remove" && len(args) == 2:
+		if env.ReadOnly {
+			return "", errors.New("this instance is mounted read-only")
+		}
+		owner, err := quota.ParseOwner(args[1])
+		if err != nil {
+			return "", err
+		}
+		if err := quota.Remove(owner); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("removed the quota of {%v}", owner), nil
+	}
+	return "", usage
+}
+
+// Handles "project list" and "project set <path> <id>", paths are relative to the root of the filesystem
+func projectCommand(env Environment, args []string) (string, error) {
+	usage := errors.New("usage: project list | project set <path> <id>")
+
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		tops := metadata.Projects()
+		paths := make([]string, 0, len(tops))
+		for dirPath := range tops {
+			paths = append(paths, dirPath)
+		}
+		sort.Strings(paths)
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "%-10s %-10s %-14s %-14s %s", "project", "inodes", "logical", "physical", "path")
+		for _, dirPath := range paths {
+			rel, err := filepath.Rel(env.Underlying, dirPath)
+			if err != nil {
+				rel = dirPath
+			}
+			used := metadata.ProjectUsage(tops[dirPath])
+			fmt.Fprintf(&b, "\n%-10d %-10d %-14d %-14d %s", tops[dirPath], used.Inodes, used.Logical, used.Physical, path.Clean("/"+rel))
+		}
+		return b.String(), nil
+
+	case len(args) == 3 && args[0] == "set":
+		if env.ReadOnly {
+			return "", errors.New("this instance is mounted read-only")
+		}
+		project, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid project id {%v}", args[2])
+		}
+		rel := path.Clean("/" + args[1])
+		errno, changed := metadata.SetProject(filepath.Join(env.Underlying, rel), uint32(project))
+		if errno != fs.OK {
+			return "", fmt.Errorf("{%v} isn't a directory OptiFS knows about", rel)
+		}
+		if project == 0 {
+			return fmt.Sprintf("took {%v} out of its project, %d dir(s) changed", rel, changed), nil
+		}
+		return fmt.Sprintf("put {%v} in project %d, %d dir(s) changed", rel, project, changed), nil
+	}
+	return "", usage
+}
+
+// Handles "log-level [<level>|<subsystem>=<level>,...]", the change lasts until the configuration is reloaded
+func logLevel(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", errors.New("usage: log-level [<level>|<subsystem>=<level>,...]")
+	}
+	if len(args) == 1 {
+		if err := logging.ApplyLevels(args[0]); err != nil {
+			return "", err
+		}
+	}
+	return logging.DescribeLevels(), nil
+}
+
+// Handles "role list" and "role grant|revoke <role> uid:<id>|gid:<id> [path]"
+func role(env Environment, args []string) (string, error) {
+	usage := errors.New("usage: role list | role grant|revoke <role> uid:<id>|gid:<id> [subtree path]")
+
+	if len(args) == 1 && args[0] == "list" {
+		var b strings.Builder
+		current := permissions.GetSysadmin()
+		fmt.Fprintf(&b, "uid:%d admin (sysadmin)\n", current.UID)
+		fmt.Fprintf(&b, "gid:%d admin (sysadmin group)", current.GID)
+		for _, grant := range permissions.Grants() {
+			fmt.Fprintf(&b, "\n%v", grant)
+		}
+		return b.String(), nil
+	}
+	if len(args) < 3 || len(args) > 4 || (args[0] != "grant" && args[0] != "revoke") {
+		return "", usage
+	}
+
+	r, err := permissions.ParseRole(args[1])
+	if err != nil {
+		return "", err
+	}
+	principal, err := permissions.ParsePrincipal(args[2])
+	if err != nil {
+		return "", err
+	}
+	grant := permissions.Grant{Principal: principal, Role: r}
+	if len(args) == 4 {
+		grant.Path = args[3]
+	} else if r == permissions.RoleSubtreeOwner {
+		return "", errors.New("subtree owners need the path of their subtree")
+	}
+
+	done := "granted"
+	if args[0] == "grant" {
+		err = permissions.AddGrant(grant)
+	} else {
+		done = "revoked"
+		err = permissions.RemoveGrant(grant)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if env.Persistence && !env.ReadOnly {
+		if err := permissions.SaveRoles(env.SaveDir); err != nil {
+			return "", fmt.Errorf("role changed, but couldn't be saved: %v", err)
+		}
+	}
+	return fmt.Sprintf("%v {%v}", done, grant), nil
+}
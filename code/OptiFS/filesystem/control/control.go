@@ -0,0 +1,255 @@
+// This file contains the control socket, which lets the sysadmin manage a live OptiFS instance
+
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"filesystem/audit"
+	"filesystem/logging"
+	"filesystem/permissions"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Logs connections and the commands they send
+var logger = logging.For(logging.Control)
+
+// Request is a single command sent over the control socket, one JSON object per line
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Response is the reply to a Request, Error is empty if the command succeeded
+type Response struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// The commands a role lets someone who isn't the sysadmin send
+var roleCommands = map[string]permissions.Role{
+	"quota": permissions.RoleQuotaAdmin,
+}
+
+// Handler performs a command, returning the output to show the sysadmin
+type Handler func(args []string) (string, error)
+
+// Server listens on a Unix domain socket for commands from the sysadmin
+type Server struct {
+	path     string
+	listener *net.UnixListener
+
+	handlersLock sync.RWMutex
+	handlers     map[string]Handler
+}
+
+// Creates a control server for the socket at 'path', it doesn't listen until Start is called
+func NewServer(path string) *Server {
+	return &Server{path: path, handlers: make(map[string]Handler)}
+}
+
+// Registers the handler of a command, replacing any existing one
+func (s *Server) Handle(command string, handler Handler) {
+	s.handlersLock.Lock()
+	defer s.handlersLock.Unlock()
+
+	s.handlers[command] = handler
+}
+
+// Starts listening on the control socket, serving connections in the background
+func (s *Server) Start() error {
+	// A socket left behind by an instance that didn't shut down cleanly would stop us listening
+	if info, err := os.Lstat(s.path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("{%v} exists and isn't a socket", s.path)
+		}
+		if conn, dialErr := net.Dial("unix", s.path); dialErr == nil {
+			conn.Close()
+			return fmt.Errorf("control socket {%v} is already in use", s.path)
+		}
+		logger.Info("Removing stale control socket", "socket", s.path)
+		os.Remove(s.path)
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: s.path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	listener.SetUnlinkOnClose(true)
+
+	// Anyone may connect, every peer is authenticated against the sysadmin
+	if err := os.Chmod(s.path, 0666); err != nil {
+		listener.Close()
+		return err
+	}
+
+	s.listener = listener
+	logger.Info("Control socket listening", "socket", s.path)
+
+	go s.serve()
+	return nil
+}
+
+// Stops listening, removing the control socket
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Accepts connections until the listener is closed
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error("Failed to accept control connection", "err", err)
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// Authenticates the peer, then performs each request it sends
+func (s *Server) handleConnection(conn *net.UnixConn) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		logger.Warn("Couldn't get control peer credentials", "err", err)
+		encoder.Encode(Response{Error: "couldn't authenticate"})
+		return
+	}
+	if !mayConnect(cred) {
+		logger.Warn("Control connection refused", "uid", cred.Uid, "gid", cred.Gid)
+		audit.Record(audit.Event{Type: audit.Control, UID: cred.Uid, GID: cred.Gid, PID: uint32(cred.Pid), Outcome: audit.Denied, Detail: "not a sysadmin"})
+		encoder.Encode(Response{Error: "permission denied: not a sysadmin"})
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var request Request
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			encoder.Encode(Response{Error: "malformed request"})
+			continue
+		}
+
+		// Roles can be granted or revoked while connected, so every command is checked
+		if !mayPerform(cred, request.Command) {
+			logger.Warn("Control command refused", "command", request.Command, "uid", cred.Uid)
+			audit.Record(audit.Event{Type: audit.Control, Op: strings.Join(append([]string{request.Command}, request.Args...), " "),
+				UID: cred.Uid, GID: cred.Gid, PID: uint32(cred.Pid), Outcome: audit.Denied, Detail: "not a sysadmin"})
+			if err := encoder.Encode(Response{Error: "permission denied: not a sysadmin"}); err != nil {
+				return
+			}
+			continue
+		}
+
+		logger.Info("Control command", "command", request.Command, "args", request.Args, "uid", cred.Uid)
+		response := s.perform(request)
+		auditCommand(request, response, cred)
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// Checks if the peer can send any command, as the sysadmin or with a role that has commands of its own
+func mayConnect(cred *unix.Ucred) bool {
+	if permissions.IsSysadminCredentials(uint32(cred.Pid), cred.Uid, cred.Gid) {
+		return true
+	}
+	for _, role := range roleCommands {
+		if permissions.HasRoleCredentials(uint32(cred.Pid), cred.Uid, cred.Gid, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the peer can send 'command', the sysadmin can send anything
+func mayPerform(cred *unix.Ucred, command string) bool {
+	if permissions.IsSysadminCredentials(uint32(cred.Pid), cred.Uid, cred.Gid) {
+		return true
+	}
+	role, ok := roleCommands[command]
+	return ok && permissions.HasRoleCredentials(uint32(cred.Pid), cred.Uid, cred.Gid, role)
+}
+
+// Records a command, and whether it worked, in the audit log
+func auditCommand(request Request, response Response, cred *unix.Ucred) {
+	event := audit.Event{Type: audit.Control, Op: strings.Join(append([]string{request.Command}, request.Args...), " "),
+		UID: cred.Uid, GID: cred.Gid, PID: uint32(cred.Pid), Outcome: audit.Allowed}
+	if response.Error != "" {
+		event.Outcome, event.Detail = audit.Failed, response.Error
+	}
+	audit.Record(event)
+}
+
+// Runs the handler for a request
+func (s *Server) perform(request Request) Response {
+	s.handlersLock.RLock()
+	handler, ok := s.handlers[request.Command]
+	s.handlersLock.RUnlock()
+
+	if !ok {
+		return Response{Error: fmt.Sprintf("unknown command {%v}", request.Command)}
+	}
+
+	output, err := handler(request.Args)
+	if err != nil {
+		return Response{Output: output, Error: err.Error()}
+	}
+	return Response{Output: output}
+}
+
+// Gets the credentials of the process on the other end of the connection from the kernel (SO_PEERCRED),
+// so they can't be forged
+func peerCredentials(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// Sends a single request to the control socket at 'path', returning the response
+func Send(path string, request Request) (Response, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return Response{}, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return Response{}, err
+	}
+
+	var response Response
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return Response{}, err
+	}
+	return response, nil
+}
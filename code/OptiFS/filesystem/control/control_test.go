@@ -0,0 +1,218 @@
+package control
+
+import (
+	"errors"
+	"filesystem/metadata"
+	"filesystem/permissions"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Starts a control server in a temporary directory
+func startTestServer(t *testing.T) (*Server, string) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server := NewServer(path)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Couldn't start control server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, path
+}
+
+// Integration test for the control socket, from Send to a Handler
+func TestServer(t *testing.T) {
+	original := permissions.GetSysadmin()
+	defer permissions.ReplaceSysadmin(original)
+
+	server, path := startTestServer(t)
+	server.Handle("echo", func(args []string) (string, error) {
+		return strings.Join(args, " "), nil
+	})
+	server.Handle("fail", func(args []string) (string, error) {
+		return "", errors.New("failed")
+	})
+	server.Handle("quota", func(args []string) (string, error) {
+		return "quotas", nil
+	})
+
+	testCases := []struct {
+		name       string
+		sysadmin   uint32
+		quotaAdmin bool
+		request    Request
+		expected   Response
+	}{
+		{"sysadmin runs command", uint32(os.Getuid()), false, Request{Command: "echo", Args: []string{"a", "b"}}, Response{Output: "a b"}},
+		{"command error", uint32(os.Getuid()), false, Request{Command: "fail"}, Response{Error: "failed"}},
+		{"unknown command", uint32(os.Getuid()), false, Request{Command: "missing"}, Response{Error: "unknown command {missing}"}},
+		{"not sysadmin", uint32(os.Getuid()) + 1, false, Request{Command: "echo"}, Response{Error: "permission denied: not a sysadmin"}},
+		{"quota admin manages quotas", uint32(os.Getuid()) + 1, true, Request{Command: "quota"}, Response{Output: "quotas"}},
+		{"quota admin runs another command", uint32(os.Getuid()) + 1, true, Request{Command: "echo"}, Response{Error: "permission denied: not a sysadmin"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// a GID nobody has, so only the UID counts
+			permissions.ReplaceSysadmin(permissions.Sysadmin{UID: tc.sysadmin, GID: 1 << 30, Set: true})
+			if tc.quotaAdmin {
+				grant := permissions.Grant{Principal: permissions.Principal{ID: uint32(os.Getuid())}, Role: permissions.RoleQuotaAdmin}
+				if err := permissions.AddGrant(grant); err != nil {
+					t.Fatal(err)
+				}
+				defer permissions.RemoveGrant(grant)
+			}
+
+			response, err := Send(path, tc.request)
+			if err != nil {
+				t.Fatalf("Couldn't send request: %v", err)
+			}
+			if response != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, response)
+			}
+		})
+	}
+}
+
+// Unit test for Start in control.go, replacing a stale socket but not a live one or another file
+func TestStartStaleSocket(t *testing.T) {
+	_, path := startTestServer(t)
+	if err := NewServer(path).Start(); err == nil {
+		t.Errorf("Expected an error starting on a socket in use")
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServer(file).Start(); err == nil {
+		t.Errorf("Expected an error starting on a file that isn't a socket")
+	}
+
+	// a socket nobody is listening on, as if OptiFS had crashed
+	stale := filepath.Join(t.TempDir(), "stale.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	server := NewServer(stale)
+	if err := server.Start(); err != nil {
+		t.Errorf("Expected a stale socket to be replaced, got %v", err)
+	}
+	server.Close()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed on close")
+	}
+}
+
+// Unit tests for the default commands in commands.go
+func TestDefaultCommands(t *testing.T) {
+	server := NewServer("")
+	RegisterDefaultCommands(server, Environment{MountPoint: "/mnt", Underlying: "/under"})
+	metadata.CreateDirEntry("/under/projects/x")
+	defer metadata.RemoveDirEntry("/under/projects/x")
+
+	testCases := []struct {
+		name    string
+		request Request
+		output  string
+		err     string
+	}{
+		{"status", Request{Command: "status"}, "mount point:   /mnt", ""},
+		{"status mode", Request{Command: "status"}, "mode:          read-write", ""},
+		{"save without persistence", Request{Command: "save"}, "", "persistence is disabled for this instance"},
+		{"sysadmin usage", Request{Command: "sysadmin", Args: []string{"get"}}, "", "usage: sysadmin set uid|gid <id>"},
+		{"dedup-stats", Request{Command: "dedup-stats"}, "dedup ratio:     1.00", ""},
+		{"report duplicates", Request{Command: "report", Args: []string{"duplicates"}}, "0 duplicate group(s), 0 bytes saved", ""},
+		{"report usage", Request{Command: "report", Args: []string{"duplicates", "-yaml"}}, "", "usage: report duplicates [-json]"},
+		{"maintenance usage", Request{Command: "maintenance", Args: []string{"maybe"}}, "", "usage: maintenance on|off"},
+		{"maintenance off", Request{Command: "maintenance", Args: []string{"off"}}, "maintenance mode off", ""},
+		{"role list", Request{Command: "role", Args: []string{"list"}}, "admin (sysadmin)", ""},
+		{"role usage", Request{Command: "role", Args: []string{"give"}}, "", "usage: role list | role grant|revoke <role> uid:<id>|gid:<id> [subtree path]"},
+		{"subtree without path", Request{Command: "role", Args: []string{"grant", "subtree-owner", "uid:1000"}}, "", "subtree owners need the path of their subtree"},
+		{"snapshot list", Request{Command: "snapshot", Args: []string{"list"}}, "name", ""},
+		{"snapshot usage", Request{Command: "snapshot", Args: []string{"take"}}, "", "usage: snapshot create|delete <name> | snapshot list | snapshot restore <name> <path> [<dest>]"},
+		{"snapshot not set up", Request{Command: "snapshot", Args: []string{"create", "daily"}}, "", "snapshots aren't set up"},
+		{"trash list", Request{Command: "trash", Args: []string{"list"}}, "deleted", ""},
+		{"trash list invalid uid", Request{Command: "trash", Args: []string{"list", "bob"}}, "", "invalid uid {bob}"},
+		{"trash usage", Request{Command: "trash", Args: []string{"empty"}}, "", "usage: trash list [<uid>] | trash restore <id> [<dest>] | trash purge <id>|all|uid <uid>"},
+		{"trash restore invalid id", Request{Command: "trash", Args: []string{"restore", "first"}}, "", "invalid id {first}"},
+		{"trash purge nothing", Request{Command: "trash", Args: []string{"purge", "all"}}, "purged 0 node(s), 0 byte(s) freed", ""},
+		{"quota list", Request{Command: "quota", Args: []string{"list"}}, "charging: first", ""},
+		{"quota usage", Request{Command: "quota", Args: []string{"give"}}, "", "usage: quota list | quota show <owner> | quota set <owner> inodes|logical|physical <soft> <hard> | quota remove <owner>, where <owner> is uid:<id>, gid:<id> or project:<id>"},
+		{"quota invalid owner", Request{Command: "quota", Args: []string{"set", "bob", "inodes", "1", "2"}}, "", "owner must be uid:<id>, gid:<id> or project:<id>, not {bob}"},
+		{"quota invalid amount", Request{Command: "quota", Args: []string{"set", "uid:1000", "logical", "1X", "2G"}}, "", "invalid amount {1X}"},
+		{"quota set", Request{Command: "quota", Args: []string{"set", "uid:1000", "logical", "1G", "2G"}}, "set logical quota of {uid:1000} to 1073741824 soft, 2147483648 hard", ""},
+		{"quota show", Request{Command: "quota", Args: []string{"show", "uid:1000"}}, "1073741824", ""},
+		{"quota remove", Request{Command: "quota", Args: []string{"remove", "uid:1000"}}, "removed the quota of {uid:1000}", ""},
+		{"quota remove missing", Request{Command: "quota", Args: []string{"remove", "uid:1000"}}, "", "{uid:1000} has no quota"},
+		{"project usage", Request{Command: "project", Args: []string{"get", "/projects/x"}}, "", "usage: project list | project set <path> <id>"},
+		{"project invalid id", Request{Command: "project", Args: []string{"set", "/projects/x", "x"}}, "", "invalid project id {x}"},
+		{"project unknown directory", Request{Command: "project", Args: []string{"set", "/missing", "5"}}, "", "{/missing} isn't a directory OptiFS knows about"},
+		{"project set", Request{Command: "project", Args: []string{"set", "projects/x", "5"}}, "put {/projects/x} in project 5, 1 dir(s) changed", ""},
+		{"project list", Request{Command: "project", Args: []string{"list"}}, "/projects/x", ""},
+		{"project clear", Request{Command: "project", Args: []string{"set", "/projects/x", "0"}}, "took {/projects/x} out of its project, 1 dir(s) changed", ""},
+		{"log-level", Request{Command: "log-level"}, "vfs=", ""},
+		{"log-level set", Request{Command: "log-level", Args: []string{"dedup=debug"}}, "dedup=debug", ""},
+		{"log-level invalid", Request{Command: "log-level", Args: []string{"loud"}}, "", "unknown log level {loud}, must be debug, info, warn or error"},
+		{"reload-config without reload", Request{Command: "reload-config"}, "", "this instance has no configuration to reload"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := server.perform(tc.request)
+			if !strings.Contains(response.Output, tc.output) {
+				t.Errorf("Expected output containing {%v}, got {%v}", tc.output, response.Output)
+			}
+			if response.Error != tc.err {
+				t.Errorf("Expected error {%v}, got {%v}", tc.err, response.Error)
+			}
+		})
+	}
+}
+
+// Unit test for "sysadmin set gid" in commands.go, with a group that isn't also a user
+func TestSysadminGID(t *testing.T) {
+	gid := ""
+	for id := 0; id < 65536 && gid == ""; id++ {
+		if _, err := user.LookupGroupId(strconv.Itoa(id)); err != nil {
+			continue
+		}
+		if _, err := user.LookupId(strconv.Itoa(id)); err != nil {
+			gid = strconv.Itoa(id)
+		}
+	}
+	if gid == "" {
+		t.Skip("No group without a matching user on this system")
+	}
+
+	original := permissions.GetSysadmin()
+	defer permissions.ReplaceSysadmin(original)
+
+	server := NewServer("")
+	RegisterDefaultCommands(server, Environment{})
+	response := server.perform(Request{Command: "sysadmin", Args: []string{"set", "gid", gid}})
+	if response.Error != "" {
+		t.Fatalf("Expected no error, got {%v}", response.Error)
+	}
+	if current := permissions.GetSysadmin(); strconv.Itoa(int(current.GID)) != gid {
+		t.Errorf("Expected sysadmin gid %v, got %v", gid, current.GID)
+	}
+}
+
+// Unit test for the output of the dedup-stats command, from DedupStatistics.String in metadata/statistics.go
+func TestDedupStats(t *testing.T) {
+	output := metadata.DedupStatistics{UniqueContents: 1, Files: 2, LogicalBytes: 200, PhysicalBytes: 100}.String()
+	for _, line := range []string{"files:           2", "unique contents: 1", "saved bytes:     100", "dedup ratio:     2.00"} {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected {%v} in {%v}", line, output)
+		}
+	}
+}
@@ -3,8 +3,9 @@ module filesystem
 go 1.21.6
 
 require (
-	github.com/hanwen/go-fuse/v2 v2.4.2
-	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
+	github.com/BurntSushi/toml v1.4.0
+	github.com/hanwen/go-fuse/v2 v2.9.0 // v2.4.2 has no STATX (fs.NodeStatxer, fuse.StatxOut), needed for birth times
+	golang.org/x/sys v0.28.0 // the minimum go-fuse v2.9.0 requires, also has unix.Statx for the fallback to the underlying node
 	lukechampine.com/blake3 v1.2.1
 )
 
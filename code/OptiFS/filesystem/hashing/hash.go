@@ -1,6 +1,7 @@
 package hashing
 
 import (
+	"hash"
 	"log"
 
 	"lukechampine.com/blake3"
@@ -31,3 +32,9 @@ func HashContents(data []byte, flags uint32) [64]byte {
 
 	return blake3.Sum512(data)
 }
+
+// Gets a hash that content can be streamed into (e.g. with io.Copy), rather than read into memory.
+// Its sum is the same as HashContents of the whole content.
+func NewHasher() hash.Hash {
+	return blake3.New(64, nil)
+}
@@ -1,6 +1,8 @@
 package hashing
 
 import (
+	"io"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -50,3 +52,17 @@ func TestHashContents(t *testing.T) {
 		})
 	}
 }
+
+// Unit test for NewHasher in hash.go
+func TestNewHasher(t *testing.T) {
+	data := strings.Repeat("streamed content ", 10000)
+	hasher := NewHasher()
+	if _, err := io.Copy(hasher, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var sum [64]byte
+	copy(sum[:], hasher.Sum(nil))
+	if expected := HashContents([]byte(data), 0); sum != expected {
+		t.Errorf("Expected %x, got %x", expected, sum)
+	}
+}
@@ -0,0 +1,233 @@
+// Package logging contains the structured, leveled logging of OptiFS. Each subsystem has its own
+// logger and level, so one can be made verbose without drowning the logs in the others.
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Subsystem is a part of OptiFS with its own log level
+type Subsystem string
+
+const (
+	Main        Subsystem = "main"        // starting up, shutting down and configuration
+	VFS         Subsystem = "vfs"         // FUSE requests
+	Metadata    Subsystem = "metadata"    // the metadata hashmaps and persistence
+	Permissions Subsystem = "permissions" // permission checks, roles and the sysadmin
+	Dedup       Subsystem = "dedup"       // de-duplicating files when they're released
+	Control     Subsystem = "control"     // the control socket
+	Audit       Subsystem = "audit"       // writing and rotating the audit log
+	Snapshot    Subsystem = "snapshot"    // snapshots, version history and the content store they share
+	Trash       Subsystem = "trash"       // moving deleted nodes to the trash, restoring and expiring them
+	Quota       Subsystem = "quota"       // quota limits, grace periods and refusing what would go over them
+	Tier        Subsystem = "tier"        // moving content to the cold tier and recalling it
+)
+
+// Every subsystem, in the order they're listed
+var Subsystems = []Subsystem{Main, VFS, Metadata, Permissions, Dedup, Control, Audit, Snapshot, Trash, Quota, Tier}
+
+// The level of each subsystem, anything below it isn't logged
+var levels = func() map[Subsystem]*slog.LevelVar {
+	m := make(map[Subsystem]*slog.LevelVar)
+	for _, subsystem := range Subsystems {
+		m[subsystem] = new(slog.LevelVar)
+	}
+	return m
+}()
+
+// The handler everything is written to, replaced by Setup
+var output atomic.Pointer[slog.Handler]
+
+func init() {
+	setHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func setHandler(h slog.Handler) {
+	output.Store(&h)
+}
+
+// Options decide how logs are written
+type Options struct {
+	Format string                   // text or json
+	Level  slog.Level               // the level of any subsystem that isn't in Levels
+	Levels map[Subsystem]slog.Level // per-subsystem levels
+}
+
+// Sends logs to 'w' in the chosen format, and sets the level of every subsystem. Loggers that
+// already exist write to the new output straight away.
+func Setup(w io.Writer, options Options) error {
+	// the subsystems filter by level, so the handler itself accepts everything
+	handlerOptions := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	switch options.Format {
+	case "", "text":
+		h = slog.NewTextHandler(w, handlerOptions)
+	case "json":
+		h = slog.NewJSONHandler(w, handlerOptions)
+	default:
+		return fmt.Errorf("unknown log format {%v}, must be text or json", options.Format)
+	}
+
+	for subsystem, level := range levels {
+		if l, ok := options.Levels[subsystem]; ok {
+			level.Set(l)
+		} else {
+			level.Set(options.Level)
+		}
+	}
+	setHandler(h)
+
+	// anything still using the log package is logged by the main subsystem, at info
+	slog.SetDefault(For(Main))
+	return nil
+}
+
+// Changes the level of a subsystem, from the next log onwards
+func SetLevel(subsystem Subsystem, level slog.Level) error {
+	levelVar, ok := levels[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown subsystem {%v}", subsystem)
+	}
+	levelVar.Set(level)
+	return nil
+}
+
+// Gets the level of every subsystem
+func Levels() map[Subsystem]slog.Level {
+	current := make(map[Subsystem]slog.Level)
+	for subsystem, level := range levels {
+		current[subsystem] = level.Level()
+	}
+	return current
+}
+
+// Describes the level of every subsystem, e.g. "control=info dedup=info main=info ..."
+func DescribeLevels() string {
+	var parts []string
+	for subsystem, level := range Levels() {
+		parts = append(parts, fmt.Sprintf("%v=%v", subsystem, strings.ToLower(level.String())))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// Parses the name of a level: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level {%v}, must be debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// Parses a level specification: a level for every subsystem, and/or subsystem=level pairs,
+// separated by commas, e.g. "warn,vfs=debug". Subsystems without a level are at info.
+func ParseLevels(spec string) (slog.Level, map[Subsystem]slog.Level, error) {
+	level, perSubsystem, err := parseLevels(spec)
+	if err != nil {
+		return 0, nil, err
+	}
+	if level == nil {
+		return slog.LevelInfo, perSubsystem, nil
+	}
+	return *level, perSubsystem, nil
+}
+
+// Changes the levels given in a specification, leaving any subsystem it doesn't mention alone
+func ApplyLevels(spec string) error {
+	level, perSubsystem, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+	for subsystem, levelVar := range levels {
+		if l, ok := perSubsystem[subsystem]; ok {
+			levelVar.Set(l)
+		} else if level != nil {
+			levelVar.Set(*level)
+		}
+	}
+	return nil
+}
+
+// Parses a level specification, the level for every subsystem is nil if it doesn't have one
+func parseLevels(spec string) (*slog.Level, map[Subsystem]slog.Level, error) {
+	var level *slog.Level
+	perSubsystem := make(map[Subsystem]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(part, "=")
+		if !found {
+			l, err := ParseLevel(part)
+			if err != nil {
+				return nil, nil, err
+			}
+			level = &l
+			continue
+		}
+
+		subsystem := Subsystem(name)
+		if _, ok := levels[subsystem]; !ok {
+			return nil, nil, fmt.Errorf("unknown subsystem {%v}", name)
+		}
+		l, err := ParseLevel(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		perSubsystem[subsystem] = l
+	}
+	return level, perSubsystem, nil
+}
+
+// For gets the logger of a subsystem, every record it writes has a "subsystem" attribute
+func For(subsystem Subsystem) *slog.Logger {
+	levelVar, ok := levels[subsystem]
+	if !ok {
+		panic(fmt.Sprintf("unknown logging subsystem {%v}", subsystem))
+	}
+	return slog.New(&subsystemHandler{level: levelVar}).With("subsystem", string(subsystem))
+}
+
+// Filters records by the level of its subsystem, then passes them to the current output
+type subsystemHandler struct {
+	level *slog.LevelVar
+	// applied to the current output when handling, as it can change after the logger is made
+	wrap []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	handler := *output.Load()
+	for _, wrap := range h.wrap {
+		handler = wrap(handler)
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *subsystemHandler) with(wrap func(slog.Handler) slog.Handler) *subsystemHandler {
+	wraps := make([]func(slog.Handler) slog.Handler, len(h.wrap), len(h.wrap)+1)
+	copy(wraps, h.wrap)
+	return &subsystemHandler{level: h.level, wrap: append(wraps, wrap)}
+}
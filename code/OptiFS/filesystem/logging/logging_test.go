@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// Unit tests for ParseLevels in logging.go
+func TestParseLevels(t *testing.T) {
+	testCases := []struct {
+		name   string
+		spec   string
+		level  slog.Level
+		levels map[Subsystem]slog.Level
+		err    string // part of the expected error, empty if it should parse
+	}{
+		{"empty is info", "", slog.LevelInfo, map[Subsystem]slog.Level{}, ""},
+		{"one level", "debug", slog.LevelDebug, map[Subsystem]slog.Level{}, ""},
+		{"per subsystem", "warn, vfs=debug,dedup=error", slog.LevelWarn, map[Subsystem]slog.Level{VFS: slog.LevelDebug, Dedup: slog.LevelError}, ""},
+		{"only a subsystem", "metadata=DEBUG", slog.LevelInfo, map[Subsystem]slog.Level{Metadata: slog.LevelDebug}, ""},
+		{"unknown level", "loud", 0, nil, "unknown log level"},
+		{"unknown subsystem", "fuse=debug", 0, nil, "unknown subsystem"},
+		{"unknown subsystem level", "vfs=loud", 0, nil, "unknown log level"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			level, levels, err := ParseLevels(tc.spec)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("Expected an error containing {%v}, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected to parse, got %v", err)
+			}
+			if level != tc.level || len(levels) != len(tc.levels) {
+				t.Errorf("Expected %v %v, got %v %v", tc.level, tc.levels, level, levels)
+			}
+			for subsystem, l := range tc.levels {
+				if levels[subsystem] != l {
+					t.Errorf("Expected %v at %v, got %v", subsystem, l, levels[subsystem])
+				}
+			}
+		})
+	}
+}
+
+// Unit test for Setup, For and ApplyLevels in logging.go
+func TestSubsystemLevels(t *testing.T) {
+	var buf bytes.Buffer
+	err := Setup(&buf, Options{Format: "json", Level: slog.LevelWarn, Levels: map[Subsystem]slog.Level{VFS: slog.LevelDebug}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Setup(&bytes.Buffer{}, Options{})
+
+	// made before being written to, so it must follow the output and level it's given later
+	vfsLogger := For(VFS).With("op", "LOOKUP")
+	vfsLogger.Debug("looked up", "name", "a")
+	For(Metadata).Info("not logged")
+	For(Metadata).Warn("logged")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %v", lines)
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["subsystem"] != "vfs" || record["op"] != "LOOKUP" || record["name"] != "a" || record["level"] != "DEBUG" {
+		t.Errorf("Expected the fields of the request, got %v", record)
+	}
+
+	// only the subsystems mentioned change
+	if err := ApplyLevels("metadata=info"); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	For(Metadata).Info("now logged")
+	vfsLogger.Debug("still logged")
+	For(Dedup).Info("not logged")
+	if got := strings.Count(buf.String(), "\n"); got != 2 {
+		t.Errorf("Expected 2 lines, got %v", buf.String())
+	}
+
+	if err := Setup(&buf, Options{Format: "xml"}); err == nil {
+		t.Errorf("Expected an unknown format to fail")
+	}
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"filesystem/audit"
+	"filesystem/content"
+	"filesystem/control"
+	"filesystem/logging"
 	"filesystem/metadata"
+	"filesystem/metrics"
 	"filesystem/permissions"
+	"filesystem/quota"
+	"filesystem/snapshot"
+	"filesystem/tier"
+	"filesystem/trash"
+	"filesystem/versions"
 	"filesystem/vfs"
 	"flag"
 	"fmt"
@@ -10,47 +20,85 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 )
 
+// command line flags, any that are given override the configuration file
+var (
+	configFile            = flag.String("config", "", "load settings from a TOML configuration file, reloaded on SIGHUP")
+	debug                 = flag.Bool("debug", false, "enter debug mode")
+	readOnly              = flag.Bool("ro", false, "mount read-only: nothing can be changed and nothing is saved")
+	removePersistence     = flag.Bool("rm-persistence", false, "remove persistence saving (saving of virtual node metadata)")
+	saveLocation          = flag.String("save", "", "choose the location of saved hashmaps and sysadmin info")
+	disableIntegrityCheck = flag.Bool("disable-icheck", false, "disables the integrity check of the persistent data of the filesystem")
+	changeSysadminUID     = flag.String("change-sysadmin-uid", "", "changes the sysadmin (through UID) of the system")
+	changeSysadminGID     = flag.String("change-sysadmin-gid", "", "changes the sysadmin group of the system")
+	interval              = flag.Int("interval", 30, "defines an amount of time that the system will regularly save persistent stores")
+	atime                 = flag.String("atime", "relatime", "when reads update access times: strictatime, relatime or noatime")
+	statfs                = flag.String("statfs", "physical", "how df reports used and free space: physical or logical")
+	shutdownTimeout       = flag.Int("shutdown-timeout", 10, "how many seconds to wait for operations to finish when shutting down")
+	controlSocket         = flag.String("control", "", "choose the location of the control socket used by optifsctl (defaults to the save location)")
+	logLevel              = flag.String("log-level", "info", "how much to log: debug, info, warn or error, optionally per subsystem, e.g. warn,vfs=debug")
+	metricsAddress        = flag.String("metrics", "", "serve OpenMetrics over HTTP at this address, e.g. 127.0.0.1:9180")
+	auditFile             = flag.String("audit", "", "record denied and privileged accesses, ownership and mode changes, deletions and admin actions in this file")
+	logFormat             = flag.String("log-format", "text", "how logs are written: text or json")
+)
+
 func main() {
 	log.SetFlags(log.Lmicroseconds)
-	debug := flag.Bool("debug", false, "enter debug mode")
-	removePersistence := flag.Bool("rm-persistence", false, "remove persistence saving (saving of virtual node metadata)")
-	saveLocation := flag.String("save", "", "choose the location of saved hashmaps and sysadmin info")
-	disableIntegrityCheck := flag.Bool("disable-icheck", false, "disables the integrity check of the persistent data of the filesystem")
-	changeSysadminUID := flag.String("change-sysadmin-uid", "", "changes the sysadmin (through UID) of the system")
-	changeSysadminGID := flag.String("change-sysadmin-gid", "", "changes the sysadmin group of the system")
-	interval := flag.Int("interval", 30, "defines an amount of time that the system will regularly save persistent stores")
+
+	// subcommands that don't mount anything
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		os.Exit(runReport(os.Args[2:]))
+	}
 
 	flag.Parse() // parse arguments
-	if flag.NArg() < 2 {
-		fmt.Printf("usage: %s <mountpoint> <underlying filesystem>\n", path.Base(os.Args[0])) // show correct usage
+
+	cfg, err := buildConfiguration()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v\n", err)
+	}
+	if cfg.Mount.Point == "" || cfg.Mount.Underlying == "" {
+		fmt.Printf("usage: %s [-config <file>] <mountpoint> <underlying filesystem>\n", path.Base(os.Args[0])) // show correct usage
 		fmt.Printf("\noptions:\n")
 		flag.PrintDefaults() // show what optional flags can be used
 		os.Exit(2)           // exit w/ error code
 	}
+	if err := applySettings(cfg); err != nil {
+		log.Fatalf("Couldn't apply configuration: %v\n", err)
+	}
 
-	under, err := filepath.Abs(flag.Arg(1))
+	under, err := filepath.Abs(cfg.Mount.Underlying)
 	if err != nil {
 		log.Println("Couldn't get absolute path for underlying filesystem!")
 		return
 	}
+	// the cold tier would be part of the filesystem it's taking content out of
+	if cold := filepath.Clean(cfg.Tier.ColdDir); cfg.Tier.ColdDir != "" && (cold == under || strings.HasPrefix(cold, under+"/")) {
+		log.Fatalf("Invalid configuration: tier.cold_dir {%v} can't be inside the underlying filesystem\n", cold)
+	}
 	data := &vfs.OptiFSRoot{
 		Path: under,
 	}
 
 	// set the options for the filesystem:
 	options := &fs.Options{}
-	options.Debug = *debug    // set the debug value the user chooses (T/F)
-	options.AllowOther = true // Gives users access other than the one that originally mounts it
-	sec := time.Duration(0)   // Attempting to prevent caching
+	options.Debug = cfg.Mount.Debug           // set the debug value the user chooses (T/F)
+	options.AllowOther = cfg.Mount.AllowOther // Gives users access other than the one that originally mounts it
+	sec := time.Duration(0)                   // Attempting to prevent caching
 	options.EntryTimeout = &sec
 	options.AttrTimeout = &sec
 	options.MountOptions.Options = append(options.MountOptions.Options, "fsname="+under) // set the filesystem name
-	options.NullPermissions = true                                                       // doesn't check the permissions for calls (good for setting up custom permissions [namespaces??])
+	options.MountOptions.Options = append(options.MountOptions.Options, cfg.Mount.Options...)
+	if cfg.Mount.ReadOnly {
+		options.MountOptions.Options = append(options.MountOptions.Options, "ro") // the kernel refuses writes too
+	}
+	options.NullPermissions = true // doesn't check the permissions for calls (good for setting up custom permissions [namespaces??])
 
 	root := &vfs.OptiFSNode{
 		RootNode: data,
@@ -58,49 +106,82 @@ func main() {
 
 	var dest string
 	// if they have chosen a location to save hashmaps and sysadmin info
-	if *saveLocation != "" {
-		dest = *saveLocation
+	if cfg.Persistence.Save != "" {
+		dest = cfg.Persistence.Save
 	} else {
 		dest = under + "/../save"
-		os.MkdirAll(dest, 0700) // make the directory "save" if it doesn't exist
+		if !cfg.Mount.ReadOnly {
+			os.MkdirAll(dest, 0700) // make the directory "save" if it doesn't exist
+		}
 	}
 
-	if !(*removePersistence) {
+	if cfg.Persistence.Enabled {
 		permissions.RetrieveSysadmin(dest)
+		permissions.RetrieveRoles(dest)
+	}
+	permissions.SetRootPath(under)
+	audit.SetRootPath(under)
+	// the snapshots and versions must both be loaded before anything is swept from the content store
+	content.Setup(filepath.Join(dest, "content"), !cfg.Mount.ReadOnly)
+	if err := snapshot.Setup(dest, under); err != nil {
+		log.Printf("Couldn't load snapshots: %v\n", err)
+	}
+	if err := versions.Setup(dest, under, !cfg.Mount.ReadOnly); err != nil {
+		log.Printf("Couldn't load versions: %v\n", err)
+	}
+	if err := trash.Setup(dest, under, !cfg.Mount.ReadOnly); err != nil {
+		log.Printf("Couldn't load the trash: %v\n", err)
+	}
+	if err := quota.Setup(dest, !cfg.Mount.ReadOnly); err != nil {
+		log.Printf("Couldn't load quotas: %v\n", err)
+	}
+	if err := tier.Setup(cfg.Tier.ColdDir, !cfg.Mount.ReadOnly); err != nil {
+		log.Printf("Couldn't set up the cold tier: %v\n", err)
 	}
 
 	// if there is no sysadmin, set the current user as the sysadmin
-	if !permissions.SysAdmin.Set {
+	if !permissions.GetSysadmin().Set {
 		permissions.SetSysadmin()
 	} else if !permissions.IsUserSysadmin(nil) {
 		log.Fatal("You cannot run this OptiFS instance: not a sysadmin.")
 	}
 
 	// The user wishes to change the sysadmin UID/GID
+	if cfg.Mount.ReadOnly && (*changeSysadminUID != "" || *changeSysadminGID != "") {
+		log.Fatal("You cannot change the sysadmin of a read-only OptiFS instance.")
+	}
 	if *changeSysadminUID != "" {
 		if permissions.IsUserSysadmin(nil) {
-			permissions.ChangeSysadminUID(*changeSysadminUID)
+			auditSysadminChange("change-sysadmin-uid "+*changeSysadminUID, permissions.ChangeSysadminUID(*changeSysadminUID))
 			permissions.SaveSysadmin(dest) // save the changes
+			audit.Close()
 			return
 		}
 	}
 	if *changeSysadminGID != "" {
 		if permissions.IsUserSysadmin(nil) {
-			permissions.ChangeSysadminGID(*changeSysadminGID)
+			auditSysadminChange("change-sysadmin-gid "+*changeSysadminGID, permissions.ChangeSysadminGID(*changeSysadminGID))
 			permissions.SaveSysadmin(dest) // save the changes
+			audit.Close()
 			return
 		}
 	}
 
+	// nothing changes the filesystem while mounted read-only, and only the sysadmin can change it
+	// until the metadata has been retrieved and checked
+	vfs.SetReadOnly(cfg.Mount.ReadOnly)
+	vfs.SetMaintenance(true)
+
 	// mount the filesystem
-	server, err := fs.Mount(flag.Arg(0), root, options)
+	server, err := fs.Mount(cfg.Mount.Point, root, options)
 	if err != nil {
 		log.Fatalf("Mount Failed!!: %v\n", err)
 	}
 
-	if !(*removePersistence) {
+	if cfg.Persistence.Enabled {
 		metadata.RetrievePersistantStorage(dest) // retrieve the hashmaps
 		permissions.RetrieveSysadmin(dest)       // retrieve sysadmin info
+		permissions.RetrieveRoles(dest)          // retrieve admins and delegated roles
 		// print for debugging purposes
 		metadata.PrintRegularFileMetadataHash()
 		metadata.PrintDirMetadataHash()
@@ -108,32 +189,125 @@ func main() {
 		permissions.PrintSysadminInfo()
 	}
 
-	if !(*disableIntegrityCheck) {
+	if cfg.Persistence.IntegrityCheck {
 		metadata.InsureIntegrity()
+		tier.Check()
+	}
+	vfs.SetMaintenance(false)
+
+	// start the control socket, so the sysadmin can manage the filesystem while it's mounted
+	socketPath := cfg.Control.Socket
+	if socketPath == "" {
+		socketPath = filepath.Join(dest, "OptiFSControl.sock")
+	}
+	controlServer := control.NewServer(socketPath)
+	control.RegisterDefaultCommands(controlServer, control.Environment{
+		MountPoint:  cfg.Mount.Point,
+		Underlying:  under,
+		SaveDir:     dest,
+		Persistence: cfg.Persistence.Enabled,
+		ReadOnly:    cfg.Mount.ReadOnly,
+		Started:     time.Now(),
+		Reload: func() error {
+			return reloadConfiguration(dest)
+		},
+	})
+	if err := controlServer.Start(); err != nil {
+		log.Printf("Couldn't start control socket: %v\n", err)
+	}
+
+	// serve the metrics, if asked to
+	var metricsServer *metrics.Server
+	if cfg.Metrics.Listen != "" {
+		if metricsServer, err = metrics.Serve(cfg.Metrics.Listen); err != nil {
+			log.Printf("Couldn't serve metrics: %v\n", err)
+		}
 	}
 
 	log.Println("=========================================================")
-	log.Printf("Mounted %v with underlying root at %v\n", flag.Arg(0), data.Path)
+	log.Printf("Mounted %v with underlying root at %v\n", cfg.Mount.Point, data.Path)
+	log.Printf("CONFIG: %v", *configFile)
 	log.Printf("DEBUG: %v", options.Debug)
-	log.Printf("RMPERSIST: %v", *removePersistence)
-	log.Printf("DISABLEICHECK: %v", *disableIntegrityCheck)
-	log.Printf("SAVE INTERVAL: %v", *interval)
+	log.Printf("READ ONLY: %v", cfg.Mount.ReadOnly)
+	log.Printf("RMPERSIST: %v", !cfg.Persistence.Enabled)
+	log.Printf("DISABLEICHECK: %v", !cfg.Persistence.IntegrityCheck)
+	log.Printf("SAVE INTERVAL: %v", cfg.Persistence.Interval)
+	log.Printf("SHUTDOWN TIMEOUT: %v", cfg.Control.ShutdownTimeout)
+	log.Printf("ATIME: %v", metadata.GetAtimeMode())
 	log.Printf("SAVE LOCATION: %v", dest)
+	log.Printf("CONTROL SOCKET: %v", socketPath)
+	log.Printf("LOG LEVELS: %v", logging.DescribeLevels())
+	log.Printf("METRICS: %v", cfg.Metrics.Listen)
 	log.Println("=========================================================")
-	// when we are shutting down the filesystem, save the hashmaps
+	// a read-only instance never saves, so the save location can be read-only too
+	saving := cfg.Persistence.Enabled && !cfg.Mount.ReadOnly
+	if saving {
+		go metadata.SaveStorageRegularly(dest, cfg.Persistence.Interval)
+	}
+	// old versions and the trash expire, even if nothing is written or deleted
+	if !cfg.Mount.ReadOnly {
+		versions.Prune()
+		go versions.PruneRegularly(time.Hour)
+		trash.Expire()
+		go trash.ExpireRegularly(time.Hour)
+		go tier.MoveRegularly(time.Hour)
+	}
+
+	// reload the configuration on SIGHUP
+	go handleHangups(dest)
+
+	// wait until the filesystem is unmounted, either by a signal or by umount
+	var status atomic.Int32
+	unmountFailed := make(chan struct{})
+	go handleSignals(server, cfg.Mount.Point, &status, unmountFailed)
 
-	if !(*removePersistence) {
-		go metadata.SaveStorageRegularly(dest, *interval)
+	unmounted := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(unmounted)
+	}()
 
-		defer func() {
-			metadata.SavePersistantStorage(dest)
-			permissions.SaveSysadmin(dest)
-			// print for debugging purposes
-			metadata.PrintRegularFileMetadataHash()
-			metadata.PrintDirMetadataHash()
-			metadata.PrintNodePersistenceHash()
-		}()
+	select {
+	case <-unmounted:
+	case <-unmountFailed:
+	}
+
+	// stop taking commands before the final save
+	controlServer.Close()
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	// when we are shutting down the filesystem, save the hashmaps
+	if saving {
+		log.Println("Writing final checkpoint...")
+		if err := metadata.SavePersistantStorage(dest); err != nil {
+			log.Printf("Final checkpoint failed: %v\n", err)
+			status.Store(exitUnclean)
+		}
+		if err := permissions.SaveSysadmin(dest); err != nil {
+			status.Store(exitUnclean)
+		}
+		if err := permissions.SaveRoles(dest); err != nil {
+			status.Store(exitUnclean)
+		}
+		// print for debugging purposes
+		metadata.PrintRegularFileMetadataHash()
+		metadata.PrintDirMetadataHash()
+		metadata.PrintNodePersistenceHash()
 	}
 
-	server.Wait()
+	audit.Close()
+
+	log.Printf("OptiFS stopped with exit status {%v}\n", status.Load())
+	os.Exit(int(status.Load()))
+}
+
+// records changing the sysadmin from the command line in the audit log
+func auditSysadminChange(op string, errno syscall.Errno) {
+	event := audit.Event{Type: audit.Admin, Op: op, UID: uint32(os.Getuid()), GID: uint32(os.Getgid()), PID: uint32(os.Getpid()), Outcome: audit.Allowed}
+	if errno != fs.OK {
+		event.Outcome, event.Detail = audit.Failed, errno.Error()
+	}
+	audit.Record(event)
 }
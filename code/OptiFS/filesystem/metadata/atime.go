@@ -0,0 +1,104 @@
+// This file contains the policy deciding when accesses update the atime of a node's custom metadata
+
+package metadata
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// AtimePolicy decides when reading a node updates its access time
+type AtimePolicy int32
+
+const (
+	Relatime    AtimePolicy = iota // Only update if the atime is older than the mtime/ctime, or a day old
+	Strictatime                    // Update on every access
+	Noatime                        // Never update on access
+)
+
+// The atime policy of the filesystem, relatime by default (the same as Linux). Atomic, as reloading the
+// configuration changes it while nodes are being read.
+var atimeMode atomic.Int32
+
+// How old the atime has to be before relatime updates it regardless of the mtime/ctime
+var RelatimeInterval = 24 * time.Hour
+
+// Parses the name of an atime policy, as given to the mount options
+func ParseAtimePolicy(name string) (AtimePolicy, error) {
+	switch name {
+	case "relatime":
+		return Relatime, nil
+	case "strictatime":
+		return Strictatime, nil
+	case "noatime":
+		return Noatime, nil
+	}
+	return Relatime, fmt.Errorf("unknown atime policy {%v}", name)
+}
+
+// Changes the atime policy, from the next read onwards
+func SetAtimeMode(policy AtimePolicy) {
+	atimeMode.Store(int32(policy))
+}
+
+// Gets the atime policy
+func GetAtimeMode() AtimePolicy {
+	return AtimePolicy(atimeMode.Load())
+}
+
+func (p AtimePolicy) String() string {
+	switch p {
+	case Strictatime:
+		return "strictatime"
+	case Noatime:
+		return "noatime"
+	}
+	return "relatime"
+}
+
+// Updates the access time of a node that was just read, following the atime policy.
+// Returns whether the access time was updated.
+//
+// Avoids taking the write lock (and dirtying the metadata for the next save) when the policy
+// doesn't require an update.
+func TouchAtime(metadata *MapEntryMetadata, isDir bool) bool {
+	policy := GetAtimeMode()
+	if metadata == nil || policy == Noatime {
+		return false
+	}
+
+	now := time.Now()
+	if policy == Relatime {
+		if isDir {
+			dirMutex.RLock()
+		} else {
+			metadataMutex.RLock()
+		}
+		update := needsRelatimeUpdate(metadata.Atim, metadata.Mtim, metadata.Ctim, now)
+		if isDir {
+			dirMutex.RUnlock()
+		} else {
+			metadataMutex.RUnlock()
+		}
+
+		if !update {
+			return false
+		}
+	}
+
+	logger.Debug("Updating atime", "policy", policy)
+	UpdateTime(metadata, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, nil, nil, isDir)
+	return true
+}
+
+// The relatime rule - update if the atime isn't newer than the mtime or ctime, or is older than
+// RelatimeInterval
+func needsRelatimeUpdate(atim, mtim, ctim syscall.Timespec, now time.Time) bool {
+	atime := time.Unix(atim.Sec, atim.Nsec)
+	if !atime.After(time.Unix(mtim.Sec, mtim.Nsec)) || !atime.After(time.Unix(ctim.Sec, ctim.Nsec)) {
+		return true
+	}
+	return now.Sub(atime) >= RelatimeInterval
+}
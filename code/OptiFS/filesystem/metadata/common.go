@@ -6,12 +6,21 @@ import (
 	"bytes"
 	"sort"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 )
 
+// Limits on the extended attributes of a node, the first two are the same as the kernel's
+var XAttrNameMax = 255         // Longest name of a single attribute (XATTR_NAME_MAX)
+var XAttrSizeMax = 64 * 1024   // Largest value of a single attribute (XATTR_SIZE_MAX)
+var XAttrTotalMax = 256 * 1024 // Largest total size (names and values) of all attributes of a node
+
 // Function updates all MapEntryMetadata attributes from the given unstable attributes
 func updateAllFromStat(metadata *MapEntryMetadata, unstableAttr *syscall.Stat_t, stableAttr *fs.StableAttr, path string) {
+	// The owner and size can change, and so can the path, so charge for both once the lock is released
+	var oldPath string
+	defer func() { recharge(oldPath, path) }()
 
     // Check to see the appropriate hashmap to lock
     if unstableAttr.Mode&syscall.S_IFDIR != 0 {
@@ -23,6 +32,7 @@ func updateAllFromStat(metadata *MapEntryMetadata, unstableAttr *syscall.Stat_t,
     }
 
 	// Save the path here for dedup purposes
+	oldPath = (*metadata).Path
 	(*metadata).Path = path
 
 	// Take these from our stable attributes
@@ -45,6 +55,11 @@ func updateAllFromStat(metadata *MapEntryMetadata, unstableAttr *syscall.Stat_t,
 	(*metadata).X__pad0 = (*unstableAttr).X__pad0
 	(*metadata).X__unused = (*unstableAttr).X__unused
 
+	// The birth time is only set once, the underlying node can be replaced (dedup relinks)
+	if (*metadata).Btim == (syscall.Timespec{}) {
+		(*metadata).Btim = timespecNow()
+	}
+
 	// Create the xAttr map if it doesn't exist
 	if (*metadata).XAttr == nil {
 		(*metadata).XAttr = make(map[string][]byte)
@@ -72,12 +87,41 @@ func GetCustomXAttr(customMetadata *MapEntryMetadata, attr string, dest *[]byte,
 	if !ok {
 		return 0, fs.ToErrno(syscall.ENODATA)
 	}
+	// Ensure the destination buffer is big enough, the caller will retry with the size returned
+	if len(*dest) < len(bytes) {
+		return uint32(len(bytes)), fs.ToErrno(syscall.ERANGE)
+	}
 	// Fill the destination byte buffer
-	*dest = bytes
+	copy(*dest, bytes)
 	// Return the length and OK signal
 	return uint32(len(bytes)), fs.OK
 }
 
+// Retrieves a copy of a custom extended attribute, for internal use where there is no
+// destination buffer to fill
+func CopyCustomXAttr(customMetadata *MapEntryMetadata, attr string, isDir bool) ([]byte, syscall.Errno) {
+
+	if customMetadata == nil || customMetadata.XAttr == nil {
+		return nil, fs.ToErrno(syscall.ENODATA)
+	}
+
+	// Ensure to get the correct lock
+	if isDir {
+		dirMutex.RLock()
+		defer dirMutex.RUnlock()
+	} else {
+		metadataMutex.RLock()
+		defer metadataMutex.RUnlock()
+	}
+
+	value, ok := customMetadata.XAttr[attr]
+	if !ok {
+		return nil, fs.ToErrno(syscall.ENODATA)
+	}
+
+	return append([]byte(nil), value...), fs.OK
+}
+
 // Sets custom extended attributes
 func SetCustomXAttr(customMetadata *MapEntryMetadata, attr string, data []byte, flags uint32, isDir bool) syscall.Errno {
 
@@ -94,26 +138,38 @@ func SetCustomXAttr(customMetadata *MapEntryMetadata, attr string, data []byte,
 		defer metadataMutex.Unlock()
 	}
 
+	// Enforce the limits on the attribute itself
+	if len(attr) > XAttrNameMax {
+		return fs.ToErrno(syscall.ERANGE)
+	}
+	if len(data) > XAttrSizeMax {
+		return fs.ToErrno(syscall.E2BIG)
+	}
+
 	// Check flags
-	if flags&0x1 != 0 { // XATTR_CREATE FLAG
+	_, exists := customMetadata.XAttr[attr]
+	if flags&0x1 != 0 && exists { // XATTR_CREATE FLAG
 		// Should fail if it already exists
-		_, ok := customMetadata.XAttr[attr]
-		if ok {
-			return fs.ToErrno(syscall.EEXIST)
-		}
-		customMetadata.XAttr[attr] = data
-	} else if flags&0x2 != 0 { // XATTR_REPLACE FLAG
+		return fs.ToErrno(syscall.EEXIST)
+	} else if flags&0x2 != 0 && !exists { // XATTR_REPLACE FLAG
 		// Should fail if it doesn't exist
-		_, ok := customMetadata.XAttr[attr]
-		if !ok {
-			return fs.ToErrno(syscall.ENODATA)
+		return fs.ToErrno(syscall.ENODATA)
+	}
+
+	// Enforce the limit on all attributes of the node, replacing an attribute frees its old value
+	total := len(attr) + len(data)
+	for name, value := range customMetadata.XAttr {
+		if name != attr {
+			total += len(name) + len(value)
 		}
-		customMetadata.XAttr[attr] = data
-	} else {
-		// Assume no specific operation defined, just set
-		customMetadata.XAttr[attr] = data
+	}
+	if total > XAttrTotalMax {
+		return fs.ToErrno(syscall.ENOSPC)
 	}
 
+	// Keep our own copy, the caller's buffer may be reused
+	customMetadata.XAttr[attr] = append([]byte(nil), data...)
+
 	return fs.OK
 }
 
@@ -144,6 +200,11 @@ func RemoveCustomXAttr(customMetadata *MapEntryMetadata, attr string, isDir bool
 }
 
 func ListCustomXAttr(customMetadata *MapEntryMetadata, dest *[]byte, isDir bool) (uint32, syscall.Errno) {
+	return ListVisibleCustomXAttr(customMetadata, dest, isDir, nil)
+}
+
+// Lists the custom extended attributes that 'visible' returns true for, or all of them if 'visible' is nil
+func ListVisibleCustomXAttr(customMetadata *MapEntryMetadata, dest *[]byte, isDir bool, visible func(string) bool) (uint32, syscall.Errno) {
 	if customMetadata == nil || customMetadata.XAttr == nil {
 		return 0, fs.ToErrno(syscall.ENODATA)
 	}
@@ -164,7 +225,9 @@ func ListCustomXAttr(customMetadata *MapEntryMetadata, dest *[]byte, isDir bool)
 	// Put attributes into a string slice and sort them to create deterministic behaviour
 	var attrNames []string
 	for attrName := range customMetadata.XAttr {
-		attrNames = append(attrNames, attrName)
+		if visible == nil || visible(attrName) {
+			attrNames = append(attrNames, attrName)
+		}
 	}
 	sort.Strings(attrNames)
 
@@ -197,3 +260,9 @@ func UpdateGenNumber(current *MapEntryMetadata, isDir bool) {
 
 	current.Gen++
 }
+
+// Gets the current time as a Timespec
+func timespecNow() syscall.Timespec {
+	now := time.Now()
+	return syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}
+}
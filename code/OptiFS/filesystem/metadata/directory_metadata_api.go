@@ -3,6 +3,7 @@
 package metadata
 
 import (
+	"path/filepath"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -10,11 +11,17 @@ import (
 
 // Creates a default directory entry in the directoryMetadataHash
 func CreateDirEntry(path string) *MapEntryMetadata {
+	defer recharge(path) // once the lock is released
+
 	// needs a write lock as we are modifying the hashmap
 	dirMutex.Lock()
 	defer dirMutex.Unlock()
 
+	// New directories are in the same project as the directory they're made in
 	entry := &MapEntryMetadata{XAttr: make(map[string][]byte)}
+	if parent, ok := dirMetadataHash[filepath.Dir(path)]; ok {
+		entry.Project = parent.Project
+	}
 	dirMetadataHash[path] = entry
 	return entry
 }
@@ -57,6 +64,8 @@ func UpdateDirEntry(path string, unstableAttr *syscall.Stat_t, stableAttr *fs.St
 // Provides no response, function deletes if the entry is there, does nothing
 // if it is not.
 func RemoveDirEntry(path string) {
+	defer recharge(path) // once the lock is released
+
 	// needs a write lock as we are modifying the hashmap (deleting an entry)
 	dirMutex.Lock()
 	defer dirMutex.Unlock()
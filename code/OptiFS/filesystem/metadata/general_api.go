@@ -3,11 +3,11 @@
 package metadata
 
 import (
-	"log"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 // Updates a MapEntryMetadata object with all data provided from the Stat_t object passed
@@ -46,6 +46,9 @@ func FillAttr(customMetadata *MapEntryMetadata, out *fuse.Attr) {
 // Function updates the UID and GID of a MapEntryMetadata
 // Accepts pointers, doesn't set nil values
 func UpdateOwner(metadata *MapEntryMetadata, uid, gid *uint32, isDir bool) error {
+	var path string
+	defer func() { recharge(path) }() // once the lock is released, the path is read under it
+
 	// we check to see if we are dealing with a directory or not
 	// so we know which lock to instantiate
 	if isDir {
@@ -55,14 +58,15 @@ func UpdateOwner(metadata *MapEntryMetadata, uid, gid *uint32, isDir bool) error
 		metadataMutex.Lock()
 		defer metadataMutex.Unlock()
 	}
+	path = (*metadata).Path
 
 	if uid != nil {
 		(*metadata).Uid = *uid
-		log.Println("Updated custom UID")
+		logger.Debug("Updated custom UID")
 	}
 	if gid != nil {
 		(*metadata).Gid = *gid
-		log.Println("Updated custom GID")
+		logger.Debug("Updated custom GID")
 	}
 	return nil
 }
@@ -82,15 +86,36 @@ func UpdateTime(metadata *MapEntryMetadata, atim, mtim, ctim *syscall.Timespec,
 
 	if atim != nil {
 		(*metadata).Atim = *atim
-		log.Println("Updated custom ATime")
+		logger.Debug("Updated custom ATime")
 	}
 	if mtim != nil {
 		(*metadata).Mtim = *mtim
-		log.Println("Updated custom MTime")
+		logger.Debug("Updated custom MTime")
 	}
 	if ctim != nil {
 		(*metadata).Ctim = *ctim
-		log.Println("Updated custom CTime")
+		logger.Debug("Updated custom CTime")
+	}
+	return nil
+}
+
+// Function updates the birth time of a MapEntryMetadata, used to keep the time a node was
+// originally created (the custom metadata of regular files is only created once they're released)
+// Accepts pointers, doesn't set nil values
+func UpdateBirthTime(metadata *MapEntryMetadata, btim *syscall.Timespec, isDir bool) error {
+	// we check to see if we are dealing with a directory or not
+	// so we know which lock to instantiate
+	if isDir {
+		dirMutex.Lock()
+		defer dirMutex.Unlock()
+	} else {
+		metadataMutex.Lock()
+		defer metadataMutex.Unlock()
+	}
+
+	if btim != nil {
+		(*metadata).Btim = *btim
+		logger.Debug("Updated custom BTime")
 	}
 	return nil
 }
@@ -110,11 +135,11 @@ func UpdateLocation(metadata *MapEntryMetadata, inode, dev *uint64, isDir bool)
 
 	if inode != nil {
 		(*metadata).Ino = *inode
-		log.Println("Updated custom Inode")
+		logger.Debug("Updated custom Inode")
 	}
 	if dev != nil {
 		(*metadata).Dev = *dev
-		log.Println("Updated custom Device")
+		logger.Debug("Updated custom Device")
 	}
 	return nil
 }
@@ -122,6 +147,9 @@ func UpdateLocation(metadata *MapEntryMetadata, inode, dev *uint64, isDir bool)
 // Function updates size field of a MapEntryMetadata
 // Accepts pointers, doesn't set nil values
 func UpdateSize(metadata *MapEntryMetadata, size *int64, isDir bool) error {
+	var path string
+	defer func() { recharge(path) }() // once the lock is released, the path is read under it
+
 	// we check to see if we are dealing with a directory or not
 	// so we know which lock to instantiate
 	if isDir {
@@ -131,10 +159,11 @@ func UpdateSize(metadata *MapEntryMetadata, size *int64, isDir bool) error {
 		metadataMutex.Lock()
 		defer metadataMutex.Unlock()
 	}
+	path = (*metadata).Path
 
 	if size != nil {
 		(*metadata).Size = *size
-		log.Println("Updated custom Size")
+		logger.Debug("Updated custom Size")
 	}
 	return nil
 }
@@ -154,7 +183,7 @@ func UpdateLinkCount(metadata *MapEntryMetadata, linkCount *uint64, isDir bool)
 
 	if linkCount != nil {
 		(*metadata).Nlink = *linkCount
-		log.Println("Updated custom Nlink")
+		logger.Debug("Updated custom Nlink")
 	}
 	return nil
 }
@@ -174,7 +203,7 @@ func UpdateMode(metadata *MapEntryMetadata, mode *uint32, isDir bool) error {
 
 	if mode != nil {
 		(*metadata).Mode = *mode
-		log.Println("Updated custom Mode")
+		logger.Debug("Updated custom Mode")
 	}
 	return nil
 }
@@ -194,11 +223,11 @@ func UpdateMemoryPadding(metadata *MapEntryMetadata, X__pad0 *int32, X__unused *
 
 	if X__pad0 != nil {
 		(*metadata).X__pad0 = *X__pad0
-		log.Println("Updated custom X__pad0")
+		logger.Debug("Updated custom X__pad0")
 	}
 	if X__unused != nil {
 		(*metadata).X__unused = *X__unused
-		log.Println("Updated custom X__unused")
+		logger.Debug("Updated custom X__unused")
 	}
 	return nil
 }
@@ -228,3 +257,87 @@ func FillAttrOut(metadata *MapEntryMetadata, out *fuse.AttrOut) {
 	(*out).Attr.Rdev = uint32((*metadata).Rdev)
 	(*out).Attr.Blksize = uint32((*metadata).Blksize)
 }
+
+// Function fills the FUSE StatxOut struct with the metadata contained in the provided MapEntryMetadata
+// struct, including the birth time which the regular AttrOut can't carry.
+func FillStatxOut(metadata *MapEntryMetadata, out *fuse.StatxOut, isDir bool) {
+	// needs a read lock as data is not being modified, only read
+	if isDir {
+		dirMutex.RLock()
+		defer dirMutex.RUnlock()
+	} else {
+		metadataMutex.RLock()
+		defer metadataMutex.RUnlock()
+	}
+
+	// Fill the StatxOut with our custom attributes stored in our hash
+	(*out).Mask = unix.STATX_BASIC_STATS | unix.STATX_BTIME
+	(*out).Ino = (*metadata).Ino
+	(*out).Size = uint64((*metadata).Size)
+	(*out).Blocks = uint64((*metadata).Blocks)
+	(*out).Atime = fuse.SxTime{Sec: uint64((*metadata).Atim.Sec), Nsec: uint32((*metadata).Atim.Nsec)}
+	(*out).Btime = fuse.SxTime{Sec: uint64((*metadata).Btim.Sec), Nsec: uint32((*metadata).Btim.Nsec)}
+	(*out).Ctime = fuse.SxTime{Sec: uint64((*metadata).Ctim.Sec), Nsec: uint32((*metadata).Ctim.Nsec)}
+	(*out).Mtime = fuse.SxTime{Sec: uint64((*metadata).Mtim.Sec), Nsec: uint32((*metadata).Mtim.Nsec)}
+	(*out).Mode = uint16((*metadata).Mode)
+	(*out).Nlink = uint32((*metadata).Nlink)
+	(*out).Uid = (*metadata).Uid
+	(*out).Gid = (*metadata).Gid
+	(*out).RdevMajor = unix.Major((*metadata).Rdev)
+	(*out).RdevMinor = unix.Minor((*metadata).Rdev)
+	(*out).DevMajor = unix.Major((*metadata).Dev)
+	(*out).DevMinor = unix.Minor((*metadata).Dev)
+	(*out).Blksize = uint32((*metadata).Blksize)
+}
+
+// Copies the custom metadata of the node at 'path' (on the underlying filesystem), so it can be kept
+// after the node changes, e.g. in a snapshot. Also returns whether it's a directory.
+func CopyNodeMetadata(path string) (syscall.Errno, bool, MapEntryMetadata) {
+	err, _, _, _, _, isDir, hash, ref := RetrieveNodeInfo(path)
+	if err != fs.OK {
+		return err, false, MapEntryMetadata{}
+	}
+
+	var nodeMetadata *MapEntryMetadata
+	if isDir {
+		err, nodeMetadata = LookupDirMetadata(path)
+	} else {
+		err, nodeMetadata = LookupRegularFileMetadata(hash, ref)
+	}
+	if err != fs.OK {
+		return err, isDir, MapEntryMetadata{}
+	}
+
+	// needs a read lock as data is not being modified, only read
+	if isDir {
+		dirMutex.RLock()
+		defer dirMutex.RUnlock()
+	} else {
+		metadataMutex.RLock()
+		defer metadataMutex.RUnlock()
+	}
+
+	copied := *nodeMetadata
+	copied.XAttr = make(map[string][]byte, len(nodeMetadata.XAttr))
+	for name, value := range nodeMetadata.XAttr {
+		copied.XAttr[name] = append([]byte(nil), value...)
+	}
+	return fs.OK, isDir, copied
+}
+
+// Builds custom metadata for a node OptiFS has no metadata for yet, from the underlying node
+func FromStat(path string, st *syscall.Stat_t) MapEntryMetadata {
+	return MapEntryMetadata{
+		Path:  path,
+		Mode:  st.Mode,
+		Uid:   st.Uid,
+		Gid:   st.Gid,
+		Nlink: st.Nlink,
+		Size:  st.Size,
+		Atim:  st.Atim,
+		Mtim:  st.Mtim,
+		Ctim:  st.Ctim,
+		Btim:  st.Ctim,
+		XAttr: make(map[string][]byte),
+	}
+}
@@ -2,6 +2,11 @@
 
 package metadata
 
+import "filesystem/logging"
+
+// Logs everything the metadata module does
+var logger = logging.For(logging.Metadata)
+
 // Contains all metadata for regular files in our custom metadata system
 //
 // The key is the content of a regular file hashed using BLAKE3
@@ -3,11 +3,14 @@ package metadata
 import (
 	"bytes"
 	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 	"lukechampine.com/blake3"
 )
 
@@ -146,6 +149,18 @@ func TestGetCustomXAttr(t *testing.T) {
 			expectedLen: 5,
 			expectedErr: fs.OK,
 		},
+		{
+			name: "buffer too small",
+			metadata: &MapEntryMetadata{
+				XAttr: map[string][]byte{
+					"longAttr": []byte("this value is too long"),
+				},
+			},
+			attr:        "longAttr",
+			isDir:       false,
+			expectedLen: 22,
+			expectedErr: fs.ToErrno(syscall.ERANGE),
+		},
 	}
 
 	for _, tt := range testCases {
@@ -212,6 +227,54 @@ func TestSetCustomXAttr(t *testing.T) {
 			flags:       0x2, // XATTR_REPLACE
 			expectedErr: fs.OK,
 		},
+		{
+			name: "name too long",
+			metadata: &MapEntryMetadata{
+				XAttr: map[string][]byte{},
+			},
+			attr:        "user." + string(bytes.Repeat([]byte("a"), XAttrNameMax)),
+			data:        []byte("value"),
+			flags:       0,
+			expectedErr: fs.ToErrno(syscall.ERANGE),
+		},
+		{
+			name: "value too large",
+			metadata: &MapEntryMetadata{
+				XAttr: map[string][]byte{},
+			},
+			attr:        "user.big",
+			data:        make([]byte, XAttrSizeMax+1),
+			flags:       0,
+			expectedErr: fs.ToErrno(syscall.E2BIG),
+		},
+		{
+			name: "total size exceeded",
+			metadata: &MapEntryMetadata{
+				XAttr: map[string][]byte{
+					"user.a": make([]byte, XAttrSizeMax),
+					"user.b": make([]byte, XAttrSizeMax),
+					"user.c": make([]byte, XAttrSizeMax),
+				},
+			},
+			attr:        "user.d",
+			data:        make([]byte, XAttrSizeMax),
+			flags:       0,
+			expectedErr: fs.ToErrno(syscall.ENOSPC),
+		},
+		{
+			name: "replacing within total size",
+			metadata: &MapEntryMetadata{
+				XAttr: map[string][]byte{
+					"user.a": make([]byte, XAttrSizeMax),
+					"user.b": make([]byte, XAttrSizeMax),
+					"user.c": make([]byte, XAttrSizeMax),
+				},
+			},
+			attr:        "user.c",
+			data:        make([]byte, XAttrSizeMax),
+			flags:       0,
+			expectedErr: fs.OK,
+		},
 	}
 
 	for _, tt := range testCases {
@@ -363,6 +426,29 @@ func TestListCustomXAttr(t *testing.T) {
 	}
 }
 
+// Unit test for ListVisibleCustomXAttr in common.go
+func TestListVisibleCustomXAttr(t *testing.T) {
+	customMetadata := &MapEntryMetadata{
+		XAttr: map[string][]byte{
+			"user.foo":     nil,
+			"trusted.bar":  nil,
+			"security.baz": nil,
+		},
+	}
+	hideTrusted := func(attr string) bool {
+		return attr != "trusted.bar"
+	}
+
+	dest := make([]byte, 100)
+	size, err := ListVisibleCustomXAttr(customMetadata, &dest, false, hideTrusted)
+	if err != fs.OK {
+		t.Errorf("Incorrect error. Expected: %v, Got: %v", fs.OK, err)
+	}
+	if string(dest[:size]) != "security.baz\x00user.foo\x00" {
+		t.Errorf("Incorrect listing in dest. Got: %q", dest[:size])
+	}
+}
+
 func blake3Hash(in []byte) (out [64]byte) {
 	return blake3.Sum512(in)
 }
@@ -706,6 +792,70 @@ func TestFillAttrOut(t *testing.T) {
 	}
 }
 
+// Unit test for FillStatxOut in general_api.go
+func TestFillStatxOut(t *testing.T) {
+	inputMetadata := &MapEntryMetadata{
+		Ino:     12345,
+		Size:    4096,
+		Blocks:  8,
+		Atim:    syscall.Timespec{Sec: 1679009770, Nsec: 62539149},
+		Mtim:    syscall.Timespec{Sec: 1679009775, Nsec: 869650321},
+		Ctim:    syscall.Timespec{Sec: 1679009772, Nsec: 797906618},
+		Btim:    syscall.Timespec{Sec: 1579009772, Nsec: 123},
+		Mode:    syscall.S_IFREG | 0755,
+		Nlink:   2,
+		Uid:     1000,
+		Gid:     1000,
+		Blksize: 512,
+	}
+
+	actual := fuse.StatxOut{}
+	FillStatxOut(inputMetadata, &actual, false)
+
+	if actual.Mask&unix.STATX_BTIME == 0 {
+		t.Errorf("Expected the birth time to be marked as filled")
+	}
+	if actual.Btime.Sec != 1579009772 || actual.Btime.Nsec != 123 {
+		t.Errorf("Incorrect birth time. Got: %+v", actual.Btime)
+	}
+	if actual.Ctime.Sec != 1679009772 || actual.Mtime.Sec != 1679009775 || actual.Atime.Sec != 1679009770 {
+		t.Errorf("Incorrect timestamps. Got: %+v", actual.Statx)
+	}
+	if actual.Ino != 12345 || actual.Size != 4096 || actual.Mode != syscall.S_IFREG|0755 || actual.Uid != 1000 {
+		t.Errorf("Incorrect attribute filling. Got: %+v", actual.Statx)
+	}
+}
+
+// Unit test for the birth time being kept by updateAllFromStat and the migrate functions
+func TestBirthTimeKept(t *testing.T) {
+	birth := syscall.Timespec{Sec: 1579009772, Nsec: 123}
+	stat := &syscall.Stat_t{Mode: syscall.S_IFREG | 0644, Ctim: syscall.Timespec{Sec: 1679009772}}
+
+	// A fresh node is born now, an existing one keeps its birth time
+	fresh := &MapEntryMetadata{}
+	updateAllFromStat(fresh, stat, &fs.StableAttr{}, "test/fresh")
+	if fresh.Btim == (syscall.Timespec{}) {
+		t.Errorf("Expected a birth time for a fresh node")
+	}
+	existing := &MapEntryMetadata{Btim: birth}
+	updateAllFromStat(existing, stat, &fs.StableAttr{}, "test/existing")
+	if existing.Btim != birth {
+		t.Errorf("Expected %v, got %v", birth, existing.Btim)
+	}
+
+	// Both a rewrite and a dedup relink keep the birth time
+	migrated := &MapEntryMetadata{}
+	MigrateRegularFileMetadata(existing, migrated, stat)
+	if migrated.Btim != birth {
+		t.Errorf("Expected %v, got %v", birth, migrated.Btim)
+	}
+	relinked := &MapEntryMetadata{}
+	MigrateDuplicateFileMetadata(existing, relinked, stat)
+	if relinked.Btim != birth {
+		t.Errorf("Expected %v, got %v", birth, relinked.Btim)
+	}
+}
+
 // Unit tests for StoreRegFileInfo in persistence_api.go
 func TestStoreRegFileInfo(t *testing.T) {
 	testCases := []struct {
@@ -999,6 +1149,151 @@ func TestRetrieveNodeInfo(t *testing.T) {
 	}
 }
 
+// Unit test for ExchangePaths function in persistence_api.go
+func TestExchangePaths(t *testing.T) {
+	fileHash := blake3Hash([]byte{1, 2, 3, 4})
+
+	testCases := []struct {
+		name          string
+		path1         string
+		path2         string
+		expectedNodes map[string]uint64 // path -> StableIno
+		expectedDirs  []string
+		expectedFile  string
+	}{
+		{
+			name:          "Exchange file and directory",
+			path1:         "test/file",
+			path2:         "test/dir",
+			expectedNodes: map[string]uint64{"test/dir": 1, "test/file": 2, "test/file/child": 3, "test/other": 4},
+			expectedDirs:  []string{"test/file", "test/file/child"},
+			expectedFile:  "test/dir",
+		},
+		{
+			name:          "Unrelated paths",
+			path1:         "test/a",
+			path2:         "test/b",
+			expectedNodes: map[string]uint64{"test/file": 1, "test/dir": 2, "test/dir/child": 3, "test/other": 4},
+			expectedDirs:  []string{"test/dir", "test/dir/child"},
+			expectedFile:  "test/file",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Redeclare the hashmap dependencies
+			nodePersistenceHash = map[string]*NodeInfo{
+				"test/file":      {StableIno: 1, ContentHash: fileHash, RefNum: 1},
+				"test/dir":       {StableIno: 2, IsDir: true},
+				"test/dir/child": {StableIno: 3, IsDir: true},
+				"test/other":     {StableIno: 4, IsDir: true},
+			}
+			dirMetadataHash = map[string]*MapEntryMetadata{
+				"test/dir":       {Path: "test/dir"},
+				"test/dir/child": {Path: "test/dir/child"},
+			}
+			fileMetadata := &MapEntryMetadata{Path: "test/file"}
+			regularFileMetadataHash = map[[64]byte]*MapEntry{
+				fileHash: {EntryList: map[uint64]*MapEntryMetadata{1: fileMetadata}},
+			}
+
+			ExchangePaths(tc.path1, tc.path2)
+
+			if len(nodePersistenceHash) != len(tc.expectedNodes) {
+				t.Errorf("Expected %v nodes, got %v\n", len(tc.expectedNodes), len(nodePersistenceHash))
+			}
+			for path, ino := range tc.expectedNodes {
+				info, ok := nodePersistenceHash[path]
+				if !ok || info.StableIno != ino {
+					t.Errorf("Expected {%v} to have ino %v, got %v\n", path, ino, info)
+				}
+			}
+			for _, path := range tc.expectedDirs {
+				dirMetadata, ok := dirMetadataHash[path]
+				if !ok || dirMetadata.Path != path {
+					t.Errorf("Expected directory metadata at {%v}, got %v\n", path, dirMetadata)
+				}
+			}
+			if fileMetadata.Path != tc.expectedFile {
+				t.Errorf("Expected file path {%v}, got {%v}\n", tc.expectedFile, fileMetadata.Path)
+			}
+		})
+	}
+}
+
+// Unit test for MovePath function in persistence_api.go
+func TestMovePath(t *testing.T) {
+	fileHash := blake3Hash([]byte{1, 2, 3, 4})
+
+	testCases := []struct {
+		name          string
+		from          string
+		to            string
+		expectedNodes map[string]uint64 // path -> StableIno
+		expectedDirs  []string
+		expectedFile  string
+	}{
+		{
+			name:          "Move file",
+			from:          "test/file",
+			to:            "trash/1",
+			expectedNodes: map[string]uint64{"trash/1": 1, "test/dir": 2, "test/dir/child": 3, "test/dirx": 4},
+			expectedDirs:  []string{"test/dir", "test/dir/child", "test/dirx"},
+			expectedFile:  "trash/1",
+		},
+		{
+			name:          "Move directory and everything under it",
+			from:          "test/dir",
+			to:            "trash/2",
+			expectedNodes: map[string]uint64{"test/file": 1, "trash/2": 2, "trash/2/child": 3, "test/dirx": 4},
+			expectedDirs:  []string{"trash/2", "trash/2/child", "test/dirx"},
+			expectedFile:  "test/file",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Redeclare the hashmap dependencies
+			nodePersistenceHash = map[string]*NodeInfo{
+				"test/file":      {StableIno: 1, ContentHash: fileHash, RefNum: 1},
+				"test/dir":       {StableIno: 2, IsDir: true},
+				"test/dir/child": {StableIno: 3, IsDir: true},
+				"test/dirx":      {StableIno: 4, IsDir: true},
+			}
+			dirMetadataHash = map[string]*MapEntryMetadata{
+				"test/dir":       {Path: "test/dir"},
+				"test/dir/child": {Path: "test/dir/child"},
+				"test/dirx":      {Path: "test/dirx"},
+			}
+			fileMetadata := &MapEntryMetadata{Path: "test/file"}
+			regularFileMetadataHash = map[[64]byte]*MapEntry{
+				fileHash: {EntryList: map[uint64]*MapEntryMetadata{1: fileMetadata}},
+			}
+
+			MovePath(tc.from, tc.to)
+
+			if len(nodePersistenceHash) != len(tc.expectedNodes) {
+				t.Errorf("Expected %v nodes, got %v\n", len(tc.expectedNodes), len(nodePersistenceHash))
+			}
+			for path, ino := range tc.expectedNodes {
+				info, ok := nodePersistenceHash[path]
+				if !ok || info.StableIno != ino {
+					t.Errorf("Expected {%v} to have ino %v, got %v\n", path, ino, info)
+				}
+			}
+			for _, path := range tc.expectedDirs {
+				dirMetadata, ok := dirMetadataHash[path]
+				if !ok || dirMetadata.Path != path {
+					t.Errorf("Expected directory metadata at {%v}, got %v\n", path, dirMetadata)
+				}
+			}
+			if fileMetadata.Path != tc.expectedFile {
+				t.Errorf("Expected file path {%v}, got {%v}\n", tc.expectedFile, fileMetadata.Path)
+			}
+		})
+	}
+}
+
 // Unit test for EmptyFileIdentifier function in regular_file_metadata_api.go
 func TestEmptyFileIdentifier(t *testing.T) {
 	testcases := []struct {
@@ -1739,6 +2034,12 @@ func TestUpdateFullRegularFileMetadata(t *testing.T) {
 			}
 
 			if testCase.expectedError == fs.OK {
+				// The birth time is set to when the node was first seen, rather than from the stat
+				actual := regularFileMetadataHash[testCase.inputHash].EntryList[testCase.inputRef]
+				if actual.Btim == (syscall.Timespec{}) {
+					t.Errorf("Expected a birth time to be set\n")
+				}
+				expected.Btim = actual.Btim
 				testCase.expectedReturn[testCase.inputHash].EntryList[testCase.inputRef] = expected
 			}
 			if !reflect.DeepEqual(testCase.expectedReturn, regularFileMetadataHash) {
@@ -1858,3 +2159,454 @@ func TestMigrateRegularFileMetadata(t *testing.T) {
 		})
 	}
 }
+
+// Unit test for TouchAtime in atime.go
+func TestTouchAtime(t *testing.T) {
+	now := time.Now()
+	recent := syscall.Timespec{Sec: now.Add(-time.Hour).Unix()}
+	older := syscall.Timespec{Sec: now.Add(-2 * time.Hour).Unix()}
+	stale := syscall.Timespec{Sec: now.Add(-48 * time.Hour).Unix()}
+
+	testCases := []struct {
+		name     string
+		policy   AtimePolicy
+		atim     syscall.Timespec
+		mtim     syscall.Timespec
+		expected bool
+	}{
+		{"noatime never updates", Noatime, older, recent, false},
+		{"strictatime always updates", Strictatime, recent, older, true},
+		{"relatime updates when modified since", Relatime, older, recent, true},
+		{"relatime skips recent atime", Relatime, recent, older, false},
+		{"relatime updates day old atime", Relatime, stale, syscall.Timespec{Sec: stale.Sec - 1}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SetAtimeMode(tc.policy)
+			defer SetAtimeMode(Relatime)
+
+			nodeMetadata := &MapEntryMetadata{Atim: tc.atim, Mtim: tc.mtim, Ctim: tc.mtim}
+			updated := TouchAtime(nodeMetadata, false)
+			if updated != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, updated)
+			}
+			if updated == (nodeMetadata.Atim == tc.atim) {
+				t.Errorf("Atime change doesn't match the update: %v", nodeMetadata.Atim)
+			}
+		})
+	}
+}
+
+// Unit test for ParseAtimePolicy in atime.go
+func TestParseAtimePolicy(t *testing.T) {
+	for _, policy := range []AtimePolicy{Relatime, Strictatime, Noatime} {
+		parsed, err := ParseAtimePolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("Expected %v, got %v (%v)", policy, parsed, err)
+		}
+	}
+	if _, err := ParseAtimePolicy("atime"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
+
+// Unit test for GetDedupStatistics in statistics.go
+func TestGetDedupStatistics(t *testing.T) {
+	regularFileMetadataHash = map[[64]byte]*MapEntry{
+		{1}: {EntryList: map[uint64]*MapEntryMetadata{1: {Size: 100}, 2: {Size: 100}, 3: {Size: 100}}},
+		{2}: {EntryList: map[uint64]*MapEntryMetadata{1: {Size: 50}}},
+		{3}: {EntryList: map[uint64]*MapEntryMetadata{}},
+	}
+	defer func() { regularFileMetadataHash = make(map[[64]byte]*MapEntry) }()
+
+	stats := GetDedupStatistics()
+	expected := DedupStatistics{UniqueContents: 2, Files: 4, LogicalBytes: 350, PhysicalBytes: 150}
+	if stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+	if stats.SavedBytes() != 200 {
+		t.Errorf("Expected 200 saved bytes, got %v", stats.SavedBytes())
+	}
+	if ratio := (DedupStatistics{}).Ratio(); ratio != 1 {
+		t.Errorf("Expected a ratio of 1 with nothing stored, got %v", ratio)
+	}
+	if !strings.Contains(stats.String(), "dedup ratio:     2.33") {
+		t.Errorf("Expected the ratio in {%v}", stats.String())
+	}
+}
+
+// Unit test for CountNodes in statistics.go
+func TestCountNodes(t *testing.T) {
+	nodePersistenceHash = map[string]*NodeInfo{
+		"/a":     {IsDir: true},
+		"/a/b":   {},
+		"/a/c":   {},
+		"/a/d/e": {},
+	}
+	defer func() { nodePersistenceHash = make(map[string]*NodeInfo) }()
+
+	files, dirs := CountNodes()
+	if files != 3 || dirs != 1 {
+		t.Errorf("Expected 3 files and 1 directory, got %v and %v", files, dirs)
+	}
+}
+
+// Unit test for UsageByOwner, SharedContents and PathsWithContent in statistics.go
+func TestContentReports(t *testing.T) {
+	regularFileMetadataHash = map[[64]byte]*MapEntry{
+		{1}: {EntryList: map[uint64]*MapEntryMetadata{
+			1: {Path: "/under/b", Uid: 1000, Size: 100},
+			2: {Path: "/under/a", Uid: 1001, Size: 100},
+		}},
+		{2}: {EntryList: map[uint64]*MapEntryMetadata{1: {Path: "/under/c", Uid: 1000, Size: 50}}},
+	}
+	defer func() { regularFileMetadataHash = make(map[[64]byte]*MapEntry) }()
+
+	usage := UsageByOwner()
+	expected := map[uint32]OwnerUsage{1000: {Files: 2, Bytes: 150}, 1001: {Files: 1, Bytes: 100}}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Errorf("Expected usage %v, got %v", expected, usage)
+	}
+
+	if shared := SharedContents(); !reflect.DeepEqual(shared, [][64]byte{{1}}) {
+		t.Errorf("Expected only the first content to be shared, got %v", len(shared))
+	}
+
+	if paths := PathsWithContent([64]byte{1}); !reflect.DeepEqual(paths, []string{"/under/a", "/under/b"}) {
+		t.Errorf("Expected sorted paths, got %v", paths)
+	}
+	if paths := PathsWithContent([64]byte{3}); len(paths) != 0 {
+		t.Errorf("Expected no paths for unknown content, got %v", paths)
+	}
+}
+
+// Unit test for the health recorded by SavePersistantStorage in persistence_api.go
+func TestHealth(t *testing.T) {
+	defer func() { health = Health{} }()
+
+	if err := SavePersistantStorage(t.TempDir()); err != nil {
+		t.Fatalf("Couldn't save: %v", err)
+	}
+	if h := GetHealth(); h.LastSave.IsZero() || h.LastSaveError != nil {
+		t.Errorf("Expected a successful save to be recorded, got %+v", h)
+	}
+
+	if err := SavePersistantStorage("/nonexistent/save"); err == nil {
+		t.Fatalf("Expected saving to a missing directory to fail")
+	}
+	if h := GetHealth(); h.LastSaveError == nil {
+		t.Errorf("Expected a failed save to be recorded, got %+v", h)
+	}
+}
+
+// Unit test for DuplicateGroups, DuplicateGroupsFromSave and WriteDuplicateReport in report.go
+func TestDuplicateGroups(t *testing.T) {
+	regularFileMetadataHash = map[[64]byte]*MapEntry{
+		{1}: {ReferenceCount: 2, EntryList: map[uint64]*MapEntryMetadata{
+			1: {Path: "/under/b", Uid: 1000, Gid: 1000, Size: 100},
+			2: {Path: "/under/a", Uid: 1001, Gid: 1001, Size: 100},
+		}},
+		{2}: {ReferenceCount: 3, EntryList: map[uint64]*MapEntryMetadata{
+			1: {Path: "/under/c", Size: 500},
+			2: {Path: "/under/d", Size: 500},
+			3: {Path: "/under/e", Size: 500},
+		}},
+		{3}: {ReferenceCount: 1, EntryList: map[uint64]*MapEntryMetadata{1: {Path: "/under/f", Size: 50}}},
+	}
+	defer func() { regularFileMetadataHash = make(map[[64]byte]*MapEntry) }()
+
+	groups := DuplicateGroups()
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 duplicate groups, got %+v", groups)
+	}
+	if groups[0].SavedBytes != 1000 || groups[1].SavedBytes != 100 {
+		t.Errorf("Expected the groups sorted by bytes saved, got %v then %v", groups[0].SavedBytes, groups[1].SavedBytes)
+	}
+	expectedFiles := []DuplicateFile{{"/under/a", 1001, 1001}, {"/under/b", 1000, 1000}}
+	if !reflect.DeepEqual(groups[1].Files, expectedFiles) {
+		t.Errorf("Expected files %v, got %v", expectedFiles, groups[1].Files)
+	}
+
+	// the saved metadata gives the same report
+	dir := t.TempDir()
+	if err := SaveMetadataMap(regularFileMetadataHash, dir); err != nil {
+		t.Fatalf("Couldn't save: %v", err)
+	}
+	saved, err := DuplicateGroupsFromSave(dir)
+	if err != nil || !reflect.DeepEqual(saved, groups) {
+		t.Errorf("Expected the saved report to match, got %+v, %v", saved, err)
+	}
+	if _, err := DuplicateGroupsFromSave(t.TempDir()); err == nil {
+		t.Errorf("Expected an error without saved metadata")
+	}
+
+	var table strings.Builder
+	if err := WriteDuplicateReport(&table, groups, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(table.String(), "2 duplicate group(s), 1100 bytes saved") {
+		t.Errorf("Expected a summary in {%v}", table.String())
+	}
+
+	var js strings.Builder
+	if err := WriteDuplicateReport(&js, nil, true); err != nil || strings.TrimSpace(js.String()) != "[]" {
+		t.Errorf("Expected an empty JSON list, got {%v}, %v", js.String(), err)
+	}
+}
+
+// Unit test for CopyNodeMetadata in general_api.go
+func TestCopyNodeMetadata(t *testing.T) {
+	hash := [64]byte{1}
+	nodePersistenceHash = map[string]*NodeInfo{
+		"/root/file": {ContentHash: hash, RefNum: 1},
+		"/root/dir":  {IsDir: true},
+	}
+	regularFileMetadataHash = map[[64]byte]*MapEntry{
+		hash: {ReferenceCount: 1, EntryList: map[uint64]*MapEntryMetadata{1: {Path: "/root/file", Size: 5, XAttr: map[string][]byte{"user.a": []byte("x")}}}},
+	}
+	dirMetadataHash = map[string]*MapEntryMetadata{"/root/dir": {Path: "/root/dir", Mode: syscall.S_IFDIR | 0755}}
+	defer func() {
+		nodePersistenceHash = make(map[string]*NodeInfo)
+		regularFileMetadataHash = make(map[[64]byte]*MapEntry)
+		dirMetadataHash = make(map[string]*MapEntryMetadata)
+	}()
+
+	err, isDir, copied := CopyNodeMetadata("/root/file")
+	if err != fs.OK || isDir || copied.Size != 5 {
+		t.Fatalf("Expected the file's metadata, got %v %v %+v", err, isDir, copied)
+	}
+	// The copy mustn't change with the original
+	regularFileMetadataHash[hash].EntryList[1].XAttr["user.a"][0] = 'y'
+	regularFileMetadataHash[hash].EntryList[1].Size = 6
+	if string(copied.XAttr["user.a"]) != "x" || copied.Size != 5 {
+		t.Errorf("Expected the copy to be kept, got %+v", copied)
+	}
+
+	if err, isDir, copied = CopyNodeMetadata("/root/dir"); err != fs.OK || !isDir || copied.Mode != syscall.S_IFDIR|0755 {
+		t.Errorf("Expected the directory's metadata, got %v %v %+v", err, isDir, copied)
+	}
+	if err, _, _ = CopyNodeMetadata("/root/missing"); err != syscall.ENODATA {
+		t.Errorf("Expected ENODATA for a missing node, got %v", err)
+	}
+}
+
+// Sets up a filesystem with two files sharing a content (one of them hard linked), another file and a
+// directory, all charged from scratch
+func setupUsage(t *testing.T) {
+	nodePersistenceHash = map[string]*NodeInfo{
+		"/root/a":    {ContentHash: [64]byte{1}, RefNum: 1},
+		"/root/b":    {ContentHash: [64]byte{1}, RefNum: 2},
+		"/root/link": {ContentHash: [64]byte{1}, RefNum: 2},
+		"/root/c":    {ContentHash: [64]byte{2}, RefNum: 1},
+		"/root/dir":  {IsDir: true},
+	}
+	regularFileMetadataHash = map[[64]byte]*MapEntry{
+		{1}: {ReferenceCount: 2, IndexCounter: 2, EntryList: map[uint64]*MapEntryMetadata{
+			1: {Path: "/root/a", Uid: 1000, Gid: 100, Size: 101},
+			2: {Path: "/root/b", Uid: 1001, Gid: 100, Size: 101},
+		}},
+		{2}: {ReferenceCount: 1, IndexCounter: 1, EntryList: map[uint64]*MapEntryMetadata{1: {Path: "/root/c", Uid: 1000, Gid: 200, Size: 50}}},
+	}
+	dirMetadataHash = map[string]*MapEntryMetadata{"/root/dir": {Path: "/root/dir", Uid: 1001, Gid: 200, Size: 4096}}
+	t.Cleanup(func() {
+		nodePersistenceHash = make(map[string]*NodeInfo)
+		regularFileMetadataHash = make(map[[64]byte]*MapEntry)
+		dirMetadataHash = make(map[string]*MapEntryMetadata)
+		SetChargingMode(ChargeFirst)
+		RechargeAll()
+	})
+	RechargeAll()
+}
+
+// Unit test for RechargeAll and SetChargingMode in usage.go
+func TestChargingModes(t *testing.T) {
+	setupUsage(t)
+
+	testCases := []struct {
+		mode   ChargingMode
+		a      Usage // what uid 1000 is charged
+		b      Usage // what uid 1001 is charged
+		shared Usage // what gid 100 is charged
+	}{
+		// The hard link is another inode, but the file's size is only charged once
+		{ChargeFirst, Usage{2, 151, 151}, Usage{3, 101, 0}, Usage{3, 202, 101}},
+		{ChargeSplit, Usage{2, 151, 101}, Usage{3, 101, 50}, Usage{3, 202, 101}},
+		{ChargeFull, Usage{2, 151, 151}, Usage{3, 101, 101}, Usage{3, 202, 202}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			SetChargingMode(tc.mode)
+			if a, b, shared := UserUsage(1000), UserUsage(1001), GroupUsage(100); a != tc.a || b != tc.b || shared != tc.shared {
+				t.Errorf("Expected %+v, %+v and %+v, got %+v, %+v and %+v", tc.a, tc.b, tc.shared, a, b, shared)
+			}
+		})
+	}
+
+	if mode, err := ParseChargingMode("split"); err != nil || mode != ChargeSplit {
+		t.Errorf("Expected split, got %v (%v)", mode, err)
+	}
+	if _, err := ParseChargingMode("owner"); err == nil {
+		t.Errorf("Expected an unknown charging mode to fail")
+	}
+}
+
+// Unit test for the charges kept up to date by recharge in usage.go
+func TestRecharge(t *testing.T) {
+	setupUsage(t)
+	users, groups := AllUsage()
+
+	// Giving the first file away moves its whole charge
+	newUid := uint32(1001)
+	UpdateOwner(regularFileMetadataHash[[64]byte{1}].EntryList[1], &newUid, nil, false)
+	if a, b := UserUsage(1000), UserUsage(1001); a != (Usage{1, 50, 50}) || b != (Usage{4, 202, 101}) {
+		t.Errorf("Expected the file to be charged to its new owner, got %+v and %+v", a, b)
+	}
+
+	// Once the first file is removed, the next file with its content is charged for it
+	RemoveNodeInfo("/root/a")
+	RemoveRegularFileMetadata([64]byte{1}, 1)
+	if b := UserUsage(1001); b != (Usage{3, 101, 101}) {
+		t.Errorf("Expected the remaining file to be charged for the content, got %+v", b)
+	}
+
+	// Moving a node doesn't change what anyone is charged
+	MovePath("/root/dir", "/root/moved")
+	newSize := int64(80)
+	UpdateSize(regularFileMetadataHash[[64]byte{2}].EntryList[1], &newSize, false)
+	if b, c := UserUsage(1001), UserUsage(1000); b != (Usage{3, 101, 101}) || c != (Usage{1, 80, 80}) {
+		t.Errorf("Expected only the size to change, got %+v and %+v", b, c)
+	}
+
+	// The charges kept are the same as charging from scratch
+	kept, keptGroups := AllUsage()
+	RechargeAll()
+	if scratch, scratchGroups := AllUsage(); !reflect.DeepEqual(kept, scratch) || !reflect.DeepEqual(keptGroups, scratchGroups) {
+		t.Errorf("Expected %v and %v, got %v and %v", scratch, scratchGroups, kept, keptGroups)
+	}
+	if reflect.DeepEqual(users, kept) || len(groups) != 2 {
+		t.Errorf("Expected the usage to have changed from %v", users)
+	}
+}
+
+// Unit test for SetProject, ProjectOf and Projects in project_api.go, and the usage of projects
+func TestProjects(t *testing.T) {
+	setupUsage(t)
+	CreateDirEntry("/root")
+
+	if errno, _ := SetProject("/root/missing", 5); errno != syscall.ENOENT {
+		t.Errorf("Expected ENOENT for a directory without custom metadata, got %v", errno)
+	}
+	if errno, changed := SetProject("/root/dir", 5); errno != fs.OK || changed != 1 {
+		t.Fatalf("Expected one directory to be changed, got %v (%v)", changed, errno)
+	}
+
+	// New directories inherit the project, and files are in the project of their directory
+	CreateDirEntry("/root/dir/sub")
+	nodePersistenceHash["/root/dir/sub"] = &NodeInfo{IsDir: true}
+	if project := ProjectOf("/root/dir/sub"); project != 5 {
+		t.Errorf("Expected the new directory to inherit the project, got %v", project)
+	}
+	if project := ProjectOf("/root/dir/sub/file"); project != 5 {
+		t.Errorf("Expected the file to be in its directory's project, got %v", project)
+	}
+	if project := ProjectOf("/root/a"); project != 0 {
+		t.Errorf("Expected the file not to be in a project, got %v", project)
+	}
+	if tops := Projects(); !reflect.DeepEqual(tops, map[string]uint32{"/root/dir": 5}) {
+		t.Errorf("Expected only the top of the project, got %v", tops)
+	}
+
+	// Only what's under the directory is charged to the project, whoever owns it
+	MovePath("/root/c", "/root/dir/c")
+	RechargeAll()
+	if usage := ProjectUsage(5); usage != (Usage{3, 50, 50}) {
+		t.Errorf("Expected the directories and the file in the project, got %+v", usage)
+	}
+
+	if _, changed := SetProject("/root/dir", 0); changed != 2 {
+		t.Errorf("Expected both directories to be changed, got %v", changed)
+	}
+	if usage := ProjectUsage(5); usage != (Usage{}) || len(Projects()) != 0 {
+		t.Errorf("Expected nothing in the project, got %+v", usage)
+	}
+}
+
+// Unit test for ContentTier, SetContentTier, TouchContent, ContentsInTier and ContentSize in tier_api.go
+func TestContentTiers(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+	regularFileMetadataHash = map[[64]byte]*MapEntry{
+		{1}: {LastRead: old, EntryList: map[uint64]*MapEntryMetadata{1: {Path: "/under/a", Size: 100}}},
+		{2}: {LastRead: time.Now(), EntryList: map[uint64]*MapEntryMetadata{1: {Path: "/under/b", Size: 50}}},
+		{3}: {LastRead: old, EntryList: map[uint64]*MapEntryMetadata{}},
+		{}:  {LastRead: old, EntryList: map[uint64]*MapEntryMetadata{1: {Path: "/under/empty"}}},
+	}
+	defer func() { regularFileMetadataHash = make(map[[64]byte]*MapEntry) }()
+
+	dayAgo := time.Now().Add(-24 * time.Hour)
+	if hashes := ContentsInTier(Hot, dayAgo); !reflect.DeepEqual(hashes, [][64]byte{{1}}) {
+		t.Errorf("Expected only the unread content with files, got %v", len(hashes))
+	}
+	if hashes := ContentsInTier(Hot, time.Time{}); !reflect.DeepEqual(hashes, [][64]byte{{1}, {2}}) {
+		t.Errorf("Expected every hot content with files, got %v", len(hashes))
+	}
+
+	if err := SetContentTier([64]byte{1}, Cold); err != fs.OK {
+		t.Fatalf("Expected the tier to be set, got %v", err)
+	}
+	if err := SetContentTier([64]byte{9}, Cold); err != syscall.ENOENT {
+		t.Errorf("Expected ENOENT for unknown content, got %v", err)
+	}
+	if tier := ContentTier([64]byte{1}); tier != Cold {
+		t.Errorf("Expected the content to be cold, got %v", tier)
+	}
+	if tier := ContentTier([64]byte{9}); tier != Hot {
+		t.Errorf("Expected unknown content to be hot, got %v", tier)
+	}
+	if hashes := ContentsInTier(Cold, time.Time{}); !reflect.DeepEqual(hashes, [][64]byte{{1}}) {
+		t.Errorf("Expected the cold content, got %v", len(hashes))
+	}
+
+	TouchContent([64]byte{1})
+	if hashes := ContentsInTier(Cold, dayAgo); len(hashes) != 0 {
+		t.Errorf("Expected the content to have been read, got %v", len(hashes))
+	}
+
+	if size := ContentSize([64]byte{2}); size != 50 {
+		t.Errorf("Expected a size of 50, got %v", size)
+	}
+	if size := ContentSize([64]byte{9}); size != -1 {
+		t.Errorf("Expected -1 for unknown content, got %v", size)
+	}
+}
+
+// Unit test for CreatePrivateFileMapEntry and ContentHashOf in regular_file_metadata_api.go
+func TestPrivateFileMapEntry(t *testing.T) {
+	defer func() { regularFileMetadataHash = make(map[[64]byte]*MapEntry) }()
+
+	shared := CreateRegularFileMapEntry([64]byte{1})
+	_, sharedMetadata := CreateRegularFileMetadata(shared)
+	sharedMetadata.Size = 100
+
+	key, entry := CreatePrivateFileMapEntry([64]byte{1})
+	_, privateMetadata := CreateRegularFileMetadata(entry)
+	privateMetadata.Size = 100
+	if key == [64]byte{1} || EmptyFileIdentifier(key) {
+		t.Fatalf("Expected a key of its own")
+	}
+
+	// The excluded file has its own copy, so it's neither another file with the shared content nor free
+	if rec := RetrieveRecent(shared); rec != sharedMetadata {
+		t.Errorf("Expected only the shared file to be linked to, got %+v", rec)
+	}
+	if stats := GetDedupStatistics(); stats.Files != 2 || stats.PhysicalBytes != 200 || stats.SavedBytes() != 0 {
+		t.Errorf("Expected nothing to be saved, got %+v", stats)
+	}
+
+	if hash := ContentHashOf(key); hash != [64]byte{1} {
+		t.Errorf("Expected the content hash of the excluded file, got %x", hash)
+	}
+	if hash := ContentHashOf([64]byte{1}); hash != [64]byte{1} {
+		t.Errorf("Expected the key of a shared entry to be its hash, got %x", hash)
+	}
+}
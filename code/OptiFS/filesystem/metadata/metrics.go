@@ -0,0 +1,29 @@
+// This file contains the metrics of the metadata module, worked out whenever they're scraped
+
+package metadata
+
+import "filesystem/metrics"
+
+// How long saving the persistent stores took, and how often it failed
+var saveDurations = metrics.NewHistogram("optifs_save_duration_seconds", "How long saving the persistent stores took.", metrics.DurationBuckets)
+var saveFailures = metrics.NewCounter("optifs_save_failures", "Saves of the persistent stores that failed.")
+
+var _ = metrics.NewGaugeVec("optifs_metadata_entries", "Entries in each metadata hashmap.", "map", func() map[string]float64 {
+	metadataMutex.RLock()
+	regularFiles := len(regularFileMetadataHash)
+	metadataMutex.RUnlock()
+
+	dirMutex.RLock()
+	dirs := len(dirMetadataHash)
+	dirMutex.RUnlock()
+
+	nodeMutex.RLock()
+	nodes := len(nodePersistenceHash)
+	nodeMutex.RUnlock()
+
+	return map[string]float64{"regular_file": float64(regularFiles), "dir": float64(dirs), "node_persistence": float64(nodes)}
+})
+
+var _ = metrics.NewGauge("optifs_dedup_saved_bytes", "Bytes de-duplication is currently saving.", func() float64 {
+	return float64(CachedDedupStatistics().SavedBytes())
+})
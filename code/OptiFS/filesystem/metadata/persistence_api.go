@@ -4,9 +4,11 @@ package metadata
 
 import (
 	"encoding/gob"
-	"log"
+	"fmt"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,6 +21,8 @@ var dirMutex sync.RWMutex      // lock for hashmap saving directory infor
 
 // Stores the content hash and reference number for keeping a node persistent between OptiFS instances
 func StoreRegFileInfo(path string, stableAttr *fs.StableAttr, mode uint32, contentHash [64]byte, refNum uint64) {
+	defer recharge(path) // once the lock is released
+
 	// needs a write lock as we are modifying the hashmap
 	nodeMutex.Lock()
 	defer nodeMutex.Unlock()
@@ -28,6 +32,8 @@ func StoreRegFileInfo(path string, stableAttr *fs.StableAttr, mode uint32, conte
 
 // Specifically stores a directory into the persistence hash
 func StoreDirInfo(path string, stableAttr *fs.StableAttr, mode uint32) {
+	defer recharge(path) // once the lock is released
+
 	// needs a write lock as we are modifying the hashmap
 	nodeMutex.Lock()
 	defer nodeMutex.Unlock()
@@ -37,14 +43,16 @@ func StoreDirInfo(path string, stableAttr *fs.StableAttr, mode uint32) {
 
 // Updates node info in the persistence hash, all values except the path are optional and won't be updated if nil
 func UpdateNodeInfo(path string, isDir *bool, stableAttr *fs.StableAttr, mode *uint32, contentHash *[64]byte, refNum *uint64) {
+	defer recharge(path) // once the lock is released
+
 	// needs a write lock as we are modifying the hashmap
 	nodeMutex.Lock()
 	defer nodeMutex.Unlock()
 
-	log.Printf("Updating {%v}'s Persistent Data", path)
+	logger.Debug("Updating Persistent Data", "path", path)
 	store, ok := nodePersistenceHash[path]
 	if !ok {
-		log.Println("DOESNT EXIST!")
+		logger.Debug("DOESNT EXIST!")
 		return
 	}
 	if isDir != nil {
@@ -75,28 +83,166 @@ func RetrieveNodeInfo(path string) (syscall.Errno, uint64, uint32, uint64, uint3
 
 	info, ok := nodePersistenceHash[path]
 	if !ok {
-		log.Println("Failed to retrieve node!")
+		logger.Debug("Failed to retrieve node!")
 		return fs.ToErrno(syscall.ENODATA), 0, 0, 0, 0, false, [64]byte{}, 0
 	}
 
-	log.Printf("Retrieved persistent data for {%v}.\n", path)
+	logger.Debug("Retrieved persistent data", "path", path)
 
 	return fs.OK, info.StableIno, info.StableMode, info.StableGen, info.Mode, info.IsDir, info.ContentHash, info.RefNum
 }
 
 // Removes an entry from the nodePersistenceHash
 func RemoveNodeInfo(path string) error {
+	defer recharge(path) // once the lock is released
+
 	// needs a write lock as we are modifying the hashmap
 	nodeMutex.Lock()
 	defer nodeMutex.Unlock()
 
 	delete(nodePersistenceHash, path)
 
-    log.Printf("Removed persistent data for {%v}.\n", path)
+    logger.Debug("Removed persistent data", "path", path)
 
 	return nil
 }
 
+// Swaps the paths of two nodes (and anything below them if they are directories) across the
+// nodePersistenceHash and the directoryMetadataHash, and updates the paths stored in the custom
+// metadata of each node. Performed while holding every lock, so the exchange is atomic.
+func ExchangePaths(path1 string, path2 string) {
+	var moved []string
+	defer func() { recharge(moved...) }() // once the locks are released
+
+	nodeMutex.Lock()
+	defer nodeMutex.Unlock()
+	dirMutex.Lock()
+	defer dirMutex.Unlock()
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	logger.Debug("Exchanging", "path", path1, "other_path", path2)
+
+	// Work out where every affected node ends up before modifying anything
+	nodeMoves := make(map[string]string)
+	for path := range nodePersistenceHash {
+		if newPath, ok := exchangedPath(path, path1, path2); ok {
+			nodeMoves[path] = newPath
+		}
+	}
+	dirMoves := make(map[string]string)
+	for path := range dirMetadataHash {
+		if newPath, ok := exchangedPath(path, path1, path2); ok {
+			dirMoves[path] = newPath
+		}
+	}
+
+	// Take every affected entry out, then put them back in their new place
+	nodes := make(map[string]*NodeInfo)
+	for path, newPath := range nodeMoves {
+		nodes[newPath] = nodePersistenceHash[path]
+		delete(nodePersistenceHash, path)
+		moved = append(moved, path)
+	}
+	dirs := make(map[string]*MapEntryMetadata)
+	for path, newPath := range dirMoves {
+		dirs[newPath] = dirMetadataHash[path]
+		delete(dirMetadataHash, path)
+	}
+
+	for path, info := range nodes {
+		nodePersistenceHash[path] = info
+		// Regular files remember their path, which is needed to link duplicates to them
+		if !info.IsDir {
+			if entry, ok := regularFileMetadataHash[info.ContentHash]; ok {
+				if fileMetadata, ok := entry.EntryList[info.RefNum]; ok {
+					fileMetadata.Path = path
+				}
+			}
+		}
+	}
+	for path, dirMetadata := range dirs {
+		dirMetadataHash[path] = dirMetadata
+		dirMetadata.Path = path
+	}
+}
+
+// Works out where a path ends up when path1 and path2 are exchanged. Returns false if
+// the path isn't affected by the exchange.
+func exchangedPath(path string, path1 string, path2 string) (string, bool) {
+	switch {
+	case path == path1:
+		return path2, true
+	case path == path2:
+		return path1, true
+	case strings.HasPrefix(path, path1+"/"):
+		return path2 + strings.TrimPrefix(path, path1), true
+	case strings.HasPrefix(path, path2+"/"):
+		return path1 + strings.TrimPrefix(path, path2), true
+	}
+	return path, false
+}
+
+// Moves a node (and anything below it if it's a directory) from 'from' to 'to' across the
+// nodePersistenceHash and the directoryMetadataHash, and updates the paths stored in the custom
+// metadata of each node. The node keeps its custom metadata, unlike when it's removed and created again.
+func MovePath(from string, to string) {
+	var moved []string
+	defer func() { recharge(moved...) }() // once the locks are released
+
+	nodeMutex.Lock()
+	defer nodeMutex.Unlock()
+	dirMutex.Lock()
+	defer dirMutex.Unlock()
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	logger.Debug("Moving", "path", from, "new_path", to)
+
+	nodes := make(map[string]*NodeInfo)
+	for path, info := range nodePersistenceHash {
+		if newPath, ok := movedPath(path, from, to); ok {
+			nodes[newPath] = info
+			delete(nodePersistenceHash, path)
+			moved = append(moved, path, newPath)
+		}
+	}
+	dirs := make(map[string]*MapEntryMetadata)
+	for path, dirMetadata := range dirMetadataHash {
+		if newPath, ok := movedPath(path, from, to); ok {
+			dirs[newPath] = dirMetadata
+			delete(dirMetadataHash, path)
+		}
+	}
+
+	for path, info := range nodes {
+		nodePersistenceHash[path] = info
+		// Regular files remember their path, which is needed to link duplicates to them
+		if !info.IsDir {
+			if entry, ok := regularFileMetadataHash[info.ContentHash]; ok {
+				if fileMetadata, ok := entry.EntryList[info.RefNum]; ok {
+					fileMetadata.Path = path
+				}
+			}
+		}
+	}
+	for path, dirMetadata := range dirs {
+		dirMetadataHash[path] = dirMetadata
+		dirMetadata.Path = path
+	}
+}
+
+// Works out where a path ends up when 'from' is moved to 'to'. Returns false if the path isn't moved.
+func movedPath(path string, from string, to string) (string, bool) {
+	switch {
+	case path == from:
+		return to, true
+	case strings.HasPrefix(path, from+"/"):
+		return to + strings.TrimPrefix(path, from), true
+	}
+	return path, false
+}
+
 // Function saves the regularFileMetadataHash
 // Since a hashmap will be deleted when the system is restarted (stored in RAM),
 // we encode the hashmap and store it in a file saved on disk to be loaded when OptiFS starts
@@ -106,14 +252,14 @@ func SaveMetadataMap(hashmap map[[64]byte]*MapEntry, dest string) error {
 	metadataMutex.Lock()
 	defer metadataMutex.Unlock()
 
-    log.Println("Saving regular file metadata hash map")
+    logger.Debug("Saving regular file metadata hash map")
 
 	// create the file if it doesn't exist, truncate it if it does
 	// we assume nobody will be calling this file, as it is a very unique name
 	file, err := os.Create(dest + "/OptiFSRegularFileMetadataSave.gob")
 
 	if err != nil {
-        log.Println("Failed to create save.")
+        logger.Error("Failed to create save.")
 		return err
 	}
 
@@ -123,11 +269,11 @@ func SaveMetadataMap(hashmap map[[64]byte]*MapEntry, dest string) error {
 	eErr := encode.Encode(hashmap) // encode the hashmap into binary, put it in the file
 
 	if eErr != nil {
-        log.Println("Failed to encode.")
+        logger.Error("Failed to encode.")
 		return eErr
 	}
 
-	log.Println("Saved succesfully.")
+	logger.Debug("Saved succesfully.")
 
 	return nil
 }
@@ -140,12 +286,12 @@ func RetrieveMetadataMap(dest string) error {
 	metadataMutex.Lock()
 	defer metadataMutex.Unlock()
 
-    log.Println("Retrieving regular file metadata hash map")
+    logger.Debug("Retrieving regular file metadata hash map")
 
 	file, err := os.Open(dest + "/OptiFSRegularFileMetadataSave.gob") // open where the hashmap was encoded
 
 	if err != nil {
-        log.Println("Doesn't exist.")
+        logger.Debug("Doesn't exist.")
 		return err
 	}
 
@@ -155,11 +301,11 @@ func RetrieveMetadataMap(dest string) error {
 	dErr := decode.Decode(&regularFileMetadataHash) // decode the file back into the hashmap
 
 	if dErr != nil {
-        log.Println("Failed to decode.")
+        logger.Error("Failed to decode.")
 		return dErr
 	}
 
-	log.Println("Retrieved succesfully.")
+	logger.Debug("Retrieved succesfully.")
 
 	return nil
 }
@@ -173,14 +319,14 @@ func SaveNodePersistenceHash(hashmap map[string]*NodeInfo, dest string) error {
 	nodeMutex.Lock()
 	defer nodeMutex.Unlock()
 
-    log.Println("Saving persistence metadata hash map")
+    logger.Debug("Saving persistence metadata hash map")
 
 	// create the file if it doesn't exist, truncate it if it does
 	// we assume nobody will be calling this file, as it is a very unique name
 	file, err := os.Create(dest + "/OptiFSNodePersistenceSave.gob")
 
 	if err != nil {
-        log.Println("Doesn't exist.")
+        logger.Debug("Doesn't exist.")
 		return err
 	}
 
@@ -190,11 +336,11 @@ func SaveNodePersistenceHash(hashmap map[string]*NodeInfo, dest string) error {
 	eErr := encode.Encode(hashmap) // encode the hashmap into binary, put it in the file
 
 	if eErr != nil {
-		log.Println("Failed to encode.")
+		logger.Error("Failed to encode.")
 		return eErr
 	}
 
-	log.Println("Saved succesfully.")
+	logger.Debug("Saved succesfully.")
 
 	return nil
 }
@@ -206,12 +352,12 @@ func RetrieveNodePersistenceHash(dest string) error {
 	nodeMutex.Lock()
 	defer nodeMutex.Unlock()
 
-	log.Println("Retrieving persistence metadata hash map")
+	logger.Debug("Retrieving persistence metadata hash map")
 
 	file, err := os.Open(dest + "/OptiFSNodePersistenceSave.gob") // open where the hashmap was encoded
 
 	if err != nil {
-        log.Println("Doesn't exist.")
+        logger.Debug("Doesn't exist.")
 		return err
 	}
 
@@ -221,11 +367,11 @@ func RetrieveNodePersistenceHash(dest string) error {
 	dErr := decode.Decode(&nodePersistenceHash) // decode the file back into the hashmap
 
 	if dErr != nil {
-		log.Println("Failed to decode.")
+		logger.Error("Failed to decode.")
 		return dErr
 	}
 
-    log.Println("Retrieved succesfully.")
+    logger.Debug("Retrieved succesfully.")
 
 	return nil
 }
@@ -238,14 +384,14 @@ func SaveDirMetadataHash(hashmap map[string]*MapEntryMetadata, dest string) erro
 	dirMutex.Lock()
 	defer dirMutex.Unlock()
 
-	log.Println("Saving directory metadata hash map")
+	logger.Debug("Saving directory metadata hash map")
 
 	// create the file if it doesn't exist, truncate it if it does
 	// we assume nobody will be calling this file, as it is a very unique name
 	file, err := os.Create(dest + "/OptiFSDirMetadataSave.gob")
 
 	if err != nil {
-        log.Println("Doesn't exist.")
+        logger.Debug("Doesn't exist.")
 		return err
 	}
 
@@ -255,11 +401,11 @@ func SaveDirMetadataHash(hashmap map[string]*MapEntryMetadata, dest string) erro
 	eErr := encode.Encode(hashmap) // encode the hashmap into binary, put it in the file
 
 	if eErr != nil {
-        log.Println("Failed to encode.")
+        logger.Error("Failed to encode.")
 		return eErr
 	}
 
-    log.Println("Saved succesfully.")
+    logger.Debug("Saved succesfully.")
 
 	return nil
 
@@ -273,12 +419,12 @@ func RetrieveDirMetadataHash(dest string) error {
 	dirMutex.Lock()
 	defer dirMutex.Unlock()
 
-	log.Println("Retrieving directory metadata hash map")
+	logger.Debug("Retrieving directory metadata hash map")
 
 	file, err := os.Open(dest + "/OptiFSDirMetadataSave.gob") // open where the hashmap was encoded
 
 	if err != nil {
-        log.Println("Doesn't exist.")
+        logger.Debug("Doesn't exist.")
 		return err
 	}
 
@@ -288,11 +434,11 @@ func RetrieveDirMetadataHash(dest string) error {
 	dErr := decode.Decode(&dirMetadataHash) // decode the file back into the hashmap
 
 	if dErr != nil {
-        log.Println("Failed to decode.")
+        logger.Error("Failed to decode.")
 		return dErr
 	}
 
-    log.Println("Retrieved succesfully.")
+    logger.Debug("Retrieved succesfully.")
 
 	return nil
 
@@ -300,11 +446,26 @@ func RetrieveDirMetadataHash(dest string) error {
 
 // for saving the hashmaps when system is shut off
 // preserves private hashmaps
-func SavePersistantStorage(dest string) {
-	log.Println("Taking snapshot of file system...")
-	SaveNodePersistenceHash(nodePersistenceHash, dest)
-	SaveMetadataMap(regularFileMetadataHash, dest)
-	SaveDirMetadataHash(dirMetadataHash, dest)
+//
+// every hashmap is saved even if one fails, the first error is returned
+func SavePersistantStorage(dest string) error {
+	logger.Debug("Taking snapshot of file system...")
+	start := time.Now()
+	errs := []error{
+		SaveNodePersistenceHash(nodePersistenceHash, dest),
+		SaveMetadataMap(regularFileMetadataHash, dest),
+		SaveDirMetadataHash(dirMetadataHash, dest),
+	}
+	saveDurations.Observe(time.Since(start).Seconds())
+	for _, err := range errs {
+		if err != nil {
+			saveFailures.Inc()
+			recordSave(err)
+			return err
+		}
+	}
+	recordSave(nil)
+	return nil
 }
 
 // for actually loading the hashmaps when the system is turned on
@@ -313,45 +474,86 @@ func RetrievePersistantStorage(dest string) {
 	RetrieveNodePersistenceHash(dest)
 	RetrieveMetadataMap(dest)
 	RetrieveDirMetadataHash(dest)
+	backfillBirthTimes()
+	backfillLastRead()
+	RechargeAll()
+}
+
+// Metadata saved before birth times were recorded has none, so use the change time
+// as the best estimate we have
+func backfillBirthTimes() {
+	metadataMutex.Lock()
+	for _, entry := range regularFileMetadataHash {
+		for _, fileMetadata := range entry.EntryList {
+			if fileMetadata.Btim == (syscall.Timespec{}) {
+				fileMetadata.Btim = fileMetadata.Ctim
+			}
+		}
+	}
+	metadataMutex.Unlock()
+
+	dirMutex.Lock()
+	for _, dirMetadata := range dirMetadataHash {
+		if dirMetadata.Btim == (syscall.Timespec{}) {
+			dirMetadata.Btim = dirMetadata.Ctim
+		}
+	}
+	dirMutex.Unlock()
+}
+
+// Metadata saved before contents were tiered has no time they were last read, so count them as read
+// now, rather than moving everything to the cold tier straight away
+func backfillLastRead() {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	now := time.Now()
+	for _, entry := range regularFileMetadataHash {
+		if entry.LastRead.IsZero() {
+			entry.LastRead = now
+		}
+	}
 }
 
 // Printing the regularFileMetadataHash for testing purposes
 func PrintRegularFileMetadataHash() {
-	log.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
-	log.Println("PRINTING FILE METADATA HASHMAP")
+	logger.Debug("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
+	logger.Debug("PRINTING FILE METADATA HASHMAP")
 	for key, value := range regularFileMetadataHash {
-		log.Printf("Key: %+v, Value: %+v\n", key, value)
+		logger.Debug("Entry", "key", fmt.Sprintf("%+v", key), "value", fmt.Sprintf("%+v", value))
 	}
-	log.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
+	logger.Debug("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
 }
 
 // Printing the dirMetadataHash for testing purposes
 func PrintDirMetadataHash() {
-	log.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
-	log.Println("PRINTING DIR METADATA HASHMAP")
+	logger.Debug("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
+	logger.Debug("PRINTING DIR METADATA HASHMAP")
 	for key, value := range dirMetadataHash {
-		log.Printf("Key: %+v, Value: %+v\n", key, value)
+		logger.Debug("Entry", "key", fmt.Sprintf("%+v", key), "value", fmt.Sprintf("%+v", value))
 	}
-	log.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
+	logger.Debug("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
 }
 
 // Printing the nodePersistenceHash for testing purposes
 func PrintNodePersistenceHash() {
-	log.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
-	log.Println("PRINTING NODE METADATA HASHMAP")
+	logger.Debug("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
+	logger.Debug("PRINTING NODE METADATA HASHMAP")
 	for key, value := range nodePersistenceHash {
-		log.Printf("Key: %+v, Value: %+v\n", key, value)
+		logger.Debug("Entry", "key", fmt.Sprintf("%+v", key), "value", fmt.Sprintf("%+v", value))
 	}
-	log.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
+	logger.Debug("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
 }
 
 // Ensure integrity
 //
 // Function looks through all retrieved hashmaps and ensures all their entries align with
 // data in the underlying filesystem
-func InsureIntegrity() {
+//
+// Returns the number of nodes that were removed.
+func InsureIntegrity() int {
 
-    log.Println("Checking integrity of metadata against underlying filesystem.")
+    logger.Debug("Checking integrity of metadata against underlying filesystem.")
 
 	// Collect any miss-entries
 	pathsToDelete := []struct {
@@ -363,13 +565,15 @@ func InsureIntegrity() {
 
     // Finds all discrepencies and stores them to be deleted
     // Cannot delete them during iteration - messes up the loop
+	// Can be run on a live filesystem, so make sure nothing changes while we're looking
+	nodeMutex.RLock()
 	for path, nodeInfo := range nodePersistenceHash {
 		// check to see that the node exists
 		var st syscall.Stat_t
 		err := syscall.Stat(path, &st)
 		if err != nil {
 			// if there is an error, delete the entry
-			log.Printf("INTEGRITY ERROR: {%v} - {%v}\n", path, err)
+			logger.Warn("INTEGRITY ERROR", "path", path, "err", err)
 			pathsToDelete = append(pathsToDelete, struct {
 				path  string
 				isDir bool
@@ -378,6 +582,7 @@ func InsureIntegrity() {
 			}{path, nodeInfo.IsDir, nodeInfo.ContentHash, nodeInfo.RefNum})
 		}
 	}
+	nodeMutex.RUnlock()
 
 	// Deletes all incorrect metadata
 	for index := range pathsToDelete {
@@ -389,24 +594,38 @@ func InsureIntegrity() {
 		// Remove from relevant metadata struct
 		if isDir {
 			RemoveDirEntry(path)
-			log.Printf("Removed custom metadata for {%v} directory.\n", path)
+			logger.Debug("Removed custom metadata for directory.", "path", path)
 		} else {
 			RemoveRegularFileMetadata(hash, ref)
-			log.Printf("Removed custom metadata for {%v} file.\n", path)
+			logger.Debug("Removed custom metadata for file.", "path", path)
 		}
 
 		// Remove from persisten store
 		RemoveNodeInfo(path)
-		log.Printf("Removed {%v} from persistent store\n", path)
+		logger.Info("Removed from persistent store", "path", path)
 	}
 
-	log.Println("FILESYSTEM HEALTHY")
+	logger.Debug("FILESYSTEM HEALTHY")
+
+	recordIntegrityCheck(len(pathsToDelete))
+	return len(pathsToDelete)
+}
+
+// the number of seconds between saves, can be changed while SaveStorageRegularly is running
+var saveInterval atomic.Int64
+
+// changes how often SaveStorageRegularly saves, from the next save onwards
+func SetSaveInterval(interval int) {
+	logger.Debug("Saving regularly", "interval", interval)
+	saveInterval.Store(int64(interval))
 }
 
 // allows us to constantly save each hashmap for data integrity
 // saves every 30s by default
 func SaveStorageRegularly(dest string, interval int) {
-	for range time.Tick(time.Second * time.Duration(interval)) {
+	SetSaveInterval(interval)
+	for {
+		time.Sleep(time.Second * time.Duration(saveInterval.Load()))
 		SavePersistantStorage(dest)
 	}
 }
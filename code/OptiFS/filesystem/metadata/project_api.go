@@ -0,0 +1,80 @@
+// This file contains all public functions for external modules to work with projects, the directories
+// (and everything under them) charged together regardless of who owns what's in them
+
+package metadata
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Gets the project the node at 'path' is charged to, a directory's own project, otherwise the project
+// of the directory it's in. 0 if it isn't in a project.
+func ProjectOf(path string) uint32 {
+	dirMutex.RLock()
+	defer dirMutex.RUnlock()
+
+	return projectOf(path)
+}
+
+// Gets the project of the node at 'path', must be called holding dirMutex
+func projectOf(path string) uint32 {
+	if dirMetadata, ok := dirMetadataHash[path]; ok {
+		return dirMetadata.Project
+	}
+	if parent, ok := dirMetadataHash[filepath.Dir(path)]; ok {
+		return parent.Project
+	}
+	return 0
+}
+
+// Puts the directory at 'path', and every directory under it, in 'project' (0 to take them out of any
+// project), returning how many directories were changed. Everything is charged again afterwards.
+func SetProject(path string, project uint32) (syscall.Errno, int) {
+	changed := 0
+	defer func() {
+		if changed > 0 {
+			RechargeAll() // once the lock is released
+		}
+	}()
+
+	dirMutex.Lock()
+	defer dirMutex.Unlock()
+
+	if _, ok := dirMetadataHash[path]; !ok {
+		return fs.ToErrno(syscall.ENOENT), 0
+	}
+	for dirPath, dirMetadata := range dirMetadataHash {
+		if dirPath != path && !strings.HasPrefix(dirPath, path+"/") {
+			continue
+		}
+		if dirMetadata.Project != project {
+			dirMetadata.Project = project
+			changed++
+		}
+	}
+	logger.Info("Set project", "path", path, "project", project, "changed", changed)
+	return fs.OK, changed
+}
+
+// Gets the top directory of every project, the directories in a project that aren't in a directory
+// in the same project, keyed by their path
+func Projects() map[string]uint32 {
+	dirMutex.RLock()
+	defer dirMutex.RUnlock()
+
+	tops := make(map[string]uint32)
+	for path, dirMetadata := range dirMetadataHash {
+		if dirMetadata.Project == 0 {
+			continue
+		}
+		if parent, ok := dirMetadataHash[filepath.Dir(path)]; ok && parent.Project == dirMetadata.Project {
+			continue
+		}
+		tops[path] = dirMetadata.Project
+	}
+	return tops
+}
@@ -3,7 +3,9 @@
 package metadata
 
 import (
+	"crypto/rand"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 )
@@ -105,12 +107,15 @@ func LookupRegularFileEntry(contentHash [64]byte) (syscall.Errno, *MapEntry) {
 // Also handles if this potentially creates an empty MapEntry struct.
 func RemoveRegularFileMetadata(contentHash [64]byte, refNum uint64) syscall.Errno {
 	// Check to see if an entry exists
-	err, entry, _ := RetrieveRegularFileMapEntryAndMetadataFromHashAndRef(contentHash, refNum)
+	err, entry, fileMetadata := RetrieveRegularFileMapEntryAndMetadataFromHashAndRef(contentHash, refNum)
 	if err != fs.OK {
 		return err
 	}
+	var path string
+	defer func() { recharge(path) }() // once the lock is released, the path is read under it
 
 	metadataMutex.Lock()
+	path = fileMetadata.Path
 	// Delete the metadata from our entry
 	delete(entry.EntryList, refNum)
 	// Reflect these changes in the MapEntry
@@ -200,14 +205,19 @@ func UpdateFullRegularFileMetadata(contentHash [64]byte, refNum uint64, unstable
 
 // Moves old metadata to a new node being created
 func MigrateRegularFileMetadata(oldMeta *MapEntryMetadata, newMeta *MapEntryMetadata, unstableAttr *syscall.Stat_t) syscall.Errno {
+	var path string
+	defer func() { recharge(path) }() // the new metadata takes the old path, once the lock is released
+
 	// needs a write lock as we are modifying the metadata
 	metadataMutex.Lock()
 	defer metadataMutex.Unlock()
 
 	// Old attributes to carry across
+	path = (*oldMeta).Path
 	(*newMeta).Path = (*oldMeta).Path
 	(*newMeta).Mode = (*oldMeta).Mode
 	(*newMeta).Ctim = (*oldMeta).Ctim
+	(*newMeta).Btim = (*oldMeta).Btim
 	(*newMeta).Uid = (*oldMeta).Uid
 	(*newMeta).Gid = (*oldMeta).Gid
 	(*newMeta).Dev = (*oldMeta).Dev
@@ -231,14 +241,19 @@ func MigrateRegularFileMetadata(oldMeta *MapEntryMetadata, newMeta *MapEntryMeta
 
 // Handle the passover or metadata in a duplicate scenario, where the underlying node is a hardlink, but we don't want it to appear as so
 func MigrateDuplicateFileMetadata(oldMeta *MapEntryMetadata, newMeta *MapEntryMetadata, unstableAttr *syscall.Stat_t) syscall.Errno {
+	var path string
+	defer func() { recharge(path) }() // the new metadata takes the old path, once the lock is released
+
 	// needs a write lock as we are modifying the metadata
 	metadataMutex.Lock()
 	defer metadataMutex.Unlock()
 
 	// Old attributes to carry across
+	path = (*oldMeta).Path
 	(*newMeta).Path = (*oldMeta).Path
 	(*newMeta).Mode = (*oldMeta).Mode
 	(*newMeta).Ctim = (*oldMeta).Ctim
+	(*newMeta).Btim = (*oldMeta).Btim
 	(*newMeta).Uid = (*oldMeta).Uid
 	(*newMeta).Gid = (*oldMeta).Gid
 	(*newMeta).Dev = (*oldMeta).Dev
@@ -260,6 +275,8 @@ func MigrateDuplicateFileMetadata(oldMeta *MapEntryMetadata, newMeta *MapEntryMe
 
 // Handle the creation of a metadata entry for a new duplicate file with no previous metadata entry
 func InitialiseNewDuplicateFileMetadata(newMeta *MapEntryMetadata, spareUnstableAttr *syscall.Stat_t, linkUnstableAttr *syscall.Stat_t, path string, uid uint32, gid uint32) error {
+	defer recharge(path) // once the lock is released
+
 	// needs a write lock as we are modifying the metadata
 	metadataMutex.Lock()
 	defer metadataMutex.Unlock()
@@ -270,6 +287,7 @@ func InitialiseNewDuplicateFileMetadata(newMeta *MapEntryMetadata, spareUnstable
 	(*newMeta).Atim = (*spareUnstableAttr).Atim
 	(*newMeta).Mtim = (*spareUnstableAttr).Mtim
 	(*newMeta).Ctim = (*spareUnstableAttr).Ctim
+	(*newMeta).Btim = (*spareUnstableAttr).Ctim // The spare file was only just created
 	(*newMeta).Uid = uid
 	(*newMeta).Gid = gid
 	(*newMeta).Dev = (*spareUnstableAttr).Dev
@@ -308,6 +326,7 @@ func CreateRegularFileMapEntry(contentHash [64]byte) *MapEntry {
 		EntryList:       make(map[uint64]*MapEntryMetadata),
 		IndexCounter:    0,
 		UnderlyingInode: 0,
+		LastRead:        time.Now(),
 	}
 
 	// Place the new MapEntry inside the file hash
@@ -315,6 +334,42 @@ func CreateRegularFileMapEntry(contentHash [64]byte) *MapEntry {
 	return newEntry
 }
 
+// Creates a MapEntry of its own for a file the de-duplication policy keeps out of de-duplication, so it
+// isn't counted, charged or linked to as another copy of 'contentHash'. The entry is under a random key
+// rather than the hash, which is returned with the entry.
+func CreatePrivateFileMapEntry(contentHash [64]byte) ([64]byte, *MapEntry) {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	var key [64]byte
+	for {
+		rand.Read(key[:])
+		if _, taken := regularFileMetadataHash[key]; !taken && !EmptyFileIdentifier(key) {
+			break
+		}
+	}
+
+	newEntry := &MapEntry{
+		EntryList: make(map[uint64]*MapEntryMetadata),
+		LastRead:  time.Now(),
+		Content:   contentHash,
+	}
+	regularFileMetadataHash[key] = newEntry
+	return key, newEntry
+}
+
+// Gets the hash of the content of the MapEntry under 'key', which is the key itself unless the entry is
+// of a file kept out of de-duplication
+func ContentHashOf(key [64]byte) [64]byte {
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	if entry, ok := regularFileMetadataHash[key]; ok && !EmptyFileIdentifier(entry.Content) {
+		return entry.Content
+	}
+	return key
+}
+
 // Create a new createMapEntryMetadata struct (with default values) in the provided MapEntry.
 // Returns the new createMapEntryMetadata along with the refNum to it.
 func CreateRegularFileMetadata(entry *MapEntry) (refNum uint64, newEntry *MapEntryMetadata) {
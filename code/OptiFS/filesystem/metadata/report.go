@@ -0,0 +1,115 @@
+// This file contains the report of which contents are shared by more than one file
+
+package metadata
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// DuplicateFile is one of the files sharing a content
+type DuplicateFile struct {
+	Path string `json:"path"`
+	Uid  uint32 `json:"uid"`
+	Gid  uint32 `json:"gid"`
+}
+
+// DuplicateGroup is a content that more than one file references
+type DuplicateGroup struct {
+	Hash       string          `json:"hash"`        // the content hash, in hex
+	Size       int64           `json:"size"`        // the size of the content, in bytes
+	References uint32          `json:"references"`  // how many files reference it
+	SavedBytes int64           `json:"saved_bytes"` // how much storing it once saves
+	Files      []DuplicateFile `json:"files"`       // sorted by path
+}
+
+// Gets every content with more than one reference, the ones saving the most space first
+func DuplicateGroups() []DuplicateGroup {
+	// needs a read lock as data is not being modified, only read
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	return duplicateGroups(regularFileMetadataHash)
+}
+
+// Gets the duplicate groups from the regular file metadata saved in 'dest', without mounting
+// or touching the metadata in memory
+func DuplicateGroupsFromSave(dest string) ([]DuplicateGroup, error) {
+	file, err := os.Open(dest + "/OptiFSRegularFileMetadataSave.gob")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var hashmap map[[64]byte]*MapEntry
+	if err := gob.NewDecoder(file).Decode(&hashmap); err != nil {
+		return nil, fmt.Errorf("couldn't decode {%v}: %v", file.Name(), err)
+	}
+	return duplicateGroups(hashmap), nil
+}
+
+func duplicateGroups(hashmap map[[64]byte]*MapEntry) []DuplicateGroup {
+	var groups []DuplicateGroup
+	for hash, entry := range hashmap {
+		if entry == nil || entry.ReferenceCount <= 1 {
+			continue
+		}
+
+		group := DuplicateGroup{Hash: hex.EncodeToString(hash[:]), References: entry.ReferenceCount}
+		for _, fileMetadata := range entry.EntryList {
+			group.Size = fileMetadata.Size // every entry has the same content
+			group.Files = append(group.Files, DuplicateFile{Path: fileMetadata.Path, Uid: fileMetadata.Uid, Gid: fileMetadata.Gid})
+		}
+		group.SavedBytes = group.Size * int64(group.References-1)
+		sort.Slice(group.Files, func(i, j int) bool { return group.Files[i].Path < group.Files[j].Path })
+
+		groups = append(groups, group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].SavedBytes != groups[j].SavedBytes {
+			return groups[i].SavedBytes > groups[j].SavedBytes
+		}
+		return groups[i].Hash < groups[j].Hash
+	})
+	return groups
+}
+
+// Writes the duplicate groups as JSON, or as a table (a row per file) if 'asJSON' is false
+func WriteDuplicateReport(w io.Writer, groups []DuplicateGroup, asJSON bool) error {
+	if asJSON {
+		if groups == nil {
+			groups = []DuplicateGroup{} // [] rather than null
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(groups)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "HASH\tSIZE\tREFS\tSAVED\tUID\tGID\tPATH")
+	var saved int64
+	for _, group := range groups {
+		saved += group.SavedBytes
+		for i, file := range group.Files {
+			// only the first row of a group shows the content, so groups stand out
+			if i == 0 {
+				fmt.Fprintf(table, "%v\t%d\t%d\t%d\t", group.Hash[:16], group.Size, group.References, group.SavedBytes)
+			} else {
+				fmt.Fprint(table, "\t\t\t\t")
+			}
+			fmt.Fprintf(table, "%d\t%d\t%v\n", file.Uid, file.Gid, file.Path)
+		}
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d duplicate group(s), %d bytes saved\n", len(groups), saved)
+	return err
+}
@@ -0,0 +1,202 @@
+// This file contains the statistics the metadata module can report about the filesystem
+
+package metadata
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupStatistics describes how much space deduplication is saving
+type DedupStatistics struct {
+	UniqueContents uint64 // How many distinct contents are stored
+	Files          uint64 // How many regular files reference them
+	LogicalBytes   int64  // The size of every file added up, as users see it
+	PhysicalBytes  int64  // The size of each distinct content added up, as it is stored
+}
+
+// How many bytes deduplication is saving
+func (s DedupStatistics) SavedBytes() int64 {
+	return s.LogicalBytes - s.PhysicalBytes
+}
+
+// The ratio of logical to physical size, 1 if nothing is stored
+func (s DedupStatistics) Ratio() float64 {
+	if s.PhysicalBytes == 0 {
+		return 1
+	}
+	return float64(s.LogicalBytes) / float64(s.PhysicalBytes)
+}
+
+func (s DedupStatistics) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "files:           %d\n", s.Files)
+	fmt.Fprintf(&b, "unique contents: %d\n", s.UniqueContents)
+	fmt.Fprintf(&b, "logical bytes:   %d\n", s.LogicalBytes)
+	fmt.Fprintf(&b, "physical bytes:  %d\n", s.PhysicalBytes)
+	fmt.Fprintf(&b, "saved bytes:     %d\n", s.SavedBytes())
+	fmt.Fprintf(&b, "dedup ratio:     %.2f", s.Ratio())
+	return b.String()
+}
+
+// Works out the deduplication statistics from the regularFileMetadataHash
+func GetDedupStatistics() DedupStatistics {
+	// needs a read lock as data is not being modified, only read
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	var stats DedupStatistics
+	for _, entry := range regularFileMetadataHash {
+		if entry == nil || len(entry.EntryList) == 0 {
+			continue
+		}
+
+		stats.UniqueContents++
+		var contentSize int64
+		for _, fileMetadata := range entry.EntryList {
+			stats.Files++
+			stats.LogicalBytes += fileMetadata.Size
+			contentSize = fileMetadata.Size // every entry has the same content
+		}
+		stats.PhysicalBytes += contentSize
+	}
+
+	return stats
+}
+
+// How long CachedDedupStatistics reuses the statistics before working them out again
+var DedupStatisticsCacheTTL = time.Second
+
+var cachedDedupStatistics DedupStatistics
+var cachedDedupStatisticsTime time.Time
+var cachedDedupStatisticsMutex sync.Mutex
+
+// Gets the deduplication statistics, working them out at most once every DedupStatisticsCacheTTL.
+// For callers that are frequent (e.g. STATFS) and don't need them to be exact.
+func CachedDedupStatistics() DedupStatistics {
+	cachedDedupStatisticsMutex.Lock()
+	defer cachedDedupStatisticsMutex.Unlock()
+
+	if time.Since(cachedDedupStatisticsTime) >= DedupStatisticsCacheTTL {
+		cachedDedupStatistics = GetDedupStatistics()
+		cachedDedupStatisticsTime = time.Now()
+	}
+	return cachedDedupStatistics
+}
+
+// Counts the regular files and directories in the nodePersistenceHash
+func CountNodes() (files int, dirs int) {
+	// needs a read lock as data is not being modified, only read
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
+
+	for _, info := range nodePersistenceHash {
+		if info.IsDir {
+			dirs++
+		} else {
+			files++
+		}
+	}
+	return files, dirs
+}
+
+// OwnerUsage is how much a user owns
+type OwnerUsage struct {
+	Files int64
+	Bytes int64 // the logical size of their files, de-duplicated content counts in full for every owner
+}
+
+// Works out how much each user (by UID) owns, from the regularFileMetadataHash
+func UsageByOwner() map[uint32]OwnerUsage {
+	// needs a read lock as data is not being modified, only read
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	usage := make(map[uint32]OwnerUsage)
+	for _, entry := range regularFileMetadataHash {
+		if entry == nil {
+			continue
+		}
+		for _, fileMetadata := range entry.EntryList {
+			owner := usage[fileMetadata.Uid]
+			owner.Files++
+			owner.Bytes += fileMetadata.Size
+			usage[fileMetadata.Uid] = owner
+		}
+	}
+	return usage
+}
+
+// Gets the hash of every content that more than one file shares
+func SharedContents() [][64]byte {
+	// needs a read lock as data is not being modified, only read
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	var shared [][64]byte
+	for hash, entry := range regularFileMetadataHash {
+		if entry != nil && len(entry.EntryList) > 1 {
+			shared = append(shared, hash)
+		}
+	}
+	return shared
+}
+
+// Gets the (underlying) paths of every file with the content 'hash', sorted
+func PathsWithContent(hash [64]byte) []string {
+	// needs a read lock as data is not being modified, only read
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	entry, ok := regularFileMetadataHash[hash]
+	if !ok || entry == nil {
+		return nil
+	}
+
+	paths := make([]string, 0, len(entry.EntryList))
+	for _, fileMetadata := range entry.EntryList {
+		paths = append(paths, fileMetadata.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Health describes the last save and integrity check of the persistent stores
+type Health struct {
+	LastSave           time.Time // zero if there hasn't been one
+	LastSaveError      error
+	LastIntegrityCheck time.Time // zero if there hasn't been one
+	StaleNodesRemoved  int       // by the last integrity check
+}
+
+var health Health
+var healthMutex sync.RWMutex
+
+// Gets the health of the persistent stores
+func GetHealth() Health {
+	healthMutex.RLock()
+	defer healthMutex.RUnlock()
+
+	return health
+}
+
+// Records the outcome of saving the persistent stores
+func recordSave(err error) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	health.LastSave = time.Now()
+	health.LastSaveError = err
+}
+
+// Records the outcome of an integrity check
+func recordIntegrityCheck(removed int) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	health.LastIntegrityCheck = time.Now()
+	health.StaleNodesRemoved = removed
+}
@@ -4,6 +4,7 @@ package metadata
 
 import (
 	"syscall"
+	"time"
 	//"github.com/hanwen/go-fuse/v2/fs"
 )
 
@@ -18,6 +19,9 @@ type MapEntry struct {
 	EntryList       map[uint64]*MapEntryMetadata
 	UnderlyingInode uint32
 	IndexCounter    uint64
+	Tier            Tier      // Where the content is kept
+	LastRead        time.Time // When the content was last opened, whatever the atime policy
+	Content         [64]byte  // The hash of the content, only set for files kept out of de-duplication, which have an entry (and key) of their own
 }
 
 // MapEntryMetadata is a struct that represents a node's custom metadata
@@ -40,8 +44,10 @@ type MapEntryMetadata struct {
 	Atim      syscall.Timespec
 	Mtim      syscall.Timespec
 	Ctim      syscall.Timespec
+	Btim      syscall.Timespec // Birth time, set once when the node is first seen and never refreshed from a stat
 	X__unused [3]int64
 	XAttr     map[string][]byte
+	Project   uint32 // The project a directory (and the files in it) is charged to, 0 if it isn't in one
 }
 
 // NodeInfo is used to store data required to keep our nodes persistent between OptiFS instances
@@ -0,0 +1,96 @@
+// This file contains all public functions for external modules to find and change which tier each
+// content is kept in
+
+package metadata
+
+import (
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Tier is where a content is kept
+type Tier int
+
+const (
+	Hot  Tier = iota // in the files themselves, under the root of the underlying filesystem
+	Cold             // in the cold tier, the files under the root are left empty
+)
+
+func (t Tier) String() string {
+	if t == Cold {
+		return "cold"
+	}
+	return "hot"
+}
+
+// Gets which tier the content 'hash' is in, contents OptiFS doesn't know are in the files themselves
+func ContentTier(hash [64]byte) Tier {
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	if entry, ok := regularFileMetadataHash[hash]; ok {
+		return entry.Tier
+	}
+	return Hot
+}
+
+// Records that the content 'hash' is now in 'tier'
+func SetContentTier(hash [64]byte, tier Tier) syscall.Errno {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	entry, ok := regularFileMetadataHash[hash]
+	if !ok {
+		return fs.ToErrno(syscall.ENOENT)
+	}
+	entry.Tier = tier
+	return fs.OK
+}
+
+// Records that the content 'hash' was just read
+func TouchContent(hash [64]byte) {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	if entry, ok := regularFileMetadataHash[hash]; ok {
+		entry.LastRead = time.Now()
+	}
+}
+
+// Gets every content in 'tier', or only those that haven't been read since 'unreadSince' if it isn't
+// zero. Empty files have no content to move, so they're never included.
+func ContentsInTier(tier Tier, unreadSince time.Time) [][64]byte {
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	var hashes [][64]byte
+	for hash, entry := range regularFileMetadataHash {
+		if EmptyFileIdentifier(hash) || entry.Tier != tier || len(entry.EntryList) == 0 {
+			continue
+		}
+		if !unreadSince.IsZero() && !entry.LastRead.Before(unreadSince) {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return string(hashes[i][:]) < string(hashes[j][:]) })
+	return hashes
+}
+
+// Gets the size of the content 'hash', as its files' custom metadata has it. -1 if it isn't known.
+func ContentSize(hash [64]byte) int64 {
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	entry, ok := regularFileMetadataHash[hash]
+	if !ok {
+		return -1
+	}
+	for _, fileMetadata := range entry.EntryList {
+		return fileMetadata.Size // every entry has the same content
+	}
+	return -1
+}
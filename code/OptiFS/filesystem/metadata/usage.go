@@ -0,0 +1,337 @@
+// This file contains how much each user, group and project is charged for the nodes they own. The charges are
+// kept up to date as the custom metadata changes, rather than worked out by going through every node.
+
+package metadata
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Usage is how much an owner is charged for
+type Usage struct {
+	Inodes   int64 // how many files and directories they own (or are in the project)
+	Logical  int64 // the size of their files, as they see it
+	Physical int64 // the size of the content they're charged for, which depends on the ChargingMode
+}
+
+func (u Usage) add(other Usage) Usage {
+	return Usage{Inodes: u.Inodes + other.Inodes, Logical: u.Logical + other.Logical, Physical: u.Physical + other.Physical}
+}
+
+func (u Usage) sub(other Usage) Usage {
+	return Usage{Inodes: u.Inodes - other.Inodes, Logical: u.Logical - other.Logical, Physical: u.Physical - other.Physical}
+}
+
+// ChargingMode decides who is charged for the physical size of content several files share
+type ChargingMode int
+
+const (
+	ChargeFirst ChargingMode = iota // the first file with the content (the lowest reference number) is charged for all of it
+	ChargeSplit                     // every file with the content is charged an equal share of it
+	ChargeFull                      // every file is charged for all of its content, as if nothing was shared
+)
+
+// Parses the name of a charging mode, as given in the configuration
+func ParseChargingMode(name string) (ChargingMode, error) {
+	switch name {
+	case "first":
+		return ChargeFirst, nil
+	case "split":
+		return ChargeSplit, nil
+	case "full":
+		return ChargeFull, nil
+	}
+	return ChargeFirst, fmt.Errorf("unknown charging mode {%v}", name)
+}
+
+func (m ChargingMode) String() string {
+	switch m {
+	case ChargeSplit:
+		return "split"
+	case ChargeFull:
+		return "full"
+	}
+	return "first"
+}
+
+// What the owner of a node is charged for it
+type charge struct {
+	uid     uint32
+	gid     uint32
+	project uint32   // 0 if the node isn't in a project
+	hash    [64]byte // the content of a regular file, zero for directories and empty files
+	ref     uint64
+	size    int64
+	usage   Usage // what the owner is currently charged
+}
+
+var usageMutex sync.Mutex // lock for everything below, taken before any of the hashmap locks
+var chargingMode = ChargeFirst
+var charges = make(map[string]*charge)           // keyed by the path of the node, like the nodePersistenceHash
+var sharers = make(map[[64]byte]map[string]bool) // the path of every node charged for each content
+var userUsage = make(map[uint32]Usage)
+var groupUsage = make(map[uint32]Usage)
+var projectUsage = make(map[uint32]Usage)
+
+// Changes how shared content is charged, and charges every owner again
+func SetChargingMode(mode ChargingMode) {
+	usageMutex.Lock()
+	changed := chargingMode != mode
+	chargingMode = mode
+	usageMutex.Unlock()
+
+	logger.Info("Setting charging mode", "mode", mode)
+	if changed {
+		RechargeAll()
+	}
+}
+
+// Gets how shared content is charged
+func GetChargingMode() ChargingMode {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	return chargingMode
+}
+
+// Gets how much the user 'uid' is charged for
+func UserUsage(uid uint32) Usage {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	return userUsage[uid]
+}
+
+// Gets how much the group 'gid' is charged for
+func GroupUsage(gid uint32) Usage {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	return groupUsage[gid]
+}
+
+// Gets how much the project 'project' is charged for
+func ProjectUsage(project uint32) Usage {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	return projectUsage[project]
+}
+
+// Gets how much every user and every group that owns something is charged for
+func AllUsage() (users map[uint32]Usage, groups map[uint32]Usage) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	users = make(map[uint32]Usage, len(userUsage))
+	for uid, usage := range userUsage {
+		users[uid] = usage
+	}
+	groups = make(map[uint32]Usage, len(groupUsage))
+	for gid, usage := range groupUsage {
+		groups[gid] = usage
+	}
+	return users, groups
+}
+
+// Works out every charge from scratch, after the hashmaps are loaded or the charging mode changes
+func RechargeAll() {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
+	dirMutex.RLock()
+	defer dirMutex.RUnlock()
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	charges = make(map[string]*charge)
+	sharers = make(map[[64]byte]map[string]bool)
+	userUsage = make(map[uint32]Usage)
+	groupUsage = make(map[uint32]Usage)
+	projectUsage = make(map[uint32]Usage)
+
+	for path := range nodePersistenceHash {
+		if c := chargeFor(path); c != nil {
+			addCharge(path, c)
+		}
+	}
+	for _, c := range charges {
+		if c.hash == ([64]byte{}) {
+			settle(c, true, 1)
+		}
+	}
+	for hash := range sharers {
+		settleContent(hash)
+	}
+	logger.Debug("Charged every owner", "nodes", len(charges), "users", len(userUsage), "groups", len(groupUsage), "projects", len(projectUsage))
+}
+
+// Charges the owners of the nodes at 'paths' (and any nodes they share content with) again, after
+// their custom metadata or persistent data changed. Must be called without holding any of the locks.
+func recharge(paths ...string) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
+	dirMutex.RLock()
+	defer dirMutex.RUnlock()
+	metadataMutex.RLock()
+	defer metadataMutex.RUnlock()
+
+	affected := make(map[[64]byte]bool)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if old, ok := charges[path]; ok {
+			removeCharge(path, old)
+			if old.hash != ([64]byte{}) {
+				affected[old.hash] = true
+			}
+		}
+		if c := chargeFor(path); c != nil {
+			addCharge(path, c)
+			if c.hash != ([64]byte{}) {
+				affected[c.hash] = true
+			}
+		}
+	}
+
+	for _, path := range paths {
+		if c, ok := charges[path]; ok && c.hash == ([64]byte{}) {
+			settle(c, true, 1)
+		}
+	}
+	for hash := range affected {
+		settleContent(hash)
+	}
+}
+
+// Works out who is charged for the node at 'path' and how big it is, nil if it isn't charged (yet).
+// Must be called holding every lock.
+func chargeFor(path string) *charge {
+	info, ok := nodePersistenceHash[path]
+	if !ok {
+		return nil
+	}
+	if info.IsDir {
+		dirMetadata, ok := dirMetadataHash[path]
+		if !ok {
+			return nil
+		}
+		return &charge{uid: dirMetadata.Uid, gid: dirMetadata.Gid, project: dirMetadata.Project}
+	}
+
+	// Files only have custom metadata once they've been released
+	entry, ok := regularFileMetadataHash[info.ContentHash]
+	if !ok {
+		return nil
+	}
+	fileMetadata, ok := entry.EntryList[info.RefNum]
+	if !ok {
+		return nil
+	}
+	return &charge{uid: fileMetadata.Uid, gid: fileMetadata.Gid, project: projectOf(path), hash: info.ContentHash, ref: info.RefNum, size: fileMetadata.Size}
+}
+
+// Starts charging for the node at 'path', nothing is charged until it's settled. Must be called holding usageMutex.
+func addCharge(path string, c *charge) {
+	charges[path] = c
+	if c.hash == ([64]byte{}) {
+		return
+	}
+	if sharers[c.hash] == nil {
+		sharers[c.hash] = make(map[string]bool)
+	}
+	sharers[c.hash][path] = true
+}
+
+// Stops charging for the node at 'path'. Must be called holding usageMutex.
+func removeCharge(path string, c *charge) {
+	apply(c, Usage{}.sub(c.usage))
+	delete(charges, path)
+	if c.hash == ([64]byte{}) {
+		return
+	}
+	delete(sharers[c.hash], path)
+	if len(sharers[c.hash]) == 0 {
+		delete(sharers, c.hash)
+	}
+}
+
+// Charges the owners of every node with the content 'hash' what they owe now. Hard links to the same
+// file share a reference number, each is an inode but the file's size is only charged once. Must be
+// called holding usageMutex.
+func settleContent(hash [64]byte) {
+	linked := make(map[uint64]string) // the path charged for the size of each file
+	for path := range sharers[hash] {
+		ref := charges[path].ref
+		if other, ok := linked[ref]; !ok || path < other {
+			linked[ref] = path
+		}
+	}
+	var first uint64
+	for ref := range linked {
+		if first == 0 || ref < first {
+			first = ref
+		}
+	}
+
+	for path := range sharers[hash] {
+		c := charges[path]
+		if linked[c.ref] != path {
+			settleUsage(c, Usage{Inodes: 1})
+			continue
+		}
+		settle(c, c.ref == first, len(linked))
+	}
+}
+
+// Charges the owner of a node what they owe now, the node is the 'first' of the 'sharing' files with
+// its content. Must be called holding usageMutex.
+func settle(c *charge, first bool, sharing int) {
+	usage := Usage{Inodes: 1, Logical: c.size, Physical: c.size}
+	switch {
+	case chargingMode == ChargeFirst && !first:
+		usage.Physical = 0
+	case chargingMode == ChargeSplit:
+		usage.Physical = c.size / int64(sharing)
+		if first {
+			usage.Physical += c.size % int64(sharing)
+		}
+	}
+	settleUsage(c, usage)
+}
+
+// Charges the owner of a node 'usage' instead of what they were charged. Must be called holding usageMutex.
+func settleUsage(c *charge, usage Usage) {
+	apply(c, usage.sub(c.usage))
+	c.usage = usage
+}
+
+// Adds 'delta' to what the owners of a node, and its project, are charged. Must be called holding usageMutex.
+func apply(c *charge, delta Usage) {
+	if delta == (Usage{}) {
+		return
+	}
+	if usage := userUsage[c.uid].add(delta); usage == (Usage{}) {
+		delete(userUsage, c.uid)
+	} else {
+		userUsage[c.uid] = usage
+	}
+	if usage := groupUsage[c.gid].add(delta); usage == (Usage{}) {
+		delete(groupUsage, c.gid)
+	} else {
+		groupUsage[c.gid] = usage
+	}
+	if c.project == 0 {
+		return
+	}
+	if usage := projectUsage[c.project].add(delta); usage == (Usage{}) {
+		delete(projectUsage, c.project)
+	} else {
+		projectUsage[c.project] = usage
+	}
+}
@@ -0,0 +1,306 @@
+// Package metrics contains the operational metrics of OptiFS, served over HTTP in the OpenMetrics
+// text format so they can be scraped by Prometheus.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A metric family, written out whenever the metrics are scraped
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Every metric, in the order they were made
+var registry []metric
+var registryMutex sync.Mutex
+
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	for _, existing := range registry {
+		if existing.name() == m.name() {
+			panic(fmt.Sprintf("metric {%v} registered twice", m.name()))
+		}
+	}
+	registry = append(registry, m)
+}
+
+// The buckets of latency histograms, in seconds
+var DurationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Counter counts something that only goes up, once per combination of label values
+type Counter struct {
+	family     string
+	help       string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Makes and registers a counter, 'family' shouldn't end in _total as it's added to the samples
+func NewCounter(family, help string, labelNames ...string) *Counter {
+	c := &Counter{family: family, help: help, labelNames: labelNames, series: make(map[string]*counterSeries)}
+	register(c)
+	return c
+}
+
+// Adds one to the counter with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Adds 'v' (which can't be negative) to the counter with the given label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	key := seriesKey(c.labelNames, labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: labelValues}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+// Gets the value of the counter with the given label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := seriesKey(c.labelNames, labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, ok := c.series[key]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) name() string { return c.family }
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.family, "counter", c.help)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// a counter without labels is always there, even before it's counted anything
+	if len(c.labelNames) == 0 && len(c.series) == 0 {
+		fmt.Fprintf(w, "%v_total 0\n", c.family)
+	}
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%v_total%v %v\n", c.family, formatLabels(c.labelNames, s.labelValues), formatValue(s.value))
+	}
+}
+
+// Histogram counts observations (e.g. latencies) into buckets, once per combination of label values
+type Histogram struct {
+	family     string
+	help       string
+	buckets    []float64 // upper bounds, sorted
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative, with +Inf last
+	sum         float64
+	count       uint64
+}
+
+// Makes and registers a histogram with the given bucket upper bounds
+func NewHistogram(family, help string, buckets []float64, labelNames ...string) *Histogram {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	h := &Histogram{family: family, help: help, buckets: sorted, labelNames: labelNames, series: make(map[string]*histogramSeries)}
+	register(h)
+	return h
+}
+
+// Records an observation in the histogram with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := seriesKey(h.labelNames, labelValues)
+	bucket := sort.SearchFloat64s(h.buckets, v) // the first bucket v fits in, or +Inf
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[bucket]++
+	s.sum += v
+	s.count++
+}
+
+// Gets how many observations the histogram with the given label values has
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := seriesKey(h.labelNames, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) name() string { return h.family }
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.family, "histogram", h.help)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	names := append(append([]string(nil), h.labelNames...), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			values := append(append([]string(nil), s.labelValues...), formatValue(le))
+			fmt.Fprintf(w, "%v_bucket%v %d\n", h.family, formatLabels(names, values), cumulative)
+		}
+		labels := formatLabels(h.labelNames, s.labelValues)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.family, labels, formatValue(s.sum))
+		fmt.Fprintf(w, "%v_count%v %d\n", h.family, labels, s.count)
+	}
+}
+
+// Gauge is a value that can go up and down, worked out whenever the metrics are scraped
+type Gauge struct {
+	family    string
+	help      string
+	labelName string
+	values    func() map[string]float64 // by the value of the label
+}
+
+// Makes and registers a gauge without labels
+func NewGauge(family, help string, value func() float64) *Gauge {
+	return NewGaugeVec(family, help, "", func() map[string]float64 { return map[string]float64{"": value()} })
+}
+
+// Makes and registers a gauge with one label, 'values' gets the value for each value of the label
+func NewGaugeVec(family, help, labelName string, values func() map[string]float64) *Gauge {
+	g := &Gauge{family: family, help: help, labelName: labelName, values: values}
+	register(g)
+	return g
+}
+
+func (g *Gauge) name() string { return g.family }
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.family, "gauge", g.help)
+
+	values := g.values()
+	for _, labelValue := range sortedKeys(values) {
+		labels := ""
+		if g.labelName != "" {
+			labels = formatLabels([]string{g.labelName}, []string{labelValue})
+		}
+		fmt.Fprintf(w, "%v%v %v\n", g.family, labels, formatValue(values[labelValue]))
+	}
+}
+
+// Writes every metric in the OpenMetrics text format
+func WriteOpenMetrics(w io.Writer) error {
+	registryMutex.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMutex.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	b.WriteString("# EOF\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHeader(w io.Writer, family, kind, help string) {
+	fmt.Fprintf(w, "# TYPE %v %v\n", family, kind)
+	fmt.Fprintf(w, "# HELP %v %v\n", family, escape(help, false))
+}
+
+// Identifies a combination of label values, there must be one for every label
+func seriesKey(labelNames []string, labelValues []string) string {
+	if len(labelValues) != len(labelNames) {
+		panic(fmt.Sprintf("metric has labels %v, but was given values %v", labelNames, labelValues))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Formats labels as {name="value",...}, or nothing if there aren't any
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%v=\"%v\"", name, escape(values[i], true))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Escapes backslashes and newlines, and quotes in label values
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Unit test for Counter, Histogram, Gauge and WriteOpenMetrics in metrics.go
+func TestWriteOpenMetrics(t *testing.T) {
+	registry = nil
+	defer func() { registry = nil }()
+
+	ops := NewCounter("test_operations", "Operations.", "op")
+	ops.Inc("LOOKUP")
+	ops.Add(2, "READ")
+	ops.Add(-1, "READ") // counters never go down
+	NewCounter("test_failures", "Failures.")
+	durations := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 0.1}, "op")
+	durations.Observe(0.05, "READ")
+	durations.Observe(0.5, "READ")
+	durations.Observe(2, "READ")
+	NewGaugeVec("test_entries", "Entries.", "map", func() map[string]float64 {
+		return map[string]float64{"dir": 3, "quo\"te": 1}
+	})
+
+	var b strings.Builder
+	if err := WriteOpenMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# TYPE test_operations counter
+# HELP test_operations Operations.
+test_operations_total{op="LOOKUP"} 1
+test_operations_total{op="READ"} 2
+# TYPE test_failures counter
+# HELP test_failures Failures.
+test_failures_total 0
+# TYPE test_duration_seconds histogram
+# HELP test_duration_seconds Durations.
+test_duration_seconds_bucket{op="READ",le="0.1"} 1
+test_duration_seconds_bucket{op="READ",le="1"} 2
+test_duration_seconds_bucket{op="READ",le="+Inf"} 3
+test_duration_seconds_sum{op="READ"} 2.55
+test_duration_seconds_count{op="READ"} 3
+# TYPE test_entries gauge
+# HELP test_entries Entries.
+test_entries{map="dir"} 3
+test_entries{map="quo\"te"} 1
+# EOF
+`
+	if b.String() != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, b.String())
+	}
+	if ops.Value("READ") != 2 || durations.Count("READ") != 3 || durations.Count("LOOKUP") != 0 {
+		t.Errorf("Expected the values to be kept, got %v and %v", ops.Value("READ"), durations.Count("READ"))
+	}
+}
+
+// Unit test for Serve in server.go
+func TestServe(t *testing.T) {
+	registry = nil
+	defer func() { registry = nil }()
+	NewCounter("test_scrapes", "Scrapes.").Inc()
+
+	server, err := Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	response, err := http.Get("http://" + server.Addr() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+
+	if response.Header.Get("Content-Type") != ContentType {
+		t.Errorf("Expected the OpenMetrics content type, got %v", response.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), "test_scrapes_total 1\n") || !strings.HasSuffix(string(body), "# EOF\n") {
+		t.Errorf("Expected the metrics, got %v", string(body))
+	}
+}
@@ -0,0 +1,60 @@
+// This file contains the HTTP listener the metrics are scraped from
+
+package metrics
+
+import (
+	"filesystem/logging"
+	"net"
+	"net/http"
+	"time"
+)
+
+var logger = logging.For(logging.Main)
+
+// The content type of the OpenMetrics text format
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Serves the metrics at /metrics
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		if err := WriteOpenMetrics(w); err != nil {
+			logger.Warn("Couldn't write metrics", "err", err)
+		}
+	})
+	return mux
+}
+
+// Server serves the metrics over HTTP until it's closed
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// Starts serving the metrics at 'address' (e.g. "127.0.0.1:9180")
+func Serve(address string) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{listener: listener, server: &http.Server{Handler: Handler(), ReadHeaderTimeout: 10 * time.Second}}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Metrics listener stopped", "err", err)
+		}
+	}()
+	logger.Info("Serving metrics", "address", listener.Addr().String())
+	return s, nil
+}
+
+// The address the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stops serving the metrics
+func (s *Server) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,66 @@
+// optifsctl sends commands to the control socket of a running OptiFS instance
+package main
+
+import (
+	"filesystem/control"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+)
+
+func main() {
+	socket := flag.String("socket", os.Getenv("OPTIFS_CONTROL"), "the control socket of the OptiFS instance (default $OPTIFS_CONTROL)")
+
+	flag.Parse() // parse arguments
+	if flag.NArg() < 1 || *socket == "" {
+		fmt.Printf("usage: %s -socket <control socket> <command> [args...]\n", path.Base(os.Args[0])) // show correct usage
+		fmt.Printf("\ncommands:\n")
+		fmt.Printf("  status                      show the state of the instance\n")
+		fmt.Printf("  save                        save the persistent stores now\n")
+		fmt.Printf("  fsck                        check the metadata against the underlying filesystem\n")
+		fmt.Printf("  maintenance on|off          only let the sysadmin write, e.g. during a migration\n")
+		fmt.Printf("  sysadmin set uid|gid <id>   change the sysadmin\n")
+		fmt.Printf("  role list                   list the admins and delegated roles\n")
+		fmt.Printf("  role grant|revoke <role> uid:<id>|gid:<id> [path]\n")
+		fmt.Printf("                              grant or revoke admin, quota-admin, auditor or subtree-owner\n")
+		fmt.Printf("  dedup-stats                 show how much space deduplication is saving\n")
+		fmt.Printf("  report duplicates [-json]   list the contents shared by more than one file\n")
+		fmt.Printf("  snapshot create|delete <name>\n")
+		fmt.Printf("                              take or delete a snapshot of the filesystem\n")
+		fmt.Printf("  snapshot list               list the snapshots\n")
+		fmt.Printf("  snapshot restore <name> <path> [<dest>]\n")
+		fmt.Printf("                              restore a file or subtree from a snapshot\n")
+		fmt.Printf("  trash list [<uid>]          list what's in the trash, or only what <uid> deleted\n")
+		fmt.Printf("  trash restore <id> [<dest>] move a node back out of the trash\n")
+		fmt.Printf("  trash purge <id>|all|uid <uid>\n")
+		fmt.Printf("                              remove nodes from the trash for good\n")
+		fmt.Printf("  quota list                  show everyone's quota and usage\n")
+		fmt.Printf("  quota show <owner>          show the quota and usage of uid:<id>, gid:<id> or project:<id>\n")
+		fmt.Printf("  quota set <owner> <resource> <soft> <hard>\n")
+		fmt.Printf("                              limit inodes, logical or physical bytes, 0 for no limit\n")
+		fmt.Printf("  quota remove <owner>        remove every limit of uid:<id>, gid:<id> or project:<id>\n")
+		fmt.Printf("  project list                list the projects and how much is in them\n")
+		fmt.Printf("  project set <path> <id>     put a directory and everything under it in a project, 0 for none\n")
+		fmt.Printf("  tier move                   move unread content to the cold tier now\n")
+		fmt.Printf("  log-level [levels]          show or change the log levels, e.g. vfs=debug\n")
+		fmt.Printf("  reload-config               reload the configuration of the instance\n")
+		fmt.Printf("\noptions:\n")
+		flag.PrintDefaults() // show what optional flags can be used
+		os.Exit(2)           // exit w/ error code
+	}
+
+	response, err := control.Send(*socket, control.Request{Command: flag.Arg(0), Args: flag.Args()[1:]})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't reach OptiFS at {%v}: %v\n", *socket, err)
+		os.Exit(1)
+	}
+
+	if response.Output != "" {
+		fmt.Println(response.Output)
+	}
+	if response.Error != "" {
+		fmt.Fprintf(os.Stderr, "error: %v\n", response.Error)
+		os.Exit(1)
+	}
+}
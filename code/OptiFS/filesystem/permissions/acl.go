@@ -0,0 +1,449 @@
+// This file contains the handling of POSIX access control lists (ACLs) for the permissions module
+
+package permissions
+
+import (
+	"context"
+	"encoding/binary"
+	"filesystem/metadata"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Names of the extended attributes the kernel uses to pass ACLs to and from the filesystem
+const (
+	ACLAccessXAttr  = "system.posix_acl_access"
+	ACLDefaultXAttr = "system.posix_acl_default"
+)
+
+// Tags that identify the type of an ACL entry, as defined by the kernel's posix_acl_xattr.h
+const (
+	aclUserObj  uint16 = 0x01
+	aclUser     uint16 = 0x02
+	aclGroupObj uint16 = 0x04
+	aclGroup    uint16 = 0x08
+	aclMask     uint16 = 0x10
+	aclOther    uint16 = 0x20
+)
+
+const (
+	aclXAttrVersion uint32 = 0x0002     // Version of the xattr representation of an ACL
+	aclHeaderSize          = 4          // Size of the version header
+	aclEntrySize           = 8          // Size of a single (tag, perm, id) entry
+	aclUndefinedID  uint32 = 0xffffffff // ID used by entries which don't refer to a user or group
+)
+
+// ACLEntry is a single entry of a POSIX ACL
+type ACLEntry struct {
+	Tag  uint16
+	Perm uint16
+	ID   uint32
+}
+
+// ACL is a POSIX access control list, made up of ACLEntry's
+type ACL []ACLEntry
+
+// Checks if the extended attribute provided holds a POSIX ACL
+func IsACLXAttr(attr string) bool {
+	return attr == ACLAccessXAttr || attr == ACLDefaultXAttr
+}
+
+// Decodes and validates an ACL from its extended attribute representation.
+//
+// Returns EINVAL if the data is malformed or the ACL isn't valid.
+func ParseACL(data []byte) (ACL, syscall.Errno) {
+	if len(data) < aclHeaderSize || (len(data)-aclHeaderSize)%aclEntrySize != 0 {
+		logger.Debug("ACL has an invalid size.")
+		return nil, fs.ToErrno(syscall.EINVAL)
+	}
+	if binary.LittleEndian.Uint32(data[:aclHeaderSize]) != aclXAttrVersion {
+		logger.Debug("ACL has an unsupported version.")
+		return nil, fs.ToErrno(syscall.EINVAL)
+	}
+
+	acl := make(ACL, 0, (len(data)-aclHeaderSize)/aclEntrySize)
+	for offset := aclHeaderSize; offset < len(data); offset += aclEntrySize {
+		acl = append(acl, ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(data[offset:]),
+			Perm: binary.LittleEndian.Uint16(data[offset+2:]),
+			ID:   binary.LittleEndian.Uint32(data[offset+4:]),
+		})
+	}
+
+	if err := acl.validate(); err != fs.OK {
+		return nil, err
+	}
+	return acl, fs.OK
+}
+
+// Encodes the ACL into its extended attribute representation
+func (acl ACL) Bytes() []byte {
+	data := make([]byte, aclHeaderSize+len(acl)*aclEntrySize)
+	binary.LittleEndian.PutUint32(data, aclXAttrVersion)
+	for index, entry := range acl {
+		offset := aclHeaderSize + index*aclEntrySize
+		binary.LittleEndian.PutUint16(data[offset:], entry.Tag)
+		binary.LittleEndian.PutUint16(data[offset+2:], entry.Perm)
+		binary.LittleEndian.PutUint32(data[offset+4:], entry.ID)
+	}
+	return data
+}
+
+// Ensures the ACL follows the same rules the kernel enforces (posix_acl_valid)
+//
+// Entries must be sorted by tag (and by ID for named entries), the owner, owning group
+// and other entries must exist exactly once, and a mask must exist if there are named entries
+func (acl ACL) validate() syscall.Errno {
+	var seen uint16
+	var lastTag uint16
+	var lastID uint32
+	named := false
+
+	for index, entry := range acl {
+		if entry.Perm&^07 != 0 {
+			return fs.ToErrno(syscall.EINVAL)
+		}
+		// Entries have to be in ascending order
+		if index > 0 && entry.Tag < lastTag {
+			return fs.ToErrno(syscall.EINVAL)
+		}
+
+		switch entry.Tag {
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+			// Only one of each of these is allowed
+			if seen&entry.Tag != 0 {
+				return fs.ToErrno(syscall.EINVAL)
+			}
+		case aclUser, aclGroup:
+			// Named entries must have increasing, unique IDs
+			if seen&entry.Tag != 0 && entry.ID <= lastID {
+				return fs.ToErrno(syscall.EINVAL)
+			}
+			if entry.ID == aclUndefinedID {
+				return fs.ToErrno(syscall.EINVAL)
+			}
+			lastID = entry.ID
+			named = true
+		default:
+			return fs.ToErrno(syscall.EINVAL)
+		}
+
+		seen |= entry.Tag
+		lastTag = entry.Tag
+	}
+
+	required := aclUserObj | aclGroupObj | aclOther
+	if seen&required != required {
+		return fs.ToErrno(syscall.EINVAL)
+	}
+	if named && seen&aclMask == 0 {
+		return fs.ToErrno(syscall.EINVAL)
+	}
+	return fs.OK
+}
+
+// Returns the permission bits that are equivalent to the ACL, and whether the ACL
+// can be completely represented by those bits (i.e. it has no named entries or mask)
+func (acl ACL) equivalentMode() (mode uint32, isMinimal bool) {
+	isMinimal = true
+	var groupPerm, maskPerm uint16
+	hasMask := false
+
+	for _, entry := range acl {
+		switch entry.Tag {
+		case aclUserObj:
+			mode |= uint32(entry.Perm) << 6
+		case aclGroupObj:
+			groupPerm = entry.Perm
+		case aclMask:
+			maskPerm = entry.Perm
+			hasMask = true
+			isMinimal = false
+		case aclOther:
+			mode |= uint32(entry.Perm)
+		default:
+			isMinimal = false
+		}
+	}
+
+	// The group bits of the mode reflect the mask if there is one
+	if hasMask {
+		mode |= uint32(maskPerm) << 3
+	} else {
+		mode |= uint32(groupPerm) << 3
+	}
+	return mode, isMinimal
+}
+
+// Returns a copy of the ACL with its owner, group class and other entries set to
+// the permission bits in mode. Used to keep an ACL consistent with a chmod.
+func (acl ACL) withMode(mode uint32) ACL {
+	updated := make(ACL, len(acl))
+	copy(updated, acl)
+
+	hasMask := false
+	for _, entry := range acl {
+		if entry.Tag == aclMask {
+			hasMask = true
+		}
+	}
+
+	for index := range updated {
+		switch updated[index].Tag {
+		case aclUserObj:
+			updated[index].Perm = uint16(mode>>6) & 07
+		case aclGroupObj:
+			if !hasMask {
+				updated[index].Perm = uint16(mode>>3) & 07
+			}
+		case aclMask:
+			updated[index].Perm = uint16(mode>>3) & 07
+		case aclOther:
+			updated[index].Perm = uint16(mode) & 07
+		}
+	}
+	return updated
+}
+
+// Returns a copy of the ACL restricted by the permission bits in mode, along with
+// the resulting mode. This is how a new node's access ACL is derived from its parent's
+// default ACL (posix_acl_create_masq).
+func (acl ACL) maskedBy(mode uint32) (ACL, uint32) {
+	masked := make(ACL, len(acl))
+	copy(masked, acl)
+
+	hasMask := false
+	for _, entry := range acl {
+		if entry.Tag == aclMask {
+			hasMask = true
+		}
+	}
+
+	for index := range masked {
+		switch masked[index].Tag {
+		case aclUserObj:
+			masked[index].Perm &= uint16(mode>>6) & 07
+		case aclGroupObj:
+			if !hasMask {
+				masked[index].Perm &= uint16(mode>>3) & 07
+			}
+		case aclMask:
+			masked[index].Perm &= uint16(mode>>3) & 07
+		case aclOther:
+			masked[index].Perm &= uint16(mode) & 07
+		}
+	}
+
+	newMode, _ := masked.equivalentMode()
+	return masked, (mode &^ 0777) | newMode
+}
+
+// Runs the POSIX.1e access check algorithm against the ACL.
+//
+// 'want' is the requested access in the usual rwx form (READ -> 4, WRITE -> 2, EXEC -> 1)
+func (acl ACL) permits(uid uint32, gids []uint32, nodeMetadata *metadata.MapEntryMetadata, want uint16) bool {
+	// Entries in the group class are limited by the mask, if one exists
+	var mask uint16 = 07
+	for _, entry := range acl {
+		if entry.Tag == aclMask {
+			mask = entry.Perm
+		}
+	}
+
+	// The owner of the node is handled first, and isn't limited by the mask
+	if isOwner(uid, nodeMetadata.Uid) {
+		for _, entry := range acl {
+			if entry.Tag == aclUserObj {
+				logger.Debug("User is the owner (ACL).")
+				return entry.Perm&want == want
+			}
+		}
+	}
+
+	// Then any named user entries
+	for _, entry := range acl {
+		if entry.Tag == aclUser && entry.ID == uid {
+			logger.Debug("User has a named ACL entry.")
+			return entry.Perm&mask&want == want
+		}
+	}
+
+	// Then the group entries, any matching group entry granting the access is enough
+	groupMatched := false
+	for _, entry := range acl {
+		if (entry.Tag == aclGroupObj && inGroups(gids, nodeMetadata.Gid)) || (entry.Tag == aclGroup && inGroups(gids, entry.ID)) {
+			groupMatched = true
+			if entry.Perm&mask&want == want {
+				logger.Debug("User is in a group granted access (ACL).")
+				return true
+			}
+		}
+	}
+	if groupMatched {
+		logger.Debug("User's groups don't grant access (ACL).")
+		return false
+	}
+
+	// Finally, other
+	for _, entry := range acl {
+		if entry.Tag == aclOther {
+			logger.Debug("User is considered other (ACL).")
+			return entry.Perm&want == want
+		}
+	}
+	return false
+}
+
+// Retrieves and decodes an ACL stored in the node's custom extended attributes
+//
+// Returns false if there is no ACL stored or it cannot be decoded
+func getACL(nodeMetadata *metadata.MapEntryMetadata, attr string) (ACL, bool) {
+	if nodeMetadata == nil {
+		return nil, false
+	}
+
+	isDir := nodeMetadata.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	data, err := metadata.CopyCustomXAttr(nodeMetadata, attr, isDir)
+	if err != fs.OK {
+		return nil, false
+	}
+
+	acl, perr := ParseACL(data)
+	if perr != fs.OK {
+		logger.Warn("Stored ACL is invalid, ignoring it.", "attr", attr, "path", nodeMetadata.Path)
+		return nil, false
+	}
+	return acl, true
+}
+
+// Sets an ACL on a node through its extended attribute.
+//
+// Only the owner (or the sysadmin, or the owner of its subtree) may change the ACL of a node. Setting an access ACL
+// updates the mode of the node to match, and an ACL that is fully described by the mode
+// isn't stored at all (the same as the kernel does).
+func SetACL(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, attr string, data []byte, flags uint32, isDir bool) syscall.Errno {
+
+	logger.Debug("Setting ACL", "attr", attr)
+
+	if nodeMetadata == nil {
+		return fs.ToErrno(syscall.ENODATA)
+	}
+
+	if !IsUserAdminOf(ctx, nodeMetadata.Path) && !IsOwner(ctx, nodeMetadata) {
+		logger.Debug("Only the owner can change an ACL.")
+		return fs.ToErrno(syscall.EPERM)
+	}
+
+	// An empty default ACL removes it (e.g. setfacl -k), even if there wasn't one, as the kernel does
+	if attr == ACLDefaultXAttr && len(data) == 0 {
+		logger.Debug("Empty default ACL, removing it.")
+		if err := metadata.RemoveCustomXAttr(nodeMetadata, attr, isDir); err != fs.OK && err != syscall.ENODATA {
+			return err
+		}
+		return fs.OK
+	}
+
+	// Default ACLs only make sense on directories
+	if attr == ACLDefaultXAttr && !isDir {
+		return fs.ToErrno(syscall.EACCES)
+	}
+
+	acl, err := ParseACL(data)
+	if err != fs.OK {
+		logger.Debug("Invalid ACL provided.")
+		return err
+	}
+
+	if attr == ACLDefaultXAttr {
+		return metadata.SetCustomXAttr(nodeMetadata, attr, acl.Bytes(), flags, isDir)
+	}
+
+	// Reflect the access ACL in the permission bits
+	mode, isMinimal := acl.equivalentMode()
+	newMode := (nodeMetadata.Mode &^ 0777) | mode
+	metadata.UpdateMode(nodeMetadata, &newMode, isDir)
+
+	if isMinimal {
+		logger.Debug("ACL is equivalent to the mode, not storing it.")
+		metadata.RemoveCustomXAttr(nodeMetadata, attr, isDir)
+		return fs.OK
+	}
+
+	return metadata.SetCustomXAttr(nodeMetadata, attr, acl.Bytes(), flags, isDir)
+}
+
+// Removes an ACL from a node. Only the owner (or the sysadmin, or the owner of its subtree) may do so.
+func RemoveACL(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, attr string, isDir bool) syscall.Errno {
+	if nodeMetadata == nil {
+		return fs.ToErrno(syscall.ENODATA)
+	}
+
+	if !IsUserAdminOf(ctx, nodeMetadata.Path) && !IsOwner(ctx, nodeMetadata) {
+		logger.Debug("Only the owner can remove an ACL.")
+		return fs.ToErrno(syscall.EPERM)
+	}
+
+	return metadata.RemoveCustomXAttr(nodeMetadata, attr, isDir)
+}
+
+// Keeps the access ACL of a node consistent with a change of its mode (chmod)
+func UpdateACLMode(nodeMetadata *metadata.MapEntryMetadata, mode uint32, isDir bool) {
+	acl, ok := getACL(nodeMetadata, ACLAccessXAttr)
+	if !ok {
+		return
+	}
+
+	logger.Debug("Updating access ACL to reflect the new mode.")
+	metadata.SetCustomXAttr(nodeMetadata, ACLAccessXAttr, acl.withMode(mode).Bytes(), 0, isDir)
+}
+
+// Works out what a new node created in the parent directory provided should inherit
+// from the parent's default ACL.
+//
+// Returns the mode the node should have, and the ACL extended attributes it should be
+// created with. If the parent has no default ACL, the mode is returned unchanged and
+// there are no extended attributes to inherit.
+func InheritACL(parentMetadata *metadata.MapEntryMetadata, mode uint32, isDir bool) (uint32, map[string][]byte) {
+	defaultACL, ok := getACL(parentMetadata, ACLDefaultXAttr)
+	if !ok {
+		return mode, nil
+	}
+
+	logger.Debug("Parent has a default ACL, inheriting it.")
+	inherited := make(map[string][]byte)
+
+	accessACL, newMode := defaultACL.maskedBy(mode)
+	if _, isMinimal := accessACL.equivalentMode(); !isMinimal {
+		inherited[ACLAccessXAttr] = accessACL.Bytes()
+	}
+
+	// Directories pass their default ACL on to their own children
+	if isDir {
+		inherited[ACLDefaultXAttr] = defaultACL.Bytes()
+	}
+
+	return newMode, inherited
+}
+
+// Applies an inherited mode and ACL extended attributes (from InheritACL) to a new node's
+// custom metadata. The file type bits of the node are kept.
+func ApplyInheritedACL(nodeMetadata *metadata.MapEntryMetadata, mode uint32, inherited map[string][]byte, isDir bool) {
+	if nodeMetadata == nil || inherited == nil {
+		return
+	}
+
+	newMode := (nodeMetadata.Mode &^ 07777) | (mode & 07777)
+	metadata.UpdateMode(nodeMetadata, &newMode, isDir)
+
+	// Apply in a deterministic order
+	var names []string
+	for name := range inherited {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metadata.SetCustomXAttr(nodeMetadata, name, inherited[name], 0, isDir)
+	}
+}
@@ -0,0 +1,55 @@
+// This file contains the auditing and metrics of permission checks
+
+package permissions
+
+import (
+	"context"
+	"filesystem/audit"
+	"filesystem/metadata"
+	"filesystem/metrics"
+)
+
+// How many permission checks have failed, by operation
+var denials = metrics.NewCounter("optifs_permission_denials", "Permission checks that failed, by operation.", "op")
+
+// Gets the name of an operation CheckPermissions checks
+func opName(op uint8) string {
+	switch op {
+	case 0:
+		return "read"
+	case 1:
+		return "write"
+	case 2:
+		return "execute"
+	}
+	return "unknown"
+}
+
+// Records the outcome of a permission check that didn't involve any privileges
+func auditCheck(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, op string, allowed bool) {
+	if !allowed {
+		denials.Inc(op)
+		if audit.Enabled() {
+			audit.RecordContext(ctx, audit.Event{Type: audit.Access, Op: op, Path: nodeMetadata.Path, Outcome: audit.Denied})
+		}
+		return
+	}
+	if audit.AuditsData(nodeMetadata.Path) {
+		audit.RecordContext(ctx, audit.Event{Type: audit.Access, Op: op, Path: nodeMetadata.Path, Outcome: audit.Allowed})
+	}
+}
+
+// Records a permission check the caller passed because of their privileges. It's only a bypass if
+// 'normallyAllowed' (only worked out when auditing) says the normal permissions would have refused it.
+func auditPrivileged(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, op string, normallyAllowed func() bool) {
+	if !audit.Enabled() {
+		return
+	}
+	if !normallyAllowed() {
+		audit.RecordContext(ctx, audit.Event{Type: audit.Access, Op: op, Path: nodeMetadata.Path, Outcome: audit.Bypassed})
+		return
+	}
+	if audit.AuditsData(nodeMetadata.Path) {
+		audit.RecordContext(ctx, audit.Event{Type: audit.Access, Op: op, Path: nodeMetadata.Path, Outcome: audit.Allowed})
+	}
+}
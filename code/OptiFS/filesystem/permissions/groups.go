@@ -0,0 +1,201 @@
+// This file contains the resolution of the full group membership of callers for the permissions module
+
+package permissions
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// How long a resolved group list is trusted before it is resolved again
+var GroupCacheTTL = 5 * time.Second
+
+// Identifies the caller a group list was resolved for. The UID and GID are included
+// as PIDs get reused, and a process can change its credentials.
+type groupCacheKey struct {
+	pid uint32
+	uid uint32
+	gid uint32
+}
+
+// A resolved group list and when it stops being valid
+type groupCacheEntry struct {
+	groups  []uint32
+	expires time.Time
+}
+
+var groupCache = make(map[groupCacheKey]*groupCacheEntry)
+var groupCacheMutex sync.RWMutex
+var groupCachePruned time.Time // when expired group lists were last removed
+
+// Gets every group the caller stored in 'ctx' belongs to, the primary group first, followed
+// by any supplementary groups
+func GetCallerGroups(ctx context.Context) (syscall.Errno, []uint32) {
+	caller, check := fuse.FromContext(ctx)
+	if !check {
+		logger.Debug("No caller info available")
+		return fs.ToErrno(syscall.ENODATA), nil
+	}
+	return fs.OK, resolveGroups(caller.Pid, caller.Uid, caller.Gid)
+}
+
+// Resolves the groups of a process, using the cache where possible
+func resolveGroups(pid uint32, uid uint32, gid uint32) []uint32 {
+	key := groupCacheKey{pid: pid, uid: uid, gid: gid}
+
+	groupCacheMutex.RLock()
+	entry, ok := groupCache[key]
+	groupCacheMutex.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.groups
+	}
+
+	// Prefer the groups of the actual process, as they can differ from the user database
+	// (newgrp, setgroups, containers, etc...)
+	groups, found := procGroups(pid, uid, gid)
+	if !found {
+		groups = userDatabaseGroups(uid, gid)
+	}
+
+	groupCacheMutex.Lock()
+	now := time.Now()
+	groupCache[key] = &groupCacheEntry{groups: groups, expires: now.Add(GroupCacheTTL)}
+	// PIDs keep changing, so without pruning every process that ever called would stay cached
+	if now.Sub(groupCachePruned) >= GroupCacheTTL {
+		pruneGroupCache(now)
+	}
+	groupCacheMutex.Unlock()
+
+	return groups
+}
+
+// Removes the group lists that have expired. Must be called holding groupCacheMutex.
+func pruneGroupCache(now time.Time) {
+	for key, entry := range groupCache {
+		if !now.Before(entry.expires) {
+			delete(groupCache, key)
+		}
+	}
+	groupCachePruned = now
+}
+
+// Drops every cached group list, forcing them to be resolved again on the next permission check.
+//
+// Should be called when group membership is known to have changed.
+func InvalidateGroupCache() {
+	groupCacheMutex.Lock()
+	defer groupCacheMutex.Unlock()
+
+	logger.Debug("Invalidating group cache.")
+	groupCache = make(map[groupCacheKey]*groupCacheEntry)
+}
+
+// Reads the groups of a process from /proc/<pid>/status
+//
+// Returns false if the process doesn't exist (anymore), or its credentials don't
+// match the caller's
+func procGroups(pid uint32, uid uint32, gid uint32) ([]uint32, bool) {
+	if pid == 0 {
+		return nil, false
+	}
+
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return parseProcStatusGroups(lines, uid, gid)
+}
+
+// Extracts the supplementary groups from the lines of a /proc/<pid>/status file, ensuring the
+// filesystem UID and GID of the process match the caller's
+func parseProcStatusGroups(lines []string, uid uint32, gid uint32) ([]uint32, bool) {
+	var groupsLine string
+	uidMatches, gidMatches := false, false
+
+	for _, line := range lines {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		switch key {
+		case "Uid":
+			// Real, effective, saved and filesystem UID - FUSE reports the filesystem UID
+			uidMatches = len(fields) == 4 && fields[3] == strconv.FormatUint(uint64(uid), 10)
+		case "Gid":
+			gidMatches = len(fields) == 4 && fields[3] == strconv.FormatUint(uint64(gid), 10)
+		case "Groups":
+			groupsLine = value
+		}
+	}
+
+	if !uidMatches || !gidMatches {
+		return nil, false
+	}
+
+	groups := []uint32{gid}
+	for _, field := range strings.Fields(groupsLine) {
+		group, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			continue
+		}
+		if uint32(group) != gid {
+			groups = append(groups, uint32(group))
+		}
+	}
+	return groups, true
+}
+
+// Looks the groups of a user up in the user database, used when the process can't be inspected
+func userDatabaseGroups(uid uint32, gid uint32) []uint32 {
+	groups := []uint32{gid}
+
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return groups
+	}
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return groups
+	}
+
+	for _, groupId := range groupIds {
+		group, err := strconv.ParseUint(groupId, 10, 32)
+		if err != nil {
+			continue
+		}
+		if uint32(group) != gid {
+			groups = append(groups, uint32(group))
+		}
+	}
+	return groups
+}
+
+// Checks if any of the groups provided is the group 'oGid'
+func inGroups(gids []uint32, oGid uint32) bool {
+	for _, gid := range gids {
+		if isGroup(gid, oGid) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,36 +2,45 @@ package permissions
 
 import (
 	"context"
+	"filesystem/logging"
 	"filesystem/metadata"
-	"log"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+// Logs permission checks, roles and the sysadmin
+var logger = logging.For(logging.Permissions)
+
 // Checks open syscall permissions
 func CheckOpenPermissions(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, flags uint32) bool {
 
-    log.Println("Checking OPEN PERMISSIONS based on flags...")
+    logger.Debug("Checking OPEN PERMISSIONS based on flags...")
 
-	// sysadmin is always allowed
+	// Check the intent of the open flags
+	readIntent, writeIntent := checkOpenIntent(flags)
+
+	// sysadmin is always allowed, but what they open is still audited
 	if IsUserSysadmin(&ctx) {
-        log.Println("User is sysadmin.")
+        logger.Debug("User is sysadmin.")
+		if readIntent {
+			auditPrivileged(ctx, nodeMetadata, opName(0), func() bool { return modeAllows(ctx, nodeMetadata, 0) })
+		}
+		if writeIntent {
+			auditPrivileged(ctx, nodeMetadata, opName(1), func() bool { return modeAllows(ctx, nodeMetadata, 1) })
+		}
 	    return true
 	}
 
 	isAllowed := true
 
-	// Check the intent of the open flags
-	readIntent, writeIntent := checkOpenIntent(flags)
-
-	log.Printf("Write intent: {%v} || Read intent: {%v}\n", writeIntent, readIntent)
+	logger.Debug("Checked open intent", "write", writeIntent, "read", readIntent)
 
 	// If the open intends to read, check it has permission
 	if readIntent {
 		readPerm := CheckPermissions(ctx, nodeMetadata, 0)
-		log.Printf("Checked read perm -> {%v}\n", readPerm)
+		logger.Debug("Checked read perm", "allowed", readPerm)
 		if !readPerm {
 			isAllowed = false
 		}
@@ -39,14 +48,14 @@ func CheckOpenPermissions(ctx context.Context, nodeMetadata *metadata.MapEntryMe
 	// If the open intends to write, check it has permission
 	if writeIntent {
 		writePerm := CheckPermissions(ctx, nodeMetadata, 1)
-		log.Printf("Checked write perm -> {%v}\n", writePerm)
+		logger.Debug("Checked write perm", "allowed", writePerm)
 		if !writePerm {
 			isAllowed = false
 		}
 	}
 
 
-	log.Printf("Is allowed -> {%v}\n", isAllowed)
+	logger.Debug("Checked open permissions", "allowed", isAllowed)
 	return isAllowed
 }
 
@@ -56,66 +65,106 @@ func CheckOpenPermissions(ctx context.Context, nodeMetadata *metadata.MapEntryMe
 // WRITE -> op = 1
 // EXEC -> op = 2
 func CheckPermissions(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, op uint8) bool {
+	return checkPermissions(ctx, nodeMetadata, op, true)
+}
 
-    log.Println("Checking permissions...")
+// Checks the permissions of an open file for each read, write or fsync through its handle. The access
+// was audited when the file was opened, so only denials are recorded, not every block.
+func CheckHandlePermissions(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, op uint8) bool {
+	return checkPermissions(ctx, nodeMetadata, op, false)
+}
+
+// Checks the permissions for the operation 'op', auditing checks that pass only if 'auditAllowed'
+func checkPermissions(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, op uint8, auditAllowed bool) bool {
+
+    logger.Debug("Checking permissions...")
 
 	// sysadmin is always allowed
 	if IsUserSysadmin(&ctx) {
-        log.Println("User is sysadmin.")
+        logger.Debug("User is sysadmin.")
+		if auditAllowed {
+			auditPrivileged(ctx, nodeMetadata, opName(op), func() bool { return modeAllows(ctx, nodeMetadata, op) })
+		}
 		return true
 	}
 
-	err1, uid, gid := GetUIDGID(ctx)
+	if hasDelegatedAccess(ctx, nodeMetadata, op == 0) {
+		if auditAllowed {
+			auditPrivileged(ctx, nodeMetadata, opName(op), func() bool { return modeAllows(ctx, nodeMetadata, op) })
+		}
+		return true
+	}
+
+	allowed := modeAllows(ctx, nodeMetadata, op)
+	if auditAllowed || !allowed {
+		auditCheck(ctx, nodeMetadata, opName(op), allowed)
+	}
+	return allowed
+}
+
+// Checks the mode of 'nodeMetadata' lets the user stored in 'ctx' try the operation 'op', without
+// any privileges
+func modeAllows(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, op uint8) bool {
+	err1, uid, _ := GetUIDGID(ctx)
 	if err1 != fs.OK {
-		log.Println("Failed to get UIDGID, exiting.")
+		logger.Debug("Failed to get UIDGID, exiting.")
 		return false
 	}
 
+	// The primary group and every supplementary group of the caller
+	_, gids := GetCallerGroups(ctx)
+
 	switch op {
 	case 0: // Read permission check
-		log.Println("Checking read permissions")
-		return readCheck(uid, gid, nodeMetadata)
+		logger.Debug("Checking read permissions")
+		return readCheck(uid, gids, nodeMetadata)
 	case 1:
-		log.Println("Checking write permissions")
-		return writeCheck(uid, gid, nodeMetadata)
+		logger.Debug("Checking write permissions")
+		return writeCheck(uid, gids, nodeMetadata)
 	case 2:
-		log.Println("Checking exec permissions")
-		return execCheck(uid, gid, nodeMetadata)
+		logger.Debug("Checking exec permissions")
+		return execCheck(uid, gids, nodeMetadata)
 	default:
-		log.Printf("Unknown operation permission check requested (%v)\n", op)
+		logger.Warn("Unknown operation permission check requested", "op", op)
 		return false
 	}
 }
 
-// Checks the mode against the uid and gid for read permissions
-func readCheck(uid uint32, gid uint32, nodeMetadata *metadata.MapEntryMetadata) bool {
-	return checkMode(uid, gid, nodeMetadata, syscall.S_IRUSR, syscall.S_IRGRP, syscall.S_IROTH)
+// Checks the mode against the uid and gids for read permissions
+func readCheck(uid uint32, gids []uint32, nodeMetadata *metadata.MapEntryMetadata) bool {
+	return checkMode(uid, gids, nodeMetadata, syscall.S_IRUSR, syscall.S_IRGRP, syscall.S_IROTH)
 }
 
-// Checks the mode against the uid and gid for write permissions
-func writeCheck(uid uint32, gid uint32, nodeMetadata *metadata.MapEntryMetadata) bool {
-	return checkMode(uid, gid, nodeMetadata, syscall.S_IWUSR, syscall.S_IWGRP, syscall.S_IWOTH)
+// Checks the mode against the uid and gids for write permissions
+func writeCheck(uid uint32, gids []uint32, nodeMetadata *metadata.MapEntryMetadata) bool {
+	return checkMode(uid, gids, nodeMetadata, syscall.S_IWUSR, syscall.S_IWGRP, syscall.S_IWOTH)
 }
 
-// Checks the mode against the uid and gid for exec permissions
-func execCheck(uid uint32, gid uint32, nodeMetadata *metadata.MapEntryMetadata) bool {
-	return checkMode(uid, gid, nodeMetadata, syscall.S_IXUSR, syscall.S_IXGRP, syscall.S_IXOTH)
+// Checks the mode against the uid and gids for exec permissions
+func execCheck(uid uint32, gids []uint32, nodeMetadata *metadata.MapEntryMetadata) bool {
+	return checkMode(uid, gids, nodeMetadata, syscall.S_IXUSR, syscall.S_IXGRP, syscall.S_IXOTH)
 }
 
-func checkMode(uid uint32, gid uint32, nodeMetadata *metadata.MapEntryMetadata, ownerFlag uint32, groupFlag uint32, otherFlag uint32) bool {
-	log.Println("Extracting mode...")
+func checkMode(uid uint32, gids []uint32, nodeMetadata *metadata.MapEntryMetadata, ownerFlag uint32, groupFlag uint32, otherFlag uint32) bool {
+	logger.Debug("Extracting mode...")
 	mode := nodeMetadata.Mode
 
-    log.Println("Performing bit operations...")
+	// An access ACL takes the place of the permission bits if the node has one
+	if acl, ok := getACL(nodeMetadata, ACLAccessXAttr); ok {
+		logger.Debug("Checking access ACL...")
+		return acl.permits(uid, gids, nodeMetadata, uint16(otherFlag&07))
+	}
+
+    logger.Debug("Performing bit operations...")
 	switch {
 	case isOwner(uid, nodeMetadata.Uid):
-		log.Println("User is the owner.")
+		logger.Debug("User is the owner.")
 		return mode&ownerFlag != 0
-	case isGroup(gid, nodeMetadata.Gid):
-		log.Println("User is in the group.")
+	case inGroups(gids, nodeMetadata.Gid):
+		logger.Debug("User is in the group.")
 		return mode&groupFlag != 0
 	default:
-		log.Println("User is considered other.")
+		logger.Debug("User is considered other.")
 		return mode&otherFlag != 0
 	}
 
@@ -179,7 +228,7 @@ func checkOpenIntent(flags uint32) (readIntent bool, writeIntent bool) {
 func GetUIDGID(ctx context.Context) (syscall.Errno, uint32, uint32) {
 	caller, check := fuse.FromContext(ctx)
 	if !check {
-		log.Println("No caller info available")
+		logger.Debug("No caller info available")
 		return fs.ToErrno(syscall.ENODATA), 0, 0
 	}
 	return fs.OK, uint32(caller.Uid), uint32(caller.Gid)
@@ -187,48 +236,129 @@ func GetUIDGID(ctx context.Context) (syscall.Errno, uint32, uint32) {
 
 // Checks a mask against nodeMetadata mode
 func CheckMask(ctx context.Context, mask uint32, nodeMetadata *metadata.MapEntryMetadata) bool {
-	// Allows the sysadmin to ignore permission checks
-	if IsUserSysadmin(&ctx) {
+	// Allows the sysadmin to ignore permission checks,
+	// and anyone with a delegated role that covers the request
+	if IsUserSysadmin(&ctx) || hasDelegatedAccess(ctx, nodeMetadata, mask&^4 == 0) {
+		auditPrivileged(ctx, nodeMetadata, "access", func() bool { return maskAllows(ctx, mask, nodeMetadata) })
 		return true
 	}
 
+	allowed := maskAllows(ctx, mask, nodeMetadata)
+	auditCheck(ctx, nodeMetadata, "access", allowed)
+	return allowed
+}
+
+// Checks the mode (or access ACL) of 'nodeMetadata' allows 'mask' for the user stored in 'ctx',
+// without any privileges
+func maskAllows(ctx context.Context, mask uint32, nodeMetadata *metadata.MapEntryMetadata) bool {
 	// Extract the UID and GID from the context
-	err1, currentUID, currentGID := GetUIDGID(ctx)
+	err1, currentUID, _ := GetUIDGID(ctx)
 	if err1 != fs.OK {
-		log.Println("Can't get user context")
+		logger.Debug("Can't get user context")
 		return false
 	}
+	_, currentGIDs := GetCallerGroups(ctx)
 
 	// Determine access writes based on the Mode
 	mode := nodeMetadata.Mode
 	var allowed bool
 
+	// Prioritise the access ACL if the node has one
+	acl, hasACL := getACL(nodeMetadata, ACLAccessXAttr)
+
 	switch {
+	case hasACL:
+		logger.Debug("Checking access ACL")
+		allowed = acl.permits(currentUID, currentGIDs, nodeMetadata, uint16(mask&07))
+		logger.Debug("ACL checked", "mask", mask, "allowed", allowed)
 	case isOwner(currentUID, nodeMetadata.Uid):
 		// user is the owner
-		log.Println("User is the owner")
+		logger.Debug("User is the owner")
 		// Don't shift the mode at all, as the bits are in the correct place already
 		allowed = checkPermissionBits(mask, mode)
-		log.Printf("Owner requested %v, allowed: %v\n", mask, allowed)
-	case isGroup(currentGID, nodeMetadata.Gid):
+		logger.Debug("Owner checked", "mask", mask, "allowed", allowed)
+	case inGroups(currentGIDs, nodeMetadata.Gid):
 		// User is in the group
-		log.Println("User is in the group")
+		logger.Debug("User is in the group")
 		// shift mode 3 bits to the left to line up group permission bits to be under where user bits usually are
 		allowed = checkPermissionBits(mask, mode<<3)
-		log.Printf("Group member requested %v, allowed: %v\n", mask, allowed)
+		logger.Debug("Group member checked", "mask", mask, "allowed", allowed)
 	default:
 		// Check for others permissions
-		log.Println("User is under others")
+		logger.Debug("User is under others")
 		// shift mode 6 bits to the left to line up other permission bits to be under where user bits usually are
 		allowed = checkPermissionBits(mask, mode<<6)
-		log.Printf("Other member requested %v, allowed: %v\n", mask, allowed)
+		logger.Debug("Other member checked", "mask", mask, "allowed", allowed)
 	}
 
 	if !allowed {
-		log.Println("NOT ALLOWED")
+		logger.Debug("NOT ALLOWED")
 		return false
 	}
 
-	log.Println("ALLOWED")
+	logger.Debug("ALLOWED")
 	return true
 }
+
+// Checks the restricted deletion semantics of a directory with the sticky bit (S_ISVTX) set.
+//
+// If the directory has the sticky bit, only the owner of the node being removed/renamed, the owner
+// of the directory, or the sysadmin may remove or rename it. Otherwise, this is always allowed
+// (write and exec permissions on the directory are checked separately).
+func CheckStickyBit(ctx context.Context, dirMetadata *metadata.MapEntryMetadata, nodeUid uint32) bool {
+	if dirMetadata == nil || dirMetadata.Mode&syscall.S_ISVTX == 0 {
+		return true
+	}
+
+	logger.Debug("Directory has the sticky bit set, checking ownership...")
+
+	// sysadmin is always allowed, as is the owner of a subtree the directory is in
+	if IsUserAdminOf(ctx, dirMetadata.Path) {
+		logger.Debug("User is sysadmin or owns the subtree.")
+		return true
+	}
+
+	err, uid, _ := GetUIDGID(ctx)
+	if err != fs.OK {
+		logger.Debug("Failed to get UIDGID, exiting.")
+		return false
+	}
+
+	if isOwner(uid, nodeUid) || isOwner(uid, dirMetadata.Uid) {
+		logger.Debug("User owns the node or the directory.")
+		return true
+	}
+
+	logger.Debug("User doesn't own the node or the directory.")
+	return false
+}
+
+// Works out the group that a new node created in the parent directory provided should belong to.
+//
+// If the parent has the setgid bit (S_ISGID) set, the node takes the parent's group, and the returned
+// flag is true (new directories should then also carry the setgid bit). Otherwise the node takes the
+// caller's group.
+func InheritGroup(ctx context.Context, parentMetadata *metadata.MapEntryMetadata) (uint32, bool) {
+	if parentMetadata != nil && parentMetadata.Mode&syscall.S_ISGID != 0 {
+		logger.Debug("Parent directory has the setgid bit set, inheriting its group.")
+		return parentMetadata.Gid, true
+	}
+
+	_, _, gid := GetUIDGID(ctx)
+	return gid, false
+}
+
+// Ensures that a new mode set through a chmod doesn't set the setgid bit of a node unless
+// the caller is in the node's group (or is the sysadmin, or owns its subtree), the same as the kernel does
+func SanitiseSetgid(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, mode uint32) uint32 {
+	if mode&syscall.S_ISGID == 0 || IsUserAdminOf(ctx, nodeMetadata.Path) {
+		return mode
+	}
+
+	err, gids := GetCallerGroups(ctx)
+	if err != fs.OK || !inGroups(gids, nodeMetadata.Gid) {
+		logger.Debug("User isn't in the node's group, clearing setgid bit.")
+		return mode &^ syscall.S_ISGID
+	}
+	return mode
+}
@@ -2,11 +2,19 @@ package permissions
 
 import (
 	"context"
+	"encoding/json"
+	"filesystem/audit"
 	"filesystem/metadata"
+	"fmt"
+	"os"
 	"os/user"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -198,7 +206,7 @@ func TestCheckMode(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			SysAdmin = tc.currentSysadmin
-			result := checkMode(tc.uid, tc.gid, tc.nodeMetadata, tc.ownerFlag, tc.groupFlag, tc.otherFlag)
+			result := checkMode(tc.uid, []uint32{tc.gid}, tc.nodeMetadata, tc.ownerFlag, tc.groupFlag, tc.otherFlag)
 			if result != tc.expected {
 				t.Errorf("Expected %v, got %v", tc.expected, result)
 			}
@@ -255,7 +263,7 @@ func TestReadCheck(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			SysAdmin = tc.currentSysadmin
-			result := readCheck(tc.uid, tc.gid, tc.nodeMetadata)
+			result := readCheck(tc.uid, []uint32{tc.gid}, tc.nodeMetadata)
 			if result != tc.expected {
 				t.Errorf("Expected %v, got %v", tc.expected, result)
 			}
@@ -312,7 +320,7 @@ func TestWriteCheck(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			SysAdmin = tc.currentSysadmin
-			result := writeCheck(tc.uid, tc.gid, tc.nodeMetadata)
+			result := writeCheck(tc.uid, []uint32{tc.gid}, tc.nodeMetadata)
 			if result != tc.expected {
 				t.Errorf("Expected %v, got %v", tc.expected, result)
 			}
@@ -370,7 +378,7 @@ func TestExecCheck(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			SysAdmin = tc.currentSysadmin
-			result := execCheck(tc.uid, tc.gid, tc.nodeMetadata)
+			result := execCheck(tc.uid, []uint32{tc.gid}, tc.nodeMetadata)
 			if result != tc.expected {
 				t.Errorf("Expected %v, got %v", tc.expected, result)
 			}
@@ -886,3 +894,655 @@ func TestChangeSysadminGID(t *testing.T) {
 		})
 	}
 }
+
+// Builds the xattr representation of an ACL for testing
+func aclBytes(entries ...ACLEntry) []byte {
+	return ACL(entries).Bytes()
+}
+
+func TestParseACL(t *testing.T) {
+	testCases := []struct {
+		name          string
+		data          []byte
+		expectedError syscall.Errno
+	}{
+		{
+			name: "Minimal ACL",
+			data: aclBytes(
+				ACLEntry{Tag: aclUserObj, Perm: 6, ID: aclUndefinedID},
+				ACLEntry{Tag: aclGroupObj, Perm: 4, ID: aclUndefinedID},
+				ACLEntry{Tag: aclOther, Perm: 4, ID: aclUndefinedID},
+			),
+			expectedError: fs.OK,
+		},
+		{
+			name: "Named entries with mask",
+			data: aclBytes(
+				ACLEntry{Tag: aclUserObj, Perm: 7, ID: aclUndefinedID},
+				ACLEntry{Tag: aclUser, Perm: 6, ID: 1000},
+				ACLEntry{Tag: aclUser, Perm: 4, ID: 1001},
+				ACLEntry{Tag: aclGroupObj, Perm: 5, ID: aclUndefinedID},
+				ACLEntry{Tag: aclGroup, Perm: 7, ID: 2000},
+				ACLEntry{Tag: aclMask, Perm: 7, ID: aclUndefinedID},
+				ACLEntry{Tag: aclOther, Perm: 0, ID: aclUndefinedID},
+			),
+			expectedError: fs.OK,
+		},
+		{
+			name: "Named entry without mask",
+			data: aclBytes(
+				ACLEntry{Tag: aclUserObj, Perm: 7, ID: aclUndefinedID},
+				ACLEntry{Tag: aclUser, Perm: 6, ID: 1000},
+				ACLEntry{Tag: aclGroupObj, Perm: 5, ID: aclUndefinedID},
+				ACLEntry{Tag: aclOther, Perm: 0, ID: aclUndefinedID},
+			),
+			expectedError: fs.ToErrno(syscall.EINVAL),
+		},
+		{
+			name: "Missing other entry",
+			data: aclBytes(
+				ACLEntry{Tag: aclUserObj, Perm: 7, ID: aclUndefinedID},
+				ACLEntry{Tag: aclGroupObj, Perm: 5, ID: aclUndefinedID},
+			),
+			expectedError: fs.ToErrno(syscall.EINVAL),
+		},
+		{
+			name: "Unsorted entries",
+			data: aclBytes(
+				ACLEntry{Tag: aclGroupObj, Perm: 5, ID: aclUndefinedID},
+				ACLEntry{Tag: aclUserObj, Perm: 7, ID: aclUndefinedID},
+				ACLEntry{Tag: aclOther, Perm: 0, ID: aclUndefinedID},
+			),
+			expectedError: fs.ToErrno(syscall.EINVAL),
+		},
+		{
+			name:          "Truncated data",
+			data:          []byte{2, 0, 0, 0, 1, 0},
+			expectedError: fs.ToErrno(syscall.EINVAL),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			acl, err := ParseACL(tc.data)
+			if err != tc.expectedError {
+				t.Errorf("Expected %v, got %v", tc.expectedError, err)
+			}
+			if err == fs.OK && string(acl.Bytes()) != string(tc.data) {
+				t.Errorf("ACL didn't encode back to the same bytes")
+			}
+		})
+	}
+}
+
+func TestCheckPermissionsWithACL(t *testing.T) {
+	acl := aclBytes(
+		ACLEntry{Tag: aclUserObj, Perm: 6, ID: aclUndefinedID},
+		ACLEntry{Tag: aclUser, Perm: 7, ID: 1001},
+		ACLEntry{Tag: aclUser, Perm: 6, ID: 1002},
+		ACLEntry{Tag: aclGroupObj, Perm: 4, ID: aclUndefinedID},
+		ACLEntry{Tag: aclGroup, Perm: 6, ID: 2000},
+		ACLEntry{Tag: aclMask, Perm: 6, ID: aclUndefinedID},
+		ACLEntry{Tag: aclOther, Perm: 0, ID: aclUndefinedID},
+	)
+	node := &metadata.MapEntryMetadata{Uid: 1000, Gid: 1000, Mode: syscall.S_IFREG | 0660, XAttr: map[string][]byte{ACLAccessXAttr: acl}}
+
+	testCases := []struct {
+		name     string
+		uid      uint32
+		gid      uint32
+		op       uint8
+		expected bool
+	}{
+		{name: "Owner write", uid: 1000, gid: 1000, op: 1, expected: true},
+		{name: "Owner exec", uid: 1000, gid: 1000, op: 2, expected: false},
+		{name: "Named user write", uid: 1001, gid: 3000, op: 1, expected: true},
+		{name: "Named user exec limited by mask", uid: 1001, gid: 3000, op: 2, expected: false},
+		{name: "Owning group write", uid: 1003, gid: 1000, op: 1, expected: false},
+		{name: "Named group write", uid: 1003, gid: 2000, op: 1, expected: true},
+		{name: "Other read", uid: 1003, gid: 3000, op: 0, expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SysAdmin = Sysadmin{UID: 1320, GID: 1320, Set: true}
+			ctx := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: tc.uid, Gid: tc.gid}, Pid: 123})
+			result := CheckPermissions(ctx, node, tc.op)
+			if result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestSetEmptyDefaultACL(t *testing.T) {
+	defaultACL := aclBytes(
+		ACLEntry{Tag: aclUserObj, Perm: 7, ID: aclUndefinedID},
+		ACLEntry{Tag: aclGroupObj, Perm: 5, ID: aclUndefinedID},
+		ACLEntry{Tag: aclOther, Perm: 0, ID: aclUndefinedID},
+	)
+	ctx := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123})
+
+	testCases := []struct {
+		name  string
+		node  *metadata.MapEntryMetadata
+		isDir bool
+	}{
+		{name: "Removes the default ACL", node: &metadata.MapEntryMetadata{Uid: 1000, Gid: 1000, Mode: syscall.S_IFDIR | 0755, XAttr: map[string][]byte{ACLDefaultXAttr: defaultACL}}, isDir: true},
+		{name: "No default ACL to remove", node: &metadata.MapEntryMetadata{Uid: 1000, Gid: 1000, Mode: syscall.S_IFDIR | 0755, XAttr: map[string][]byte{}}, isDir: true},
+		{name: "Regular file", node: &metadata.MapEntryMetadata{Uid: 1000, Gid: 1000, Mode: syscall.S_IFREG | 0644, XAttr: map[string][]byte{}}, isDir: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SysAdmin = Sysadmin{UID: 1320, GID: 1320, Set: true}
+			if err := SetACL(ctx, tc.node, ACLDefaultXAttr, nil, 0, tc.isDir); err != fs.OK {
+				t.Errorf("Expected OK, got %v", err)
+			}
+			if _, ok := tc.node.XAttr[ACLDefaultXAttr]; ok {
+				t.Errorf("Expected no default ACL left")
+			}
+		})
+	}
+
+	// Someone other than the owner still can't
+	SysAdmin = Sysadmin{UID: 1320, GID: 1320, Set: true}
+	node := &metadata.MapEntryMetadata{Uid: 1001, Gid: 1001, Mode: syscall.S_IFDIR | 0755, XAttr: map[string][]byte{ACLDefaultXAttr: defaultACL}}
+	if err := SetACL(ctx, node, ACLDefaultXAttr, nil, 0, true); err != syscall.EPERM {
+		t.Errorf("Expected EPERM, got %v", err)
+	}
+}
+
+func TestInheritACL(t *testing.T) {
+	defaultACL := aclBytes(
+		ACLEntry{Tag: aclUserObj, Perm: 7, ID: aclUndefinedID},
+		ACLEntry{Tag: aclGroupObj, Perm: 5, ID: aclUndefinedID},
+		ACLEntry{Tag: aclGroup, Perm: 7, ID: 2000},
+		ACLEntry{Tag: aclMask, Perm: 7, ID: aclUndefinedID},
+		ACLEntry{Tag: aclOther, Perm: 0, ID: aclUndefinedID},
+	)
+
+	testCases := []struct {
+		name            string
+		parent          *metadata.MapEntryMetadata
+		mode            uint32
+		isDir           bool
+		expectedMode    uint32
+		expectedXAttrs  []string
+		expectedInherit bool
+	}{
+		{
+			name:            "No default ACL",
+			parent:          &metadata.MapEntryMetadata{Mode: syscall.S_IFDIR | 0755, XAttr: map[string][]byte{}},
+			mode:            syscall.S_IFREG | 0644,
+			isDir:           false,
+			expectedMode:    syscall.S_IFREG | 0644,
+			expectedInherit: false,
+		},
+		{
+			name:            "File inherits access ACL",
+			parent:          &metadata.MapEntryMetadata{Mode: syscall.S_IFDIR | 0775, XAttr: map[string][]byte{ACLDefaultXAttr: defaultACL}},
+			mode:            syscall.S_IFREG | 0666,
+			isDir:           false,
+			expectedMode:    syscall.S_IFREG | 0660,
+			expectedXAttrs:  []string{ACLAccessXAttr},
+			expectedInherit: true,
+		},
+		{
+			name:            "Directory inherits access and default ACL",
+			parent:          &metadata.MapEntryMetadata{Mode: syscall.S_IFDIR | 0775, XAttr: map[string][]byte{ACLDefaultXAttr: defaultACL}},
+			mode:            syscall.S_IFDIR | 0777,
+			isDir:           true,
+			expectedMode:    syscall.S_IFDIR | 0770,
+			expectedXAttrs:  []string{ACLAccessXAttr, ACLDefaultXAttr},
+			expectedInherit: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mode, inherited := InheritACL(tc.parent, tc.mode, tc.isDir)
+			if mode != tc.expectedMode {
+				t.Errorf("Expected mode %o, got %o", tc.expectedMode, mode)
+			}
+			if (inherited != nil) != tc.expectedInherit {
+				t.Fatalf("Expected inheritance %v, got %v", tc.expectedInherit, inherited != nil)
+			}
+			for _, name := range tc.expectedXAttrs {
+				if _, ok := inherited[name]; !ok {
+					t.Errorf("Expected %v to be inherited", name)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckStickyBit(t *testing.T) {
+	testCases := []struct {
+		name        string
+		ctx         context.Context
+		dirMetadata *metadata.MapEntryMetadata
+		nodeUid     uint32
+		expected    bool
+	}{
+		{
+			name:        "No sticky bit",
+			ctx:         fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123}),
+			dirMetadata: &metadata.MapEntryMetadata{Uid: 1500, Gid: 1500, Mode: syscall.S_IFDIR | 0777},
+			nodeUid:     1600,
+			expected:    true,
+		},
+		{
+			name:        "Sticky bit - node owner",
+			ctx:         fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123}),
+			dirMetadata: &metadata.MapEntryMetadata{Uid: 1500, Gid: 1500, Mode: syscall.S_IFDIR | syscall.S_ISVTX | 0777},
+			nodeUid:     1000,
+			expected:    true,
+		},
+		{
+			name:        "Sticky bit - directory owner",
+			ctx:         fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1500, Gid: 1000}, Pid: 123}),
+			dirMetadata: &metadata.MapEntryMetadata{Uid: 1500, Gid: 1500, Mode: syscall.S_IFDIR | syscall.S_ISVTX | 0777},
+			nodeUid:     1600,
+			expected:    true,
+		},
+		{
+			name:        "Sticky bit - someone else's node",
+			ctx:         fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123}),
+			dirMetadata: &metadata.MapEntryMetadata{Uid: 1500, Gid: 1500, Mode: syscall.S_IFDIR | syscall.S_ISVTX | 0777},
+			nodeUid:     1600,
+			expected:    false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SysAdmin = Sysadmin{UID: 1320, GID: 1320, Set: true}
+			result := CheckStickyBit(tc.ctx, tc.dirMetadata, tc.nodeUid)
+			if result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInheritGroup(t *testing.T) {
+	testCases := []struct {
+		name           string
+		parentMetadata *metadata.MapEntryMetadata
+		expectedGid    uint32
+		expectedSetgid bool
+	}{
+		{
+			name:           "No parent metadata",
+			parentMetadata: nil,
+			expectedGid:    1000,
+			expectedSetgid: false,
+		},
+		{
+			name:           "Parent without setgid",
+			parentMetadata: &metadata.MapEntryMetadata{Uid: 1500, Gid: 2000, Mode: syscall.S_IFDIR | 0775},
+			expectedGid:    1000,
+			expectedSetgid: false,
+		},
+		{
+			name:           "Parent with setgid",
+			parentMetadata: &metadata.MapEntryMetadata{Uid: 1500, Gid: 2000, Mode: syscall.S_IFDIR | syscall.S_ISGID | 0775},
+			expectedGid:    2000,
+			expectedSetgid: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123})
+			gid, setgid := InheritGroup(ctx, tc.parentMetadata)
+			if gid != tc.expectedGid || setgid != tc.expectedSetgid {
+				t.Errorf("Expected %v (%v), got %v (%v)", tc.expectedGid, tc.expectedSetgid, gid, setgid)
+			}
+		})
+	}
+}
+
+func TestSanitiseSetgid(t *testing.T) {
+	testCases := []struct {
+		name         string
+		ctx          context.Context
+		nodeMetadata *metadata.MapEntryMetadata
+		mode         uint32
+		expected     uint32
+	}{
+		{
+			name:         "Group member keeps setgid",
+			ctx:          fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 2000}, Pid: 123}),
+			nodeMetadata: &metadata.MapEntryMetadata{Uid: 1000, Gid: 2000},
+			mode:         syscall.S_ISGID | 0755,
+			expected:     syscall.S_ISGID | 0755,
+		},
+		{
+			name:         "Non-member loses setgid",
+			ctx:          fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123}),
+			nodeMetadata: &metadata.MapEntryMetadata{Uid: 1000, Gid: 2000},
+			mode:         syscall.S_ISGID | 0755,
+			expected:     0755,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SysAdmin = Sysadmin{UID: 1320, GID: 1320, Set: true}
+			result := SanitiseSetgid(tc.ctx, tc.nodeMetadata, tc.mode)
+			if result != tc.expected {
+				t.Errorf("Expected %o, got %o", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestParseProcStatusGroups(t *testing.T) {
+	status := []string{
+		"Name:\tcat",
+		"Uid:\t1000\t1000\t1000\t1000",
+		"Gid:\t1000\t1000\t1000\t1000",
+		"Groups:\t4 24 1000 2000 ",
+	}
+
+	testCases := []struct {
+		name          string
+		lines         []string
+		uid           uint32
+		gid           uint32
+		expected      []uint32
+		expectedFound bool
+	}{
+		{
+			name:          "Matching credentials",
+			lines:         status,
+			uid:           1000,
+			gid:           1000,
+			expected:      []uint32{1000, 4, 24, 2000},
+			expectedFound: true,
+		},
+		{
+			name:          "Mismatched UID",
+			lines:         status,
+			uid:           1001,
+			gid:           1000,
+			expected:      nil,
+			expectedFound: false,
+		},
+		{
+			name:          "Mismatched GID",
+			lines:         status,
+			uid:           1000,
+			gid:           1001,
+			expected:      nil,
+			expectedFound: false,
+		},
+		{
+			name:          "No supplementary groups",
+			lines:         []string{"Uid:\t0\t0\t0\t0", "Gid:\t0\t0\t0\t0", "Groups:\t"},
+			uid:           0,
+			gid:           0,
+			expected:      []uint32{0},
+			expectedFound: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, found := parseProcStatusGroups(tc.lines, tc.uid, tc.gid)
+			if found != tc.expectedFound || !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %v (%v), got %v (%v)", tc.expected, tc.expectedFound, result, found)
+			}
+		})
+	}
+}
+
+func TestSupplementaryGroups(t *testing.T) {
+	testCases := []struct {
+		name         string
+		gids         []uint32
+		nodeMetadata *metadata.MapEntryMetadata
+		expected     bool
+	}{
+		{
+			name:         "Primary group grants access",
+			gids:         []uint32{2000, 3000},
+			nodeMetadata: &metadata.MapEntryMetadata{Uid: 1, Gid: 2000, Mode: 0040},
+			expected:     true,
+		},
+		{
+			name:         "Supplementary group grants access",
+			gids:         []uint32{2000, 3000},
+			nodeMetadata: &metadata.MapEntryMetadata{Uid: 1, Gid: 3000, Mode: 0040},
+			expected:     true,
+		},
+		{
+			name:         "Supplementary group denies access",
+			gids:         []uint32{2000, 3000},
+			nodeMetadata: &metadata.MapEntryMetadata{Uid: 1, Gid: 3000, Mode: 0004},
+			expected:     false,
+		},
+		{
+			name:         "Not in any group",
+			gids:         []uint32{2000, 3000},
+			nodeMetadata: &metadata.MapEntryMetadata{Uid: 1, Gid: 4000, Mode: 0040},
+			expected:     false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := readCheck(1000, tc.gids, tc.nodeMetadata)
+			if result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestGroupCache(t *testing.T) {
+	InvalidateGroupCache()
+
+	// Pretend a previous lookup resolved a supplementary group for this caller
+	key := groupCacheKey{pid: 123, uid: 1000, gid: 1000}
+	groupCache[key] = &groupCacheEntry{groups: []uint32{1000, 5000}, expires: time.Now().Add(time.Minute)}
+
+	ctx := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123})
+	_, gids := GetCallerGroups(ctx)
+	if !inGroups(gids, 5000) {
+		t.Errorf("Expected cached groups to include 5000, got %v", gids)
+	}
+
+	// Once invalidated, the groups are resolved again
+	InvalidateGroupCache()
+	_, gids = GetCallerGroups(ctx)
+	if inGroups(gids, 5000) {
+		t.Errorf("Expected invalidated groups not to include 5000, got %v", gids)
+	}
+	if !inGroups(gids, 1000) {
+		t.Errorf("Expected primary group 1000 in %v", gids)
+	}
+
+	// Expired group lists are removed when other callers are resolved
+	stale := groupCacheKey{pid: 456, uid: 1001, gid: 1001}
+	groupCache[stale] = &groupCacheEntry{groups: []uint32{1001}, expires: time.Now().Add(-time.Minute)}
+	groupCachePruned = time.Time{}
+	resolveGroups(789, 1002, 1002)
+	if _, ok := groupCache[stale]; ok {
+		t.Errorf("Expected the expired group list to be removed")
+	}
+	if _, ok := groupCache[groupCacheKey{pid: 789, uid: 1002, gid: 1002}]; !ok {
+		t.Errorf("Expected the new group list to be cached")
+	}
+}
+
+func TestCheckXAttrAccess(t *testing.T) {
+	user := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123})
+	admin := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1320, Gid: 1320}, Pid: 123})
+	file := &metadata.MapEntryMetadata{Uid: 1000, Gid: 1000, Mode: syscall.S_IFREG | 0444}
+	symlink := &metadata.MapEntryMetadata{Uid: 1000, Gid: 1000, Mode: syscall.S_IFLNK | 0777}
+
+	testCases := []struct {
+		name         string
+		ctx          context.Context
+		nodeMetadata *metadata.MapEntryMetadata
+		attr         string
+		write        bool
+		expected     syscall.Errno
+	}{
+		{"Read user attribute", user, file, "user.foo", false, fs.OK},
+		{"Write user attribute without write permission", user, file, "user.foo", true, syscall.EACCES},
+		{"Write user attribute on symlink", user, symlink, "user.foo", true, syscall.EPERM},
+		{"Read trusted attribute as user", user, file, "trusted.foo", false, syscall.ENODATA},
+		{"Write trusted attribute as user", user, file, "trusted.foo", true, syscall.EPERM},
+		{"Write trusted attribute as sysadmin", admin, file, "trusted.foo", true, fs.OK},
+		{"Read security attribute as user", user, file, "security.foo", false, fs.OK},
+		{"Write security attribute as user", user, file, "security.foo", true, syscall.EPERM},
+		{"Read ACL", user, file, ACLAccessXAttr, false, fs.OK},
+		{"Unknown system attribute", admin, file, "system.foo", false, syscall.EOPNOTSUPP},
+		{"Unknown namespace", admin, file, "foo", true, syscall.EOPNOTSUPP},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SysAdmin = Sysadmin{UID: 1320, GID: 1320, Set: true}
+			result := CheckXAttrAccess(tc.ctx, tc.nodeMetadata, tc.attr, tc.write)
+			if result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	SysAdmin = Sysadmin{UID: 1320, GID: 1320, Set: true}
+	SetRootPath("/under")
+	defer func() {
+		grants = nil
+		SetRootPath("")
+	}()
+
+	caller := func(uid uint32) context.Context {
+		return fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: uid}, Pid: 123})
+	}
+	grantFor := func(principal string, role Role, path string) Grant {
+		p, err := ParsePrincipal(principal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Grant{Principal: p, Role: role, Path: path}
+	}
+
+	for _, g := range []Grant{
+		grantFor("uid:2000", RoleAdmin, ""),
+		grantFor("uid:2001", RoleAuditor, ""),
+		grantFor("gid:2002", RoleSubtreeOwner, "/projects/x/"),
+	} {
+		if err := AddGrant(g); err != nil {
+			t.Fatalf("Couldn't grant {%v}: %v", g, err)
+		}
+	}
+	if err := AddGrant(grantFor("uid:2000", RoleAdmin, "")); err == nil {
+		t.Errorf("Expected a duplicate grant to fail")
+	}
+	if err := AddGrant(grantFor("uid:2000", RoleSubtreeOwner, "/")); err == nil {
+		t.Errorf("Expected the root to be refused as a subtree")
+	}
+
+	node := &metadata.MapEntryMetadata{Path: "/under/projects/x/file", Uid: 1000, Gid: 1000, Mode: syscall.S_IFREG | 0600}
+	other := &metadata.MapEntryMetadata{Path: "/under/projects/xy/file", Uid: 1000, Gid: 1000, Mode: syscall.S_IFREG | 0600}
+
+	testCases := []struct {
+		name     string
+		uid      uint32
+		node     *metadata.MapEntryMetadata
+		op       uint8
+		expected bool
+	}{
+		{"admin writes", 2000, node, 1, true},
+		{"auditor reads", 2001, node, 0, true},
+		{"auditor can't write", 2001, node, 1, false},
+		{"auditor can't execute", 2001, node, 2, false},
+		{"subtree owner writes", 2002, node, 1, true},
+		{"subtree owner outside the subtree", 2002, other, 1, false},
+		{"nobody", 3000, node, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if allowed := CheckPermissions(caller(tc.uid), tc.node, tc.op); allowed != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, allowed)
+			}
+		})
+	}
+
+	if !IsSysadminCredentials(0, 2000, 2000) || IsSysadminCredentials(0, 2001, 2001) {
+		t.Errorf("Expected only the admin to use the control socket")
+	}
+	if !HasRole(caller(2000), RoleQuotaAdmin) || HasRole(caller(2001), RoleQuotaAdmin) {
+		t.Errorf("Expected admins to have every role, and auditors only their own")
+	}
+
+	// the grants survive a save
+	dir := t.TempDir()
+	if err := SaveRoles(dir); err != nil {
+		t.Fatal(err)
+	}
+	saved := Grants()
+	if err := RemoveGrant(grantFor("uid:2001", RoleAuditor, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := RetrieveRoles(dir); err != nil || !reflect.DeepEqual(Grants(), saved) {
+		t.Errorf("Expected %v to be retrieved, got %v, %v", saved, Grants(), err)
+	}
+}
+
+// Unit test for auditing CheckPermissions, CheckOpenPermissions, CheckHandlePermissions and CheckMask in audit.go
+func TestAuditPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Configure(audit.Options{File: path, DataPaths: []string{"/secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	SysAdmin = Sysadmin{UID: 1320, GID: 1320, Set: true}
+
+	user := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}, Pid: 123})
+	sysadmin := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1320, Gid: 1320}, Pid: 456})
+	private := &metadata.MapEntryMetadata{Path: "/private", Uid: 1000, Gid: 1000, Mode: 0600}
+	secret := &metadata.MapEntryMetadata{Path: "/secret/file", Uid: 1000, Gid: 1000, Mode: 0600}
+
+	CheckPermissions(user, private, 0)                        // allowed, not recorded
+	CheckPermissions(user, private, 2)                        // denied
+	CheckPermissions(sysadmin, private, 0)                    // bypassed
+	CheckPermissions(user, secret, 0)                         // allowed, recorded as it's under a data path
+	CheckMask(user, 1, private)                               // denied
+	CheckOpenPermissions(sysadmin, private, syscall.O_WRONLY) // bypassed, opening is audited for the sysadmin too
+	CheckHandlePermissions(user, secret, 0)                   // allowed, but already recorded when it was opened
+	CheckHandlePermissions(user, private, 2)                  // denied
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outcomes []string
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var e audit.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		outcomes = append(outcomes, fmt.Sprintf("%v %v %v %v", e.UID, e.Op, e.Path, e.Outcome))
+	}
+	expected := []string{
+		"1000 execute /private denied",
+		"1320 read /private bypassed",
+		"1000 read /secret/file allowed",
+		"1000 access /private denied",
+		"1320 write /private bypassed",
+		"1000 execute /private denied",
+	}
+	if !reflect.DeepEqual(outcomes, expected) {
+		t.Errorf("Expected %v, got %v", expected, outcomes)
+	}
+}
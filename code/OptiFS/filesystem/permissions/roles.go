@@ -0,0 +1,290 @@
+package permissions
+
+import (
+	"context"
+	"encoding/gob"
+	"filesystem/metadata"
+	"filesystem/persist"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Role is what a grant lets a principal do, on top of their normal permissions
+type Role string
+
+const (
+	RoleAdmin        Role = "admin"         // everything the sysadmin can do
+	RoleQuotaAdmin   Role = "quota-admin"   // see everyone's usage and manage quotas
+	RoleAuditor      Role = "auditor"       // read (but not change) anything
+	RoleSubtreeOwner Role = "subtree-owner" // everything the sysadmin can do, but only under a directory
+)
+
+// Checks the name of a role
+func ParseRole(name string) (Role, error) {
+	switch role := Role(name); role {
+	case RoleAdmin, RoleQuotaAdmin, RoleAuditor, RoleSubtreeOwner:
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role {%v}, must be admin, quota-admin, auditor or subtree-owner", name)
+}
+
+// Principal is who a grant is for, a user or everyone in a group
+type Principal struct {
+	IsGroup bool
+	ID      uint32
+}
+
+// Parses a principal written as uid:<id> or gid:<id>
+func ParsePrincipal(s string) (Principal, error) {
+	kind, id, found := strings.Cut(s, ":")
+	if !found || (kind != "uid" && kind != "gid") {
+		return Principal{}, fmt.Errorf("principal must be uid:<id> or gid:<id>, not {%v}", s)
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid id in principal {%v}", s)
+	}
+	return Principal{IsGroup: kind == "gid", ID: uint32(n)}, nil
+}
+
+func (p Principal) String() string {
+	if p.IsGroup {
+		return fmt.Sprintf("gid:%d", p.ID)
+	}
+	return fmt.Sprintf("uid:%d", p.ID)
+}
+
+// Checks if a caller, with their uid and every group they're in, is the principal
+func (p Principal) matches(uid uint32, gids []uint32) bool {
+	if p.IsGroup {
+		return inGroups(gids, p.ID)
+	}
+	return uid == p.ID
+}
+
+// Grant gives a principal a role. Subtree owners also have the directory (relative to the
+// root of the filesystem, e.g. "/projects/x") they own.
+type Grant struct {
+	Principal Principal
+	Role      Role
+	Path      string
+}
+
+func (g Grant) String() string {
+	if g.Role == RoleSubtreeOwner {
+		return fmt.Sprintf("%v %v %v", g.Principal, g.Role, g.Path)
+	}
+	return fmt.Sprintf("%v %v", g.Principal, g.Role)
+}
+
+// Every grant, on top of the sysadmin
+var grants []Grant
+var grantsMutex sync.RWMutex
+
+// The root of the underlying filesystem, subtree paths are relative to it
+var rootPath string
+
+// Sets the root of the underlying filesystem, so subtrees can be matched against the paths of nodes
+func SetRootPath(path string) {
+	grantsMutex.Lock()
+	defer grantsMutex.Unlock()
+
+	rootPath = path
+}
+
+// Checks a grant makes sense, cleaning its path
+func (g *Grant) validate() error {
+	if g.Role != RoleSubtreeOwner {
+		if g.Path != "" {
+			return fmt.Errorf("only subtree owners have a path")
+		}
+		return nil
+	}
+
+	if !strings.HasPrefix(g.Path, "/") {
+		return fmt.Errorf("subtree path must start with /, not {%v}", g.Path)
+	}
+	g.Path = filepath.Clean(g.Path)
+	if g.Path == "/" {
+		return fmt.Errorf("the whole filesystem can't be a subtree, grant the admin role instead")
+	}
+	return nil
+}
+
+// Adds a grant, it takes effect straight away
+func AddGrant(g Grant) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+
+	grantsMutex.Lock()
+	defer grantsMutex.Unlock()
+
+	for _, existing := range grants {
+		if existing == g {
+			return fmt.Errorf("{%v} is already granted", g)
+		}
+	}
+	logger.Info("Granting role", "grant", g)
+	grants = append(grants, g)
+	return nil
+}
+
+// Removes a grant, it takes effect straight away
+func RemoveGrant(g Grant) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+
+	grantsMutex.Lock()
+	defer grantsMutex.Unlock()
+
+	for i, existing := range grants {
+		if existing == g {
+			logger.Info("Revoking role", "grant", g)
+			grants = append(grants[:i], grants[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("{%v} isn't granted", g)
+}
+
+// Gets every grant, sorted
+func Grants() []Grant {
+	grantsMutex.RLock()
+	defer grantsMutex.RUnlock()
+
+	sorted := append([]Grant(nil), grants...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].String() < sorted[j].String() })
+	return sorted
+}
+
+// save the grants alongside the sysadmin details
+func SaveRoles(dest string) error {
+	grantsMutex.RLock()
+	defer grantsMutex.RUnlock()
+
+	logger.Debug("Saving roles")
+
+	// replace the save atomically, so a crash or an encoding error doesn't lose every grant
+	if err := persist.SaveGob(dest, "OptiFSRolesSave.gob", grants); err != nil {
+		logger.Error("Couldn't save roles.", "err", err)
+		return err
+	}
+
+	logger.Debug("Succesfully saved roles.")
+	return nil
+}
+
+// retrieve the grants when the system boots up, or the configuration is reloaded
+func RetrieveRoles(dest string) error {
+	logger.Debug("Retrieving roles")
+
+	file, err := os.Open(dest + "/OptiFSRolesSave.gob")
+	if err != nil {
+		logger.Debug("Couldn't open save file.")
+		return err
+	}
+	defer file.Close()
+
+	var retrieved []Grant
+	if err := gob.NewDecoder(file).Decode(&retrieved); err != nil {
+		logger.Error("Couldn't decode roles.")
+		return err
+	}
+
+	grantsMutex.Lock()
+	grants = retrieved
+	grantsMutex.Unlock()
+
+	logger.Debug("Succesfully retrieved roles.")
+	return nil
+}
+
+// Checks if a caller has been granted 'role'. For subtree owners, 'path' (on the underlying
+// filesystem) must be in the subtree.
+func isGranted(uid uint32, gids []uint32, role Role, path string) bool {
+	grantsMutex.RLock()
+	defer grantsMutex.RUnlock()
+
+	for _, g := range grants {
+		if g.Role != role || !g.Principal.matches(uid, gids) {
+			continue
+		}
+		if role != RoleSubtreeOwner {
+			return true
+		}
+		subtree := filepath.Join(rootPath, g.Path)
+		if path == subtree || strings.HasPrefix(path, subtree+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the caller has 'role', the sysadmin (and admins) have every role
+func HasRole(ctx context.Context, role Role) bool {
+	if IsUserSysadmin(&ctx) {
+		return true
+	}
+
+	err, uid, _ := GetUIDGID(ctx)
+	if err != fs.OK {
+		return false
+	}
+	_, gids := GetCallerGroups(ctx)
+	return isGranted(uid, gids, role, "")
+}
+
+// Checks if the credentials of a process (e.g. a peer of the control socket) have 'role', the sysadmin
+// (and admins) have every role
+func HasRoleCredentials(pid uint32, uid uint32, gid uint32, role Role) bool {
+	gids := resolveGroups(pid, uid, gid)
+	return isSysadminID(uid, gids) || isGranted(uid, gids, role, "")
+}
+
+// Checks if the caller can do anything with the node at 'path' (on the underlying filesystem),
+// as the sysadmin, an admin or the owner of a subtree it's in
+func IsUserAdminOf(ctx context.Context, path string) bool {
+	if IsUserSysadmin(&ctx) {
+		return true
+	}
+	return ownsSubtree(ctx, path)
+}
+
+// Checks if the caller owns a subtree that 'path' (on the underlying filesystem) is in
+func ownsSubtree(ctx context.Context, path string) bool {
+	err, uid, _ := GetUIDGID(ctx)
+	if err != fs.OK {
+		return false
+	}
+	_, gids := GetCallerGroups(ctx)
+	return isGranted(uid, gids, RoleSubtreeOwner, path)
+}
+
+// Checks if a delegated role lets the caller past the permission checks of a node:
+// subtree owners can do anything under their subtree, auditors can read anything (but not write or execute it)
+func hasDelegatedAccess(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, readOnly bool) bool {
+	err, uid, _ := GetUIDGID(ctx)
+	if err != fs.OK {
+		return false
+	}
+	_, gids := GetCallerGroups(ctx)
+
+	if isGranted(uid, gids, RoleSubtreeOwner, nodeMetadata.Path) {
+		logger.Debug("User owns the subtree.")
+		return true
+	}
+	if readOnly && isGranted(uid, gids, RoleAuditor, "") {
+		logger.Debug("User is an auditor.")
+		return true
+	}
+	return false
+}
@@ -3,10 +3,12 @@ package permissions
 import (
 	"context"
 	"encoding/gob"
+	"filesystem/persist"
 	"log"
 	"os"
 	"os/user"
 	"strconv"
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -19,31 +21,43 @@ type Sysadmin struct {
 }
 
 var SysAdmin Sysadmin
+var sysadminMutex sync.RWMutex // the control socket can change the sysadmin while permissions are checked
 
-// save the sysadmin details when the system shuts down
-func SaveSysadmin(dest string) error {
-	// create the file if it doesn't exist, truncate it if it does
-	// we assume nobody will be calling this file, as it is a very unique name
-	log.Println("Saving sysadmin info")
+// Gets a copy of the sysadmin details, safe to use while they're being changed
+func GetSysadmin() Sysadmin {
+	sysadminMutex.RLock()
+	defer sysadminMutex.RUnlock()
 
-	file, err := os.Create(dest + "/OptiFSSysadminSave.gob")
+	return SysAdmin
+}
 
-	if err != nil {
-		log.Println("Couldn't create save file.")
-		return err
-	}
+// Replaces the sysadmin details, returning the ones they replaced
+func ReplaceSysadmin(details Sysadmin) Sysadmin {
+	sysadminMutex.Lock()
+	defer sysadminMutex.Unlock()
+
+	previous := SysAdmin
+	SysAdmin = details
+	return previous
+}
 
-	defer file.Close() // don't let the file close
+// Checks if the user 'uid', in the groups 'gids', is the sysadmin, in the sysadmin group or an admin
+func isSysadminID(uid uint32, gids []uint32) bool {
+	current := GetSysadmin()
+	return uid == current.UID || inGroups(gids, current.GID) || isGranted(uid, gids, RoleAdmin, "")
+}
 
-	encode := gob.NewEncoder(file)  // set the file that we created to the encoder
-	eErr := encode.Encode(SysAdmin) // encode the hashmap into binary, put it in the file
+// save the sysadmin details when the system shuts down
+func SaveSysadmin(dest string) error {
+	logger.Debug("Saving sysadmin info")
 
-	if eErr != nil {
-		log.Println("Couldn't encode sysadmin info.")
-		return eErr
+	// replace the save atomically, so a crash or an encoding error leaves the previous one as it was
+	if err := persist.SaveGob(dest, "OptiFSSysadminSave.gob", GetSysadmin()); err != nil {
+		logger.Error("Couldn't save sysadmin info.", "err", err)
+		return err
 	}
 
-	log.Println("Succesfully saved sysadmin info.")
+	logger.Debug("Succesfully saved sysadmin info.")
 
 	return nil
 }
@@ -51,76 +65,85 @@ func SaveSysadmin(dest string) error {
 // retrieve the sysadmin details when the system boots up
 func RetrieveSysadmin(dest string) error {
 
-	log.Println("Retrieving sysadmin info")
+	logger.Debug("Retrieving sysadmin info")
 
 	file, err := os.Open(dest + "/OptiFSSysadminSave.gob") // open where the info was encoded
 
 	if err != nil {
-		log.Println("Couldn't open save file.")
+		logger.Debug("Couldn't open save file.")
 		return err
 	}
 
 	defer file.Close() // don't let file close
 
-	decode := gob.NewDecoder(file)   // set the file that we opened to the decoder
-	dErr := decode.Decode(&SysAdmin) // decode the file back into the struct
+	var retrieved Sysadmin
+	decode := gob.NewDecoder(file)    // set the file that we opened to the decoder
+	dErr := decode.Decode(&retrieved) // decode the file back into the struct
 
 	if dErr != nil {
-		log.Println("Couldn't decode sysadmin info.")
+		logger.Error("Couldn't decode sysadmin info.")
 		return dErr
 	}
+	sysadminMutex.Lock()
+	SysAdmin = retrieved
+	sysadminMutex.Unlock()
 
-	log.Println("Succesfully retrieved sysadmin info.")
+	logger.Debug("Succesfully retrieved sysadmin info.")
 
 	return nil
 }
 
 // print the current sysadmin
 func PrintSysadminInfo() {
-	log.Printf("Current SysAdmin: %+v\n", SysAdmin)
+	current := GetSysadmin()
+	logger.Info("Current SysAdmin", "uid", current.UID, "gid", current.GID)
 }
 
 // get the UID and GID of the sysadmin that runs the filesystem
 // this is saved (persisent), so we only need to get it once
 func SetSysadmin() syscall.Errno {
-	log.Println("NO SYSADMIN SET - Setting user as sysadmin.")
+	logger.Debug("NO SYSADMIN SET - Setting user as sysadmin.")
 
 	sysadmin, sErr := user.Current() // get the current user
 	if sErr != nil {
-		log.Printf("Couldn't get sysadmin info!: %v\n", sErr)
+		logger.Error("Couldn't get sysadmin info!", "err", sErr)
 		return fs.ToErrno(sErr)
 	}
 
 	u, uidConversionErr := strconv.Atoi(sysadmin.Uid) // get the UID
 	if uidConversionErr != nil {
-		log.Printf("Couldn't get sysadmin UID: %v\n", uidConversionErr)
+		logger.Error("Couldn't get sysadmin UID", "err", uidConversionErr)
 		return fs.ToErrno(uidConversionErr)
 	}
 
 	g, gidConversionErr := strconv.Atoi(sysadmin.Gid) // get the GID
 	if gidConversionErr != nil {
-		log.Printf("Couldn't get sysadmin GID: %v\n", gidConversionErr)
+		logger.Error("Couldn't get sysadmin GID", "err", gidConversionErr)
 		return fs.ToErrno(gidConversionErr)
 	}
 
 	// fill in sysadmin details
+	sysadminMutex.Lock()
 	SysAdmin.UID = uint32(u)
 	SysAdmin.GID = uint32(g)
 	SysAdmin.Set = true
+	sysadminMutex.Unlock()
 
 	return fs.OK
 }
 
-// checks if the user is the sysadmin of the system, or is in the same sysadmin group
+// checks if the user is the sysadmin of the system, is in the same sysadmin group, or has been granted the admin role
 func IsUserSysadmin(ctx *context.Context) bool {
 
 	// if we have a context to get it from
 	if ctx != nil {
-		ctxErr, uid, gid := GetUIDGID(*ctx)
+		ctxErr, uid, _ := GetUIDGID(*ctx)
 		if ctxErr != fs.OK {
 			log.Fatalf("Couldn't get sysadmin UID from context!: %v\n", ctxErr)
 		}
-		if uid == SysAdmin.UID || gid == SysAdmin.GID {
+		// the sysadmin group counts whether it is the caller's primary or a supplementary group
+		_, gids := GetCallerGroups(*ctx)
+		if isSysadminID(uid, gids) {
 			return true
 		}
 	} else {
@@ -142,8 +165,9 @@ func IsUserSysadmin(ctx *context.Context) bool {
 			log.Fatalf("Couldn't get sysadmin GID!: %v\n", gidConversionErr)
 		}
 
-		// if they have the same UID or are in the same group (sysadmin group)
-		if uint32(userUID) == SysAdmin.UID || uint32(userGID) == SysAdmin.GID {
+		// if they have the same UID or are in the same group (sysadmin group), or have been made an admin
+		userGIDs := userDatabaseGroups(uint32(userUID), uint32(userGID))
+		if isSysadminID(uint32(userUID), userGIDs) {
 			return true
 		}
 
@@ -153,6 +177,13 @@ func IsUserSysadmin(ctx *context.Context) bool {
 	return false
 }
 
+// checks if the credentials of a process (e.g. a peer of the control socket) belong to the sysadmin,
+// someone in the sysadmin group or an admin
+func IsSysadminCredentials(pid uint32, uid uint32, gid uint32) bool {
+	gids := resolveGroups(pid, uid, gid)
+	return isSysadminID(uid, gids)
+}
+
 // checker function, if the UID is valid returns true, else false
 func ValidUID(uid string) bool {
 	_, err := user.LookupId(uid)
@@ -169,17 +200,19 @@ func ValidGID(gid string) bool {
 // it is checked before this function is called that the person calling it is a current sysadmin
 func ChangeSysadminUID(uid string) syscall.Errno {
 	if !ValidUID(uid) {
-        log.Printf("UID does not exist on system: {%v}\n", uid)
+        logger.Warn("UID does not exist on system", "uid", uid)
 		return fs.ToErrno(syscall.ENOENT)
 	}
 
 	// extract userID
 	newUid, conversionErr := strconv.Atoi(uid)
 	if conversionErr != nil {
-		log.Printf("Invalid UID provided: {%v}\n", conversionErr)
+		logger.Warn("Invalid UID provided", "err", conversionErr)
 		return fs.ToErrno(syscall.ENOENT)
 	}
+	sysadminMutex.Lock()
 	SysAdmin.UID = uint32(newUid) // set new UID
+	sysadminMutex.Unlock()
 
 	return fs.OK
 
@@ -188,18 +221,20 @@ func ChangeSysadminUID(uid string) syscall.Errno {
 // change the group of the sysadmin (if specified)
 // it is checked before this function is called that the person calling it is a current sysadmin
 func ChangeSysadminGID(gid string) syscall.Errno {
-	if !ValidUID(gid) {
-		log.Printf("GID does not exist on system: {%v}\n", gid)
+	if !ValidGID(gid) {
+		logger.Warn("GID does not exist on system", "gid", gid)
 		return fs.ToErrno(syscall.ENOENT)
 	}
 
 	// extract GID
 	newGid, conversionErr := strconv.Atoi(gid)
 	if conversionErr != nil {
-		log.Printf("Invalid GID provided: {%v}\n", conversionErr)
+		logger.Warn("Invalid GID provided", "err", conversionErr)
 		return fs.ToErrno(syscall.ENOENT)
 	}
+	sysadminMutex.Lock()
 	SysAdmin.GID = uint32(newGid) // set new GID
+	sysadminMutex.Unlock()
 
 	return fs.OK
 
@@ -0,0 +1,89 @@
+// This file contains the routing of extended attributes by namespace for the permissions module
+
+package permissions
+
+import (
+	"context"
+	"filesystem/metadata"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Extended attribute namespaces, as the prefix of the attribute's name
+const (
+	XAttrUserNamespace     = "user."
+	XAttrTrustedNamespace  = "trusted."
+	XAttrSecurityNamespace = "security."
+	XAttrSystemNamespace   = "system."
+)
+
+// Checks whether the caller may read (write = false) or set/remove (write = true) the extended
+// attribute 'attr' of a node. ACLs (system.posix_acl_*) are handled by SetACL/RemoveACL instead.
+//
+// user.*     - virtual, follows the permission bits/ACL of the node, only on regular files and directories
+// trusted.*  - virtual, only visible to and modifiable by the sysadmin
+// security.* - virtual, readable by anyone but only modifiable by the sysadmin
+// system.*   - only the POSIX ACLs are understood
+//
+// trusted.* and security.* aren't passed through to the underlying node, as deduplicated files
+// share their underlying node - they would then share these attributes as well.
+func CheckXAttrAccess(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, attr string, write bool) syscall.Errno {
+	switch {
+	case strings.HasPrefix(attr, XAttrUserNamespace):
+		if nodeMetadata == nil {
+			return fs.OK
+		}
+		fileType := nodeMetadata.Mode & syscall.S_IFMT
+		if fileType != syscall.S_IFREG && fileType != syscall.S_IFDIR {
+			logger.Debug("user.* attributes only exist on regular files and directories.")
+			if write {
+				return fs.ToErrno(syscall.EPERM)
+			}
+			return fs.ToErrno(syscall.ENODATA)
+		}
+		if write {
+			if !CheckPermissions(ctx, nodeMetadata, 1) {
+				return fs.ToErrno(syscall.EACCES)
+			}
+		} else if !CheckPermissions(ctx, nodeMetadata, 0) {
+			return fs.ToErrno(syscall.EACCES)
+		}
+		return fs.OK
+
+	case strings.HasPrefix(attr, XAttrTrustedNamespace):
+		if !IsUserSysadmin(&ctx) {
+			logger.Debug("trusted.* attributes are reserved for the sysadmin.")
+			// Hide their existence from anyone else, the same as the kernel does
+			if write {
+				return fs.ToErrno(syscall.EPERM)
+			}
+			return fs.ToErrno(syscall.ENODATA)
+		}
+		return fs.OK
+
+	case strings.HasPrefix(attr, XAttrSecurityNamespace):
+		if write && !IsUserSysadmin(&ctx) {
+			logger.Debug("security.* attributes can only be changed by the sysadmin.")
+			return fs.ToErrno(syscall.EPERM)
+		}
+		return fs.OK
+
+	case IsACLXAttr(attr):
+		// Anyone can read an ACL, the same as the mode
+		return fs.OK
+	}
+
+	// Any other system.* attribute, or an attribute without a known namespace
+	logger.Debug("Unsupported extended attribute namespace", "attr", attr)
+	return fs.ToErrno(syscall.EOPNOTSUPP)
+}
+
+// Checks whether an extended attribute should appear when the caller lists the attributes of a node
+func IsXAttrVisible(ctx context.Context, attr string) bool {
+	if strings.HasPrefix(attr, XAttrTrustedNamespace) {
+		return IsUserSysadmin(&ctx)
+	}
+	return true
+}
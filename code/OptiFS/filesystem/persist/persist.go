@@ -0,0 +1,49 @@
+// Package persist has what the stores kept in the save location (snapshots, versions, the trash,
+// quotas, roles and the sysadmin) share: naming nodes relative to the root of the filesystem, and
+// saving state atomically.
+
+package persist
+
+import (
+	"encoding/gob"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Gets the path of 'nodePath' (on the underlying filesystem) relative to the root of the filesystem
+// at 'root', e.g. "/projects/x". Paths that aren't under the root are returned as they are.
+func RelativePath(root string, nodePath string) string {
+	if root == "" {
+		return nodePath
+	}
+	rel, err := filepath.Rel(root, nodePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nodePath // e.g. a sibling of the root, /data2 next to /data
+	}
+	return path.Clean("/" + rel)
+}
+
+// Encodes 'value' with gob into 'name' in 'dir', replacing it atomically, so a crash while saving
+// leaves the previous save as it was
+func SaveGob(dir string, name string, value any) error {
+	file, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := gob.NewEncoder(file).Encode(value); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(dir, name))
+}
@@ -0,0 +1,70 @@
+package persist
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Unit test for RelativePath in persist.go
+func TestRelativePath(t *testing.T) {
+	testCases := []struct {
+		name     string
+		root     string
+		nodePath string
+		expected string
+	}{
+		{"root", "/data", "/data", "/"},
+		{"under the root", "/data", "/data/projects/x", "/projects/x"},
+		{"sibling of the root", "/data", "/data2/x", "/data2/x"},
+		{"outside the root", "/data", "/other", "/other"},
+		{"no root", "", "/data/x", "/data/x"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if rel := RelativePath(tc.root, tc.nodePath); rel != tc.expected {
+				t.Errorf("Expected {%v}, got {%v}", tc.expected, rel)
+			}
+		})
+	}
+}
+
+// Unit test for SaveGob in persist.go
+func TestSaveGob(t *testing.T) {
+	dir := t.TempDir()
+	saved := map[string]int{"a": 1, "b": 2}
+	if err := SaveGob(dir, "save.gob", saved); err != nil {
+		t.Fatal(err)
+	}
+	// saving again replaces it
+	saved["c"] = 3
+	if err := SaveGob(dir, "save.gob", saved); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "save.gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var retrieved map[string]int
+	if err := gob.NewDecoder(file).Decode(&retrieved); err != nil || !reflect.DeepEqual(retrieved, saved) {
+		t.Errorf("Expected %v, got %v (%v)", saved, retrieved, err)
+	}
+
+	// nothing else is left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the save, got %v", entries)
+	}
+
+	// a value gob can't encode leaves the save as it was
+	if err := SaveGob(dir, "save.gob", func() {}); err == nil {
+		t.Errorf("Expected an error encoding a func")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the save, got %v", entries)
+	}
+}
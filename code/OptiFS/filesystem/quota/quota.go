@@ -0,0 +1,434 @@
+// Package quota limits how much each user and group can own, and how much each project (a directory
+// and everything under it) can hold: how many inodes, how many logical bytes, and how many physical
+// bytes, with shared content charged the way the metadata module is set to.
+// Every limit has a hard limit that can never be passed, and a soft limit that can be passed for a
+// grace period, after which nothing more can be allocated until usage is back under it.
+
+package quota
+
+import (
+	"encoding/gob"
+	"errors"
+	"filesystem/logging"
+	"filesystem/metadata"
+	"filesystem/metrics"
+	"filesystem/persist"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var logger = logging.For(logging.Quota)
+
+// Operations refused because they would have gone over a quota, by the kind of owner whose quota it was
+var denials = metrics.NewCounter("optifs_quota_denials", "Operations refused with EDQUOT because they would go over a quota.", "kind")
+
+// Kind is what sort of owner a quota is for
+type Kind int
+
+const (
+	User Kind = iota
+	Group
+	Project // a directory and everything under it, whoever owns what's in it
+)
+
+// Owner is who (or what) a quota is for, a user, a group or a project
+type Owner struct {
+	Kind Kind
+	ID   uint32
+}
+
+// Parses an owner written as uid:<id> or gid:<id>, the same as the principals of roles, or project:<id>
+func ParseOwner(s string) (Owner, error) {
+	kind, id, found := strings.Cut(s, ":")
+	if !found || (kind != "uid" && kind != "gid" && kind != "project") {
+		return Owner{}, fmt.Errorf("owner must be uid:<id>, gid:<id> or project:<id>, not {%v}", s)
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil || (kind == "project" && n == 0) {
+		return Owner{}, fmt.Errorf("invalid id in owner {%v}", s)
+	}
+	switch kind {
+	case "gid":
+		return Owner{Kind: Group, ID: uint32(n)}, nil
+	case "project":
+		return Owner{Kind: Project, ID: uint32(n)}, nil
+	}
+	return Owner{Kind: User, ID: uint32(n)}, nil
+}
+
+func (o Owner) String() string {
+	switch o.Kind {
+	case Group:
+		return fmt.Sprintf("gid:%d", o.ID)
+	case Project:
+		return fmt.Sprintf("project:%d", o.ID)
+	}
+	return fmt.Sprintf("uid:%d", o.ID)
+}
+
+// Resource is what a limit limits
+type Resource int
+
+const (
+	Inodes   Resource = iota // files and directories
+	Logical                  // bytes, as the owner sees them
+	Physical                 // bytes of content the owner is charged for
+)
+
+// Every resource, in the order they're listed
+var Resources = []Resource{Inodes, Logical, Physical}
+
+// Parses the name of a resource
+func ParseResource(name string) (Resource, error) {
+	for _, r := range Resources {
+		if r.String() == name {
+			return r, nil
+		}
+	}
+	return Inodes, fmt.Errorf("unknown resource {%v}, must be inodes, logical or physical", name)
+}
+
+func (r Resource) String() string {
+	switch r {
+	case Logical:
+		return "logical"
+	case Physical:
+		return "physical"
+	}
+	return "inodes"
+}
+
+// How much of a resource 'usage' is
+func (r Resource) of(usage metadata.Usage) int64 {
+	switch r {
+	case Logical:
+		return usage.Logical
+	case Physical:
+		return usage.Physical
+	}
+	return usage.Inodes
+}
+
+// Limit is how much of a resource an owner can have, 0 for no limit
+type Limit struct {
+	Soft int64
+	Hard int64
+}
+
+// Quota is the limits of an owner, by resource, and when they went over each soft limit
+type Quota struct {
+	Limits [3]Limit
+	Over   [3]time.Time // zero while usage is under the soft limit
+}
+
+// Status is an owner's quota along with how much they're using
+type Status struct {
+	Owner Owner
+	Quota Quota
+	Usage metadata.Usage
+}
+
+// How long is left of the grace period for 'r' at 'now', 0 if usage isn't over the soft limit and
+// negative once it has run out
+func (s Status) GraceLeft(r Resource, now time.Time) time.Duration {
+	if s.Quota.Over[r].IsZero() {
+		return 0
+	}
+	return s.Quota.Over[r].Add(GetGrace()).Sub(now)
+}
+
+var quotasLock sync.Mutex
+var quotas = make(map[Owner]*Quota)
+var grace = 7 * 24 * time.Hour
+
+var saveDir string // where the quotas are saved
+var writable bool  // false for read-only mounts, nothing is saved
+
+// How much an owner is using, the metadata module keeps it up to date
+var usageOf = func(owner Owner) metadata.Usage {
+	switch owner.Kind {
+	case Group:
+		return metadata.GroupUsage(owner.ID)
+	case Project:
+		return metadata.ProjectUsage(owner.ID)
+	}
+	return metadata.UserUsage(owner.ID)
+}
+
+// Keeps the quotas in 'dir', loading any already saved there. Nothing is saved unless it's 'canWrite'.
+func Setup(dir string, canWrite bool) error {
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	saveDir, writable = dir, canWrite
+	quotas = make(map[Owner]*Quota)
+
+	file, err := os.Open(filepath.Join(saveDir, "OptiFSQuotasSave.gob"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	if err := gob.NewDecoder(file).Decode(&quotas); err != nil {
+		return err
+	}
+	logger.Info("Loaded quotas", "owners", len(quotas))
+	return nil
+}
+
+// Saves the quotas, must be called holding quotasLock
+func save() error {
+	if saveDir == "" || !writable {
+		return nil
+	}
+
+	return persist.SaveGob(saveDir, "OptiFSQuotasSave.gob", quotas)
+}
+
+// Sets how many days usage can stay over a soft limit
+func SetGrace(days int) {
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	logger.Info("Setting quota grace period", "days", days)
+	grace = time.Duration(days) * 24 * time.Hour
+}
+
+// Gets how long usage can stay over a soft limit
+func GetGrace() time.Duration {
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	return grace
+}
+
+// Sets the limit of 'owner' on 'r', a limit of 0 (soft and hard) removes it
+func Set(owner Owner, r Resource, limit Limit) error {
+	if limit.Soft < 0 || limit.Hard < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if limit.Hard > 0 && limit.Soft > limit.Hard {
+		return fmt.Errorf("the soft limit (%d) can't be over the hard limit (%d)", limit.Soft, limit.Hard)
+	}
+
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	q, ok := quotas[owner]
+	if !ok {
+		q = &Quota{}
+		quotas[owner] = q
+	}
+	q.Limits[r] = limit
+	q.Over[r] = time.Time{}
+	track(q, usageOf(owner), time.Now())
+	if q.Limits == ([3]Limit{}) {
+		delete(quotas, owner)
+	}
+
+	logger.Info("Set quota", "owner", owner, "resource", r, "soft", limit.Soft, "hard", limit.Hard)
+	return save()
+}
+
+// Removes every limit of 'owner'
+func Remove(owner Owner) error {
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	if _, ok := quotas[owner]; !ok {
+		return fmt.Errorf("{%v} has no quota", owner)
+	}
+	delete(quotas, owner)
+
+	logger.Info("Removed quota", "owner", owner)
+	return save()
+}
+
+// Gets the quota and usage of 'owner', with no limits if they don't have a quota
+func Get(owner Owner) Status {
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	return status(owner, time.Now())
+}
+
+// Gets the quota and usage of every owner with a quota, users, then groups, then projects, by id
+func List() []Status {
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	now := time.Now()
+	list := make([]Status, 0, len(quotas))
+	for owner := range quotas {
+		list = append(list, status(owner, now))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Owner.Kind != list[j].Owner.Kind {
+			return list[i].Owner.Kind < list[j].Owner.Kind
+		}
+		return list[i].Owner.ID < list[j].Owner.ID
+	})
+	return list
+}
+
+// Gets the quota and usage of 'owner' at 'now', must be called holding quotasLock
+func status(owner Owner, now time.Time) Status {
+	s := Status{Owner: owner, Usage: usageOf(owner)}
+	if q, ok := quotas[owner]; ok {
+		if track(q, s.Usage, now) {
+			if err := save(); err != nil {
+				logger.Error("Couldn't save quotas", "err", err)
+			}
+		}
+		s.Quota = *q
+	}
+	return s
+}
+
+// Checks if the user 'uid' and the group 'gid' can be charged 'delta' more, EDQUOT if either would go
+// over a hard limit, or over a soft limit they've been over for longer than the grace period
+func Check(uid uint32, gid uint32, delta metadata.Usage) syscall.Errno {
+	if errno := CheckOwner(Owner{Kind: User, ID: uid}, delta); errno != 0 {
+		return errno
+	}
+	return CheckOwner(Owner{Kind: Group, ID: gid}, delta)
+}
+
+// Checks if the project 'project' can hold 'delta' more, see Check. Nodes that aren't in a project
+// (project 0) are never refused.
+func CheckProject(project uint32, delta metadata.Usage) syscall.Errno {
+	if project == 0 {
+		return 0
+	}
+	return CheckOwner(Owner{Kind: Project, ID: project}, delta)
+}
+
+// Checks if 'owner' can be charged 'delta' more, see Check
+func CheckOwner(owner Owner, delta metadata.Usage) syscall.Errno {
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	q, ok := quotas[owner]
+	if !ok {
+		return 0
+	}
+
+	now := time.Now()
+	usage := usageOf(owner)
+	if track(q, usage, now) {
+		if err := save(); err != nil {
+			logger.Error("Couldn't save quotas", "err", err)
+		}
+	}
+
+	for _, r := range Resources {
+		more := r.of(delta)
+		if more <= 0 {
+			continue // nothing can stop usage going down
+		}
+		used, limit := r.of(usage), q.Limits[r]
+		if limit.Hard > 0 && used+more > limit.Hard {
+			logger.Debug("Over hard limit", "owner", owner, "resource", r, "used", used, "more", more, "hard", limit.Hard)
+			denials.Inc(kindLabel(owner))
+			return syscall.EDQUOT
+		}
+		if limit.Soft > 0 && used+more > limit.Soft && !q.Over[r].IsZero() && now.Sub(q.Over[r]) >= grace {
+			logger.Debug("Over soft limit for longer than the grace period", "owner", owner, "resource", r, "used", used, "more", more, "soft", limit.Soft, "since", q.Over[r])
+			denials.Inc(kindLabel(owner))
+			return syscall.EDQUOT
+		}
+	}
+	return 0
+}
+
+// Records when usage went over each soft limit of 'q', and forgets once it's back under. Returns
+// whether anything changed. Must be called holding quotasLock.
+func track(q *Quota, usage metadata.Usage, now time.Time) bool {
+	changed := false
+	for _, r := range Resources {
+		over := q.Limits[r].Soft > 0 && r.of(usage) > q.Limits[r].Soft
+		if over && q.Over[r].IsZero() {
+			q.Over[r], changed = now, true
+		} else if !over && !q.Over[r].IsZero() {
+			q.Over[r], changed = time.Time{}, true
+		}
+	}
+	return changed
+}
+
+// The label of the denials metric for 'owner'
+func kindLabel(owner Owner) string {
+	switch owner.Kind {
+	case Group:
+		return "group"
+	case Project:
+		return "project"
+	}
+	return "user"
+}
+
+// Parses an amount given for a limit, a number optionally followed by K, M, G or T (powers of 1024)
+func ParseAmount(s string) (int64, error) {
+	digits, multiplier := s, int64(1)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			digits = s[:n-1]
+		}
+	}
+	amount, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || amount < 0 || amount > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid amount {%v}", s)
+	}
+	return amount * multiplier, nil
+}
+
+// Describes quotas and usage, one line for each resource of each owner
+func Describe(list []Status, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-16s %-9s %-14s %-14s %-14s %s", "owner", "resource", "used", "soft", "hard", "grace")
+	for _, s := range list {
+		for _, r := range Resources {
+			limit := s.Quota.Limits[r]
+			fmt.Fprintf(&b, "\n%-16v %-9v %-14d %-14s %-14s %s", s.Owner, r, r.of(s.Usage), describeLimit(limit.Soft), describeLimit(limit.Hard), describeGrace(s.GraceLeft(r, now), !s.Quota.Over[r].IsZero()))
+		}
+	}
+	return b.String()
+}
+
+func describeLimit(limit int64) string {
+	if limit == 0 {
+		return "none"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+func describeGrace(left time.Duration, over bool) string {
+	switch {
+	case !over:
+		return "-"
+	case left <= 0:
+		return "expired"
+	}
+	left = left.Round(time.Minute)
+	return fmt.Sprintf("%dd%dh%dm left", int(left.Hours())/24, int(left.Hours())%24, int(left.Minutes())%60)
+}
@@ -0,0 +1,200 @@
+package quota
+
+import (
+	"filesystem/metadata"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Sets up quotas saved in a temporary directory, with 'usage' as what every owner is using
+func setupQuotas(t *testing.T, usage map[Owner]metadata.Usage) string {
+	save := t.TempDir()
+	if err := Setup(save, true); err != nil {
+		t.Fatal(err)
+	}
+	SetGrace(7)
+
+	original := usageOf
+	usageOf = func(owner Owner) metadata.Usage { return usage[owner] }
+	t.Cleanup(func() { usageOf = original })
+	return save
+}
+
+// Unit test for Check and Set in quota.go
+func TestCheck(t *testing.T) {
+	user, group := Owner{Kind: User, ID: 1000}, Owner{Kind: Group, ID: 100}
+	usage := map[Owner]metadata.Usage{user: {Inodes: 5, Logical: 900, Physical: 600}, group: {Inodes: 5, Logical: 900, Physical: 600}}
+	setupQuotas(t, usage)
+
+	if err := Set(user, Logical, Limit{Soft: 500, Hard: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(group, Inodes, Limit{Hard: 6}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name  string
+		uid   uint32
+		gid   uint32
+		delta metadata.Usage
+		errno syscall.Errno
+	}{
+		{"under the hard limit", 1000, 200, metadata.Usage{Logical: 100}, 0},
+		{"over the hard limit", 1000, 200, metadata.Usage{Logical: 101}, syscall.EDQUOT},
+		{"going down", 1000, 200, metadata.Usage{Logical: -500}, 0},
+		{"another resource", 1000, 200, metadata.Usage{Physical: 1 << 20}, 0},
+		{"group's hard limit", 1001, 100, metadata.Usage{Inodes: 2}, syscall.EDQUOT},
+		{"no quota", 1001, 200, metadata.Usage{Inodes: 1 << 20}, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if errno := Check(tc.uid, tc.gid, tc.delta); errno != tc.errno {
+				t.Errorf("Expected %v, got %v", tc.errno, errno)
+			}
+		})
+	}
+
+	// The user went over the soft limit when it was set, so they have until the grace period runs out
+	status := Get(user)
+	if status.Quota.Over[Logical].IsZero() || status.GraceLeft(Logical, time.Now()) <= 6*24*time.Hour {
+		t.Errorf("Expected the grace period to have started, got %+v", status.Quota)
+	}
+	quotas[user].Over[Logical] = time.Now().Add(-8 * 24 * time.Hour)
+	if errno := Check(1000, 200, metadata.Usage{Logical: 1}); errno != syscall.EDQUOT {
+		t.Errorf("Expected EDQUOT once the grace period ran out, got %v", errno)
+	}
+
+	// Going back under the soft limit forgets it was ever over
+	usage[user] = metadata.Usage{Logical: 400}
+	if errno := Check(1000, 200, metadata.Usage{Logical: 100}); errno != 0 || !Get(user).Quota.Over[Logical].IsZero() {
+		t.Errorf("Expected to be under the soft limit, got %v", errno)
+	}
+
+	// Projects are checked on their own, nodes outside every project never are
+	project := Owner{Kind: Project, ID: 5}
+	usage[project] = metadata.Usage{Physical: 1 << 20}
+	Set(project, Physical, Limit{Hard: 1 << 20})
+	if errno := CheckProject(5, metadata.Usage{Physical: 1}); errno != syscall.EDQUOT {
+		t.Errorf("Expected EDQUOT for a full project, got %v", errno)
+	}
+	if errno := CheckProject(0, metadata.Usage{Physical: 1 << 30}); errno != 0 {
+		t.Errorf("Expected nodes outside a project not to be limited, got %v", errno)
+	}
+
+	errorCases := []Limit{{Soft: -1}, {Soft: 10, Hard: 5}}
+	for _, limit := range errorCases {
+		if err := Set(user, Inodes, limit); err == nil {
+			t.Errorf("Expected %+v to be refused", limit)
+		}
+	}
+}
+
+// Unit test for List, Remove and Setup in quota.go
+func TestList(t *testing.T) {
+	save := setupQuotas(t, map[Owner]metadata.Usage{})
+	Set(Owner{Kind: Project, ID: 1}, Physical, Limit{Hard: 10})
+	Set(Owner{Kind: Group, ID: 1}, Physical, Limit{Hard: 10})
+	Set(Owner{Kind: User, ID: 2}, Inodes, Limit{Soft: 1, Hard: 2})
+	Set(Owner{Kind: User, ID: 1}, Inodes, Limit{Hard: 2})
+
+	list := List()
+	if len(list) != 4 || list[0].Owner.String() != "uid:1" || list[1].Owner.String() != "uid:2" || list[2].Owner.String() != "gid:1" || list[3].Owner.String() != "project:1" {
+		t.Fatalf("Expected users, groups then projects by id, got %v", list)
+	}
+	Remove(Owner{Kind: Project, ID: 1})
+
+	// Setting every limit to 0 removes the quota
+	Set(Owner{Kind: User, ID: 1}, Inodes, Limit{})
+	if err := Remove(Owner{Kind: Group, ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(Owner{Kind: Group, ID: 1}); err == nil || err.Error() != "{gid:1} has no quota" {
+		t.Errorf("Expected removing a missing quota to fail, got %v", err)
+	}
+
+	// The quotas are loaded again when OptiFS restarts
+	if err := Setup(save, true); err != nil {
+		t.Fatal(err)
+	}
+	if list := List(); len(list) != 1 || list[0].Quota.Limits[Inodes] != (Limit{Soft: 1, Hard: 2}) {
+		t.Errorf("Expected the saved quota, got %v", list)
+	}
+}
+
+// Unit test for ParseOwner, ParseResource and ParseAmount in quota.go
+func TestParse(t *testing.T) {
+	ownerCases := []struct {
+		s     string
+		owner Owner
+		err   bool
+	}{
+		{"uid:1000", Owner{Kind: User, ID: 1000}, false},
+		{"gid:0", Owner{Kind: Group, ID: 0}, false},
+		{"project:5", Owner{Kind: Project, ID: 5}, false},
+		{"project:0", Owner{}, true},
+		{"user:1000", Owner{}, true},
+		{"uid:-1", Owner{}, true},
+		{"1000", Owner{}, true},
+	}
+	for _, tc := range ownerCases {
+		if owner, err := ParseOwner(tc.s); owner != tc.owner || (err != nil) != tc.err {
+			t.Errorf("Expected %v for {%v}, got %v (%v)", tc.owner, tc.s, owner, err)
+		}
+	}
+
+	if r, err := ParseResource("physical"); r != Physical || err != nil {
+		t.Errorf("Expected physical, got %v (%v)", r, err)
+	}
+	if _, err := ParseResource("bytes"); err == nil {
+		t.Errorf("Expected an unknown resource to fail")
+	}
+
+	amountCases := []struct {
+		s      string
+		amount int64
+		err    bool
+	}{
+		{"0", 0, false},
+		{"1500", 1500, false},
+		{"10K", 10 << 10, false},
+		{"2g", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"K", 0, true},
+		{"-1", 0, true},
+		{"9999999T", 0, true},
+	}
+	for _, tc := range amountCases {
+		if amount, err := ParseAmount(tc.s); amount != tc.amount || (err != nil) != tc.err {
+			t.Errorf("Expected %v for {%v}, got %v (%v)", tc.amount, tc.s, amount, err)
+		}
+	}
+}
+
+// Unit test for Describe in quota.go
+func TestDescribe(t *testing.T) {
+	now := time.Now()
+	status := Status{Owner: Owner{Kind: User, ID: 7}, Usage: metadata.Usage{Inodes: 3, Logical: 20, Physical: 20}}
+	status.Quota.Limits[Inodes] = Limit{Soft: 2, Hard: 5}
+	status.Quota.Over[Inodes] = now.Add(-time.Hour)
+	status.Quota.Limits[Logical] = Limit{Soft: 10}
+	status.Quota.Over[Logical] = now.Add(-8 * 24 * time.Hour)
+	SetGrace(7)
+
+	lines := strings.Split(Describe([]Status{status}, now), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "owner") {
+		t.Fatalf("Expected a header and a line for each resource, got %q", lines)
+	}
+	expected := [][]string{
+		{"uid:7", "inodes", "3", "2", "5", "6d23h0m", "left"},
+		{"uid:7", "logical", "20", "10", "none", "expired"},
+		{"uid:7", "physical", "20", "none", "none", "-"},
+	}
+	for i, fields := range expected {
+		if got := strings.Fields(lines[i+1]); strings.Join(got, " ") != strings.Join(fields, " ") {
+			t.Errorf("Expected %v, got %v", fields, got)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"filesystem/control"
+	"filesystem/metadata"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+)
+
+// runs "filesystem report duplicates", which lists every content shared by more than one file.
+// works offline against a save directory, or online through the control socket of a mounted instance.
+// returns the exit status.
+func runReport(args []string) int {
+	reportFlags := flag.NewFlagSet("report", flag.ContinueOnError)
+	saveDir := reportFlags.String("save", "", "read the metadata saved in this directory (offline)")
+	socket := reportFlags.String("socket", os.Getenv("OPTIFS_CONTROL"), "ask the OptiFS instance listening on this control socket (online, default $OPTIFS_CONTROL)")
+	asJSON := reportFlags.Bool("json", false, "output JSON instead of a table")
+	reportFlags.Usage = func() {
+		fmt.Printf("usage: %s report duplicates [-json] (-save <dir> | -socket <control socket>)\n", path.Base(os.Args[0])) // show correct usage
+		fmt.Printf("\noptions:\n")
+		reportFlags.PrintDefaults() // show what optional flags can be used
+	}
+
+	if len(args) < 1 || args[0] != "duplicates" {
+		reportFlags.Usage()
+		return 2
+	}
+	if err := reportFlags.Parse(args[1:]); err != nil || reportFlags.NArg() > 0 {
+		return 2
+	}
+
+	// the save directory is more specific than $OPTIFS_CONTROL, so it wins
+	if *saveDir != "" {
+		// loading the metadata logs a lot, which would get mixed up with the report
+		log.SetOutput(io.Discard)
+
+		groups, err := metadata.DuplicateGroupsFromSave(*saveDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't read saved metadata in {%v}: %v\n", *saveDir, err)
+			return 1
+		}
+		if err := metadata.WriteDuplicateReport(os.Stdout, groups, *asJSON); err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't write report: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if *socket == "" {
+		reportFlags.Usage()
+		return 2
+	}
+	request := control.Request{Command: "report", Args: []string{"duplicates"}}
+	if *asJSON {
+		request.Args = append(request.Args, "-json")
+	}
+	response, err := control.Send(*socket, request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't reach OptiFS at {%v}: %v\n", *socket, err)
+		return 1
+	}
+	if response.Error != "" {
+		fmt.Fprintf(os.Stderr, "error: %v\n", response.Error)
+		return 1
+	}
+	fmt.Println(response.Output)
+	return 0
+}
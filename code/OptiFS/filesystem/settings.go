@@ -0,0 +1,222 @@
+package main
+
+import (
+	"filesystem/audit"
+	"filesystem/config"
+	"filesystem/logging"
+	"filesystem/metadata"
+	"filesystem/permissions"
+	"filesystem/quota"
+	"filesystem/tier"
+	"filesystem/trash"
+	"filesystem/versions"
+	"filesystem/vfs"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// the configuration currently in effect
+var currentConfig *config.Config
+var currentConfigLock sync.RWMutex
+
+// the log file currently in use, nil if logging to standard error
+var logFile *os.File
+
+// gets the configuration currently in effect
+func settings() *config.Config {
+	currentConfigLock.RLock()
+	defer currentConfigLock.RUnlock()
+
+	return currentConfig
+}
+
+// builds the configuration: the defaults, overridden by the configuration file (if there is one),
+// overridden by any flags given on the command line
+func buildConfiguration() (*config.Config, error) {
+	cfg := config.Defaults()
+	if *configFile != "" {
+		loaded, err := config.Load(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = loaded
+	}
+
+	// only the flags that were actually given, otherwise their defaults would hide the file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "debug":
+			cfg.Mount.Debug = *debug
+		case "ro":
+			cfg.Mount.ReadOnly = *readOnly
+		case "atime":
+			cfg.Mount.Atime = *atime
+		case "statfs":
+			cfg.Mount.Statfs = *statfs
+		case "rm-persistence":
+			cfg.Persistence.Enabled = !(*removePersistence)
+		case "save":
+			cfg.Persistence.Save = *saveLocation
+		case "interval":
+			cfg.Persistence.Interval = *interval
+		case "disable-icheck":
+			cfg.Persistence.IntegrityCheck = !(*disableIntegrityCheck)
+		case "control":
+			cfg.Control.Socket = *controlSocket
+		case "shutdown-timeout":
+			cfg.Control.ShutdownTimeout = *shutdownTimeout
+		case "log-level":
+			cfg.Logging.Level = *logLevel
+		case "log-format":
+			cfg.Logging.Format = *logFormat
+		case "metrics":
+			cfg.Metrics.Listen = *metricsAddress
+		case "audit":
+			cfg.Audit.File = *auditFile
+		}
+	})
+	if flag.NArg() >= 2 {
+		cfg.Mount.Point = flag.Arg(0)
+		cfg.Mount.Underlying = flag.Arg(1)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// puts the settings that can change while mounted into effect
+func applySettings(cfg *config.Config) error {
+	// open the new log file before giving up the old one, so logs aren't lost if it fails
+	newLogFile, err := cfg.OpenLogFile()
+	if err != nil {
+		return err
+	}
+	var output io.Writer = os.Stderr
+	if newLogFile != nil {
+		output = newLogFile
+	}
+	if err := logging.Setup(output, cfg.LoggingOptions()); err != nil {
+		if newLogFile != nil {
+			newLogFile.Close()
+		}
+		return err
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = newLogFile
+
+	err = audit.Configure(audit.Options{
+		File:      cfg.Audit.File,
+		MaxSize:   cfg.Audit.MaxSizeMB << 20,
+		Keep:      cfg.Audit.Keep,
+		DataPaths: cfg.Audit.DataPaths,
+	})
+	if err != nil {
+		return err
+	}
+
+	atimePolicy, err := metadata.ParseAtimePolicy(cfg.Mount.Atime)
+	if err != nil {
+		return err
+	}
+	metadata.SetAtimeMode(atimePolicy)
+	statfsMode, err := vfs.ParseStatfsMode(cfg.Mount.Statfs)
+	if err != nil {
+		return err
+	}
+	vfs.SetStatfsMode(statfsMode)
+	metadata.SetSaveInterval(cfg.Persistence.Interval)
+	vfs.SetDedupPolicy(dedupPolicy(cfg.Dedup))
+	versions.SetRules(versionRules(cfg.Versions))
+	trash.SetPolicy(cfg.Trash.Enabled, cfg.Trash.Days)
+	chargingMode, err := metadata.ParseChargingMode(cfg.Quota.Charging)
+	if err != nil {
+		return err
+	}
+	metadata.SetChargingMode(chargingMode)
+	quota.SetGrace(cfg.Quota.GraceDays)
+	tier.SetPolicy(cfg.Tier.Days, cfg.Tier.ReadCold)
+
+	currentConfigLock.Lock()
+	currentConfig = cfg
+	currentConfigLock.Unlock()
+
+	return nil
+}
+
+// converts the de-duplication settings into the policy the VFS uses, rules inherit anything they don't set
+func dedupPolicy(dedup config.DedupConfig) vfs.DedupPolicy {
+	policy := vfs.DedupPolicy{Enabled: dedup.Enabled, MinSize: dedup.MinSize}
+	for _, rule := range dedup.Rules {
+		vfsRule := vfs.DedupRule{Path: rule.Path, Enabled: dedup.Enabled, MinSize: dedup.MinSize}
+		if rule.Enabled != nil {
+			vfsRule.Enabled = *rule.Enabled
+		}
+		if rule.MinSize != nil {
+			vfsRule.MinSize = *rule.MinSize
+		}
+		policy.Rules = append(policy.Rules, vfsRule)
+	}
+	return policy
+}
+
+// re-reads the configuration file, sysadmin info and roles, putting everything that can change
+// without a remount into effect. the configuration in effect is kept if the new one is invalid.
+func reloadConfiguration(saveDir string) error {
+	log.Println("Reloading configuration...")
+
+	cfg, err := buildConfiguration()
+	if err != nil {
+		log.Printf("Couldn't reload configuration, keeping the current one: %v\n", err)
+		return err
+	}
+
+	current := settings()
+	for _, setting := range current.FixedChanges(cfg) {
+		log.Printf("{%v} changed, but won't take effect until OptiFS is remounted\n", setting)
+	}
+	cfg.KeepFixed(current)
+
+	if err := applySettings(cfg); err != nil {
+		log.Printf("Couldn't apply configuration: %v\n", err)
+		return err
+	}
+
+	if cfg.Persistence.Enabled {
+		if err := permissions.RetrieveSysadmin(saveDir); err != nil {
+			return err
+		}
+		// there's nothing to retrieve until a role has been granted
+		if err := permissions.RetrieveRoles(saveDir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	permissions.InvalidateGroupCache()
+
+	log.Println("Reloaded configuration.")
+	return nil
+}
+
+// reloads the configuration whenever OptiFS receives SIGHUP
+func handleHangups(saveDir string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		reloadConfiguration(saveDir)
+	}
+}
+
+// converts the version settings into the rules the versions package uses
+func versionRules(versionsConfig config.VersionsConfig) []versions.Rule {
+	rules := make([]versions.Rule, len(versionsConfig.Rules))
+	for i, rule := range versionsConfig.Rules {
+		rules[i] = versions.Rule{Path: rule.Path, Keep: rule.Keep, Days: rule.Days}
+	}
+	return rules
+}
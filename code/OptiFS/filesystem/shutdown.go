@@ -0,0 +1,83 @@
+package main
+
+import (
+	"filesystem/vfs"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// exit statuses of OptiFS
+const (
+	exitClean   = 0 // unmounted and saved everything
+	exitUnclean = 1 // something couldn't be finished, unmounted or saved
+)
+
+// waits for SIGINT/SIGTERM, then shuts the filesystem down gracefully:
+// refuses new operations, waits (up to the shutdown timeout) for the ones in flight (including RELEASE de-duplication),
+// finishes files that are still open and unmounts.
+// a second signal forces OptiFS to exit straight away.
+//
+// closes 'unmountFailed' if the filesystem couldn't be unmounted, as server.Wait() won't return
+func handleSignals(server *fuse.Server, mountPoint string, status *atomic.Int32, unmountFailed chan<- struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Printf("Received {%v}, shutting down gracefully (send it again to force)...\n", sig)
+
+	go func() {
+		sig := <-signals
+		log.Printf("Received {%v} again, forcing exit without saving!\n", sig)
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+
+	// the timeout may have been reloaded since mounting
+	timeout := time.Duration(settings().Control.ShutdownTimeout) * time.Second
+	if !vfs.StopOperations(timeout) {
+		status.Store(exitUnclean)
+	}
+
+	// anything written to files that are still open would otherwise never be de-duplicated or saved
+	if finished := vfs.FinishOpenFiles(); finished > 0 {
+		log.Printf("Finished {%v} files that were still open\n", finished)
+	}
+
+	log.Printf("Unmounting %v...\n", mountPoint)
+	if err := server.Unmount(); err != nil {
+		// most likely still busy (open files, a shell in the mount point...)
+		log.Printf("Couldn't unmount: %v\n", err)
+		status.Store(exitUnclean)
+		if err := lazyUnmount(mountPoint); err != nil {
+			log.Printf("Couldn't detach mount point, it must be unmounted by hand: %v\n", err)
+		} else {
+			log.Println("Detached mount point, it will be unmounted once it's no longer busy.")
+		}
+		close(unmountFailed)
+	}
+}
+
+// detaches the mount point so nothing new can use it, even though it's busy
+func lazyUnmount(mountPoint string) error {
+	// only works as root
+	err := syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+	if err == nil {
+		return nil
+	}
+
+	for _, bin := range []string{"fusermount3", "fusermount"} {
+		if path, lookErr := exec.LookPath(bin); lookErr == nil {
+			err = exec.Command(path, "-u", "-z", mountPoint).Run()
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+// This file contains restoring files and subtrees from a snapshot
+
+package snapshot
+
+import (
+	"filesystem/content"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Restores the node at 'rel' in the snapshot called 'name', and everything under it if it's a
+// directory, to 'dest' (relative to the root of the filesystem, the node's own path if empty).
+//
+// Everything is written through the mount at 'mountPoint', so the restored files get custom metadata
+// and are de-duplicated the same as any other. Existing files are overwritten, anything that isn't in
+// the snapshot is left alone. Returns how many nodes were restored.
+func Restore(name string, rel string, mountPoint string, dest string) (int, error) {
+	snap := Get(name)
+	if snap == nil {
+		return 0, fmt.Errorf("no snapshot called {%v}", name)
+	}
+
+	rel = path.Clean("/" + rel)
+	if dest == "" {
+		dest = rel
+	}
+	dest = path.Clean("/" + dest)
+	if hidden(dest) {
+		return 0, fmt.Errorf("can't restore into {%v}", dest)
+	}
+	if snap.Lookup(rel) == nil {
+		return 0, fmt.Errorf("{%v} isn't in snapshot {%v}", rel, name)
+	}
+
+	// Parents before their children
+	var nodes []*Node
+	for nodePath, node := range snap.Nodes {
+		if nodePath == rel || rel == "/" || strings.HasPrefix(nodePath, rel+"/") {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Path < nodes[j].Path })
+
+	target := func(node *Node) string {
+		return filepath.Join(mountPoint, dest, strings.TrimPrefix(node.Path, rel))
+	}
+
+	for _, node := range nodes {
+		if err := restoreNode(node, target(node)); err != nil {
+			return 0, fmt.Errorf("couldn't restore {%v}: %v", node.Path, err)
+		}
+	}
+
+	// Children change their directory's times, so directories are done last, deepest first
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if err := restoreAttributes(nodes[i], target(nodes[i])); err != nil {
+			return 0, fmt.Errorf("couldn't restore the attributes of {%v}: %v", nodes[i].Path, err)
+		}
+	}
+
+	logger.Info("Restored from snapshot", "name", name, "path", rel, "dest", dest, "nodes", len(nodes))
+	return len(nodes), nil
+}
+
+// Recreates a node at 'target'
+func restoreNode(node *Node, target string) error {
+	switch node.Metadata.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		// Writable until its own attributes are restored, so its children can be
+		return os.MkdirAll(target, 0700)
+
+	case syscall.S_IFLNK:
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(node.Target, target)
+
+	default:
+		stored, err := os.Open(content.Path(node.Hash))
+		if err != nil {
+			return err
+		}
+		defer stored.Close()
+
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, stored); err != nil {
+			file.Close()
+			return err
+		}
+		// Closing the file is when OptiFS de-duplicates it
+		return file.Close()
+	}
+}
+
+// Gives a restored node the owner, mode, extended attributes and times it had in the snapshot
+func restoreAttributes(node *Node, target string) error {
+	attr := node.Metadata
+	if err := os.Lchown(target, int(attr.Uid), int(attr.Gid)); err != nil {
+		return err
+	}
+
+	isLink := attr.Mode&syscall.S_IFMT == syscall.S_IFLNK
+	if !isLink {
+		if err := os.Chmod(target, os.FileMode(attr.Mode&0777)|modeBits(attr.Mode)); err != nil {
+			return err
+		}
+		for name, value := range attr.XAttr {
+			if err := unix.Lsetxattr(target, name, value, 0); err != nil {
+				logger.Warn("Couldn't restore extended attribute", "path", node.Path, "attr", name, "err", err)
+			}
+		}
+	}
+
+	times := []unix.Timespec{unix.Timespec(attr.Atim), unix.Timespec(attr.Mtim)}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// Converts the setuid, setgid and sticky bits of a mode to the os package's
+func modeBits(mode uint32) os.FileMode {
+	var bits os.FileMode
+	if mode&syscall.S_ISUID != 0 {
+		bits |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		bits |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		bits |= os.ModeSticky
+	}
+	return bits
+}
@@ -0,0 +1,325 @@
+// Package snapshot keeps read-only, point-in-time copies of the filesystem. A snapshot records the
+// custom metadata of every node, and the content of each regular file is kept once, by its hash, in
+// the content store, so content that doesn't change between snapshots (or that several files share)
+// costs nothing more.
+
+package snapshot
+
+import (
+	"encoding/gob"
+	"errors"
+	"filesystem/content"
+	"filesystem/logging"
+	"filesystem/metadata"
+	"filesystem/persist"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var logger = logging.For(logging.Snapshot)
+
+// The content of every snapshot is kept until the snapshot is deleted
+func init() {
+	content.Register(referenced)
+}
+
+// Node is a file, directory or symlink as it was when the snapshot was taken
+type Node struct {
+	Path     string   // relative to the root of the filesystem, e.g. "/docs/a.txt"
+	Hash     [64]byte // of a regular file's content, which is kept in the content store
+	Target   string   // of a symlink
+	Metadata metadata.MapEntryMetadata
+}
+
+// Checks if the node is a directory
+func (n *Node) IsDir() bool {
+	return n.Metadata.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// Snapshot is the state of the filesystem at a point in time
+type Snapshot struct {
+	Name    string
+	Created time.Time
+	Nodes   map[string]*Node // by path
+
+	children map[string][]*Node // the nodes in each directory, sorted by name
+}
+
+// Gets the node at 'rel' (relative to the root of the filesystem), nil if it isn't in the snapshot
+func (s *Snapshot) Lookup(rel string) *Node {
+	return s.Nodes[rel]
+}
+
+// Gets the nodes in the directory at 'rel', sorted by name
+func (s *Snapshot) Children(rel string) []*Node {
+	return s.children[rel]
+}
+
+// The logical size of every regular file in the snapshot
+func (s *Snapshot) Size() int64 {
+	var size int64
+	for _, node := range s.Nodes {
+		if node.Metadata.Mode&syscall.S_IFMT == syscall.S_IFREG {
+			size += node.Metadata.Size
+		}
+	}
+	return size
+}
+
+// Builds the lookup of the nodes in each directory
+func (s *Snapshot) index() {
+	s.children = make(map[string][]*Node)
+	for rel, node := range s.Nodes {
+		if rel == "/" {
+			continue
+		}
+		parent := path.Dir(rel)
+		s.children[parent] = append(s.children[parent], node)
+	}
+	for _, nodes := range s.children {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Path < nodes[j].Path })
+	}
+}
+
+var snapshotsLock sync.RWMutex
+var snapshots = make(map[string]*Snapshot)
+
+// Only one snapshot is created or deleted at a time
+var changeLock sync.Mutex
+
+var storeDir string // where the snapshots are kept, empty if snapshots can't be taken
+var rootPath string // the root of the underlying filesystem
+
+// Names that can't be used inside the root of the filesystem, they're hidden by the virtual directories and the trash
+var hiddenNames = []string{".optifs", ".snapshots", ".versions", ".optifs-trash"}
+
+// The names a snapshot can have, they're used as file names
+var validName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@:+-]{0,254}$`)
+
+// Keeps snapshots of the filesystem rooted at 'root' in '<saveDir>/snapshots', loading the ones
+// already there. The content store must be set up too.
+func Setup(saveDir string, root string) error {
+	snapshotsLock.Lock()
+	defer snapshotsLock.Unlock()
+
+	storeDir = filepath.Join(saveDir, "snapshots")
+	rootPath = root
+	snapshots = make(map[string]*Snapshot)
+
+	manifests, err := filepath.Glob(filepath.Join(storeDir, "*.gob"))
+	if err != nil {
+		return err
+	}
+	for _, manifest := range manifests {
+		snap, err := load(manifest)
+		if err != nil {
+			logger.Error("Couldn't load snapshot", "file", manifest, "err", err)
+			continue
+		}
+		snapshots[snap.Name] = snap
+	}
+	logger.Info("Loaded snapshots", "dir", storeDir, "count", len(snapshots))
+	return nil
+}
+
+// Reads a snapshot's manifest
+func load(manifest string) (*Snapshot, error) {
+	file, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var snap Snapshot
+	if err := gob.NewDecoder(file).Decode(&snap); err != nil {
+		return nil, err
+	}
+	snap.index()
+	return &snap, nil
+}
+
+// Writes a snapshot's manifest, replacing it atomically
+func save(snap *Snapshot) error {
+	return persist.SaveGob(storeDir, snap.Name+".gob", snap)
+}
+
+// Gets the snapshot called 'name', nil if there isn't one
+func Get(name string) *Snapshot {
+	snapshotsLock.RLock()
+	defer snapshotsLock.RUnlock()
+
+	return snapshots[name]
+}
+
+// Gets every snapshot, oldest first
+func List() []*Snapshot {
+	snapshotsLock.RLock()
+	defer snapshotsLock.RUnlock()
+
+	list := make([]*Snapshot, 0, len(snapshots))
+	for _, snap := range snapshots {
+		list = append(list, snap)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Takes a snapshot of the whole filesystem called 'name'. Regular files are captured as they are on
+// the underlying filesystem, so a file that is being written has whatever has been written so far.
+// Nodes other than regular files, directories and symlinks aren't kept.
+func Create(name string) (*Snapshot, error) {
+	if storeDir == "" {
+		return nil, errors.New("snapshots aren't set up")
+	}
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name {%v}", name)
+	}
+
+	changeLock.Lock()
+	defer changeLock.Unlock()
+
+	if Get(name) != nil {
+		return nil, fmt.Errorf("snapshot {%v} already exists", name)
+	}
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Nothing the snapshot keeps can be swept until it's been added
+	release := content.Hold()
+	defer release()
+
+	start := time.Now()
+	snap := &Snapshot{Name: name, Created: start, Nodes: make(map[string]*Node)}
+	err := filepath.WalkDir(rootPath, func(nodePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := persist.RelativePath(rootPath, nodePath)
+		if hidden(rel) || strings.HasSuffix(rel, "~(TMP)") || strings.HasSuffix(rel, "~(SPARE)") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		node, err := capture(nodePath, rel)
+		if err != nil {
+			return fmt.Errorf("couldn't capture {%v}: %v", rel, err)
+		}
+		if node != nil {
+			snap.Nodes[rel] = node
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snap.index()
+	if err := save(snap); err != nil {
+		return nil, fmt.Errorf("couldn't save snapshot: %v", err)
+	}
+
+	snapshotsLock.Lock()
+	snapshots[name] = snap
+	snapshotsLock.Unlock()
+
+	logger.Info("Created snapshot", "name", name, "nodes", len(snap.Nodes), "duration", time.Since(start))
+	return snap, nil
+}
+
+// Records a node, and keeps its content if it's a regular file. Returns nil for nodes that aren't kept.
+func capture(nodePath string, rel string) (*Node, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(nodePath, &st); err != nil {
+		return nil, err
+	}
+
+	node := &Node{Path: rel}
+	if err, _, nodeMetadata := metadata.CopyNodeMetadata(nodePath); err == 0 {
+		node.Metadata = nodeMetadata
+	} else {
+		// OptiFS hasn't seen it yet, the underlying node is all there is
+		node.Metadata = metadata.FromStat(nodePath, &st)
+	}
+	// The type always comes from the underlying node
+	node.Metadata.Mode = st.Mode&syscall.S_IFMT | node.Metadata.Mode&07777
+
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+	case syscall.S_IFLNK:
+		target, err := os.Readlink(nodePath)
+		if err != nil {
+			return nil, err
+		}
+		node.Target = target
+	case syscall.S_IFREG:
+		hash, size, err := content.KeepFile(nodePath)
+		if err != nil {
+			return nil, err
+		}
+		node.Hash = hash
+		if size >= 0 {
+			node.Metadata.Size = size
+		}
+	default:
+		logger.Debug("Not keeping special file", "path", rel)
+		return nil, nil
+	}
+	return node, nil
+}
+
+// Deletes the snapshot called 'name', then removes any content no other snapshot has.
+// Returns how many bytes were freed.
+func Delete(name string) (int64, error) {
+	changeLock.Lock()
+	defer changeLock.Unlock()
+
+	if Get(name) == nil {
+		return 0, fmt.Errorf("no snapshot called {%v}", name)
+	}
+	if err := os.Remove(filepath.Join(storeDir, name+".gob")); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	snapshotsLock.Lock()
+	delete(snapshots, name)
+	snapshotsLock.Unlock()
+
+	freed, err := content.Sweep()
+	logger.Info("Deleted snapshot", "name", name, "freed_bytes", freed)
+	return freed, err
+}
+
+// Gets the hash of every content a snapshot has
+func referenced() [][64]byte {
+	var hashes [][64]byte
+	for _, snap := range List() {
+		for _, node := range snap.Nodes {
+			if node.Metadata.Mode&syscall.S_IFMT == syscall.S_IFREG {
+				hashes = append(hashes, node.Hash)
+			}
+		}
+	}
+	return hashes
+}
+
+// Checks if 'rel' is, or is under, one of the virtual directories in the root
+func hidden(rel string) bool {
+	for _, name := range hiddenNames {
+		if rel == "/"+name || strings.HasPrefix(rel, "/"+name+"/") {
+			return true
+		}
+	}
+	return false
+}
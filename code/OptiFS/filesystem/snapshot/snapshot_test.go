@@ -0,0 +1,221 @@
+package snapshot
+
+import (
+	"filesystem/content"
+	"filesystem/hashing"
+	"filesystem/metadata"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Builds a filesystem to take snapshots of, returning the save location and the root
+func setupTree(t *testing.T) (string, string) {
+	save, root := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"a.txt":         "same",
+		"docs/b.txt":    "same",
+		"docs/c.txt":    "different",
+		".optifs/stats": "hidden",
+	}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("docs/c.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	content.Setup(filepath.Join(save, "content"), true)
+	if err := Setup(save, root); err != nil {
+		t.Fatal(err)
+	}
+	return save, root
+}
+
+// Counts the contents in the content store
+func contents(t *testing.T) int {
+	entries, err := os.ReadDir(filepath.Dir(content.Path([64]byte{})))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// Unit test for Create, Get, List and Setup in snapshot.go
+func TestCreate(t *testing.T) {
+	save, root := setupTree(t)
+
+	testCases := []struct {
+		name string
+		err  string
+	}{
+		{"daily", ""},
+		{"daily", "snapshot {daily} already exists"},
+		{"../escape", "invalid snapshot name {../escape}"},
+		{".hidden", "invalid snapshot name {.hidden}"},
+	}
+	for _, tc := range testCases {
+		_, err := Create(tc.name)
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("Creating {%v}: expected error {%v}, got {%v}", tc.name, tc.err, err)
+		}
+	}
+
+	snap := Get("daily")
+	if snap == nil {
+		t.Fatal("Expected the snapshot to exist")
+	}
+	for _, rel := range []string{"/", "/a.txt", "/docs", "/docs/b.txt", "/docs/c.txt", "/link"} {
+		if snap.Lookup(rel) == nil {
+			t.Errorf("Expected {%v} in the snapshot", rel)
+		}
+	}
+	if snap.Lookup("/.optifs") != nil || snap.Lookup("/.optifs/stats") != nil {
+		t.Errorf("Expected the control directory to be left out")
+	}
+	if snap.Lookup("/link").Target != "docs/c.txt" || !snap.Lookup("/docs").IsDir() {
+		t.Errorf("Expected the symlink and directory to be kept, got %+v %+v", snap.Lookup("/link"), snap.Lookup("/docs"))
+	}
+	if children := snap.Children("/docs"); len(children) != 2 || children[0].Path != "/docs/b.txt" {
+		t.Errorf("Expected the children of /docs, sorted, got %v", children)
+	}
+	if snap.Size() != int64(len("same")*2+len("different")) {
+		t.Errorf("Expected the logical size of the files, got %v", snap.Size())
+	}
+	// The same content is only kept once
+	if n := contents(t); n != 2 {
+		t.Errorf("Expected 2 contents in the store, got %v", n)
+	}
+
+	// A second snapshot of the same files costs nothing more
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("changed"), 0640)
+	if _, err := Create("weekly"); err != nil {
+		t.Fatal(err)
+	}
+	if n := contents(t); n != 3 {
+		t.Errorf("Expected 3 contents in the store, got %v", n)
+	}
+
+	// The snapshots are loaded again when OptiFS restarts
+	if err := Setup(save, root); err != nil {
+		t.Fatal(err)
+	}
+	list := List()
+	if len(list) != 2 || list[0].Name != "daily" || list[1].Name != "weekly" {
+		t.Fatalf("Expected both snapshots, oldest first, got %v", list)
+	}
+	if list[0].Children("/docs") == nil {
+		t.Errorf("Expected loaded snapshots to be indexed")
+	}
+}
+
+// Unit test for capturing content OptiFS already knows in snapshot.go
+func TestCreateKnownContent(t *testing.T) {
+	_, root := setupTree(t)
+
+	// a.txt is recorded with its content, which is already stored
+	path := filepath.Join(root, "a.txt")
+	hash := hashing.HashContents([]byte("same"), 0)
+	ref, fileMetadata := metadata.CreateRegularFileMetadata(metadata.CreateRegularFileMapEntry(hash))
+	fileMetadata.Path, fileMetadata.Mode, fileMetadata.Size = path, 0100640, int64(len("same"))
+	metadata.StoreRegFileInfo(path, &fs.StableAttr{}, 0100640, hash, ref)
+	defer metadata.RemoveNodeInfo(path)
+	defer metadata.RemoveRegularFileMetadata(hash, ref)
+	if _, err := content.Put([]byte("same")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored content is used without reading the file again, so what's underneath doesn't matter
+	os.WriteFile(path, []byte("SAME"), 0640)
+	snap, err := Create("known")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node := snap.Lookup("/a.txt"); node.Hash != hash || node.Metadata.Size != int64(len("same")) {
+		t.Errorf("Expected the recorded content to be kept, got %x (%v bytes)", node.Hash, node.Metadata.Size)
+	}
+	// Only what OptiFS doesn't know is copied, streamed into the store
+	if n := contents(t); n != 2 {
+		t.Errorf("Expected 2 contents in the store, got %v", n)
+	}
+}
+
+// Unit test for Delete in snapshot.go
+func TestDelete(t *testing.T) {
+	_, root := setupTree(t)
+	Create("first")
+	os.WriteFile(filepath.Join(root, "docs/c.txt"), []byte("changed"), 0640)
+	Create("second")
+
+	if _, err := Delete("missing"); err == nil {
+		t.Errorf("Expected deleting a missing snapshot to fail")
+	}
+
+	// Only the content no other snapshot has is removed
+	freed, err := Delete("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != int64(len("different")) || contents(t) != 2 {
+		t.Errorf("Expected the old content of c.txt to be freed, got %v bytes with %v contents left", freed, contents(t))
+	}
+	if Get("first") != nil {
+		t.Errorf("Expected the snapshot to be gone")
+	}
+
+	Delete("second")
+	if contents(t) != 0 {
+		t.Errorf("Expected an empty content store, got %v", contents(t))
+	}
+}
+
+// Unit test for Restore in restore.go
+func TestRestore(t *testing.T) {
+	_, root := setupTree(t)
+	Create("daily")
+	os.WriteFile(filepath.Join(root, "docs/c.txt"), []byte("changed"), 0600)
+	os.RemoveAll(filepath.Join(root, "a.txt"))
+
+	testCases := []struct {
+		name    string
+		path    string
+		dest    string
+		check   string
+		content string
+		err     string
+	}{
+		{"single file", "/a.txt", "", "a.txt", "same", ""},
+		{"subtree", "/docs", "", "docs/c.txt", "different", ""},
+		{"elsewhere", "/docs", "/restored", "restored/b.txt", "same", ""},
+		{"missing", "/nothing", "", "", "", "{/nothing} isn't in snapshot {daily}"},
+		{"into the control directory", "/docs", "/.optifs/docs", "", "", "can't restore into {/.optifs/docs}"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Restore("daily", tc.path, root, tc.dest)
+			if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+				t.Fatalf("Expected error {%v}, got {%v}", tc.err, err)
+			}
+			if tc.check == "" {
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(root, tc.check))
+			if err != nil || string(data) != tc.content {
+				t.Errorf("Expected {%v} in {%v}, got {%s} (%v)", tc.content, tc.check, data, err)
+			}
+			if info, err := os.Stat(filepath.Join(root, tc.check)); err != nil || info.Mode().Perm() != 0640 {
+				t.Errorf("Expected the mode to be restored, got %v (%v)", info.Mode(), err)
+			}
+		})
+	}
+
+	if _, err := Restore("missing", "/", root, ""); err == nil {
+		t.Errorf("Expected restoring from a missing snapshot to fail")
+	}
+}
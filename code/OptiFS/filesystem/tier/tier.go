@@ -0,0 +1,550 @@
+// Package tier keeps content nobody has read for a while in a second, slower tier (another directory or
+// disk), so it doesn't take up space under the root of the underlying filesystem. The namespace doesn't
+// change: the files stay where they are, but empty, while their content is in the cold tier, named by
+// its hash. The content is recalled into the files when one of them is next opened, or read straight
+// from the cold tier if the policy says so.
+
+package tier
+
+import (
+	"encoding/hex"
+	"errors"
+	"filesystem/hashing"
+	"filesystem/logging"
+	"filesystem/metadata"
+	"filesystem/metrics"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+var logger = logging.For(logging.Tier)
+
+// Contents moved to the cold tier, and recalled from it
+var moves = metrics.NewCounter("optifs_tier_moves", "Contents moved to the cold tier (cold) or recalled from it (hot).", "to")
+
+// Returned when a content isn't moved because a file with it is open
+var errInUse = errors.New("the content is open")
+
+var lock sync.Mutex                                // held while the policy, or what's open or being copied, is read or changed
+var contentLocks = make(map[[64]byte]*contentLock) // held while each content changes tier, or a file with it is opened
+var opens = make(map[[64]byte]int)                 // how many files are open with each content, which isn't moved while any are
+var writers = make(map[[64]byte]int)               // how many of those are open for writing, so may not have the content any more
+var copying = make(map[string]bool)                // the temporary files in the cold tier being written outside the locks
+var coldDir string                                 // where the cold tier is, empty if there isn't one
+var writable bool                                  // false for read-only mounts, nothing is moved, recalled or removed
+var coldAfter time.Duration                        // contents that haven't been read for this long are moved, 0 never
+var readCold bool                                  // whether files opened only for reading are read from the cold tier
+
+// Keeps the cold tier in 'dir' (empty for no cold tier), creating it if needed. Nothing is moved,
+// recalled or removed unless it's 'canWrite'.
+func Setup(dir string, canWrite bool) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	coldDir, writable = dir, canWrite
+	opens, writers = make(map[[64]byte]int), make(map[[64]byte]int)
+	if dir == "" || !canWrite {
+		return nil
+	}
+	return os.MkdirAll(dir, 0700)
+}
+
+// Decides how many days content can go unread before it's moved to the cold tier (0 to never move it),
+// and whether files opened only for reading are read straight from the cold tier rather than recalled
+func SetPolicy(days int, fromCold bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("Setting tier policy", "days", days, "read_cold", fromCold)
+	coldAfter, readCold = time.Duration(days)*24*time.Hour, fromCold
+}
+
+// The lock of a content, and how many are using or waiting for it, so it can be removed once none are
+type contentLock struct {
+	sync.Mutex
+	users int
+}
+
+// Locks the content 'hash' while it changes tier, or a file with it is opened, returning the function
+// that unlocks it. Each content has its own lock, so slow IO to the cold tier for one content doesn't
+// hold up opening files with any other.
+func lockContent(hash [64]byte) func() {
+	lock.Lock()
+	l, ok := contentLocks[hash]
+	if !ok {
+		l = &contentLock{}
+		contentLocks[hash] = l
+	}
+	l.users++
+	lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		lock.Lock()
+		defer lock.Unlock()
+		if l.users--; l.users == 0 {
+			delete(contentLocks, hash)
+		}
+	}
+}
+
+// Locks the content 'hash' the same way a move or recall does, for anything outside the tier that
+// needs the files with it left as they are (e.g. linking another file to one of them). Returns the
+// function that unlocks it.
+func LockContent(hash [64]byte) func() {
+	return lockContent(hash)
+}
+
+// Gets where the cold copy of the content 'hash' is kept
+func ColdPath(hash [64]byte) string {
+	return filepath.Join(coldDir, hex.EncodeToString(hash[:]))
+}
+
+// Gets the content of the regular file at 'nodePath', zero if it's empty or OptiFS doesn't know it
+func contentOf(nodePath string) [64]byte {
+	err, _, _, _, _, isDir, hash, _ := metadata.RetrieveNodeInfo(nodePath)
+	if err != fs.OK || isDir {
+		return [64]byte{}
+	}
+	return hash
+}
+
+// Opens the file at 'nodePath' like syscall.Open, making sure its content is there first. Cold content
+// is recalled, unless the file is only being read and is read straight from the cold tier (always the
+// case on a read-only mount). The content isn't moved until the returned function is called, once the
+// file is closed.
+func Open(nodePath string, flags int, perm uint32) (int, func(), error) {
+	hash := contentOf(nodePath)
+	if metadata.EmptyFileIdentifier(hash) {
+		fd, err := syscall.Open(nodePath, flags, perm)
+		return fd, func() {}, err
+	}
+
+	unlock := lockContent(hash)
+	defer unlock()
+
+	lock.Lock()
+	fromCold := readCold || !writable
+	lock.Unlock()
+
+	reading := flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND|syscall.O_CREAT) == 0
+	openPath := nodePath
+	if metadata.ContentTier(hash) == metadata.Cold {
+		if reading && fromCold {
+			logger.Debug("Reading from the cold tier", "path", nodePath)
+			openPath = ColdPath(hash)
+		} else if err := recall(hash); err != nil {
+			return -1, nil, err
+		}
+	}
+
+	fd, err := syscall.Open(openPath, flags, perm)
+	if err != nil {
+		return -1, nil, err
+	}
+	metadata.TouchContent(hash)
+	return fd, hold(hash, !reading), nil
+}
+
+// Opens the file at 'nodePath' to read its content, from the cold tier if that's where it is, without
+// recalling it. Also gets the hash of the content, if the file is known to have it (zero if OptiFS
+// doesn't know the file, or it's open for writing). The content isn't moved until the returned
+// function is called, once the file is closed.
+func OpenRead(nodePath string) (*os.File, [64]byte, func(), error) {
+	key := contentOf(nodePath)
+	if metadata.EmptyFileIdentifier(key) {
+		file, err := os.Open(nodePath)
+		return file, [64]byte{}, func() {}, err
+	}
+
+	// Opened holding the content's lock, so a recall can't remove the cold copy first
+	unlock := lockContent(key)
+	defer unlock()
+
+	readPath := nodePath
+	if metadata.ContentTier(key) == metadata.Cold {
+		readPath = ColdPath(key)
+	}
+	file, err := os.Open(readPath)
+	if err != nil {
+		return nil, [64]byte{}, nil, err
+	}
+	var hash [64]byte
+	lock.Lock()
+	if writers[key] == 0 {
+		hash = metadata.ContentHashOf(key)
+	}
+	lock.Unlock()
+	return file, hash, hold(key, false), nil
+}
+
+// Counts a file open with the content 'hash', and if it's 'writing', returning the function that stops
+// counting it. Must be called holding the content's lock.
+func hold(hash [64]byte, writing bool) func() {
+	lock.Lock()
+	opens[hash]++
+	if writing {
+		writers[hash]++
+	}
+	lock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if opens[hash]--; opens[hash] <= 0 {
+				delete(opens, hash)
+			}
+			if writing {
+				if writers[hash]--; writers[hash] <= 0 {
+					delete(writers, hash)
+				}
+			}
+		})
+	}
+}
+
+// Copies the content 'hash' back from the cold tier into its files, then removes the cold copy. Must be
+// called holding the content's lock.
+func recall(hash [64]byte) error {
+	lock.Lock()
+	dir, canWrite := coldDir, writable
+	lock.Unlock()
+	if dir == "" || !canWrite {
+		logger.Error("Can't recall content", "hash", fmt.Sprintf("%x", hash), "cold_dir", dir, "writable", canWrite)
+		return syscall.EIO
+	}
+
+	cold, err := os.Open(ColdPath(hash))
+	if err != nil {
+		logger.Error("Couldn't read content from the cold tier", "hash", fmt.Sprintf("%x", hash), "err", err)
+		return syscall.EIO
+	}
+	defer cold.Close()
+
+	// Files that are hard linked (as de-duplicated files are) only need writing once
+	written := make(map[[2]uint64]bool)
+	var size int64
+	for _, path := range filesWithContent(hash) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			return err
+		}
+		if written[[2]uint64{st.Dev, st.Ino}] {
+			continue
+		}
+		if size, err = copyInto(path, cold); err != nil {
+			logger.Error("Couldn't recall content", "path", path, "err", err)
+			return err
+		}
+		written[[2]uint64{st.Dev, st.Ino}] = true
+	}
+
+	metadata.SetContentTier(hash, metadata.Hot)
+	if err := os.Remove(ColdPath(hash)); err != nil {
+		logger.Warn("Couldn't remove recalled content from the cold tier", "hash", fmt.Sprintf("%x", hash), "err", err)
+	}
+	moves.Inc("hot")
+	logger.Debug("Recalled content", "hash", fmt.Sprintf("%x", hash), "files", len(written), "size", size)
+	return nil
+}
+
+// Streams all of 'src' into the file at 'path', replacing what it had, returning how much was copied
+func copyInto(path string, src *os.File) (int64, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return n, err
+	}
+	return n, dst.Close()
+}
+
+// Gets the files that have the content 'hash' now. Metadata can be left at a file's old content after
+// it's rewritten, so each file's own content is checked before it's emptied or written over.
+func filesWithContent(hash [64]byte) []string {
+	var paths []string
+	for _, path := range metadata.PathsWithContent(hash) {
+		if contentOf(path) == hash {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Moves every content that hasn't been read for longer than the policy allows to the cold tier, and
+// removes anything left in the cold tier that no file has any more. Returns how many were moved.
+func Move() int {
+	lock.Lock()
+	enabled, after := coldDir != "" && writable && coldAfter > 0, coldAfter
+	lock.Unlock()
+	if !enabled {
+		return 0
+	}
+
+	moved := 0
+	for _, hash := range metadata.ContentsInTier(metadata.Hot, time.Now().Add(-after)) {
+		err := moveCold(hash)
+		switch {
+		case errors.Is(err, errInUse):
+			logger.Debug("Not moving open content", "hash", fmt.Sprintf("%x", hash))
+		case err != nil:
+			logger.Warn("Couldn't move content to the cold tier", "hash", fmt.Sprintf("%x", hash), "err", err)
+		default:
+			moved++
+		}
+	}
+	removed := sweep()
+	if moved > 0 || removed > 0 {
+		logger.Info("Moved contents to the cold tier", "moved", moved, "removed", removed)
+	}
+	return moved
+}
+
+// Moves the content 'hash' to the cold tier, leaving its files empty
+func moveCold(hash [64]byte) error {
+	paths := filesWithContent(hash)
+	if len(paths) == 0 {
+		return errors.New("no file has the content")
+	}
+
+	lock.Lock()
+	if opens[hash] > 0 {
+		lock.Unlock()
+		return errInUse
+	}
+	tmp, err := os.CreateTemp(coldDir, ".tmp-*")
+	if err != nil {
+		lock.Unlock()
+		return err
+	}
+	copying[tmp.Name()] = true
+	lock.Unlock()
+
+	// The copy is made without any lock, as the cold tier is slow, so it's checked before it's kept
+	defer func() {
+		lock.Lock()
+		delete(copying, tmp.Name())
+		lock.Unlock()
+		os.Remove(tmp.Name())
+	}()
+
+	var before syscall.Stat_t
+	if err := syscall.Stat(paths[0], &before); err != nil {
+		tmp.Close()
+		return err
+	}
+	src, err := os.Open(paths[0])
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	hasher := hashing.NewHasher()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), src)
+	src.Close()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	var copied [64]byte
+	copy(copied[:], hasher.Sum(nil))
+	if copied != metadata.ContentHashOf(hash) {
+		tmp.Close()
+		return fmt.Errorf("{%v} doesn't have the content it should", paths[0])
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	unlock := lockContent(hash)
+	defer unlock()
+
+	// Nothing can have opened or changed the files while the content was copied
+	lock.Lock()
+	inUse := opens[hash] > 0
+	lock.Unlock()
+	if inUse {
+		return errInUse
+	}
+	if metadata.ContentTier(hash) != metadata.Hot {
+		return errors.New("the content was already moved")
+	}
+	var after syscall.Stat_t
+	if err := syscall.Stat(paths[0], &after); err != nil {
+		return err
+	}
+	if after.Mtim != before.Mtim || after.Size != before.Size {
+		return fmt.Errorf("{%v} changed while it was being copied", paths[0])
+	}
+	inodes := make(map[[2]uint64]string)
+	for _, path := range filesWithContent(hash) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			return err
+		}
+		if st.Size != size {
+			return fmt.Errorf("{%v} changed while the content was being copied", path)
+		}
+		inodes[[2]uint64{st.Dev, st.Ino}] = path
+	}
+
+	if err := os.Rename(tmp.Name(), ColdPath(hash)); err != nil {
+		return err
+	}
+	// Once the files start being emptied, the content is only whole in the cold tier
+	metadata.SetContentTier(hash, metadata.Cold)
+	moves.Inc("cold")
+	for _, path := range inodes {
+		if err := os.Truncate(path, 0); err != nil {
+			logger.Warn("Couldn't empty file moved to the cold tier", "path", path, "err", err)
+		}
+	}
+	logger.Debug("Moved content to the cold tier", "hash", fmt.Sprintf("%x", hash), "files", len(inodes), "size", size)
+	return nil
+}
+
+// Removes everything in the cold tier that isn't the cold copy of a content, returning how many were
+// removed
+func sweep() int {
+	lock.Lock()
+	dir := coldDir
+	lock.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Warn("Couldn't list the cold tier", "err", err)
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if hash, ok := parseName(entry.Name()); ok {
+			// Held so the content can't change tier while it's checked and removed
+			unlock := lockContent(hash)
+			kept := metadata.ContentSize(hash) >= 0 && metadata.ContentTier(hash) == metadata.Cold
+			if !kept && removeCold(name) {
+				removed++
+			}
+			unlock()
+			continue
+		}
+
+		lock.Lock()
+		if !copying[name] && removeCold(name) {
+			removed++
+		}
+		lock.Unlock()
+	}
+	return removed
+}
+
+// Removes 'name' from the cold tier, returning whether it was removed
+func removeCold(name string) bool {
+	if err := os.Remove(name); err != nil {
+		logger.Warn("Couldn't remove from the cold tier", "name", filepath.Base(name), "err", err)
+		return false
+	}
+	logger.Debug("Removed from the cold tier", "name", filepath.Base(name))
+	return true
+}
+
+// Gets the content a file in the cold tier is the copy of, false if it isn't one
+func parseName(name string) ([64]byte, bool) {
+	var hash [64]byte
+	if strings.HasPrefix(name, ".") {
+		return hash, false
+	}
+	decoded, err := hex.DecodeString(name)
+	if err != nil || len(decoded) != len(hash) {
+		return hash, false
+	}
+	copy(hash[:], decoded)
+	return hash, true
+}
+
+// Checks both tiers against the metadata: every cold content must have its cold copy, and a content
+// whose files were emptied just before a crash (before the metadata saying it's cold was saved) is
+// cold again. Anything else in the cold tier is removed. Returns how many cold contents are missing.
+func Check() int {
+	lock.Lock()
+	dir, canWrite := coldDir, writable
+	lock.Unlock()
+
+	missing := 0
+	for _, hash := range metadata.ContentsInTier(metadata.Cold, time.Time{}) {
+		unlock := lockContent(hash)
+		if _, err := os.Stat(ColdPath(hash)); dir == "" || err != nil {
+			logger.Error("INTEGRITY ERROR, cold content is missing", "hash", fmt.Sprintf("%x", hash), "paths", metadata.PathsWithContent(hash), "err", err)
+			missing++
+		}
+		unlock()
+	}
+
+	if dir != "" {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			hash, ok := parseName(entry.Name())
+			if !ok {
+				continue
+			}
+			unlock := lockContent(hash)
+			if metadata.ContentTier(hash) == metadata.Hot && emptied(hash) {
+				logger.Warn("Content was moved to the cold tier without being recorded, it's cold again", "hash", entry.Name())
+				metadata.SetContentTier(hash, metadata.Cold)
+			}
+			unlock()
+		}
+	}
+
+	if dir != "" && canWrite {
+		sweep()
+	}
+	logger.Debug("Checked the tiers", "missing", missing)
+	return missing
+}
+
+// Checks if every file with the content 'hash' is empty when it shouldn't be. Must be called holding the
+// content's lock.
+func emptied(hash [64]byte) bool {
+	size := metadata.ContentSize(hash)
+	if size <= 0 {
+		return false
+	}
+	paths := filesWithContent(hash)
+	for _, path := range paths {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil || st.Size != 0 {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
+
+// Moves unread content to the cold tier every 'interval'
+func MoveRegularly(interval time.Duration) {
+	for range time.Tick(interval) {
+		Move()
+	}
+}
@@ -0,0 +1,299 @@
+package tier
+
+import (
+	"filesystem/hashing"
+	"filesystem/metadata"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Sets up a cold tier for a temporary filesystem, returning the root and the cold tier
+func setupTier(t *testing.T, days int, fromCold bool) (string, string) {
+	root, cold := t.TempDir(), filepath.Join(t.TempDir(), "cold")
+	if err := Setup(cold, true); err != nil {
+		t.Fatal(err)
+	}
+	SetPolicy(days, fromCold)
+	t.Cleanup(func() {
+		Setup("", true)
+		SetPolicy(0, false)
+	})
+	return root, cold
+}
+
+// Writes 'data' to each of 'names' under 'root', the first of them hard linked to any that end in
+// "-link" as de-duplicated files are, and records them as having been last read 'unread' ago. Returns
+// the hash of the content.
+func addContent(t *testing.T, root string, data string, unread time.Duration, names ...string) [64]byte {
+	hash := hashing.HashContents([]byte(data), 0)
+	entry := metadata.CreateRegularFileMapEntry(hash)
+	entry.LastRead = time.Now().Add(-unread)
+
+	for i, name := range names {
+		path := filepath.Join(root, name)
+		var err error
+		if i > 0 && strings.HasSuffix(name, "-link") {
+			err = os.Link(filepath.Join(root, names[0]), path)
+		} else {
+			err = os.WriteFile(path, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, fileMetadata := metadata.CreateRegularFileMetadata(entry)
+		fileMetadata.Path, fileMetadata.Size = path, int64(len(data))
+		metadata.StoreRegFileInfo(path, &fs.StableAttr{}, 0644, hash, ref)
+		t.Cleanup(func() {
+			metadata.RemoveNodeInfo(path)
+			metadata.RemoveRegularFileMetadata(hash, ref)
+		})
+	}
+	return hash
+}
+
+// Checks that the file at 'path' holds 'expected'
+func checkFile(t *testing.T, path string, expected string) {
+	t.Helper()
+	if data, err := os.ReadFile(path); err != nil || string(data) != expected {
+		t.Errorf("Expected {%v} to hold {%v}, got {%s} (%v)", path, expected, data, err)
+	}
+}
+
+// Unit test for Move in tier.go
+func TestMove(t *testing.T) {
+	root, _ := setupTier(t, 1, false)
+	unread := addContent(t, root, "unread", 48*time.Hour, "a", "a-link", "copy")
+	recent := addContent(t, root, "recent", time.Hour, "b")
+	open := addContent(t, root, "open", 48*time.Hour, "c")
+
+	fd, release, err := Open(filepath.Join(root, "c"), syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	// Opening counts as reading, so it has to look unread again
+	_, entry := metadata.LookupRegularFileEntry(open)
+	entry.LastRead = time.Now().Add(-48 * time.Hour)
+
+	if moved := Move(); moved != 1 {
+		t.Errorf("Expected only the unread content to be moved, got %v", moved)
+	}
+	for _, name := range []string{"a", "a-link", "copy"} {
+		checkFile(t, filepath.Join(root, name), "")
+	}
+	checkFile(t, ColdPath(unread), "unread")
+	checkFile(t, filepath.Join(root, "b"), "recent")
+	if metadata.ContentTier(unread) != metadata.Cold || metadata.ContentTier(recent) != metadata.Hot {
+		t.Errorf("Expected only the unread content to be cold")
+	}
+
+	// Open content stays where it is until it's closed
+	if metadata.ContentTier(open) != metadata.Hot {
+		t.Errorf("Expected the open content to stay hot")
+	}
+	release()
+	if moved := Move(); moved != 1 || metadata.ContentTier(open) != metadata.Cold {
+		t.Errorf("Expected the closed content to be moved, got %v", moved)
+	}
+
+	// Nothing is moved when the policy doesn't move anything
+	SetPolicy(0, false)
+	addContent(t, root, "never", 48*time.Hour, "d")
+	if moved := Move(); moved != 0 {
+		t.Errorf("Expected nothing to be moved, got %v", moved)
+	}
+}
+
+// Unit test for moving content whose metadata still has a file that was rewritten since, in tier.go
+func TestMoveRewritten(t *testing.T) {
+	root, _ := setupTier(t, 1, false)
+	unread := addContent(t, root, "unread", 48*time.Hour, "a")
+	rewritten := addContent(t, root, "rewritten", time.Hour, "b")
+
+	// b had the unread content before it was rewritten, and its old metadata was left behind
+	_, entry := metadata.LookupRegularFileEntry(unread)
+	ref, fileMetadata := metadata.CreateRegularFileMetadata(entry)
+	fileMetadata.Path, fileMetadata.Size = filepath.Join(root, "b"), int64(len("unread"))
+	defer metadata.RemoveRegularFileMetadata(unread, ref)
+
+	if moved := Move(); moved != 1 {
+		t.Fatalf("Expected the unread content to be moved, got %v", moved)
+	}
+	checkFile(t, filepath.Join(root, "a"), "")
+	checkFile(t, filepath.Join(root, "b"), "rewritten")
+	if metadata.ContentTier(rewritten) != metadata.Hot {
+		t.Errorf("Expected the rewritten content to stay hot")
+	}
+
+	// Recalling only writes the files that still have the content
+	fd, release, err := Open(filepath.Join(root, "a"), syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+	release()
+	checkFile(t, filepath.Join(root, "a"), "unread")
+	checkFile(t, filepath.Join(root, "b"), "rewritten")
+}
+
+// Unit test for lockContent in tier.go, a content being moved or recalled doesn't hold up any other
+func TestLockContent(t *testing.T) {
+	root, _ := setupTier(t, 1, false)
+	busy := addContent(t, root, "busy", time.Hour, "a")
+	addContent(t, root, "other", time.Hour, "b")
+
+	unlock := lockContent(busy)
+	opened := make(chan error, 1)
+	go func() {
+		fd, release, err := Open(filepath.Join(root, "b"), syscall.O_RDONLY, 0)
+		if err == nil {
+			syscall.Close(fd)
+			release()
+		}
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("Expected the other content to open, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected opening the other content not to wait")
+	}
+
+	// The busy content waits until it's unlocked
+	go func() {
+		fd, release, err := Open(filepath.Join(root, "a"), syscall.O_RDONLY, 0)
+		if err == nil {
+			syscall.Close(fd)
+			release()
+		}
+		opened <- err
+	}()
+	select {
+	case <-opened:
+		t.Errorf("Expected opening the busy content to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-opened; err != nil {
+		t.Errorf("Expected the busy content to open once unlocked, got %v", err)
+	}
+}
+
+// Unit test for Open in tier.go
+func TestOpen(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fromCold bool
+		flags    int
+		recalled bool
+	}{
+		{"reading recalls", false, syscall.O_RDONLY, true},
+		{"reading from the cold tier", true, syscall.O_RDONLY, false},
+		{"writing always recalls", true, syscall.O_RDWR, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root, _ := setupTier(t, 1, tc.fromCold)
+			hash := addContent(t, root, "content", 48*time.Hour, "a", "a-link", "copy")
+			if moved := Move(); moved != 1 {
+				t.Fatalf("Expected the content to be moved, got %v", moved)
+			}
+
+			fd, release, err := Open(filepath.Join(root, "a"), tc.flags, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+			defer syscall.Close(fd)
+
+			buf := make([]byte, 64)
+			if n, err := syscall.Read(fd, buf); err != nil || string(buf[:n]) != "content" {
+				t.Errorf("Expected to read the content, got {%s} (%v)", buf[:n], err)
+			}
+			if tc.recalled {
+				for _, name := range []string{"a", "a-link", "copy"} {
+					checkFile(t, filepath.Join(root, name), "content")
+				}
+				if _, err := os.Stat(ColdPath(hash)); !os.IsNotExist(err) {
+					t.Errorf("Expected the cold copy to be removed, got %v", err)
+				}
+			} else {
+				checkFile(t, filepath.Join(root, "copy"), "")
+			}
+			if recalled := metadata.ContentTier(hash) == metadata.Hot; recalled != tc.recalled {
+				t.Errorf("Expected recalled to be %v, got %v", tc.recalled, recalled)
+			}
+		})
+	}
+}
+
+// Unit test for OpenRead in tier.go
+func TestOpenRead(t *testing.T) {
+	root, _ := setupTier(t, 1, false)
+	hash := addContent(t, root, "content", 48*time.Hour, "a")
+	Move()
+
+	file, known, release, err := OpenRead(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	release()
+	if err != nil || string(data) != "content" || known != hash {
+		t.Errorf("Expected the content from the cold tier, and its hash, got {%s} %x (%v)", data, known, err)
+	}
+	if metadata.ContentTier(hash) != metadata.Cold {
+		t.Errorf("Expected reading the whole file not to recall it")
+	}
+
+	// The hash of a file being written isn't known
+	fd, closed, err := Open(filepath.Join(root, "a"), syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closed()
+	defer syscall.Close(fd)
+	file, known, release, err = OpenRead(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	release()
+	if known != ([64]byte{}) {
+		t.Errorf("Expected no hash for a file being written, got %x", known)
+	}
+}
+
+// Unit test for Check in tier.go
+func TestCheck(t *testing.T) {
+	root, cold := setupTier(t, 1, false)
+	missing := addContent(t, root, "missing", 48*time.Hour, "a")
+	unrecorded := addContent(t, root, "unrecorded", 48*time.Hour, "b")
+	Move()
+
+	// The cold copy of one content is lost, and the other was moved just before a crash
+	os.Remove(ColdPath(missing))
+	metadata.SetContentTier(unrecorded, metadata.Hot)
+	os.WriteFile(filepath.Join(cold, "stray"), []byte("stray"), 0600)
+
+	if count := Check(); count != 1 {
+		t.Errorf("Expected one missing content, got %v", count)
+	}
+	if metadata.ContentTier(unrecorded) != metadata.Cold {
+		t.Errorf("Expected the content moved before the crash to be cold")
+	}
+	checkFile(t, ColdPath(unrecorded), "unrecorded")
+	if _, err := os.Stat(filepath.Join(cold, "stray")); !os.IsNotExist(err) {
+		t.Errorf("Expected anything else in the cold tier to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+// Package trash keeps deleted files and directories for a while, so they can be restored. A deleted
+// node is moved (with its custom metadata) into a hidden directory on the underlying filesystem, one
+// for each user who deletes things, and is removed for good when it expires or is purged.
+
+package trash
+
+import (
+	"encoding/gob"
+	"errors"
+	"filesystem/logging"
+	"filesystem/metadata"
+	"filesystem/persist"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+)
+
+var logger = logging.For(logging.Trash)
+
+// The name of the trash directory in the root of the underlying filesystem, it's hidden from the mount
+const DirName = ".optifs-trash"
+
+// Entry is a node in the trash
+type Entry struct {
+	ID      uint64
+	Path    string // where it was, relative to the root of the filesystem
+	UID     uint32 // who deleted it, whose trash it's in
+	Deleted time.Time
+	IsDir   bool
+	Size    int64
+}
+
+// Where the node is kept on the underlying filesystem while it's in the trash
+func (e *Entry) trashPath() string {
+	return filepath.Join(rootPath, DirName, strconv.FormatUint(uint64(e.UID), 10), strconv.FormatUint(e.ID, 10))
+}
+
+var entriesLock sync.Mutex
+var entries = make(map[uint64]*Entry)
+var nextID uint64 = 1
+
+var saveDir string  // where the trash is saved
+var writable bool   // false for read-only mounts, nothing is moved, restored or removed
+var rootPath string // the root of the underlying filesystem
+
+var enabled bool // deleted nodes are only kept if the trash is enabled
+var keepFor time.Duration
+
+// Keeps the trash of the filesystem at 'root', saving it in 'dir' and loading anything already saved
+// there. Nothing is changed unless it's 'canWrite'.
+func Setup(dir string, root string, canWrite bool) error {
+	entriesLock.Lock()
+	defer entriesLock.Unlock()
+
+	saveDir, rootPath, writable = dir, root, canWrite
+	entries, nextID = make(map[uint64]*Entry), 1
+
+	file, err := os.Open(filepath.Join(saveDir, "OptiFSTrashSave.gob"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	if err := gob.NewDecoder(file).Decode(&entries); err != nil {
+		return err
+	}
+	for id := range entries {
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+	logger.Info("Loaded trash", "entries", len(entries))
+	return nil
+}
+
+// Saves the trash, must be called holding entriesLock
+func save() error {
+	if saveDir == "" || !writable {
+		return nil
+	}
+
+	return persist.SaveGob(saveDir, "OptiFSTrashSave.gob", entries)
+}
+
+// Decides if deleted nodes are kept, and for how many days (0 to keep them until they're purged).
+// Anything that's now expired is removed.
+func SetPolicy(keep bool, days int) {
+	entriesLock.Lock()
+	enabled, keepFor = keep, time.Duration(days)*24*time.Hour
+	entriesLock.Unlock()
+
+	logger.Info("Setting trash policy", "enabled", keep, "days", days)
+	Expire()
+}
+
+// Checks if deleted nodes are moved to the trash, rather than removed
+func Enabled() bool {
+	entriesLock.Lock()
+	defer entriesLock.Unlock()
+
+	return enabled && writable && rootPath != ""
+}
+
+// Checks if 'rel' (relative to the root) is in the trash directory
+func IsTrashPath(rel string) bool {
+	rel = path.Clean("/" + rel)
+	return rel == "/"+DirName || strings.HasPrefix(rel, "/"+DirName+"/")
+}
+
+// Moves the node at 'nodePath' (on the underlying filesystem) into the trash of 'uid', who is deleting
+// it, instead of removing it. Directories must be empty, as with rmdir.
+func Move(nodePath string, uid uint32) (*Entry, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(nodePath, &st); err != nil {
+		return nil, err
+	}
+	entry := &Entry{Path: persist.RelativePath(rootPath, nodePath), UID: uid, Deleted: time.Now(), Size: st.Size}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		entry.IsDir, entry.Size = true, 0
+		children, err := os.ReadDir(nodePath)
+		if err != nil {
+			return nil, err
+		}
+		if len(children) > 0 {
+			return nil, syscall.ENOTEMPTY
+		}
+	}
+
+	entriesLock.Lock()
+	defer entriesLock.Unlock()
+
+	entry.ID = nextID
+	if err := os.MkdirAll(filepath.Dir(entry.trashPath()), 0700); err != nil {
+		return nil, err
+	}
+	if err := syscall.Rename(nodePath, entry.trashPath()); err != nil {
+		return nil, err
+	}
+	metadata.MovePath(nodePath, entry.trashPath())
+
+	nextID++
+	entries[entry.ID] = entry
+	if err := save(); err != nil {
+		logger.Error("Couldn't save the trash", "err", err)
+	}
+	logger.Debug("Moved to trash", "path", entry.Path, "id", entry.ID, "uid", uid)
+	return entry, nil
+}
+
+// Gets what's in the trash, oldest first, only what 'uid' deleted if it isn't nil
+func List(uid *uint32) []*Entry {
+	entriesLock.Lock()
+	defer entriesLock.Unlock()
+
+	var list []*Entry
+	for _, entry := range entries {
+		if uid == nil || entry.UID == *uid {
+			list = append(list, entry)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Moves the node with 'id' back out of the trash, to 'dest' (relative to the root of the filesystem,
+// where it was if empty). Nothing is overwritten, and the directory it goes in must exist.
+func Restore(id uint64, dest string) (*Entry, error) {
+	if !writable {
+		return nil, errors.New("this instance is mounted read-only")
+	}
+
+	entriesLock.Lock()
+	defer entriesLock.Unlock()
+
+	entry, ok := entries[id]
+	if !ok {
+		return nil, fmt.Errorf("nothing in the trash with id %d", id)
+	}
+	if dest == "" {
+		dest = entry.Path
+	}
+	dest = path.Clean("/" + dest)
+	if dest == "/" || IsTrashPath(dest) {
+		return nil, fmt.Errorf("can't restore to {%v}", dest)
+	}
+
+	target := filepath.Join(rootPath, dest)
+	if _, err := os.Lstat(target); err == nil {
+		return nil, fmt.Errorf("{%v} already exists", dest)
+	}
+	if info, err := os.Stat(filepath.Dir(target)); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("{%v} doesn't exist, restore it first or restore somewhere else", path.Dir(dest))
+	}
+
+	// Nothing is replaced, even if it appears after the check
+	if err := renameNoReplace(entry.trashPath(), target); err != nil {
+		return nil, err
+	}
+	metadata.MovePath(entry.trashPath(), target)
+
+	delete(entries, id)
+	if err := save(); err != nil {
+		logger.Error("Couldn't save the trash", "err", err)
+	}
+	logger.Info("Restored from trash", "id", id, "path", entry.Path, "dest", dest)
+	return entry, nil
+}
+
+// Removes the node with 'id' from the trash for good, returning its size
+func Purge(id uint64) (int64, error) {
+	if !writable {
+		return 0, errors.New("this instance is mounted read-only")
+	}
+
+	entriesLock.Lock()
+	defer entriesLock.Unlock()
+
+	entry, ok := entries[id]
+	if !ok {
+		return 0, fmt.Errorf("nothing in the trash with id %d", id)
+	}
+	if err := remove(entry); err != nil {
+		return 0, err
+	}
+	if err := save(); err != nil {
+		logger.Error("Couldn't save the trash", "err", err)
+	}
+	return entry.Size, nil
+}
+
+// Removes a node and its custom metadata for good, must be called holding entriesLock
+func remove(entry *Entry) error {
+	trashPath := entry.trashPath()
+	if err := os.Remove(trashPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if entry.IsDir {
+		metadata.RemoveDirEntry(trashPath)
+	} else if err, _, _, _, _, _, hash, ref := metadata.RetrieveNodeInfo(trashPath); err == fs.OK {
+		metadata.RemoveRegularFileMetadata(hash, ref)
+	}
+	metadata.RemoveNodeInfo(trashPath)
+
+	delete(entries, entry.ID)
+	logger.Debug("Removed from trash", "id", entry.ID, "path", entry.Path)
+	return nil
+}
+
+// Removes everything from the trash that has been there longer than it's kept, returning how many
+// nodes were removed. Disabling the trash only stops more being added, what's there still expires.
+func Expire() int {
+	entriesLock.Lock()
+	defer entriesLock.Unlock()
+
+	if !writable || rootPath == "" {
+		return 0
+	}
+
+	removed := 0
+	now := time.Now()
+	for _, entry := range entries {
+		if keepFor == 0 || now.Sub(entry.Deleted) < keepFor {
+			continue
+		}
+		if err := remove(entry); err != nil {
+			logger.Error("Couldn't remove expired node from the trash", "id", entry.ID, "path", entry.Path, "err", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		if err := save(); err != nil {
+			logger.Error("Couldn't save the trash", "err", err)
+		}
+		logger.Info("Expired nodes from the trash", "removed", removed)
+	}
+	return removed
+}
+
+// Renames 'from' to 'to', unless something is already at 'to'
+func renameNoReplace(from string, to string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, from, unix.AT_FDCWD, to, unix.RENAME_NOREPLACE)
+	if err == syscall.EINVAL {
+		// The underlying filesystem doesn't support it, it was checked beforehand
+		return syscall.Rename(from, to)
+	}
+	return err
+}
+
+// Expires the trash every 'interval'
+func ExpireRegularly(interval time.Duration) {
+	for range time.Tick(interval) {
+		Expire()
+	}
+}
@@ -0,0 +1,150 @@
+package trash
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Sets up the trash of a temporary filesystem with a file and a directory, returning the save
+// location and the root
+func setupTrash(t *testing.T) (string, string) {
+	save, root := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "docs", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs", "report.txt"), []byte("report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setup(save, root, true); err != nil {
+		t.Fatal(err)
+	}
+	SetPolicy(true, 30)
+	return save, root
+}
+
+// Unit test for Move and List in trash.go
+func TestMove(t *testing.T) {
+	_, root := setupTrash(t)
+
+	file, err := Move(filepath.Join(root, "docs", "report.txt"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Path != "/docs/report.txt" || file.Size != int64(len("report")) || file.IsDir {
+		t.Errorf("Expected the file's entry, got %+v", file)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs", "report.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be gone from where it was, got %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, DirName, "1000", "1")); err != nil || string(data) != "report" {
+		t.Errorf("Expected the file in the user's trash, got {%s} (%v)", data, err)
+	}
+
+	// Directories must be empty, as with rmdir
+	if _, err := Move(filepath.Join(root, "docs"), 1000); err != syscall.ENOTEMPTY {
+		t.Errorf("Expected ENOTEMPTY, got %v", err)
+	}
+	dir, err := Move(filepath.Join(root, "docs", "empty"), 0)
+	if err != nil || !dir.IsDir || dir.ID != 2 {
+		t.Fatalf("Expected the directory's entry, got %+v (%v)", dir, err)
+	}
+
+	uid := uint32(1000)
+	if list := List(&uid); len(list) != 1 || list[0].ID != 1 {
+		t.Errorf("Expected only the user's entry, got %v", list)
+	}
+	if list := List(nil); len(list) != 2 || list[0].ID != 1 || list[1].ID != 2 {
+		t.Errorf("Expected every entry, oldest first, got %v", list)
+	}
+}
+
+// Unit test for Restore in trash.go
+func TestRestore(t *testing.T) {
+	_, root := setupTrash(t)
+	Move(filepath.Join(root, "docs", "report.txt"), 1000)
+	Move(filepath.Join(root, "docs", "empty"), 1000)
+	os.WriteFile(filepath.Join(root, "docs", "report.txt"), []byte("newer"), 0644)
+
+	testCases := []struct {
+		name string
+		id   uint64
+		dest string
+		err  string
+	}{
+		{"missing", 9, "", "nothing in the trash with id 9"},
+		{"existing file isn't overwritten", 1, "", "{/docs/report.txt} already exists"},
+		{"into the trash", 1, "/" + DirName + "/x", "can't restore to {/.optifs-trash/x}"},
+		{"missing directory", 1, "/gone/report.txt", "{/gone} doesn't exist, restore it first or restore somewhere else"},
+		{"elsewhere", 1, "/docs/report-old.txt", ""},
+		{"where it was", 2, "", ""},
+		{"already restored", 2, "", "nothing in the trash with id 2"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Restore(tc.id, tc.dest)
+			if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+				t.Errorf("Expected error {%v}, got {%v}", tc.err, err)
+			}
+		})
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "docs", "report-old.txt")); err != nil || string(data) != "report" {
+		t.Errorf("Expected the restored file, got {%s} (%v)", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "docs", "empty")); err != nil || !info.IsDir() {
+		t.Errorf("Expected the restored directory, got %v", err)
+	}
+	if len(List(nil)) != 0 {
+		t.Errorf("Expected an empty trash, got %v", List(nil))
+	}
+}
+
+// Unit test for Purge, Expire and Setup in trash.go
+func TestExpire(t *testing.T) {
+	save, root := setupTrash(t)
+	old, _ := Move(filepath.Join(root, "docs", "report.txt"), 1000)
+	Move(filepath.Join(root, "docs", "empty"), 1000)
+	old.Deleted = time.Now().Add(-31 * 24 * time.Hour)
+
+	if removed := Expire(); removed != 1 || len(List(nil)) != 1 {
+		t.Errorf("Expected the old file to expire, removed %v", removed)
+	}
+	if _, err := os.Stat(filepath.Join(root, DirName, "1000", "1")); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired file to be removed, got %v", err)
+	}
+
+	// Disabling the trash doesn't empty it
+	SetPolicy(false, 30)
+	if len(List(nil)) != 1 {
+		t.Errorf("Expected the trash to be kept")
+	}
+
+	// The trash is loaded again when OptiFS restarts, and new entries don't reuse ids
+	if err := Setup(save, root, true); err != nil {
+		t.Fatal(err)
+	}
+	if list := List(nil); len(list) != 1 || list[0].ID != 2 {
+		t.Fatalf("Expected the saved entry, got %v", list)
+	}
+	os.WriteFile(filepath.Join(root, "another"), nil, 0644)
+	if entry, err := Move(filepath.Join(root, "another"), 0); err != nil || entry.ID != 3 {
+		t.Errorf("Expected a new id, got %+v (%v)", entry, err)
+	}
+
+	if _, err := Purge(9); err == nil || !strings.Contains(err.Error(), "nothing in the trash") {
+		t.Errorf("Expected purging a missing entry to fail, got %v", err)
+	}
+	if _, err := Purge(2); err != nil || len(List(nil)) != 1 {
+		t.Errorf("Expected the entry to be purged, got %v", err)
+	}
+
+	// Nothing is changed on a read-only mount
+	Setup(save, root, false)
+	if _, err := Purge(3); err == nil {
+		t.Errorf("Expected purging on a read-only mount to fail")
+	}
+}
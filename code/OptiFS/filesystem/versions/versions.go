@@ -0,0 +1,335 @@
+// Package versions keeps the previous versions of files that are rewritten. The content of each
+// version is kept in the content store, so a version with content that is already stored (in another
+// version, a snapshot, or shared by several files) costs nothing more. How many versions are kept, and
+// for how long, is decided by rules for subtrees of the filesystem.
+
+package versions
+
+import (
+	"encoding/gob"
+	"filesystem/content"
+	"filesystem/logging"
+	"filesystem/metadata"
+	"filesystem/persist"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var logger = logging.For(logging.Snapshot)
+
+// The extended attribute listing the versions of a file, setting it to "restore <number>" restores one
+const XAttrName = "user.optifs.versions"
+
+// Version is the content and metadata a file had before it was rewritten
+type Version struct {
+	Number   uint64 // counts up from 1 for each path, never reused
+	Saved    time.Time
+	Hash     [64]byte // of the content, which is kept in the content store
+	Metadata metadata.MapEntryMetadata
+}
+
+// Rule decides how many versions of the files under a directory are kept. A version is kept while
+// it's one of the newest 'Keep', or it's younger than 'Days', whichever keeps it longer.
+type Rule struct {
+	Path string // relative to the root of the filesystem, e.g. "/projects"
+	Keep int    // how many versions are kept, 0 for no limit by count
+	Days int    // how many days versions are kept, 0 for no limit by age
+}
+
+// Checks if the rule keeps versions at all, a rule that doesn't turns versions off under its path
+func (r Rule) keeps() bool {
+	return r.Keep > 0 || r.Days > 0
+}
+
+var rules []Rule
+var rulesLock sync.RWMutex
+
+var historiesLock sync.RWMutex
+var histories = make(map[string][]*Version) // by path relative to the root, oldest first
+
+// Versions saved when a file was opened, until it's closed and it's known if it changed. Their
+// content mustn't be swept in the meantime.
+var pending = make(map[*Version]bool)
+
+var saveDir string  // where the versions are saved, empty if they aren't
+var writable bool   // false for read-only mounts, the versions are loaded but never saved
+var rootPath string // the root of the underlying filesystem
+
+// The versions keep their content until they're removed
+func init() {
+	content.Register(referenced)
+}
+
+// Replaces the rules deciding which versions are kept, and removes the versions they no longer keep
+func SetRules(newRules []Rule) {
+	rulesLock.Lock()
+	rules = newRules
+	rulesLock.Unlock()
+
+	logger.Info("Setting version rules", "rules", fmt.Sprintf("%+v", newRules))
+	Prune()
+}
+
+// Gets the rule for the file at 'rel' (relative to the root), the rule for the closest directory above it wins
+func ruleFor(rel string) (Rule, bool) {
+	rulesLock.RLock()
+	defer rulesLock.RUnlock()
+
+	var found Rule
+	longest := -1
+	for _, rule := range rules {
+		if rule.Path != "/" && rel != rule.Path && !strings.HasPrefix(rel, rule.Path+"/") {
+			continue
+		}
+		if len(rule.Path) > longest {
+			longest = len(rule.Path)
+			found = rule
+		}
+	}
+	return found, longest >= 0 && found.keeps()
+}
+
+// Keeps the versions of files under 'root' in 'dir', loading the ones already saved there. Versions
+// aren't saved unless it's 'canWrite'.
+func Setup(dir string, root string, canWrite bool) error {
+	historiesLock.Lock()
+	defer historiesLock.Unlock()
+
+	saveDir, rootPath, writable = dir, root, canWrite
+	histories = make(map[string][]*Version)
+	if saveDir == "" {
+		return nil
+	}
+
+	file, err := os.Open(filepath.Join(saveDir, "OptiFSVersionsSave.gob"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	if err := gob.NewDecoder(file).Decode(&histories); err != nil {
+		return err
+	}
+	logger.Info("Loaded versions", "files", len(histories))
+	return nil
+}
+
+// Saves every version, must be called holding historiesLock
+func save() error {
+	if saveDir == "" || !writable {
+		return nil
+	}
+
+	return persist.SaveGob(saveDir, "OptiFSVersionsSave.gob", histories)
+}
+
+// Checks if versions are kept of the file at 'nodePath' (on the underlying filesystem)
+func Enabled(nodePath string) bool {
+	if rootPath == "" {
+		return false
+	}
+	_, ok := ruleFor(persist.RelativePath(rootPath, nodePath))
+	return ok
+}
+
+// Keeps the content and metadata of the file at 'nodePath' (on the underlying filesystem), before it's
+// opened to be written. Returns nil if versions aren't kept of it, or it has no content yet.
+//
+// The version is only added to the file's history by Commit, once it's known the file changed,
+// otherwise it must be given to Discard.
+func Preserve(nodePath string) (*Version, error) {
+	if !Enabled(nodePath) {
+		return nil, nil
+	}
+	err, isDir, fileMetadata := metadata.CopyNodeMetadata(nodePath)
+	if err != 0 {
+		// OptiFS hasn't seen it yet, the underlying file is all there is
+		var st syscall.Stat_t
+		if statErr := syscall.Lstat(nodePath, &st); statErr != nil {
+			return nil, nil // it's being created
+		}
+		isDir = st.Mode&syscall.S_IFMT != syscall.S_IFREG
+		fileMetadata = metadata.FromStat(nodePath, &st)
+	}
+	if isDir {
+		return nil, nil
+	}
+
+	release := content.Hold()
+	defer release()
+
+	hash, size, keepErr := content.KeepFile(nodePath)
+	if keepErr != nil {
+		return nil, keepErr
+	}
+	if size >= 0 {
+		fileMetadata.Size = size
+	}
+	version := &Version{Saved: time.Now(), Hash: hash, Metadata: fileMetadata}
+
+	historiesLock.Lock()
+	pending[version] = true
+	historiesLock.Unlock()
+
+	return version, nil
+}
+
+// Adds a version kept by Preserve to the history of the file at 'nodePath', now it has changed
+func Commit(nodePath string, version *Version) {
+	rel := persist.RelativePath(rootPath, nodePath)
+
+	historiesLock.Lock()
+	delete(pending, version)
+	history := histories[rel]
+	version.Number = 1
+	if len(history) > 0 {
+		version.Number = history[len(history)-1].Number + 1
+	}
+	histories[rel] = append(history, version)
+	removed := prune(rel, time.Now())
+
+	if err := save(); err != nil {
+		logger.Error("Couldn't save versions", "err", err)
+	}
+	historiesLock.Unlock()
+	logger.Debug("Kept version", "path", rel, "version", version.Number)
+
+	// The oldest version may have been the last to have its content
+	if removed > 0 {
+		if _, err := content.Sweep(); err != nil {
+			logger.Error("Couldn't sweep the content store", "err", err)
+		}
+	}
+}
+
+// Forgets a version kept by Preserve, the file didn't change
+func Discard(version *Version) {
+	historiesLock.Lock()
+	defer historiesLock.Unlock()
+
+	delete(pending, version)
+}
+
+// Removes the versions of the file at 'rel' its rule no longer keeps, returning how many were removed.
+// Must be called holding historiesLock.
+func prune(rel string, now time.Time) int {
+	history := histories[rel]
+	rule, ok := ruleFor(rel)
+	if !ok {
+		delete(histories, rel)
+		return len(history)
+	}
+
+	var kept []*Version
+	for i, version := range history {
+		newest := rule.Keep > 0 && len(history)-i <= rule.Keep
+		young := rule.Days > 0 && now.Sub(version.Saved) < time.Duration(rule.Days)*24*time.Hour
+		if newest || young {
+			kept = append(kept, version)
+		}
+	}
+	if len(kept) == 0 {
+		delete(histories, rel)
+	} else {
+		histories[rel] = kept
+	}
+	return len(history) - len(kept)
+}
+
+// Removes every version the rules no longer keep, and any content nothing needs any more
+func Prune() {
+	historiesLock.Lock()
+	for rel := range histories {
+		prune(rel, time.Now())
+	}
+	if err := save(); err != nil {
+		logger.Error("Couldn't save versions", "err", err)
+	}
+	historiesLock.Unlock()
+
+	if _, err := content.Sweep(); err != nil {
+		logger.Error("Couldn't sweep the content store", "err", err)
+	}
+}
+
+// Prunes the versions every 'interval', so old versions expire
+func PruneRegularly(interval time.Duration) {
+	for range time.Tick(interval) {
+		Prune()
+	}
+}
+
+// Gets the versions of the file at 'rel' (relative to the root), oldest first
+func List(rel string) []*Version {
+	historiesLock.RLock()
+	defer historiesLock.RUnlock()
+
+	return append([]*Version(nil), histories[rel]...)
+}
+
+// Gets version 'number' of the file at 'rel', nil if there isn't one
+func Get(rel string, number uint64) *Version {
+	for _, version := range List(rel) {
+		if version.Number == number {
+			return version
+		}
+	}
+	return nil
+}
+
+// Gets the path of every file with versions, sorted
+func Paths() []string {
+	historiesLock.RLock()
+	defer historiesLock.RUnlock()
+
+	paths := make([]string, 0, len(histories))
+	for rel := range histories {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Describes the versions of a file, one per line, for the extended attribute
+func Describe(history []*Version) string {
+	var b strings.Builder
+	for _, version := range history {
+		fmt.Fprintf(&b, "%d %v %d\n", version.Number, version.Saved.UTC().Format(time.RFC3339), version.Metadata.Size)
+	}
+	return b.String()
+}
+
+// Parses "restore <number>", the value the extended attribute is set to
+func ParseRestore(value string) (uint64, error) {
+	var number uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(value), "restore %d", &number); err != nil {
+		return 0, fmt.Errorf("expected {restore <number>}, not {%v}", strings.TrimSpace(value))
+	}
+	return number, nil
+}
+
+// Gets the hash of every content a version has, including those waiting to be committed
+func referenced() [][64]byte {
+	historiesLock.RLock()
+	defer historiesLock.RUnlock()
+
+	var hashes [][64]byte
+	for _, history := range histories {
+		for _, version := range history {
+			hashes = append(hashes, version.Hash)
+		}
+	}
+	for version := range pending {
+		hashes = append(hashes, version.Hash)
+	}
+	return hashes
+}
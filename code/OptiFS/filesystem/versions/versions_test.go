@@ -0,0 +1,211 @@
+package versions
+
+import (
+	"filesystem/content"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Sets up versions for a temporary filesystem, returning the save location and the root
+func setupVersions(t *testing.T, rules []Rule) (string, string) {
+	save, root := t.TempDir(), t.TempDir()
+	content.Setup(filepath.Join(save, "content"), true)
+	if err := Setup(save, root, true); err != nil {
+		t.Fatal(err)
+	}
+	SetRules(rules)
+	t.Cleanup(func() { SetRules(nil) })
+	return save, root
+}
+
+// Writes a file, keeping its previous version the same way OptiFS does when it's opened and released
+func rewrite(t *testing.T, nodePath string, data string) {
+	version, err := Preserve(nodePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(nodePath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if version != nil {
+		Commit(nodePath, version)
+	}
+}
+
+// Unit test for ruleFor in versions.go
+func TestRuleFor(t *testing.T) {
+	setupVersions(t, []Rule{
+		{Path: "/", Keep: 1},
+		{Path: "/projects", Keep: 10, Days: 30},
+		{Path: "/projects/scratch", Keep: 0, Days: 0},
+	})
+
+	testCases := []struct {
+		rel  string
+		keep int
+		ok   bool
+	}{
+		{"/notes.txt", 1, true},
+		{"/projects/plan.txt", 10, true},
+		{"/projectsx/plan.txt", 1, true},
+		{"/projects/scratch/tmp.txt", 0, false},
+	}
+	for _, tc := range testCases {
+		rule, ok := ruleFor(tc.rel)
+		if ok != tc.ok || (ok && rule.Keep != tc.keep) {
+			t.Errorf("Expected {%v} to keep %v (%v), got %+v (%v)", tc.rel, tc.keep, tc.ok, rule, ok)
+		}
+	}
+}
+
+// Unit test for Preserve, Commit, Discard and List in versions.go
+func TestCommit(t *testing.T) {
+	_, root := setupVersions(t, []Rule{{Path: "/kept", Keep: 2}})
+	os.Mkdir(filepath.Join(root, "kept"), 0755)
+	file := filepath.Join(root, "kept", "file")
+	unversioned := filepath.Join(root, "other")
+
+	// A file being created has no previous version
+	rewrite(t, file, "one")
+	rewrite(t, file, "two")
+	rewrite(t, file, "three")
+	rewrite(t, file, "four")
+	rewrite(t, unversioned, "one")
+	rewrite(t, unversioned, "two")
+
+	history := List("/kept/file")
+	if len(history) != 2 || history[0].Number != 2 || history[1].Number != 3 {
+		t.Fatalf("Expected versions 2 and 3, got %v", history)
+	}
+	if data, err := os.ReadFile(content.Path(history[1].Hash)); err != nil || string(data) != "three" {
+		t.Errorf("Expected the content of version 3 in the store, got {%s} (%v)", data, err)
+	}
+	if history[1].Metadata.Size != int64(len("three")) {
+		t.Errorf("Expected the size of the version, got %v", history[1].Metadata.Size)
+	}
+	if List("/other") != nil || !reflect.DeepEqual(Paths(), []string{"/kept/file"}) {
+		t.Errorf("Expected no versions outside the rules, got %v", Paths())
+	}
+	if Get("/kept/file", 1) != nil || Get("/kept/file", 3) == nil {
+		t.Errorf("Expected version 1 to have been pruned")
+	}
+
+	// Only the content of kept versions stays in the store
+	entries, _ := os.ReadDir(filepath.Dir(content.Path([64]byte{})))
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 contents in the store, got %v", len(entries))
+	}
+
+	// A file that didn't change keeps no new version
+	version, _ := Preserve(file)
+	Discard(version)
+	if len(List("/kept/file")) != 2 || len(referenced()) != 2 {
+		t.Errorf("Expected the discarded version to be forgotten")
+	}
+}
+
+// Unit test for prune in versions.go
+func TestPrune(t *testing.T) {
+	setupVersions(t, nil)
+	now := time.Now()
+	day := 24 * time.Hour
+
+	testCases := []struct {
+		name string
+		rule Rule
+		kept []uint64
+	}{
+		{"by count", Rule{Path: "/", Keep: 2}, []uint64{3, 4}},
+		{"by age", Rule{Path: "/", Days: 7}, []uint64{3, 4}},
+		{"whichever keeps longer", Rule{Path: "/", Keep: 1, Days: 15}, []uint64{2, 3, 4}},
+		{"turned off", Rule{Path: "/"}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rulesLock.Lock()
+			rules = []Rule{tc.rule}
+			rulesLock.Unlock()
+
+			histories["/file"] = []*Version{
+				{Number: 1, Saved: now.Add(-30 * day)},
+				{Number: 2, Saved: now.Add(-10 * day)},
+				{Number: 3, Saved: now.Add(-2 * day)},
+				{Number: 4, Saved: now},
+			}
+			removed := prune("/file", now)
+
+			var kept []uint64
+			for _, version := range histories["/file"] {
+				kept = append(kept, version.Number)
+			}
+			if !reflect.DeepEqual(kept, tc.kept) || removed != 4-len(tc.kept) {
+				t.Errorf("Expected %v kept, got %v (%v removed)", tc.kept, kept, removed)
+			}
+		})
+	}
+}
+
+// Unit test for Setup and save in versions.go
+func TestSetup(t *testing.T) {
+	save, root := setupVersions(t, []Rule{{Path: "/", Keep: 5}})
+	file := filepath.Join(root, "file")
+	rewrite(t, file, "one")
+	rewrite(t, file, "two")
+
+	// The versions are loaded again when OptiFS restarts
+	if err := Setup(save, root, true); err != nil {
+		t.Fatal(err)
+	}
+	if history := List("/file"); len(history) != 1 || history[0].Number != 1 {
+		t.Fatalf("Expected the saved version, got %v", history)
+	}
+
+	// Read-only mounts load the versions but never save them
+	if err := Setup(save, root, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(List("/file")) != 1 {
+		t.Errorf("Expected the versions to be loaded read-only")
+	}
+	rewrite(t, file, "three")
+	if err := Setup(save, root, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(List("/file")) != 1 {
+		t.Errorf("Expected nothing to be saved by a read-only mount")
+	}
+}
+
+// Unit test for Describe and ParseRestore in versions.go
+func TestDescribe(t *testing.T) {
+	saved := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	history := []*Version{{Number: 4, Saved: saved}, {Number: 7, Saved: saved.Add(time.Hour)}}
+	history[0].Metadata.Size = 10
+	history[1].Metadata.Size = 20
+
+	expected := "4 2024-03-01T12:00:00Z 10\n7 2024-03-01T13:00:00Z 20\n"
+	if described := Describe(history); described != expected {
+		t.Errorf("Expected {%v}, got {%v}", expected, described)
+	}
+
+	testCases := []struct {
+		value  string
+		number uint64
+		ok     bool
+	}{
+		{"restore 7", 7, true},
+		{"restore 7\n", 7, true},
+		{"restore", 0, false},
+		{"revert 7", 0, false},
+		{"restore -1", 0, false},
+	}
+	for _, tc := range testCases {
+		number, err := ParseRestore(tc.value)
+		if (err == nil) != tc.ok || number != tc.number {
+			t.Errorf("Parsing {%q}: expected %v (%v), got %v (%v)", tc.value, tc.number, tc.ok, number, err)
+		}
+	}
+}
@@ -4,11 +4,12 @@ package vfs
 
 import (
 	"context"
+	"filesystem/audit"
 	"filesystem/metadata"
 	"filesystem/permissions"
 	"fmt"
-	"log"
 	"os/user"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -22,7 +23,7 @@ import (
 // Assumes either an OptiFSNode input, or an OptiFSFile input.
 func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadata, in *fuse.SetAttrIn, n *OptiFSNode, f *OptiFSFile, out *fuse.AttrOut, isDir bool) syscall.Errno {
 
-    log.Printf("Setting node attributes for {%v}...\n", n.RPath())
+    logger.Debug("Setting node attributes", "path", n.RPath())
 
 	// If we need to - Manually change the underlying attributes ourselves
 	var isOwner bool
@@ -31,41 +32,56 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 
 	// Check owner and write permission status
 	if customMetadata != nil {
-		log.Println("We have custom metadata!")
+		logger.Debug("We have custom metadata!")
 		isOwner = permissions.IsOwner(ctx, customMetadata)
-		hasWrite = permissions.CheckPermissions(ctx, customMetadata, 1)
+		// Write permission is only needed (and checked, and audited) to change the size or times
+		_, sizeOk := in.GetSize()
+		_, mtimeOk := in.GetMTime()
+		_, atimeOk := in.GetATime()
+		if sizeOk || mtimeOk || atimeOk {
+			hasWrite = permissions.CheckPermissions(ctx, customMetadata, 1)
+		}
 		path = customMetadata.Path
 	} else {
-		log.Println("No custom metadata!")
+		logger.Debug("No custom metadata!")
 		path = n.RPath()
 	}
 
 	// If the mode needs to be changed
 	if mode, ok := in.GetMode(); ok {
-        log.Println("Setting node MODE...")
+        logger.Debug("Setting node MODE...")
+		modeDetail := fmt.Sprintf("mode=%o", mode)
 		if customMetadata != nil {
 			// Ensure the user has ownership of the file
 			if !isOwner {
+				auditChange(ctx, audit.Chmod, path, syscall.EACCES, modeDetail)
 				return syscall.EACCES
 			}
+			// Only members of the node's group can set the setgid bit
+			mode = permissions.SanitiseSetgid(ctx, customMetadata, mode)
 			// Try and modify our custom metadata system first
 			metadata.UpdateMode(customMetadata, &mode, isDir)
+			// Keep the node's access ACL (if it has one) in line with the new mode
+			permissions.UpdateACLMode(customMetadata, mode, isDir)
 			// Otherwise, just handle the underlying node
 		} else {
 			// Change the mode to the new mode in the node if provided
 			if n != nil {
 				if err := syscall.Chmod(path, mode); err != nil {
+					auditChange(ctx, audit.Chmod, path, fs.ToErrno(err), modeDetail)
 					return fs.ToErrno(err)
 				}
-				log.Println("Set MODE in underlying filesystem")
+				logger.Debug("Set MODE in underlying filesystem")
 			} else if f != nil {
 			// Change the mode to the new mode in the file if provided
 				if err := syscall.Fchmod(f.fdesc, mode); err != nil {
+					auditChange(ctx, audit.Chmod, path, fs.ToErrno(err), modeDetail)
 					return fs.ToErrno(err)
 				}
-				log.Println("Set MODE through filehandle")
+				logger.Debug("Set MODE through filehandle")
 			}
 		}
+		auditChange(ctx, audit.Chmod, path, fs.OK, modeDetail)
 	}
 
 	// Try and get UID and GID
@@ -73,7 +89,7 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 	gid, gok := in.GetGID()
 	// If we have a UID or GID to set
 	if uok || gok {
-        log.Println("Setting node UID & GID...")
+        logger.Debug("Setting node UID & GID...")
 		// Set their default values to -1
 		// -1 indicates that the respective value shouldn't change
 		safeUID, safeGID := -1, -1
@@ -93,10 +109,12 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 			}
 			safeGID = int(gid)
 		}
+		ownerDetail := fmt.Sprintf("uid=%d gid=%d", safeUID, safeGID)
 		// Try and update our custom metadata system isntead
 		if customMetadata != nil {
 			// Ensure the user is the current owner
 			if !isOwner {
+				auditChange(ctx, audit.Chown, path, syscall.EACCES, ownerDetail)
 				return syscall.EACCES
 			}
 			// As our update function works on optional pointers, convert
@@ -111,6 +129,11 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 				tmp := uint32(safeGID)
 				saferGID = &tmp
 			}
+			// The new owner is charged for the node from now on
+			if errno := checkChownQuota(ctx, customMetadata, saferUID, saferGID, isDir); errno != fs.OK {
+				auditChange(ctx, audit.Chown, path, errno, ownerDetail)
+				return errno
+			}
 			metadata.UpdateOwner(customMetadata, saferUID, saferGID, isDir)
 			// Otherwise, just update the underlying node instead
 		} else {
@@ -118,18 +141,21 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 				// Chown these values
 				err := syscall.Chown(path, safeUID, safeGID)
 				if err != nil {
+					auditChange(ctx, audit.Chown, path, fs.ToErrno(err), ownerDetail)
 					return fs.ToErrno(err)
 				}
-				log.Println("Set UID & GID in underlying filesystem")
+				logger.Debug("Set UID & GID in underlying filesystem")
 			} else if f != nil { // Update the underlying file hande if provided
 				// Chown these values
 				err := syscall.Fchown(f.fdesc, safeUID, safeGID)
 				if err != nil {
+					auditChange(ctx, audit.Chown, path, fs.ToErrno(err), ownerDetail)
 					return fs.ToErrno(err)
 				}
-				log.Println("Set UID & GID through filehandle")
+				logger.Debug("Set UID & GID through filehandle")
 			}
 		}
+		auditChange(ctx, audit.Chown, path, fs.OK, ownerDetail)
 	}
 
 	// Same thing for modification and access times
@@ -137,7 +163,7 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 	atime, aok := in.GetATime()
 	ctime, cok := in.GetCTime()
 	if mok || aok {
-		log.Println("Setting node time...")
+		logger.Debug("Setting node time...")
 		// Initialize pointers to the time values
 		ap := &atime
 		mp := &mtime
@@ -165,7 +191,7 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 		if customMetadata != nil {
 			// Ensure we have write permissions
 			if !hasWrite {
-				log.Println("User doesn't have permission to change time!")
+				logger.Debug("User doesn't have permission to change time!")
 				return syscall.EACCES
 			}
 			metadata.UpdateTime(customMetadata, &times[0], &times[1], &times[2], isDir)
@@ -177,7 +203,7 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 				if err := syscall.UtimesNano(path, times[:]); err != nil {
 					return fs.ToErrno(err)
 				}
-				log.Println("Updated time through node.")
+				logger.Debug("Updated time through node.")
 			} else if f != nil {
 				// Line below is from github user Hanwen's go-fuse/fuse/nodefs/syscall_linux.go
 				_, _, err := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(f.fdesc), 0, uintptr(unsafe.Pointer(&times)), uintptr(0), 0, 0)
@@ -185,37 +211,42 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 				if err != 0 {
 					return fs.ToErrno(err)
 				}
-				log.Println("Updated time through filehandle.")
+				logger.Debug("Updated time through filehandle.")
 			}
 		}
 	}
 
 	// If we have a size to update, do so as well
 	if size, ok := in.GetSize(); ok {
-		log.Println("Updating node size...")
+		logger.Debug("Updating node size...")
 		// First try and change the custom metadata system
 		if customMetadata != nil {
 			// Ensure we have write permissions to be updating the size
 			if !hasWrite {
-				log.Println("User doesn't have permission to change the size!")
+				logger.Debug("User doesn't have permission to change the size!")
 				return syscall.EACCES
 			}
 			tmp := int64(size)
+			if !isDir {
+				if errno := checkGrowthQuota(ctx, path, customMetadata, tmp); errno != fs.OK {
+					return errno
+				}
+			}
 			metadata.UpdateSize(customMetadata, &tmp, isDir)
-			log.Println("Updated custom size")
+			logger.Debug("Updated custom size")
 		} else {
 			if n != nil { // Update the underlying node if available
 				if err := syscall.Truncate(path, int64(size)); err != nil {
 					return fs.ToErrno(err)
 				}
-				log.Println("Updated size in underlying filesystem.")
+				logger.Debug("Updated size in underlying filesystem.")
 			}
 			if f != nil { // Update the underlying filehandle if available
 				// Change the size
 				if err := fs.ToErrno(syscall.Ftruncate(f.fdesc, int64(size))); err != 0 {
 					return err
 				}
-				log.Println("Updated size through filehandle.")
+				logger.Debug("Updated size through filehandle.")
 			}
 		}
 	}
@@ -224,7 +255,7 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 		// Now reflect these changes in the out stream
 		// Use our custom datastruct if we can
 		if customMetadata != nil {
-			log.Println("Reflecting custom attributes changes!")
+			logger.Debug("Reflecting custom attributes changes!")
 			// Fill the AttrOut with our custom attributes stored in our hash
 			metadata.FillAttrOut(customMetadata, out)
 
@@ -232,7 +263,7 @@ func SetAttributes(ctx context.Context, customMetadata *metadata.MapEntryMetadat
 		}
 
 		// Otherwise just stat the underlying file
-		log.Println("Reflecting underlying attributes changes!")
+		logger.Debug("Reflecting underlying attributes changes!")
 		stat := syscall.Stat_t{}
 		err := syscall.Lstat(path, &stat) // respect symlinks with lstat
 		if err != nil {
@@ -282,7 +313,7 @@ func HandleHardlinkInstantiation(ctx context.Context, n *OptiFSNode, targetPath,
 // Handles the creation of virtual nodes, ensuring we check and prioritise our persistent store to maintain data persistence
 func HandleNodeInstantiation(ctx context.Context, n *OptiFSNode, nodePath string, name string, s *syscall.Stat_t, out *fuse.EntryOut, fdesc *int, flags *uint32) (syscall.Errno, *fs.Inode, *OptiFSFile) {
 
-	log.Println("Handling Node Instantiation")
+	logger.Debug("Handling Node Instantiation")
 
 	var fh *OptiFSFile
 
@@ -290,7 +321,7 @@ func HandleNodeInstantiation(ctx context.Context, n *OptiFSNode, nodePath string
 	ferr, sIno, sMode, sGen, _, isDir, existingHash, existingRef := metadata.RetrieveNodeInfo(nodePath)
 	// If we got an error (it doesn't exist) OR we have an uninitialised node (ref == 0, hash == [000...000] that isn't a directory)
 	if ferr != fs.OK || ((existingRef == 0 && existingHash == [64]byte{}) && s.Mode&syscall.S_IFMT != syscall.S_IFDIR) { // If custom node doesn't exist, create a new one
-		log.Println("Persistent node entry doesn't exist - NEW VIRTUAL NODE")
+		logger.Debug("Persistent node entry doesn't exist - NEW VIRTUAL NODE")
 
 		// Create a new node to represent the underlying looked up file
 		// or directory in our VFS
@@ -309,14 +340,14 @@ func HandleNodeInstantiation(ctx context.Context, n *OptiFSNode, nodePath string
 		if s.Mode&syscall.S_IFMT == syscall.S_IFDIR {
 			// Store the persistent data
 			metadata.StoreDirInfo(nodePath, &stable, s.Mode)
-			log.Println("Stored directory persistent data")
+			logger.Debug("Stored directory persistent data")
 			// Create and store the custom metadata
 			metadata.CreateDirEntry(nodePath)
 			metadata.UpdateDirEntry(nodePath, s, &stable)
-			log.Println("Stored directory custom metadata")
+			logger.Debug("Stored directory custom metadata")
 		} else {
 			// Store the persistent data
-			log.Println("Stored regular file persistent data")
+			logger.Debug("Stored regular file persistent data")
 			metadata.StoreRegFileInfo(nodePath, &stable, s.Mode, [64]byte{}, 0)
 			// Don't create a custom metadata entry here;
 			//     custom metadata for regular files are indexed by their content's index
@@ -329,14 +360,14 @@ func HandleNodeInstantiation(ctx context.Context, n *OptiFSNode, nodePath string
 		return fs.OK, x, fh
 	}
 
-	log.Printf("Found existing persistent node entry - CONSTRUCTING EXISTING VIRTUAL NODE")
+	logger.Debug("Found existing persistent node entry - CONSTRUCTING EXISTING VIRTUAL NODE")
 
 	stable := &fs.StableAttr{Ino: sIno, Mode: sMode, Gen: sGen}
 
 	var nd fs.InodeEmbedder
 	// Create a node with the existing attributes we found
 	if !isDir {
-		log.Println("Node is a regular file")
+		logger.Debug("Node is a regular file")
 
 		nd = n.RootNode.existingNode(existingHash, existingRef)
 
@@ -357,13 +388,13 @@ func HandleNodeInstantiation(ctx context.Context, n *OptiFSNode, nodePath string
 		return fs.OK, x, fh
 
 	} else {
-		log.Println("Node is a directory")
+		logger.Debug("Node is a directory")
 
 		nd = n.RootNode.newNode(n.EmbeddedInode(), name, s)
 
 		cerr, customMetadata := metadata.LookupDirMetadata(nodePath)
 		if cerr != 0 {
-			log.Println("No custom metadata found - EXITING!")
+			logger.Debug("No custom metadata found - EXITING!")
 			return fs.ToErrno(syscall.ENODATA), nil, nil
 		}
 		metadata.FillAttr(customMetadata, &out.Attr)
@@ -373,3 +404,91 @@ func HandleNodeInstantiation(ctx context.Context, n *OptiFSNode, nodePath string
 		return fs.OK, x, fh
 	}
 }
+
+// Retrieves the custom metadata of the node at the path provided, whether it's a regular file or a directory
+func lookupNodeMetadata(path string) (syscall.Errno, *metadata.MapEntryMetadata) {
+	err, _, _, _, _, isDir, hash, ref := metadata.RetrieveNodeInfo(path)
+	if err != fs.OK {
+		return err, nil
+	}
+
+	if isDir {
+		return metadata.LookupDirMetadata(path)
+	}
+	return metadata.LookupRegularFileMetadata(hash, ref)
+}
+
+// Retrieves the owner of the node at the path provided, prioritising our custom metadata
+// and falling back onto the underlying node
+func lookupNodeOwner(path string) (syscall.Errno, uint32) {
+	if err, nodeMetadata := lookupNodeMetadata(path); err == fs.OK {
+		return fs.OK, nodeMetadata.Uid
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return fs.ToErrno(err), 0
+	}
+	return fs.OK, st.Uid
+}
+
+// Records the mode a node was created with in its custom metadata, along with any ACLs it
+// inherited from its parent directory. The file type bits of the node are kept.
+//
+// A mode of 0 means the creation mode is unknown, and the existing mode is left alone.
+func applyCreationMode(nodeMetadata *metadata.MapEntryMetadata, mode uint32, inherited map[string][]byte, isDir bool) {
+	if nodeMetadata == nil || mode == 0 {
+		return
+	}
+
+	newMode := (nodeMetadata.Mode & syscall.S_IFMT) | (mode & 07777)
+	logger.Debug("Recording creation mode", "mode", fmt.Sprintf("%o", newMode))
+	metadata.UpdateMode(nodeMetadata, &newMode, isDir)
+
+	permissions.ApplyInheritedACL(nodeMetadata, mode, inherited, isDir)
+}
+
+// Guards the creation of the ROOT directory's custom metadata
+var rootMetadataLock sync.Mutex
+
+// Retrieves the custom metadata holding the extended attributes of a node, and whether it's a directory.
+//
+// The ROOT directory has no persistent data, so its custom metadata is only created when 'create'
+// is set (when it's first given an extended attribute).
+func (n *OptiFSNode) xattrMetadata(create bool) (syscall.Errno, *metadata.MapEntryMetadata, bool) {
+	path := n.RPath()
+
+	if n.IsRoot() {
+		rootMetadataLock.Lock()
+		defer rootMetadataLock.Unlock()
+
+		err, rootMetadata := metadata.LookupDirMetadata(path)
+		if err == fs.OK || !create {
+			return err, rootMetadata, true
+		}
+
+		logger.Debug("Creating custom metadata for the ROOT directory...")
+		var st syscall.Stat_t
+		if statErr := syscall.Stat(path, &st); statErr != nil {
+			return fs.ToErrno(statErr), nil, true
+		}
+		metadata.CreateDirEntry(path)
+		stableAttr := n.StableAttr()
+		if updateErr := metadata.UpdateDirEntry(path, &st, &stableAttr); updateErr != fs.OK {
+			return updateErr, nil, true
+		}
+		err, rootMetadata = metadata.LookupDirMetadata(path)
+		return err, rootMetadata, true
+	}
+
+	err, _, _, _, _, isDir, hash, ref := metadata.RetrieveNodeInfo(path)
+	if err != fs.OK {
+		return err, nil, isDir
+	}
+	if isDir {
+		err, dirMetadata := metadata.LookupDirMetadata(path)
+		return err, dirMetadata, isDir
+	}
+	err, fileMetadata := metadata.LookupRegularFileMetadata(hash, ref)
+	return err, fileMetadata, isDir
+}
@@ -0,0 +1,326 @@
+// This file contains the virtual /.optifs directory, which shows what OptiFS is doing from inside the mount
+
+package vfs
+
+import (
+	"context"
+	"encoding/hex"
+	"filesystem/metadata"
+	"filesystem/permissions"
+	"filesystem/quota"
+	"filesystem/trash"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// The name of the control directory in the root of the filesystem
+const ControlDirName = ".optifs"
+
+// The version of OptiFS, shown in /.optifs/version. Set when building with
+// -ldflags "-X filesystem/vfs.Version=<version>"
+var Version = "dev"
+
+// When the filesystem was mounted
+var mountedAt = time.Now()
+
+// Checks if 'name' in this directory is the control, snapshots, versions or trash directory, which
+// can't be created, removed or renamed through the filesystem
+func (n *OptiFSNode) isControlDir(name string) bool {
+	return isHiddenName(name) && n.IsRoot()
+}
+
+// Checks if 'name' is one of the directories in the root OptiFS keeps for itself
+func isHiddenName(name string) bool {
+	return name == ControlDirName || name == SnapshotDirName || name == VersionsDirName || name == trash.DirName
+}
+
+// Builds the control, snapshots and versions directories under the root, they only exist in memory
+func (n *OptiFSNode) addControlDir(ctx context.Context) {
+	logger.Debug("Adding control directory", "name", ControlDirName)
+	mountedAt = time.Now()
+
+	controlDir := n.NewPersistentInode(ctx, &controlDirNode{}, fs.StableAttr{Mode: syscall.S_IFDIR})
+	n.AddChild(ControlDirName, controlDir, true)
+
+	files := map[string]*controlFileNode{
+		"stats":   {render: renderStats},
+		"version": {render: renderVersion},
+		"usage":   {render: renderUsage},
+		"quota":   {render: renderQuota},
+		"health":  {render: renderHealth},
+	}
+	for name, file := range files {
+		controlDir.AddChild(name, controlDir.NewPersistentInode(ctx, file, fs.StableAttr{Mode: syscall.S_IFREG}), true)
+	}
+
+	dedupDir := controlDir.NewPersistentInode(ctx, &controlDirNode{}, fs.StableAttr{Mode: syscall.S_IFDIR})
+	controlDir.AddChild("dedup", dedupDir, true)
+	dedupDir.AddChild("by-hash", dedupDir.NewPersistentInode(ctx, &byHashDirNode{rootPath: n.RootNode.Path}, fs.StableAttr{Mode: syscall.S_IFDIR}), true)
+
+	n.AddChild(SnapshotDirName, n.NewPersistentInode(ctx, &snapshotsDirNode{}, fs.StableAttr{Mode: syscall.S_IFDIR}), true)
+	n.AddChild(VersionsDirName, n.NewPersistentInode(ctx, &versionsDirNode{rootPath: n.RootNode.Path, rel: "/"}, fs.StableAttr{Mode: syscall.S_IFDIR}), true)
+}
+
+// Lists the root directory, leaving out anything on the underlying filesystem with the same name
+// as the control, snapshots or versions directory, which are themselves hidden, and the trash
+func hideControlDir(rootPath string) (fs.DirStream, syscall.Errno) {
+	stream, errno := fs.NewLoopbackDirStream(rootPath)
+	if errno != fs.OK {
+		return nil, errno
+	}
+	defer stream.Close()
+
+	var entries []fuse.DirEntry
+	for stream.HasNext() {
+		entry, errno := stream.Next()
+		if errno != fs.OK {
+			return nil, errno
+		}
+		if !isHiddenName(entry.Name) {
+			entries = append(entries, entry)
+		}
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+// Fills in the attributes shared by everything in the control directory, owned by the sysadmin
+func fillControlAttr(out *fuse.Attr, mode uint32) {
+	out.Mode = mode
+	current := permissions.GetSysadmin()
+	out.Uid = current.UID
+	out.Gid = current.GID
+	out.Nlink = 1
+	t := uint64(mountedAt.Unix())
+	out.Atime, out.Mtime, out.Ctime = t, t, t
+}
+
+// A directory in the control directory, its entries are its (persistent) children
+type controlDirNode struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeGetattrer)((*controlDirNode)(nil))
+
+func (d *controlDirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillControlAttr(&out.Attr, syscall.S_IFDIR|0555)
+	return fs.OK
+}
+
+// A read-only file in the control directory, its contents are generated when it's opened
+type controlFileNode struct {
+	fs.Inode
+	adminOnly bool
+	render    func(ctx context.Context) []byte
+}
+
+var _ = (fs.NodeGetattrer)((*controlFileNode)(nil))
+var _ = (fs.NodeOpener)((*controlFileNode)(nil))
+var _ = (fs.NodeReader)((*controlFileNode)(nil))
+var _ = (fs.NodeSetattrer)((*controlFileNode)(nil))
+
+// The contents of a control file, as they were when it was opened
+type controlFileHandle struct {
+	data []byte
+}
+
+func (c *controlFileNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	mode := uint32(0444)
+	if c.adminOnly {
+		mode = 0400
+	}
+	fillControlAttr(&out.Attr, syscall.S_IFREG|mode)
+	// The size isn't known until it's opened, the same as /proc
+	if handle, ok := f.(*controlFileHandle); ok {
+		out.Size = uint64(len(handle.data))
+	}
+	return fs.OK
+}
+
+func (c *controlFileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if c.adminOnly && !permissions.HasRole(ctx, permissions.RoleAuditor) {
+		return nil, 0, syscall.EACCES
+	}
+
+	// Direct IO, as the size reported before opening is 0
+	return &controlFileHandle{data: c.render(ctx)}, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+func (c *controlFileNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	handle, ok := f.(*controlFileHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	if off >= int64(len(handle.data)) {
+		return fuse.ReadResultData(nil), fs.OK
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(handle.data)) {
+		end = int64(len(handle.data))
+	}
+	return fuse.ReadResultData(handle.data[off:end]), fs.OK
+}
+
+func (c *controlFileNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return syscall.EROFS
+}
+
+// /.optifs/dedup/by-hash - a file for every shared content, named by its hash, listing the paths sharing it.
+// Only the sysadmin (and auditors) can see it, as it reveals the paths of files anywhere in the filesystem.
+type byHashDirNode struct {
+	fs.Inode
+	rootPath string // the root of the underlying filesystem, trimmed from the paths
+}
+
+var _ = (fs.NodeGetattrer)((*byHashDirNode)(nil))
+var _ = (fs.NodeLookuper)((*byHashDirNode)(nil))
+var _ = (fs.NodeReaddirer)((*byHashDirNode)(nil))
+
+func (d *byHashDirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillControlAttr(&out.Attr, syscall.S_IFDIR|0500)
+	return fs.OK
+}
+
+func (d *byHashDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !permissions.HasRole(ctx, permissions.RoleAuditor) {
+		return nil, syscall.EACCES
+	}
+
+	decoded, err := hex.DecodeString(name)
+	if err != nil || len(decoded) != 64 {
+		return nil, syscall.ENOENT
+	}
+	var hash [64]byte
+	copy(hash[:], decoded)
+
+	if len(metadata.PathsWithContent(hash)) == 0 {
+		return nil, syscall.ENOENT
+	}
+
+	file := &controlFileNode{adminOnly: true, render: func(ctx context.Context) []byte {
+		var b strings.Builder
+		for _, path := range metadata.PathsWithContent(hash) {
+			fmt.Fprintln(&b, d.mountPath(path))
+		}
+		return []byte(b.String())
+	}}
+	fillControlAttr(&out.Attr, syscall.S_IFREG|0400)
+	return d.NewInode(ctx, file, fs.StableAttr{Mode: syscall.S_IFREG}), fs.OK
+}
+
+func (d *byHashDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if !permissions.HasRole(ctx, permissions.RoleAuditor) {
+		return nil, syscall.EACCES
+	}
+
+	var names []string
+	for _, hash := range metadata.SharedContents() {
+		names = append(names, hex.EncodeToString(hash[:]))
+	}
+	sort.Strings(names)
+
+	entries := make([]fuse.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = fuse.DirEntry{Name: name, Mode: syscall.S_IFREG}
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+// Converts a path on the underlying filesystem to the path inside the mount
+func (d *byHashDirNode) mountPath(path string) string {
+	rel, err := filepath.Rel(d.rootPath, path)
+	if err != nil {
+		return path
+	}
+	return "/" + rel
+}
+
+// /.optifs/stats - the size of the filesystem and how much de-duplication is saving
+func renderStats(ctx context.Context) []byte {
+	files, dirs := metadata.CountNodes()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "uptime:          %v\n", time.Since(mountedAt).Round(time.Second))
+	fmt.Fprintf(&b, "directories:     %d\n", dirs)
+	fmt.Fprintf(&b, "tracked files:   %d\n", files)
+	fmt.Fprintf(&b, "%v\n", metadata.GetDedupStatistics())
+	return []byte(b.String())
+}
+
+// /.optifs/version
+func renderVersion(ctx context.Context) []byte {
+	return []byte(fmt.Sprintf("OptiFS %v (%v, %v/%v)\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH))
+}
+
+// /.optifs/usage - how much each user owns, the sysadmin, quota admins and auditors see everyone, anyone else only themselves
+func renderUsage(ctx context.Context) []byte {
+	usage := metadata.UsageByOwner()
+
+	var uids []uint32
+	if permissions.HasRole(ctx, permissions.RoleQuotaAdmin) || permissions.HasRole(ctx, permissions.RoleAuditor) {
+		for uid := range usage {
+			uids = append(uids, uid)
+		}
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	} else if errno, uid, _ := permissions.GetUIDGID(ctx); errno == fs.OK {
+		uids = []uint32{uid}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-10s %-10s %s\n", "uid", "files", "bytes")
+	for _, uid := range uids {
+		fmt.Fprintf(&b, "%-10d %-10d %d\n", uid, usage[uid].Files, usage[uid].Bytes)
+	}
+	return []byte(b.String())
+}
+
+// /.optifs/quota - the quotas and usage of everyone with a quota for quota admins and auditors, anyone
+// else only sees their own user and group
+func renderQuota(ctx context.Context) []byte {
+	var list []quota.Status
+	if permissions.HasRole(ctx, permissions.RoleQuotaAdmin) || permissions.HasRole(ctx, permissions.RoleAuditor) {
+		list = quota.List()
+	} else if errno, uid, gid := permissions.GetUIDGID(ctx); errno == fs.OK {
+		list = []quota.Status{quota.Get(quota.Owner{Kind: quota.User, ID: uid}), quota.Get(quota.Owner{Kind: quota.Group, ID: gid})}
+	}
+	return []byte(quota.Describe(list, time.Now()) + "\n")
+}
+
+// /.optifs/health - whether OptiFS is running normally, and how its last save and integrity check went
+func renderHealth(ctx context.Context) []byte {
+	health := metadata.GetHealth()
+
+	status := "ok"
+	if IsShuttingDown() {
+		status = "shutting down"
+	} else if health.LastSaveError != nil {
+		status = "degraded"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "status:               %v\n", status)
+	switch {
+	case health.LastSave.IsZero():
+		fmt.Fprintf(&b, "last save:            never\n")
+	case health.LastSaveError != nil:
+		fmt.Fprintf(&b, "last save:            %v (failed: %v)\n", health.LastSave.Format(time.RFC3339), health.LastSaveError)
+	default:
+		fmt.Fprintf(&b, "last save:            %v\n", health.LastSave.Format(time.RFC3339))
+	}
+	if health.LastIntegrityCheck.IsZero() {
+		fmt.Fprintf(&b, "last integrity check: never\n")
+	} else {
+		fmt.Fprintf(&b, "last integrity check: %v (%d stale nodes removed)\n", health.LastIntegrityCheck.Format(time.RFC3339), health.StaleNodesRemoved)
+	}
+	return []byte(b.String())
+}
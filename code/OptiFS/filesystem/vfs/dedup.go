@@ -0,0 +1,72 @@
+// This file contains the policy deciding which files are de-duplicated when they're released
+
+package vfs
+
+import (
+	"filesystem/metrics"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Whether released files were de-duplicated (hit), had new content (miss) or were kept out of
+// de-duplication by the policy (excluded), and the space the hits saved
+var dedupLookups = metrics.NewCounter("optifs_dedup_lookups", "Released files that were de-duplicated (hit), had new content (miss) or were excluded by the de-duplication policy (excluded).", "result")
+var dedupReclaimedBytes = metrics.NewCounter("optifs_dedup_reclaimed_bytes", "Bytes freed by de-duplicating released files.")
+
+// DedupRule overrides the de-duplication policy for everything under a directory
+type DedupRule struct {
+	Path    string // relative to the root of the filesystem, e.g. "/scratch"
+	Enabled bool
+	MinSize int64
+}
+
+// DedupPolicy decides which files are de-duplicated
+type DedupPolicy struct {
+	Enabled bool
+	MinSize int64 // files smaller than this (in bytes) are never de-duplicated
+	Rules   []DedupRule
+}
+
+// De-duplicate everything by default
+var dedupPolicy = DedupPolicy{Enabled: true}
+var dedupPolicyLock sync.RWMutex
+
+// Replaces the de-duplication policy, it applies to every file released from now on
+func SetDedupPolicy(policy DedupPolicy) {
+	dedupPolicyLock.Lock()
+	defer dedupPolicyLock.Unlock()
+
+	dedupLogger.Info("Setting de-duplication policy", "policy", fmt.Sprintf("%+v", policy))
+	dedupPolicy = policy
+}
+
+// Decides whether a file (its path relative to the root of the filesystem) of 'size' bytes should be
+// de-duplicated. The rule for the closest directory above it wins, otherwise the defaults apply.
+func (p DedupPolicy) allows(relPath string, size int64) bool {
+	enabled, minSize := p.Enabled, p.MinSize
+
+	longest := -1
+	for _, rule := range p.Rules {
+		if rule.Path != "/" && relPath != rule.Path && !strings.HasPrefix(relPath, rule.Path+"/") {
+			continue
+		}
+		if len(rule.Path) > longest {
+			longest = len(rule.Path)
+			enabled, minSize = rule.Enabled, rule.MinSize
+		}
+	}
+
+	return enabled && size >= minSize
+}
+
+// Decides whether the file at 'nodePath' (on the underlying filesystem) should be de-duplicated
+func shouldDeduplicate(rootPath string, nodePath string, size int64) bool {
+	relPath := path.Clean("/" + strings.TrimPrefix(nodePath, rootPath))
+
+	dedupPolicyLock.RLock()
+	defer dedupPolicyLock.RUnlock()
+
+	return dedupPolicy.allows(relPath, size)
+}
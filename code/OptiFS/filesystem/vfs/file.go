@@ -6,9 +6,8 @@ import (
 	"context"
 	"filesystem/metadata"
 	"filesystem/permissions"
-	"time"
+	"filesystem/versions"
 
-	"log"
 	"sync"
 	"syscall"
 
@@ -35,6 +34,12 @@ type OptiFSFile struct {
 
 	// The flags of the file (OAPPEND, RWONLY, etc...)
 	flags uint32
+
+	// The version of the file kept when it was opened to be written, nil if versions aren't kept of it
+	previous *versions.Version
+
+	// Lets the content move to the cold tier again once the file is closed, nil if there's nothing to let go
+	release func()
 }
 
 // statuses used commonly throughout the system, to do with locks
@@ -58,26 +63,28 @@ var _ = (fs.FileSetlkwer)((*OptiFSFile)(nil)) // gets a lock on a file, waits fo
 // abstract reference to files, where the state of the file (open, offsets, reading etc)
 // can be tracked
 func NewOptiFSFile(fdesc int, attr fs.StableAttr, flags uint32, currentHash [64]byte, refNum uint64) *OptiFSFile {
-	log.Println("OptiFSFile handle created")
+	logger.Debug("OptiFSFile handle created")
 	return &OptiFSFile{fdesc: fdesc, attr: attr, flags: flags, currentHash: currentHash, refNum: refNum}
 }
 
 // handles read operations (implements concurrency)
 func (f *OptiFSFile) Read(ctx context.Context, dest []byte, offset int64) (fuse.ReadResult, syscall.Errno) {
+	req := f.startRequest(ctx, "READ")
+	defer req.done()
 
-	log.Println("Reading file")
+	req.Debug("Reading file", "offset", offset, "size", len(dest))
 
-	log.Println("Checking for custom permissions")
+	req.Debug("Checking for custom permissions")
 	// Check permissions of custom metadata (if available)
 	herr, fileMetadata := metadata.LookupRegularFileMetadata(f.currentHash, f.refNum)
 	if herr == fs.OK {
-		log.Println("Custom permissions found!")
-		allowed := permissions.CheckPermissions(ctx, fileMetadata, 0) // Check read perm
+		req.Debug("Custom permissions found!")
+		allowed := permissions.CheckHandlePermissions(ctx, fileMetadata, 0) // Check read perm
 		if !allowed {
-			log.Println("User isn't allowed to read file handle!")
+			req.Debug("User isn't allowed to read file handle!")
 			return nil, syscall.EACCES
 		}
-		log.Println("User is allowed to read file handle")
+		req.Debug("User is allowed to read file handle")
 	}
 
 	// lock the operation, and make sure it doesnt unlock until function is exited
@@ -85,14 +92,18 @@ func (f *OptiFSFile) Read(ctx context.Context, dest []byte, offset int64) (fuse.
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	// closed while shutting down, the descriptor may belong to something else by now
+	if f.fdesc < 0 {
+		return nil, syscall.EBADF
+	}
+
 	// read a specific amount of data (dest) from a specific point (offset) in the file
 	// Use the FUSE library's built-in
 	read := fuse.ReadResultFd(uintptr(f.fdesc), offset, len(dest))
 
-	// Update file's atime
-	if herr == fs.OK {
-		now := time.Now()
-		metadata.UpdateTime(fileMetadata, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, nil, nil, false)
+	// Update file's atime, if the atime policy calls for it (never when mounted read-only)
+	if herr == fs.OK && !IsReadOnly() {
+		metadata.TouchAtime(fileMetadata, false)
 	}
 
 	return read, fs.OK
@@ -104,6 +115,10 @@ func (f *OptiFSFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.fdesc < 0 {
+		return syscall.EBADF
+	}
+
 	// Perform an Fsync on the actual file in the underlying filesystem
 	return fs.ToErrno(syscall.Fsync(f.fdesc))
 }
@@ -114,6 +129,10 @@ func (f *OptiFSFile) Flush(ctx context.Context) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.fdesc < 0 {
+		return syscall.EBADF
+	}
+
 	// In order to force FUSE to flush without losing the file descriptor,
 	// we will dup the filedescriptor and then close it
 	tmpfd, err := syscall.Dup(f.fdesc)
@@ -138,15 +157,15 @@ func (f *OptiFSFile) Release(ctx context.Context) syscall.Errno {
 	if f.fdesc != -1 {
 		err = syscall.Close(f.fdesc)
 	}
-
-	if err != nil {
-		return fs.ToErrno(err)
+	if f.release != nil {
+		f.release()
+		f.release = nil
 	}
 
-	// notify that it's been released
+	// notify that it's been released, even if closing failed, as the descriptor is gone either way
 	f.fdesc = -1
 
-	return fs.OK
+	return fs.ToErrno(err)
 }
 
 // gets the status' of locks on a file
@@ -158,6 +177,10 @@ func (f *OptiFSFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock,
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.fdesc < 0 {
+		return syscall.EBADF
+	}
+
 	lock := syscall.Flock_t{}
 	lk.ToFlockT(&lock) // convert the FUSE file lock to a system file lock
 
@@ -177,6 +200,10 @@ func (f *OptiFSFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock,
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.fdesc < 0 {
+		return syscall.EBADF
+	}
+
 	lock := syscall.Flock_t{}
 	lk.ToFlockT(&lock) // convert the FUSE file lock to a system file lock
 
@@ -210,6 +237,10 @@ func (f *OptiFSFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.fdesc < 0 {
+		return syscall.EBADF
+	}
+
 	lock := syscall.Flock_t{}
 	lk.ToFlockT(&lock) // convert the FUSE file lock to a system file lock
 
@@ -0,0 +1,50 @@
+// This file contains the read-only and maintenance modes, which stop the filesystem being changed
+
+package vfs
+
+import (
+	"context"
+	"filesystem/permissions"
+	"sync/atomic"
+)
+
+// Set when mounted read-only, nothing can change the filesystem
+var readOnly atomic.Bool
+
+// Set while the sysadmin is repairing or migrating the metadata, only the sysadmin can change the filesystem
+var maintenance atomic.Bool
+
+// Makes the filesystem read-only, for audits and migrations. Only set when mounting.
+func SetReadOnly(on bool) {
+	logger.Info("Setting read-only mode", "on", on)
+	readOnly.Store(on)
+}
+
+// Whether the filesystem is mounted read-only
+func IsReadOnly() bool {
+	return readOnly.Load()
+}
+
+// Turns maintenance mode on or off, returning whether it was on before
+func SetMaintenance(on bool) bool {
+	logger.Info("Setting maintenance mode", "on", on)
+	return maintenance.Swap(on)
+}
+
+// Whether the filesystem is in maintenance mode
+func InMaintenance() bool {
+	return maintenance.Load()
+}
+
+// Decides whether the caller can change the filesystem, given the mode it's in
+func writesAllowed(ctx context.Context) bool {
+	if readOnly.Load() {
+		logger.Debug("Mounted read-only, refusing operation.")
+		return false
+	}
+	if maintenance.Load() && !permissions.IsUserSysadmin(&ctx) {
+		logger.Debug("In maintenance mode and not the sysadmin, refusing operation.")
+		return false
+	}
+	return true
+}
@@ -7,8 +7,11 @@ import (
 	"filesystem/hashing"
 	"filesystem/metadata"
 	"filesystem/permissions"
+	"filesystem/quota"
+	"filesystem/tier"
+	"filesystem/trash"
+	"filesystem/versions"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"sync"
@@ -89,17 +92,28 @@ var _ = (fs.NodeReadlinker)((*OptiFSNode)(nil)) // For reading symlinks
 // Statfs implements statistics for the filesystem that holds this
 // Inode.
 func (n *OptiFSNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	log.Println("Statting filesystem...")
+	req := n.startRequest(ctx, "STATFS")
+	defer req.done()
+
+	req.Debug("Statting filesystem...")
 	// As this is a loopback filesystem, we will stat the underlying filesystem.
 	var s syscall.Statfs_t = syscall.Statfs_t{}
 	err := syscall.Statfs(n.RPath(), &s)
 	if err != nil {
-		log.Println("Failed to stat underlying.")
+		req.Debug("Failed to stat underlying.")
 		return fs.ToErrno(err)
 	}
-	log.Printf("%v\n", s)
+	req.Debug("Statted underlying filesystem", "statfs", s)
+	if GetStatfsMode() == StatfsLogical {
+		logicalStatfs(&s, metadata.CachedDedupStatistics())
+		req.Debug("Converted to logical usage", "statfs", s)
+	}
+	if project := metadata.ProjectOf(n.RPath()); project != 0 {
+		projectStatfs(&s, quota.Get(quota.Owner{Kind: quota.Project, ID: project}), GetStatfsMode())
+		req.Debug("Limited to the project", "project", project, "statfs", s)
+	}
 	out.FromStatfsT(&s)
-	log.Println("Statted filesystem succesfully!")
+	req.Debug("Statted filesystem succesfully!")
 	return fs.OK
 }
 
@@ -121,15 +135,15 @@ func (n *OptiFSNode) IsAllowed(ctx context.Context) syscall.Errno {
 
 	// Logging
 	path := n.RPath()
-	log.Printf("Performing check for ROOT directory at {%v}\n", path)
+	logger.Debug("Performing check for ROOT directory", "path", path)
 
-	// if we're in the root directory
+	// if we're in the root directory, only admins are allowed (a subtree can't be the root)
 	if n.IsRoot() {
-		if !permissions.IsUserSysadmin(&ctx) {
+		if !permissions.IsUserAdminOf(ctx, path) {
 			return fs.ToErrno(syscall.EACCES)
 		}
 	} else {
-		log.Println("We are not in the ROOT directory, continue...")
+		logger.Debug("We are not in the ROOT directory, continue...")
 	}
 
 	return fs.OK
@@ -141,17 +155,17 @@ func (n *OptiFSNode) IsAllowedTwoLocations(ctx context.Context, newParent fs.Ino
 	// Logging
 	path := n.RPath()
 	opath := newParent.EmbeddedInode().Path(nil)
-	log.Printf("Performing check for ROOT directory at {%v} and {%v}\n", path, opath)
+	logger.Debug("Performing check for ROOT directory", "path", path, "other_path", opath)
 
 	dest := newParent.EmbeddedInode() // get the inode of the destination
 
 	// if the source or the destination is in the root directory
 	if n.IsRoot() || dest.IsRoot() {
-		if !permissions.IsUserSysadmin(&ctx) {
+		if !permissions.IsUserAdminOf(ctx, n.RootNode.Path) {
 			return fs.ToErrno(syscall.EACCES)
 		}
 	} else {
-		log.Println("We are not in the ROOT directory, continue...")
+		logger.Debug("We are not in the ROOT directory, continue...")
 	}
 
 	return fs.OK
@@ -185,7 +199,7 @@ func (n *OptiFSRoot) existingNode(existingHash [64]byte, existingRef uint64) fs.
 // calculate one using bit swapping
 func (n *OptiFSRoot) getNewStableAttr(s *syscall.Stat_t, path *string) fs.StableAttr {
 
-	log.Println("Generating new stable attr...")
+	logger.Debug("Generating new stable attr...")
 
 	// Otherwise, generate a new one
 	inodeInfoString := fmt.Sprintf("%s%d%d", *path, s.Dev, s.Ino)
@@ -207,23 +221,45 @@ func (n *OptiFSNode) GetAttr() fs.StableAttr {
 	return n.StableAttr()
 }
 
+// called when the node's inode is created, builds the control directory under the root
+func (n *OptiFSNode) OnAdd(ctx context.Context) {
+	if n.IsRoot() {
+		n.addControlDir(ctx)
+	}
+}
+
 // lookup FINDS A NODE based on its name
 func (n *OptiFSNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	req := n.startRequest(ctx, "LOOKUP")
+	defer req.done()
+
 	path := n.RPath()
 
-	log.Printf("LOOKUP performed for {%v} from node {%v}...\n", name, path)
+	req.Debug("LOOKUP performed", "name", name)
 
 	// Check execute permissions on the parent directory
-	log.Println("Looking for parent directory custom metadata...")
+	req.Debug("Looking for parent directory custom metadata...")
 	err1, dirMetadata := metadata.LookupDirMetadata(path)
 	if err1 == 0 {
-		log.Println("Checking permissions of parent directory...")
+		req.Debug("Checking permissions of parent directory...")
 		isAllowed := permissions.CheckPermissions(ctx, dirMetadata, 2) // Check exec permissions
 		if !isAllowed {
-			log.Println("Not allowed!")
+			req.Debug("Not allowed!")
 			return nil, fs.ToErrno(syscall.EACCES)
 		}
-		log.Println("Allowed!")
+		req.Debug("Allowed!")
+	}
+
+	// The control, snapshots and versions directories hide anything with the same name on the underlying
+	// filesystem, and the trash is hidden altogether
+	if n.isControlDir(name) {
+		if child := n.GetChild(name); child != nil {
+			fillControlAttr(&out.Attr, syscall.S_IFDIR|0555)
+			return child, fs.OK
+		}
+		if name == trash.DirName {
+			return nil, syscall.ENOENT
+		}
 	}
 
 	filePath := filepath.Join(n.RPath(), name) // getting the full path to the file (join name to path)
@@ -231,118 +267,132 @@ func (n *OptiFSNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut
 	err := syscall.Lstat(filePath, &s)         // gets the file attributes (also returns attrs of symbolic link)
 
 	if err != nil {
-		log.Printf("Underlying stat at {%v} failed!\n", filePath)
+		req.Debug("Underlying stat failed", "file", filePath)
 		return nil, fs.ToErrno(err)
 	}
 
 	oErr, oNode, _ := HandleNodeInstantiation(ctx, n, filePath, name, &s, out, nil, nil)
 
-	log.Println("Finished LOOKUP!")
+	req.Debug("Finished LOOKUP!")
 
 	return oNode, oErr
 }
 
 // opens a directory and then closes it
 func (n *OptiFSNode) Opendir(ctx context.Context) syscall.Errno {
+	req := n.startRequest(ctx, "OPENDIR")
+	defer req.done()
 
 	path := n.RPath()
-	log.Printf("OPENDIR performed for {%v}...\n", path)
+	req.Debug("OPENDIR performed")
 
 	// Check exec permissions if there is custom metadata
 	var customExists bool
 	err1, dirMetadata := metadata.LookupDirMetadata(path)
 	if err1 == fs.OK {
-		log.Println("Checking directory permissions...")
+		req.Debug("Checking directory permissions...")
 		isAllowed := permissions.CheckPermissions(ctx, dirMetadata, 2) // Check exec permissions
 		if !isAllowed {
-			log.Println("Not allowed!")
+			req.Debug("Not allowed!")
 			return fs.ToErrno(syscall.EACCES)
 		}
 		customExists = true
 	}
-	log.Println("Allowed!")
+	req.Debug("Allowed!")
 
-	log.Println("Attempting to open underlying directory...")
+	req.Debug("Attempting to open underlying directory...")
 
 	// Open the directory (n), 0755 is the default perms for a new directory
 	dir, err2 := syscall.Open(n.RPath(), syscall.O_DIRECTORY, 0755)
 	if err2 != nil {
-		log.Printf("Error opening dir - {%v}\n", err2)
+		req.Debug("Error opening dir", "err", err2)
 		return fs.ToErrno(err2)
 	}
-	// Update the access time of the custom metadata if it exists
-	if customExists {
-		now := time.Now()
-		metadata.UpdateTime(dirMetadata, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, nil, nil, true)
-		log.Println("Updating directory's timestamps in custom metadata.")
+	// Update the access time of the custom metadata if it exists (and the atime policy calls for it)
+	if customExists && !IsReadOnly() && metadata.TouchAtime(dirMetadata, true) {
+		req.Debug("Updating directory's timestamps in custom metadata.")
 	}
 
 	syscall.Close(dir) // close when finished
-	log.Println("Succesfully finished OPENDIR!")
+	req.Debug("Succesfully finished OPENDIR!")
 	return fs.OK
 }
 
 // opens a stream of dir entries,
 func (n *OptiFSNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	req := n.startRequest(ctx, "READDIR")
+	defer req.done()
 
 	path := n.RPath()
-	log.Printf("READDIR performed for {%v}...\n", path)
+	req.Debug("READDIR performed")
 
 	// Check read permissions if available
 	err1, dirMetadata := metadata.LookupDirMetadata(path)
 	if err1 == fs.OK {
-		log.Println("Checking permissions of directory...")
+		req.Debug("Checking permissions of directory...")
 		isAllowed := permissions.CheckPermissions(ctx, dirMetadata, 0)
 		if !isAllowed {
-			log.Println("Not allowed!")
+			req.Debug("Not allowed!")
 			return nil, fs.ToErrno(syscall.EACCES)
 		}
-		log.Println("Allowed!")
+		req.Debug("Allowed!")
+
+		// Reading the entries is an access, the same as reading a file
+		if !IsReadOnly() && metadata.TouchAtime(dirMetadata, true) {
+			req.Debug("Updating directory's timestamps in custom metadata.")
+		}
+	}
+
+	if n.IsRoot() {
+		req.Debug("Succesfully performed READDIR!")
+		return hideControlDir(path)
 	}
 
-	log.Println("Succesfully performed READDIR!")
+	req.Debug("Succesfully performed READDIR!")
 	return fs.NewLoopbackDirStream(path)
 }
 
 // get the attributes of a file/dir, either with a filehandle (if passed) or through inodes
 func (n *OptiFSNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	req := n.startRequest(ctx, "GETATTR")
+	defer req.done()
 
 	path := n.RPath()
-	log.Printf("GETATTR performed for {%v}...\n", path)
+	req.Debug("GETATTR performed")
 
 	// Not sure if attributes carry over node Lookups, check persistent storage to be sure
-	log.Println("Querying persistent store...")
+	req.Debug("Querying persistent store...")
 	var existingHash [64]byte
 	var existingRef uint64
 	if err, _, _, _, _, isDir, hash, ref := metadata.RetrieveNodeInfo(path); err == fs.OK {
-		log.Println("Hit!")
+		req.Debug("Hit!")
 		existingHash = hash
 		existingRef = ref
-		log.Printf("{%v} - {%v} - {%+v}\n", isDir, existingHash, existingRef)
+		req.Debug("Node is persistent", "dir", isDir, "hash", fmt.Sprintf("%x", existingHash), "ref", existingRef)
 
 		if !isDir {
-			log.Println("Retrieving regular file custom metadata...")
+			req.Debug("Retrieving regular file custom metadata...")
 			// Try and get an entry in our own custom system
 			err1, fileMetadata := metadata.LookupRegularFileMetadata(existingHash, existingRef)
 			if err1 == fs.OK { // If it exists
-				log.Println("Hit!")
+				req.Debug("Hit!")
 				metadata.FillAttrOut(fileMetadata, out)
 				return fs.OK
 			}
 		} else {
-			log.Println("Retrieving directory custom metadata...")
+			req.Debug("Retrieving directory custom metadata...")
 			err2, dirMetadata := metadata.LookupDirMetadata(path)
 			if err2 == fs.OK {
-				log.Println("Hit!")
+				req.Debug("Hit!")
 				metadata.FillAttrOut(dirMetadata, out)
 				return fs.OK
 			}
 		}
 	} else {
-		log.Println("Doesn't exist.")
+		req.Debug("Doesn't exist.")
 	}
 
-	log.Println("No persistent or custom metadata available - STATTING UNDERLYING NODE")
+	req.Debug("No persistent or custom metadata available - STATTING UNDERLYING NODE")
 
 	// OTHERWISE, just stat the node
 	var err error
@@ -350,40 +400,88 @@ func (n *OptiFSNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.Att
 	if f == nil {
 		// IF we're dealing with the root, stat it directly as opposed to handling symlinks
 		if &n.Inode == n.Root() {
-			log.Printf("Trying to stat the ROOT directory, handling specially - %v\n", path)
+			req.Debug("Trying to stat the ROOT directory, handling specially")
 			err = syscall.Stat(path, &s) // if we are looking for the root of FS
 		} else {
 			// Otherwise, use Lstat to handle symlinks as well as normal files/directories
-			log.Println("Statting regular filesystem node...")
+			req.Debug("Statting regular filesystem node...")
 			err = syscall.Lstat(path, &s) // if it's just a normal file/dir
 		}
 
 		if err != nil {
-			log.Printf("Statting the underlying filesystem node failed - %v.\n", err)
+			req.Debug("Statting the underlying filesystem node failed", "err", err)
 			return fs.ToErrno(err)
 		}
-		log.Printf("Succesfully statted {%v} - {%v}\n", path, s)
+		req.Debug("Succesfully statted", "stat", s)
 	} else {
-		log.Println("Statting node through file descriptor...")
+		req.Debug("Statting node through file descriptor...")
 		serr := syscall.Fstat(f.(*OptiFSFile).fdesc, &s) // stat the file descriptor to get the attrs (no path needed)
 
 		if serr != nil {
-			log.Println("Failed underlying stat.")
+			req.Debug("Failed underlying stat.")
 			return fs.ToErrno(serr)
 		}
 	}
 
 	out.FromStat(&s) // fill the attr into struct if no errors
-	log.Println("Filled out attributes - GETATTR finished!")
+	req.Debug("Filled out attributes - GETATTR finished!")
+
+	return fs.OK
+}
+
+// get the extended attributes of a file/dir (statx), which unlike GETATTR includes the birth time
+func (n *OptiFSNode) Statx(ctx context.Context, f fs.FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	req := n.startRequest(ctx, "STATX")
+	defer req.done()
+
+	path := n.RPath()
+	req.Debug("STATX performed")
+
+	// Prioritise our custom metadata, as that holds the birth time we keep across dedup relinks
+	req.Debug("Querying custom metadata...")
+	if err, customMetadata := lookupNodeMetadata(path); err == fs.OK {
+		req.Debug("Hit!")
+		_, _, _, _, _, isDir, _, _ := metadata.RetrieveNodeInfo(path)
+		metadata.FillStatxOut(customMetadata, out, isDir)
+		return fs.OK
+	}
+
+	req.Debug("No custom metadata available - STATXING UNDERLYING NODE")
+
+	var st unix.Statx_t
+	var err error
+	if f != nil {
+		req.Debug("Statxing node through file descriptor...")
+		err = unix.Statx(f.(*OptiFSFile).fdesc, "", int(flags)|unix.AT_EMPTY_PATH, int(mask), &st)
+	} else if &n.Inode == n.Root() {
+		// Follow symlinks for the root, the same as GETATTR
+		err = unix.Statx(unix.AT_FDCWD, path, int(flags), int(mask), &st)
+	} else {
+		err = unix.Statx(unix.AT_FDCWD, path, int(flags)|unix.AT_SYMLINK_NOFOLLOW, int(mask), &st)
+	}
+	if err != nil {
+		req.Debug("Statxing the underlying filesystem node failed", "err", err)
+		return fs.ToErrno(err)
+	}
+
+	out.FromStatx(&st)
+	req.Debug("Filled out attributes - STATX finished!")
 
 	return fs.OK
 }
 
 // Sets attributes of a node
 func (n *OptiFSNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	req := n.startRequest(ctx, "SETATTR")
+	defer req.done()
+
+	if !beginOperation(ctx) {
+		return syscall.EROFS
+	}
+	defer endOperation()
 
 	path := n.RPath()
-	log.Printf("SETATTR performed for {%v}...\n", path)
+	req.Debug("SETATTR performed")
 
 	// Retrieve persisten data as 'n' may have empty attributes as lookups are performed as *fs.Inode's, as opposed to
 	// *OptiFSNode, so it seems like attributes cannot always carry across operations
@@ -393,30 +491,30 @@ func (n *OptiFSNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetA
 	var isDir bool
 
 	// Search for persistent hash or ref's
-	log.Println("Querying persistent store...")
+	req.Debug("Querying persistent store...")
 	if err, _, _, _, _, tmpIsDir, hash, ref := metadata.RetrieveNodeInfo(path); err == fs.OK && !isDir {
 		existingHash = hash
 		existingRef = ref
 		isDir = tmpIsDir
-		log.Println("Hit!")
+		req.Debug("Hit!")
 
 		// Check to see if we can find an entry in our node hashmap
 		if !isDir {
-			log.Println("Looking for regular file custom metadata...")
+			req.Debug("Looking for regular file custom metadata...")
 			err1, fileMetadata := metadata.LookupRegularFileMetadata(existingHash, existingRef)
 			if err1 == fs.OK {
-				log.Println("Hit!")
+				req.Debug("Hit!")
 				if f != nil {
 					return fs.ToErrno(SetAttributes(ctx, fileMetadata, in, n, f.(*OptiFSFile), out, isDir))
 				}
 				return fs.ToErrno(SetAttributes(ctx, fileMetadata, in, n, nil, out, isDir))
 			}
 		} else {
-			log.Println("Looking for directory custom metadata...")
+			req.Debug("Looking for directory custom metadata...")
 			// Also check to see if we can find an entry in our directory hashmap
 			err2, dirMetadata := metadata.LookupDirMetadata(path)
 			if err2 == fs.OK {
-				log.Println("Hit!")
+				req.Debug("Hit!")
 				if f != nil {
 					return fs.ToErrno(SetAttributes(ctx, dirMetadata, in, n, f.(*OptiFSFile), out, isDir))
 				}
@@ -424,355 +522,328 @@ func (n *OptiFSNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetA
 			}
 		}
 	} else {
-		log.Println("No persistent data or custom metadata available.")
+		req.Debug("No persistent data or custom metadata available.")
 	}
 
 	// We don't really care if there is no custom metadata entry (yet), just return OK
 	// fs.ToErrno(SetAttributes(ctx, nil, in, n, nil, out, isDir)) <- alternative, but we don't know if it's a directory or not...
 
-	log.Println("Finished SETATTR - Ignoring.")
+	req.Debug("Finished SETATTR - Ignoring.")
 	return fs.OK
 }
 
 // Opens a file for reading, and returns a filehandle
 // flags determines how we open the file (read only, read-write, etc...)
 func (n *OptiFSNode) Open(ctx context.Context, flags uint32) (f fs.FileHandle, fFlags uint32, errno syscall.Errno) {
+	req := n.startRequest(ctx, "OPEN")
+	defer req.done()
+
+	// Only reads are allowed while shutting down, or in read-only/maintenance mode
+	if hasWriteIntent(flags) {
+		if !beginOperation(ctx) {
+			return nil, 0, syscall.EROFS
+		}
+		defer endOperation()
+	}
 
 	path := n.RPath()
-	log.Printf("OPEN performed for {%v}...\n", path)
+	req.Debug("OPEN performed", "flags", flags)
 
 	// Not sure file attributes are persisten between lookups, better to retrieve from persisten store
 	// instead of node
-	log.Println("Querying persistent store...")
+	req.Debug("Querying persistent store...")
 	var existingHash [64]byte
 	var existingRef uint64
 	if err, _, _, _, _, _, hash, ref := metadata.RetrieveNodeInfo(path); err == fs.OK {
 		existingHash = hash
 		existingRef = ref
-		log.Println("Hit!")
+		req.Debug("Hit!")
 
-		log.Println("Looking up regular file custom metadata...")
+		req.Debug("Looking up regular file custom metadata...")
 		// Check custom permissions for opening the file
 		// Lookup metadata entry
 		herr, fileMetadata := metadata.LookupRegularFileMetadata(existingHash, existingRef)
 		if herr == fs.OK { // If we found custom metadata
-			log.Println("Hit!")
+			req.Debug("Hit!")
 			allowed := permissions.CheckOpenPermissions(ctx, fileMetadata, flags)
 			if !allowed {
-				log.Println("Not allowed!")
+				req.Debug("Not allowed!")
 				return nil, 0, syscall.EACCES
 			}
-			log.Println("Allowed!")
+			req.Debug("Allowed!")
 		}
 	} else {
-		log.Println("Persistent hash and ref don't exist for node...")
+		req.Debug("Persistent hash and ref don't exist for node...")
 		// Consciously decided not to perform any permission checks if custom metadata doesn't exist
 		// This is likely a security issue, but I imagine it must be very difficult to abuse this...
 	}
 
-	log.Println("Opening underlying node...")
-	fileDescriptor, err := syscall.Open(path, int(flags), 0666) // try to open the file at path
+	// Writes change the underlying file in place, so the version it is now has to be kept before it's opened
+	var previous *versions.Version
+	if hasWriteIntent(flags) {
+		var verr error
+		if previous, verr = versions.Preserve(path); verr != nil {
+			req.Warn("Couldn't keep the previous version", "err", verr)
+		}
+	}
+
+	req.Debug("Opening underlying node...")
+	// Content in the cold tier is recalled (or read from there) first, and kept hot while the file is open
+	fileDescriptor, release, err := tier.Open(path, int(flags), 0666) // try to open the file at path
 	if err != nil {
-		log.Println("Opening underlying node failed.")
+		req.Debug("Opening underlying node failed.")
+		if previous != nil {
+			versions.Discard(previous)
+		}
 		return nil, 0, fs.ToErrno(err)
 	}
 
-	log.Println("Creating new OptiFSFile...")
+	req.Debug("Creating new OptiFSFile...")
 	// Creates a custom filehandle from the returned file descriptor from Open
 	optiFile := NewOptiFSFile(fileDescriptor, n.GetAttr(), flags, existingHash, existingRef)
-	//log.Println("Created a new loopback file")
-	log.Println("Succesfully finished OPEN!")
+	optiFile.previous = previous
+	optiFile.release = release
+	registerWriteFile(n, optiFile)
+	//req.Debug("Created a new loopback file")
+	req.Debug("Succesfully finished OPEN!")
 	return optiFile, flags, fs.OK
 }
 
 // Get EXTENDED attribute
 func (n *OptiFSNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	req := n.startRequest(ctx, "GETXATTR")
+	defer req.done()
 
-	path := n.RPath()
-	log.Printf("GETXATTR performed for {%v}...\n", path)
-
-	// If we're dealing with the root, just return FS.OK
-	if &n.Inode == n.Root() {
-		log.Println("We're dealing with the ROOT directory, ignore.")
-		return 0, fs.OK
-	}
+	req.Debug("GETXATTR performed", "attr", attr)
 
-	// Retrieve hash and refnums from persistent node
-	log.Println("Querying persistent store...")
-	err0, _, _, _, _, isDir, hash, ref := metadata.RetrieveNodeInfo(n.RPath())
+	// Retrieve the custom metadata holding the node's extended attributes
+	req.Debug("Querying custom metadata...")
+	err0, customMetadata, isDir := n.xattrMetadata(false)
 	if err0 != fs.OK {
-		log.Println("Persistent data doesn't exist, returnin ENODATA.")
+		req.Debug("Custom metadata doesn't exist, returning ENODATA.")
 		return 0, fs.ToErrno(syscall.ENODATA)
 	}
-	log.Printf("Found persistent data. {%v} - {%+v}\n", hash, ref)
+	req.Debug("Hit!")
 
-	// Check if the user has read access
-	var customMetadata *metadata.MapEntryMetadata
-	if !isDir {
-		log.Println("Searching for regular file custom metadata...")
-		err1, nodeMetadata := metadata.LookupRegularFileMetadata(hash, ref)
-		if err1 == fs.OK {
-			log.Println("Hit!")
-			hasRead := permissions.CheckPermissions(ctx, nodeMetadata, 0)
-			if !hasRead {
-				log.Println("Not allowed.")
-				return 0, syscall.EACCES
-			}
-			log.Println("Allowed.")
-			customMetadata = nodeMetadata
-		}
-	} else {
-		log.Println("Searching for directory custom metadata...")
-		err2, dirMetadata := metadata.LookupDirMetadata(path)
-		if err2 == 0 {
-			log.Println("Hit!")
-			hasRead := permissions.CheckPermissions(ctx, dirMetadata, 0)
-			if !hasRead {
-				log.Println("Not allowed.")
-				return 0, syscall.EACCES
-			}
-			log.Println("Allowed.")
-			customMetadata = dirMetadata
-		}
+	// The versions of a file aren't stored with its attributes
+	if attr == versions.XAttrName && !isDir {
+		return n.getVersionsXAttr(ctx, customMetadata, dest)
+	}
+
+	// Check if the user can read the attribute, which depends on its namespace
+	err1 := permissions.CheckXAttrAccess(ctx, customMetadata, attr, false)
+	if err1 != fs.OK {
+		req.Debug("Not allowed", "err", err1)
+		return 0, err1
 	}
+	req.Debug("Allowed.")
 
-	log.Println("Getting XAttr from custom metadata...")
+	req.Debug("Getting XAttr from custom metadata...")
 	attributeSize, err3 := metadata.GetCustomXAttr(customMetadata, attr, &dest, isDir)
-	log.Printf("Finished GETXATTR! {%v} - {%v}\n", attributeSize, err3)
+	req.Debug("Finished GETXATTR!", "size", attributeSize, "err", err3)
 
 	return uint32(attributeSize), fs.ToErrno(err3)
 }
 
 // Set EXTENDED attribute
 func (n *OptiFSNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	req := n.startRequest(ctx, "SETXATTR")
+	defer req.done()
 
-	path := n.RPath()
-	log.Printf("SETXATTR performed for {%v}...\n", path)
-
-	// If we're dealing with the root, just return FS.OK
-	if &n.Inode == n.Root() {
-		log.Println("We're dealing with the ROOT directory, ignore.")
-		return fs.OK
+	if !beginOperation(ctx) {
+		return syscall.EROFS
 	}
+	defer endOperation()
 
-	// Retrieve hash and refnums from persistent node
-	log.Println("Querying persistent data...")
-	err0, _, _, _, _, isDir, hash, ref := metadata.RetrieveNodeInfo(n.RPath())
+	req.Debug("SETXATTR performed", "attr", attr)
+
+	// Retrieve the custom metadata holding the node's extended attributes, the root's
+	// is created if this is the first attribute it has
+	req.Debug("Querying custom metadata...")
+	err0, customMetadata, isDir := n.xattrMetadata(true)
 	if err0 != fs.OK {
-		log.Println("Persistent data doesn't exist, returnin ENODATA.")
+		req.Debug("Custom metadata doesn't exist, returning ENODATA.")
 		return fs.ToErrno(syscall.ENODATA)
 	}
-	log.Println("Hit!")
+	req.Debug("Hit!")
 
-	// Check if the user has write access
-	var customMetadata *metadata.MapEntryMetadata
-	if !isDir {
-		log.Println("Searching for regular filecustom metadata...")
-		err1, nodeMetadata := metadata.LookupRegularFileMetadata(hash, ref)
-		if err1 == fs.OK {
-			log.Println("Hit!")
-			hasWrite := permissions.CheckPermissions(ctx, nodeMetadata, 1)
-			if !hasWrite {
-				log.Println("Not allowed.")
-				return syscall.EACCES
-			}
-			log.Println("Allowed.")
-			customMetadata = nodeMetadata
-		}
-	} else {
-		log.Println("Searching for directory custom metadata...")
-		err2, dirMetadata := metadata.LookupDirMetadata(path)
-		if err2 == 0 {
-			log.Println("Hit!")
-			hasWrite := permissions.CheckPermissions(ctx, dirMetadata, 1)
-			if !hasWrite {
-				log.Println("Not allowed.")
-				return syscall.EACCES
-			}
-			log.Println("Allowed.")
-			customMetadata = dirMetadata
-		}
+	// Setting the versions of a file restores one of them
+	if attr == versions.XAttrName && !isDir {
+		return n.restoreVersion(ctx, data)
+	}
+
+	// ACLs are validated and applied by the permissions module, which performs its own ownership checks
+	if permissions.IsACLXAttr(attr) {
+		err4 := permissions.SetACL(ctx, customMetadata, attr, data, flags, isDir)
+		req.Debug("Finished SETXATTR (ACL)", "err", err4)
+		return err4
+	}
+
+	// Check if the user can write the attribute, which depends on its namespace
+	err1 := permissions.CheckXAttrAccess(ctx, customMetadata, attr, true)
+	if err1 != fs.OK {
+		req.Debug("Not allowed", "err", err1)
+		return err1
 	}
+	req.Debug("Allowed.")
 
-	log.Println("Setting XAttr in custom metadata...")
+	req.Debug("Setting XAttr in custom metadata...")
 	err3 := metadata.SetCustomXAttr(customMetadata, attr, data, flags, isDir)
-	log.Printf("Finished SETXATTR - {%v}\n", err3)
+	req.Debug("Finished SETXATTR", "err", err3)
 
 	return err3
 }
 
 // Remove EXTENDED attribute
 func (n *OptiFSNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	req := n.startRequest(ctx, "REMOVEXATTR")
+	defer req.done()
 
-	path := n.RPath()
-	log.Printf("REMOVEXATTR performed for {%v}...\n", path)
-
-	// If we're dealing with the root, just return FS.OK
-	if &n.Inode == n.Root() {
-		log.Println("We're dealing with the ROOT directory, ignore.")
-		return fs.OK
+	if !beginOperation(ctx) {
+		return syscall.EROFS
 	}
+	defer endOperation()
 
-	// Retrieve hash and refnums from persistent node
-	log.Println("Querying persistent data...")
-	err0, _, _, _, _, isDir, hash, ref := metadata.RetrieveNodeInfo(n.RPath())
+	req.Debug("REMOVEXATTR performed", "attr", attr)
+
+	// Retrieve the custom metadata holding the node's extended attributes
+	req.Debug("Querying custom metadata...")
+	err0, customMetadata, isDir := n.xattrMetadata(false)
 	if err0 != fs.OK {
-		log.Println("Persistent data doesn't exist, returnin ENODATA.")
+		req.Debug("Custom metadata doesn't exist, returning ENODATA.")
 		return fs.ToErrno(syscall.ENODATA)
 	}
-	log.Println("Hit!")
+	req.Debug("Hit!")
 
-	// Custom metadata and flag to tell if we're dealing with directories or not
-	var customMetadata *metadata.MapEntryMetadata
-	if !isDir {
-		log.Println("Searching for regular file custom metadata...")
-		// Check if the user has write access
-		err1, nodeMetadata := metadata.LookupRegularFileMetadata(hash, ref)
-		if err1 == fs.OK {
-			log.Println("Hit!")
-			hasWrite := permissions.CheckPermissions(ctx, nodeMetadata, 1)
-			if !hasWrite {
-				log.Println("Not allowed.")
-				return syscall.EACCES
-			}
-			log.Println("Allowed.")
-			customMetadata = nodeMetadata
-		}
-	} else {
-		log.Println("Searching for directory custom metadata...")
-		err2, dirMetadata := metadata.LookupDirMetadata(path)
-		if err2 == 0 {
-			log.Println("Hit!")
-			hasWrite := permissions.CheckPermissions(ctx, dirMetadata, 1)
-			if !hasWrite {
-				log.Println("Not allowed.")
-				return syscall.EACCES
-			}
-			log.Println("Allowed.")
-			customMetadata = dirMetadata
-		}
+	// Only the owner can remove an ACL, which the permissions module checks for us
+	if permissions.IsACLXAttr(attr) {
+		err4 := permissions.RemoveACL(ctx, customMetadata, attr, isDir)
+		req.Debug("Finished REMOVEXATTR (ACL).", "err", err4)
+		return err4
+	}
+
+	// Check if the user can write the attribute, which depends on its namespace
+	err1 := permissions.CheckXAttrAccess(ctx, customMetadata, attr, true)
+	if err1 != fs.OK {
+		req.Debug("Not allowed", "err", err1)
+		return err1
 	}
+	req.Debug("Allowed.")
 
-	log.Println("Removing xattr in custom metadata...")
+	req.Debug("Removing xattr in custom metadata...")
 	err3 := metadata.RemoveCustomXAttr(customMetadata, attr, isDir)
-	log.Printf("Finished REMOVEXATTR. {%v}\n", err3)
+	req.Debug("Finished REMOVEXATTR.", "err", err3)
 
 	return err3
 }
 
 // List EXTENDED attributes
 func (n *OptiFSNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	req := n.startRequest(ctx, "LISTXATTR")
+	defer req.done()
 
-	path := n.RPath()
-	log.Printf("LISTXATTR performed for {%v}...\n", path)
-
-	// If we're dealing with the root, just return FS.OK
-	if &n.Inode == n.Root() {
-		log.Println("We're dealing with the ROOT directory, ignore.")
-		return 0, fs.OK
-	}
+	req.Debug("LISTXATTR performed")
 
-	// Retrieve hash and refnums from persistent node
-	log.Println("Querying persistent data...")
-	err0, _, _, _, _, isDir, hash, ref := metadata.RetrieveNodeInfo(n.RPath())
+	// Retrieve the custom metadata holding the node's extended attributes
+	req.Debug("Querying custom metadata...")
+	err0, customMetadata, isDir := n.xattrMetadata(false)
 	if err0 != fs.OK {
-		log.Println("Persistent data doesn't exist, returnin ENODATA.")
+		// The root directory simply has no attributes until one is set
+		if n.IsRoot() {
+			req.Debug("ROOT directory has no attributes yet.")
+			return 0, fs.OK
+		}
+		req.Debug("Custom metadata doesn't exist, returning ENODATA.")
 		return 0, fs.ToErrno(syscall.ENODATA)
 	}
-	log.Println("Hit!")
+	req.Debug("Hit!")
 
 	// Check if the user has read access
-	var customMetadata *metadata.MapEntryMetadata
-	if !isDir {
-		log.Println("Searching for regular file custom metadata...")
-		err1, nodeMetadata := metadata.LookupRegularFileMetadata(hash, ref)
-		if err1 == fs.OK {
-			log.Println("Hit!")
-			hasRead := permissions.CheckPermissions(ctx, nodeMetadata, 0)
-			if !hasRead {
-				log.Println("Not allowed.")
-				return 0, syscall.EACCES
-			}
-			log.Println("Allowed.")
-			customMetadata = nodeMetadata
-		}
-	} else {
-		log.Println("Searching for directory custom metadata...")
-		err2, dirMetadata := metadata.LookupDirMetadata(path)
-		if err2 == 0 {
-			log.Println("Hit!")
-			hasRead := permissions.CheckPermissions(ctx, dirMetadata, 0)
-			if !hasRead {
-				log.Println("Not allowed.")
-				return 0, syscall.EACCES
-			}
-			log.Println("Allowed.")
-			customMetadata = dirMetadata
-		}
+	hasRead := permissions.CheckPermissions(ctx, customMetadata, 0)
+	if !hasRead {
+		req.Debug("Not allowed.")
+		return 0, syscall.EACCES
 	}
+	req.Debug("Allowed.")
 
-	// Pass it down to the filesystem below
-	log.Println("Listing xattr from custom metadata...")
-	allAttributesSize, err3 := metadata.ListCustomXAttr(customMetadata, &dest, isDir)
-	log.Printf("Finished LISTXATTR. - {%v}\n", err3)
+	// Only list the attributes the caller is allowed to know about
+	req.Debug("Listing xattr from custom metadata...")
+	visible := func(attr string) bool {
+		return permissions.IsXAttrVisible(ctx, attr)
+	}
+	allAttributesSize, err3 := metadata.ListVisibleCustomXAttr(customMetadata, &dest, isDir, visible)
+	req.Debug("Finished LISTXATTR.", "err", err3)
 	return uint32(allAttributesSize), fs.ToErrno(err3)
 }
 
 // Checks access of a node
 func (n *OptiFSNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	req := n.startRequest(ctx, "ACCESS")
+	defer req.done()
 
 	path := n.RPath()
-	log.Printf("ACCESS performed for {%v}\n", path)
+	req.Debug("ACCESS performed", "mask", mask)
 
 	// Prioritise custom metadata
 
 	// Need to get the currentHash and refNum from the persistent store as node attributes may
 	// not carry across lookups
-	log.Println("Querying persistent data...")
+	req.Debug("Querying persistent data...")
 	err0, _, _, _, _, isDir, hash, ref := metadata.RetrieveNodeInfo(path)
 	if err0 != fs.OK {
-		log.Println("Doesn't exist - Performing ACCESS on underlying filesystem node")
+		req.Debug("Doesn't exist - Performing ACCESS on underlying filesystem node")
 		return fs.ToErrno(syscall.Access(path, mask))
 	}
 
-	log.Println("Hit!")
+	req.Debug("Hit!")
 
 	if !isDir {
-		log.Println("Looking up regular file custom metadata")
+		req.Debug("Looking up regular file custom metadata")
 		// Check if custom metadata exists for a regular file
 		if err, fileMetadata := metadata.LookupRegularFileMetadata(hash, ref); err == fs.OK {
 			// If there is no metadata, just perform a normal ACCESS on the underlying node
-			log.Println("Hit!")
+			req.Debug("Hit!")
 			isAllowed := permissions.CheckMask(ctx, mask, fileMetadata)
 			if !isAllowed {
-				log.Println("Not allowed.")
+				req.Debug("Not allowed.")
 				return fs.ToErrno(syscall.EACCES)
 			}
-			log.Println("Allowed!")
+			req.Debug("Allowed!")
 		}
 	} else {
-		log.Println("Looking up directory custom metadata...")
+		req.Debug("Looking up directory custom metadata...")
 		// Check if custom metadata exists for a directory
 		if err, dirMetadata := metadata.LookupDirMetadata(path); err == 0 {
-			log.Println("Hit!")
+			req.Debug("Hit!")
 			isAllowed := permissions.CheckMask(ctx, mask, dirMetadata)
 			if !isAllowed {
-				log.Println("Not allowed!")
+				req.Debug("Not allowed!")
 				return fs.ToErrno(syscall.EACCES)
 			}
-			log.Println("Allowed!")
+			req.Debug("Allowed!")
 		}
 	}
 
-	log.Println("ACCESS succesfully finished!")
+	req.Debug("ACCESS succesfully finished!")
 	return fs.OK
 }
 
 // Make a directory
 func (n *OptiFSNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	req := n.startRequest(ctx, "MKDIR")
+	defer req.done()
+
+	if !beginOperation(ctx) {
+		return nil, syscall.EROFS
+	}
+	defer endOperation()
+
+	if n.isControlDir(name) {
+		return nil, syscall.EEXIST
+	}
 
 	path := n.RPath()
-	log.Printf("MKDIR performed for {%v} in {%v}\n", name, path)
+	req.Debug("MKDIR performed", "name", name)
 
 	// check if the user is allowed to make a directory here
 	// i.e if we are in root, are they the sysadmin?
@@ -783,82 +854,106 @@ func (n *OptiFSNode) Mkdir(ctx context.Context, name string, mode uint32, out *f
 
 	filePath := filepath.Join(n.RPath(), name)
 
-	log.Println("Searching for parent directory custom metadata...")
+	req.Debug("Searching for parent directory custom metadata...")
 	// Check write and execute permissions on the parent directory
 	err1, dirMetadata := metadata.LookupDirMetadata(path)
 	if err1 == 0 {
-		log.Println("Hit!")
+		req.Debug("Hit!")
 		writePerm := permissions.CheckPermissions(ctx, dirMetadata, 1) // Check for write permissions
 		if !writePerm {
-			log.Println("Not allowed.")
+			req.Debug("Not allowed.")
 			return nil, fs.ToErrno(syscall.EACCES)
 		}
 		execPerm := permissions.CheckPermissions(ctx, dirMetadata, 2) // Check exec permissions
 		if !execPerm {
-			log.Println("Not allowed.")
+			req.Debug("Not allowed.")
 			return nil, fs.ToErrno(syscall.EACCES)
 		}
-		log.Println("Allowed!")
+		req.Debug("Allowed!")
 	} else {
 		// If custom metadata doesn't exist for the parent, just allow them,
 		// we realise this is a security vulnerability, but it would be incredibly
 		// difficult to abuse - if we had more time, we would tackle this
-		log.Println("Custom metadata doesn't exist, continuing...")
+		req.Debug("Custom metadata doesn't exist, continuing...")
+	}
+
+	// The caller is charged for the new directory
+	if errno := checkCreateQuota(ctx, dirMetadata); errno != fs.OK {
+		return nil, errno
 	}
 
 	// Create the directory
-	log.Println("Creating the directory in underlying filesystem...")
+	req.Debug("Creating the directory in underlying filesystem...")
 	err2 := syscall.Mkdir(filePath, mode)
 	if err2 != nil {
-		log.Printf("ERROR - %v\n", err2)
+		req.Debug("Underlying MKDIR failed", "err", err2)
 		return nil, fs.ToErrno(err2)
 	}
-	log.Println("Created the directory!")
+	req.Debug("Created the directory!")
 
-	log.Println("Statting underlying directory to confirm its existence.")
+	// The daemon's umask was applied on top of the caller's, so force the requested mode
+	if chmodErr := syscall.Chmod(filePath, mode&07777); chmodErr != nil {
+		req.Warn("Failed to set the mode of the underlying directory", "err", chmodErr)
+	}
+
+	req.Debug("Statting underlying directory to confirm its existence.")
 	// Now stat the new directory, ensuring it was created
 	var directoryStatus syscall.Stat_t
 	err2 = syscall.Stat(filePath, &directoryStatus)
 	if err2 != nil {
-		log.Println("Doesn't exist - how is this possible?")
+		req.Debug("Doesn't exist - how is this possible?")
 		return nil, fs.ToErrno(err2)
 	}
-	log.Println("Statted the directory succesfully!")
+	req.Debug("Statted the directory succesfully!")
 
 	// Handle the node instantiation
-	log.Println("Instantiating virtual node...")
+	req.Debug("Instantiating virtual node...")
 	oErr, oInode, _ := HandleNodeInstantiation(ctx, n, filePath, name, &directoryStatus, out, nil, nil)
-	log.Printf("Node instantiated - %v\n", oErr)
+	req.Debug("Node instantiated", "err", oErr)
 
 	// Update our custom metadata system
-	log.Println("Updating our custom metadata system...")
+	req.Debug("Updating our custom metadata system...")
 	stAttr := oInode.StableAttr()
 	dirErr := metadata.UpdateDirEntry(filePath, &directoryStatus, &stAttr) // TODO: maybe migrate
 	if dirErr != fs.OK {
-		log.Println("ERROR UPDATING ENTRY!!!")
+		req.Error("ERROR UPDATING ENTRY!!!")
 		return oInode, dirErr
 	}
 	finalDir, newMetadata := metadata.LookupDirMetadata(filePath)
 	if finalDir != fs.OK {
-		log.Println("ERROR LOOKING UP ENTRY!!!")
+		req.Error("ERROR LOOKING UP ENTRY!!!")
 		return oInode, finalDir
 	}
+	// Record the requested mode, inheriting the parent directory's default ACL (if it has one)
+	creationMode := mode | syscall.S_IFDIR
+	var inherited map[string][]byte
+	if err1 == fs.OK {
+		creationMode, inherited = permissions.InheritACL(dirMetadata, creationMode, true)
+	}
+	applyCreationMode(newMetadata, creationMode, inherited, true)
+
 	caller, check := fuse.FromContext(ctx)
 	if check {
-		log.Println("Updating owner to be correct...")
-		metadata.UpdateOwner(newMetadata, &caller.Uid, &caller.Gid, true)
+		req.Debug("Updating owner to be correct...")
+		// Take the parent's group instead if it has the setgid bit, passing the bit on as well
+		gid, inheritSetgid := permissions.InheritGroup(ctx, dirMetadata)
+		metadata.UpdateOwner(newMetadata, &caller.Uid, &gid, true)
+		if inheritSetgid {
+			newMode := newMetadata.Mode | syscall.S_ISGID
+			metadata.UpdateMode(newMetadata, &newMode, true)
+		}
 	} else {
-		log.Println("COULDNT UPDATE OWNER!!!")
+		req.Error("COULDNT UPDATE OWNER!!!")
 	}
 
-	log.Println("Finished MKDIR")
+	req.Debug("Finished MKDIR")
 
 	return oInode, oErr
 }
 
 // Function for setting the owner of the underlying file...
 // Not sure if we want to use this, might become redundant, leaving for now
-func (n *OptiFSNode) setOwner(ctx context.Context, path string) error {
+func (n *OptiFSNode) setOwner(ctx context.Context, path string, parentMetadata *metadata.MapEntryMetadata) error {
 	// make sure we are running as root user (root user id is 0)
 	// if os.Getuid() != 0 {
 	// 	return nil
@@ -870,18 +965,32 @@ func (n *OptiFSNode) setOwner(ctx context.Context, path string) error {
 		return nil
 	}
 
-	log.Printf("OWNER HAS BEEN SET TO {%v}\n", person)
+	// respect the setgid bit of the parent directory
+	gid, _ := permissions.InheritGroup(ctx, parentMetadata)
+
+	logger.Debug("OWNER HAS BEEN SET", "uid", person.Uid, "gid", gid)
 
 	// change the ownership of the file/dir to the UID and GID of the person
-	return syscall.Lchown(path, int(person.Uid), int(person.Gid))
+	return syscall.Lchown(path, int(person.Uid), int(gid))
 
 }
 
 // create a REGULAR FILE that doesn't exist, also fills in the gid/uid of the user into the file attributes
 func (n *OptiFSNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, f fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	req := n.startRequest(ctx, "CREATE")
+	defer req.done()
+
+	if !beginOperation(ctx) {
+		return nil, nil, 0, syscall.EROFS
+	}
+	defer endOperation()
+
+	if n.isControlDir(name) {
+		return nil, nil, 0, syscall.EEXIST
+	}
 
 	path := n.RPath()
-	log.Printf("CREATE performed for {%v} in {%v}...\n", name, path)
+	req.Debug("CREATE performed", "name", name)
 
 	// check if the user is allowed to make a file here
 	// i.e if we are in root, are they the sysadmin?
@@ -890,84 +999,120 @@ func (n *OptiFSNode) Create(ctx context.Context, name string, flags uint32, mode
 		return nil, nil, 0, fs.ToErrno(err)
 	}
 
-	log.Println("Looking up parent directory custom metadata...")
+	req.Debug("Looking up parent directory custom metadata...")
 	// Check write and exec permissions on the parent directory
 	err1, dirMetadata := metadata.LookupDirMetadata(path)
 	if err1 == fs.OK {
-		log.Println("Checking directory custom permissions")
+		req.Debug("Checking directory custom permissions")
 		writePerm := permissions.CheckPermissions(ctx, dirMetadata, 1) // Check for write permissions
 		if !writePerm {
-			log.Println("Not allowed - Write!")
+			req.Debug("Not allowed - Write!")
 			return nil, nil, 0, fs.ToErrno(syscall.EACCES)
 		}
 		execPerm := permissions.CheckPermissions(ctx, dirMetadata, 2) // Check exec permissions
 		if !execPerm {
-			log.Println("Not allowed - Exec!")
+			req.Debug("Not allowed - Exec!")
 			return nil, nil, 0, fs.ToErrno(syscall.EACCES)
 		}
-		log.Println("Allowed!")
+		req.Debug("Allowed!")
 	} else {
 		// We realise this is a security vulnerability - just allowing an operation to continue if
 		// we can't find custom metadata for it. Ultimately if we had time, we could continue to
 		// implement better behaviour. It would also be very difficult to abuse, as all nodes in our
 		// system MUST have custom metadata, or else there's seriously incorrect behaviour going on!
-		log.Println("No custom metadata found, continuing...")
+		req.Debug("No custom metadata found, continuing...")
+	}
+
+	// The caller is charged for the new file
+	if errno := checkCreateQuota(ctx, dirMetadata); errno != fs.OK {
+		return nil, nil, 0, errno
 	}
 
 	filePath := filepath.Join(path, name) // create the path for the new file
 
 	// try to open the file, OR create if theres no file to open
-	log.Println("Creating file in underlying filesystem...")
+	req.Debug("Creating file in underlying filesystem...")
 	fdesc, err2 := syscall.Open(filePath, int(flags)|os.O_CREATE, mode)
-	err2 = fs.ToErrno(err)
-
-	if err2 != fs.OK {
-		return nil, nil, 0, fs.ToErrno(err)
+	if err2 != nil {
+		req.Debug("Failed to create the underlying file", "err", err2)
+		return nil, nil, 0, fs.ToErrno(err2)
 	}
 
 	// Store the original creator in writeStore incase writes were to happen to this file (which is likely
 	// unless empty). We must do this here, as the original caller doesn't seem to perform WRITE calls in FUSE...
-	log.Println("Storing original creator...")
+	req.Debug("Storing original creator...")
+	hashHashMapLock.Lock()
 	_, ok := hashHashMap[filePath]
 	if !ok {
 		person, check := fuse.FromContext(ctx)
 		if check {
-			hashHashMap[filePath] = &writeStore{uid: person.Uid, gid: person.Gid}
+			now := time.Now()
+			store := &writeStore{uid: person.Uid, gid: person.Gid, mode: mode, birth: syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}}
+			// Work out what the file inherits from the parent's default ACL (if it has one),
+			// and its group if the parent has the setgid bit
+			if err1 == fs.OK {
+				store.mode, store.inheritedXAttr = permissions.InheritACL(dirMetadata, mode, false)
+				store.gid, _ = permissions.InheritGroup(ctx, dirMetadata)
+			}
+			hashHashMap[filePath] = store
 		}
 	}
+	hashHashMapLock.Unlock()
+
+	// The underlying file was created with the daemon's umask applied on top of the caller's,
+	// so force it to the mode the caller actually asked for
+	if chmodErr := syscall.Fchmod(fdesc, mode&07777); chmodErr != nil {
+		req.Warn("Failed to set the mode of the underlying file", "err", chmodErr)
+	}
 
 	// stat the new file, making sure it was created
-	log.Println("Statting underlying file to confirm it was created.")
+	req.Debug("Statting underlying file to confirm it was created.")
 	s := syscall.Stat_t{}
 	err3 := syscall.Fstat(fdesc, &s)
 	if err3 != nil {
-		log.Println("Somehow it doesn't exist - CLOSING AND EXITING!")
+		req.Debug("Somehow it doesn't exist - CLOSING AND EXITING!")
 		syscall.Close(fdesc) // close the file descr
-		return nil, nil, 0, fs.ToErrno(err)
+		return nil, nil, 0, fs.ToErrno(err3)
 	}
-	log.Println("Confirmed to exist!")
+	req.Debug("Confirmed to exist!")
 
-	log.Println("Instantiating virtual node...")
+	req.Debug("Instantiating virtual node...")
 	oErr, oNode, oFile := HandleNodeInstantiation(ctx, n, filePath, name, &s, out, &fdesc, &flags)
+	if oNode != nil {
+		if child, ok := oNode.Operations().(*OptiFSNode); ok {
+			registerWriteFile(child, oFile)
+		}
+	}
 
 	// Update the parent directory's modification and change time
 	// If we found custom metadata for the parent directory, update its timestamps
 	if err1 == fs.OK {
 		now := time.Now()
 		metadata.UpdateTime(dirMetadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, true)
-		log.Println("Updated timestamps...")
+		req.Debug("Updated timestamps...")
 	}
 
-	log.Println("Finished CREATE!")
+	req.Debug("Finished CREATE!")
 
 	return oNode, oFile, 0, oErr
 }
 
 // Unlinks (removes) a file
-func (n *OptiFSNode) Unlink(ctx context.Context, name string) syscall.Errno {
+func (n *OptiFSNode) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	req := n.startRequest(ctx, "UNLINK")
+	defer req.done()
+	defer func() { auditDelete(ctx, "unlink", filepath.Join(n.RPath(), name), errno) }()
 
-	path := n.RPath()
-	log.Printf("UNLINK performed on %v from node %v\n", name, path)
+	if !beginOperation(ctx) {
+		return syscall.EROFS
+	}
+	defer endOperation()
+
+	if n.isControlDir(name) {
+		return syscall.EPERM
+	}
+
+	req.Debug("UNLINK performed", "name", name)
 
 	// check if the user is allowed to remove a file here
 	// i.e if we are in root, are they the sysadmin?
@@ -977,27 +1122,27 @@ func (n *OptiFSNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	}
 
 	// Check write and exec permissions on the parent directory
-	log.Println("Looking for parent directory's custom metadata...")
+	req.Debug("Looking for parent directory's custom metadata...")
 	err1, dirMetadata := metadata.LookupDirMetadata(n.RPath())
 	if err1 == fs.OK {
-		log.Println("Found custom metadata for parent directory!")
+		req.Debug("Found custom metadata for parent directory!")
 		writePerm := permissions.CheckPermissions(ctx, dirMetadata, 1) // Check for write permissions
 		if !writePerm {
-			log.Println("Not allowed!")
+			req.Debug("Not allowed!")
 			return fs.ToErrno(syscall.EACCES)
 		}
 		execPerm := permissions.CheckPermissions(ctx, dirMetadata, 2) // Check exec permissions
 		if !execPerm {
-			log.Println("Not allowed!")
+			req.Debug("Not allowed!")
 			return fs.ToErrno(syscall.EACCES)
 		}
-		log.Println("Allowed!")
+		req.Debug("Allowed!")
 	} else {
 		// We realise this is a security vulnerability - just allowing an operation to continue if
 		// we can't find custom metadata for it. Ultimately if we had time, we could continue to
 		// implement better behaviour. It would also be very difficult to abuse, as all nodes in our
 		// system MUST have custom metadata, or else there's seriously incorrect behaviour going on!
-		log.Println("No custom metadata found, continuing...")
+		req.Debug("No custom metadata found, continuing...")
 	}
 
 	// Flag for custom metadata existing
@@ -1006,47 +1151,82 @@ func (n *OptiFSNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	// Construct the file's path since 'n' is actually the parent directory
 	filePath := filepath.Join(n.RPath(), name)
 
+	// Only the owners can remove the file if the parent directory has the sticky bit set
+	if err1 == fs.OK {
+		oErr, ownerUid := lookupNodeOwner(filePath)
+		if oErr != fs.OK {
+			return oErr
+		}
+		if !permissions.CheckStickyBit(ctx, dirMetadata, ownerUid) {
+			req.Debug("Not allowed - sticky bit!")
+			return fs.ToErrno(syscall.EPERM)
+		}
+	}
+
 	// Since 'n' is actually the parent directory, we need to retrieve the underlying node to search
 	// for custom metadata to cleanup
-	log.Println("Querying persistent store...")
+	req.Debug("Querying persistent store...")
 	herr, _, _, _, _, _, contentHash, refNum := metadata.RetrieveNodeInfo(filePath)
 	if herr == fs.OK {
-		log.Println("Found!")
+		req.Debug("Found!")
 		// Mark if it exists
 		customExists = true
 	}
 
-	log.Println("Performing unlink on underlying filesystem...")
-	err := syscall.Unlink(filePath)
-	if err != nil {
-		log.Println("Unlink failed - EXITING!")
-		return fs.ToErrno(err)
-	}
+	var err error
+	if trash.Enabled() {
+		// The file keeps its custom metadata in the trash of whoever deleted it
+		req.Debug("Moving file to the trash...")
+		_, uid, _ := permissions.GetUIDGID(ctx)
+		if _, err = trash.Move(filePath, uid); err != nil {
+			req.Debug("Moving to the trash failed - EXITING!", "err", err)
+			return fs.ToErrno(err)
+		}
+	} else {
+		req.Debug("Performing unlink on underlying filesystem...")
+		err = syscall.Unlink(filePath)
+		if err != nil {
+			req.Debug("Unlink failed - EXITING!")
+			return fs.ToErrno(err)
+		}
 
-	// Cleanup the custom metadata side of things ONLY if the unlink operations suceeded
-	if customExists {
-		log.Println("Cleaning up custom metadata and persistent data...")
-		metadata.RemoveRegularFileMetadata(contentHash, refNum)
-		metadata.RemoveNodeInfo(filePath)
+		// Cleanup the custom metadata side of things ONLY if the unlink operations suceeded
+		if customExists {
+			req.Debug("Cleaning up custom metadata and persistent data...")
+			metadata.RemoveRegularFileMetadata(contentHash, refNum)
+			metadata.RemoveNodeInfo(filePath)
+		}
 	}
 
 	// Update the parent directory's modification time
 	if err1 == fs.OK {
-		log.Println("Updating parent directory's timestamps.")
+		req.Debug("Updating parent directory's timestamps.")
 		now := time.Now()
 		metadata.UpdateTime(dirMetadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, true)
 	}
 
-	log.Println("Finished UNLINK!")
+	req.Debug("Finished UNLINK!")
 
 	return fs.ToErrno(err)
 }
 
 // Unlinks (removes) a directory
-func (n *OptiFSNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+func (n *OptiFSNode) Rmdir(ctx context.Context, name string) (errno syscall.Errno) {
+	req := n.startRequest(ctx, "RMDIR")
+	defer req.done()
+	defer func() { auditDelete(ctx, "rmdir", filepath.Join(n.RPath(), name), errno) }()
+
+	if !beginOperation(ctx) {
+		return syscall.EROFS
+	}
+	defer endOperation()
+
+	if n.isControlDir(name) {
+		return syscall.EPERM
+	}
 
 	path := n.RPath()
-	log.Printf("RMDIR performed on %v from node %v\n", name, path)
+	req.Debug("RMDIR performed", "name", name)
 
 	// check if the user is allowed to remove a directory here
 	// i.e if we are in root, are they the sysadmin?
@@ -1057,50 +1237,73 @@ func (n *OptiFSNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 
 	// Check exec and write permissions on the parent directory
 	// Don't need to check the directory being removed, as it must be empty to be removed
-	log.Println("Looking up parent directory's custom metadata...")
+	req.Debug("Looking up parent directory's custom metadata...")
 	err1, dirMetadata := metadata.LookupDirMetadata(path)
 	if err1 == fs.OK {
-		log.Println("Checking directory custom permissions")
+		req.Debug("Checking directory custom permissions")
 		writePerm := permissions.CheckPermissions(ctx, dirMetadata, 1) // Check for write permissions
 		if !writePerm {
-			log.Println("Not allowed!")
+			req.Debug("Not allowed!")
 			return fs.ToErrno(syscall.EACCES)
 		}
 		execPerm := permissions.CheckPermissions(ctx, dirMetadata, 2) // Check exec permissions
 		if !execPerm {
-			log.Println("Not allowed!")
+			req.Debug("Not allowed!")
 			return fs.ToErrno(syscall.EACCES)
 		}
-		log.Println("Allowed!")
+		req.Debug("Allowed!")
 	} else {
 		// We realise this is a security vulnerability - just allowing an operation to continue if
 		// we can't find custom metadata for it. Ultimately if we had time, we could continue to
 		// implement better behaviour. It would also be very difficult to abuse, as all nodes in our
 		// system MUST have custom metadata, or else there's seriously incorrect behaviour going on!
-		log.Println("No custom metadata found, continuing...")
+		req.Debug("No custom metadata found, continuing...")
 	}
 	filePath := filepath.Join(n.RPath(), name)
 
-	log.Println("Removing directory in underlying filesystem")
-	rErr := syscall.Rmdir(filePath)
-	if rErr != nil {
-		log.Printf("Unlink failed - %v\n", rErr)
-		return fs.ToErrno(rErr)
+	// Only the owners can remove the directory if the parent directory has the sticky bit set
+	if err1 == fs.OK {
+		oErr, ownerUid := lookupNodeOwner(filePath)
+		if oErr != fs.OK {
+			return oErr
+		}
+		if !permissions.CheckStickyBit(ctx, dirMetadata, ownerUid) {
+			req.Debug("Not allowed - sticky bit!")
+			return fs.ToErrno(syscall.EPERM)
+		}
 	}
 
-	// Remove the dir from our custom dir map first
-	log.Println("Removing directory entries from our maps...")
-	metadata.RemoveDirEntry(filePath)
-	metadata.RemoveNodeInfo(filePath)
+	var rErr error
+	if trash.Enabled() {
+		// The directory keeps its custom metadata in the trash of whoever deleted it
+		req.Debug("Moving directory to the trash...")
+		_, uid, _ := permissions.GetUIDGID(ctx)
+		if _, rErr = trash.Move(filePath, uid); rErr != nil {
+			req.Debug("Moving to the trash failed", "err", rErr)
+			return fs.ToErrno(rErr)
+		}
+	} else {
+		req.Debug("Removing directory in underlying filesystem")
+		rErr = syscall.Rmdir(filePath)
+		if rErr != nil {
+			req.Debug("Unlink failed", "err", rErr)
+			return fs.ToErrno(rErr)
+		}
+
+		// Remove the dir from our custom dir map first
+		req.Debug("Removing directory entries from our maps...")
+		metadata.RemoveDirEntry(filePath)
+		metadata.RemoveNodeInfo(filePath)
+	}
 
 	// Update the parent directory's modification time
 	if err1 == fs.OK {
-		log.Println("Updating parent directory's timestamp...")
+		req.Debug("Updating parent directory's timestamp...")
 		now := time.Now()
 		metadata.UpdateTime(dirMetadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, true)
 	}
 
-	log.Println("Finished RMDIR!")
+	req.Debug("Finished RMDIR!")
 	return fs.ToErrno(rErr)
 }
 
@@ -1109,15 +1312,31 @@ type writeStore struct {
 	buffer *bytes.Buffer
 	uid    uint32
 	gid    uint32
+
+	// Mode requested on CREATE (the kernel has already applied the caller's umask), masked
+	// by the parent directory's default ACL if it has one, and the ACLs inherited from it.
+	// Both are applied to the custom metadata once it is created on RELEASE
+	mode           uint32
+	inheritedXAttr map[string][]byte
+
+	// When the file was created, as its custom metadata only exists once it's released
+	birth syscall.Timespec
 }
 
 var hashHashMap = make(map[string]*writeStore) // A map keyed by a filepath and has a slice of 64byte arrays as a value
 var hashHashMapLock sync.RWMutex
 
 func (n *OptiFSNode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	req := n.startRequest(ctx, "WRITE")
+	defer req.done()
+
+	if !beginOperation(ctx) {
+		return 0, syscall.EROFS
+	}
+	defer endOperation()
 
 	nodePath := n.RPath()
-	log.Println("WRITING")
+	req.Debug("WRITING")
 
 	if f != nil {
 
@@ -1133,7 +1352,7 @@ func (n *OptiFSNode) Write(ctx context.Context, f fs.FileHandle, data []byte, of
 		// Check if we have permission to write to the file
 		err, fileMetadata := metadata.LookupRegularFileMetadata(hash, ref)
 		if err == fs.OK { // if it exists
-			writePerm := permissions.CheckPermissions(ctx, fileMetadata, 1) // check write perm
+			writePerm := permissions.CheckHandlePermissions(ctx, fileMetadata, 1) // check write perm
 			if !writePerm {
 				return 0, syscall.EACCES
 			}
@@ -1143,6 +1362,11 @@ func (n *OptiFSNode) Write(ctx context.Context, f fs.FileHandle, data []byte, of
 		// implement better behaviour. It would also be very difficult to abuse, as all nodes in our
 		// system MUST have custom metadata, or else there's seriously incorrect behaviour going on!
 
+		// The owner is charged for anything the file grows by
+		if errno := checkGrowthQuota(ctx, nodePath, fileMetadata, off+int64(len(data))); errno != fs.OK {
+			return 0, errno
+		}
+
 		// Hash the content
 		newHash := hashing.HashContents(data, f.(*OptiFSFile).flags)
 
@@ -1170,7 +1394,7 @@ func (n *OptiFSNode) Write(ctx context.Context, f fs.FileHandle, data []byte, of
 			hashHashMap[nodePath] = entry
 		}
 		hashHashMapLock.Unlock()
-		log.Println("Stored hash in respective byte buffer...")
+		req.Debug("Stored hash in respective byte buffer...")
 
 		// Now write to the underlying file
 		numOfBytesWritten, werr := syscall.Pwrite(f.(*OptiFSFile).fdesc, data, off)
@@ -1182,7 +1406,7 @@ func (n *OptiFSNode) Write(ctx context.Context, f fs.FileHandle, data []byte, of
 		if err == fs.OK {
 			now := time.Now()
 			metadata.UpdateTime(fileMetadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, nil, false)
-			log.Println("Updated node's timestamp...")
+			req.Debug("Updated node's timestamp...")
 		}
 
 		return uint32(numOfBytesWritten), fs.OK
@@ -1192,93 +1416,161 @@ func (n *OptiFSNode) Write(ctx context.Context, f fs.FileHandle, data []byte, of
 }
 
 func (n *OptiFSNode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	req := n.startRequest(ctx, "FLUSH")
+	defer req.done()
 
-	path := n.RPath()
-	log.Printf("FLUSH performed on {%v}\n", path)
+	req.Debug("FLUSH performed")
 	if f != nil {
 		return f.(fs.FileFlusher).Flush(ctx)
 	}
-	log.Println("FLUSH - EBADFD")
+	req.Debug("FLUSH - EBADFD")
 	return syscall.EBADFD // bad file descriptor
 }
 
 // FUSE's version of a close
 func (n *OptiFSNode) Release(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	req := n.startRequest(ctx, "RELEASE")
+	defer req.done()
+
+	// Always let a release through, even while shutting down, so its de-duplication finishes
+	trackOperation()
+	defer endOperation()
+
+	if optiFile, ok := f.(*OptiFSFile); ok && !claimRelease(optiFile) {
+		req.Debug("RELEASE was already finished while shutting down")
+		return fs.OK
+	}
+
+	return n.release(ctx, f)
+}
+
+// Closes the file, performing de-duplication if it was opened with the intent to write to it
+func (n *OptiFSNode) release(ctx context.Context, f fs.FileHandle) syscall.Errno {
 
 	nodePath := n.RPath()
-	log.Printf("RELEASE performed by {%v}\n", nodePath)
+	dedupLogger.Debug("RELEASE performed", "path", nodePath)
 
 	if f != nil {
 
 		flags := f.(*OptiFSFile).flags
 
-		log.Println("Checking original OPEN flags for write intent...")
+		dedupLogger.Debug("Checking original OPEN flags for write intent...")
 		// Big check here to REALLY make sure we want to perform deduplication steps
 		// Flags have to have write intend AND the bytebuffer for the file can't be empty
-		if !(flags&syscall.O_WRONLY == syscall.O_WRONLY || flags&syscall.O_RDWR == syscall.O_RDWR ||
-			flags&syscall.O_CREAT == syscall.O_CREAT || flags&syscall.O_TRUNC == syscall.O_TRUNC ||
-			flags&syscall.O_APPEND == syscall.O_APPEND) {
-			log.Println("No writing intent, simply releasing file")
+		if !hasWriteIntent(flags) {
+			dedupLogger.Debug("No writing intent, simply releasing file")
 			return f.(*OptiFSFile).Release(ctx)
 		}
-		log.Println("Writing intent, continuing to perform de-duplication steps")
+		dedupLogger.Debug("Writing intent, continuing to perform de-duplication steps")
 
 		// These will be defined from writeStore below, to tell who originally performed the write
 		var callerUid uint32
 		var callerGid uint32
+		// Also defined from writeStore, the mode requested at creation and what the file
+		// inherited from its parent directory
+		var creationMode uint32
+		var inheritedXAttr map[string][]byte
+		var birth syscall.Timespec
 
 		// Calculate the final hash
-		log.Println("Retrieving byte buffer")
+		dedupLogger.Debug("Retrieving byte buffer")
 		hashHashMapLock.Lock()
 		var newHash [64]byte
+		var written bool
 		if hashHashMap != nil {
 			writeStore, ok := hashHashMap[nodePath]
+			written = ok
 			if ok {
 				if writeStore.buffer != nil {
-                    log.Println("Computing final hash...")
+                    dedupLogger.Debug("Computing final hash...")
 					newHash = hashing.HashContents(writeStore.buffer.Bytes(), 0)
 				}
 				callerUid = writeStore.uid
 				callerGid = writeStore.gid
-				log.Printf("Final hash computed: {%x}\n", newHash)
+				creationMode = writeStore.mode
+				birth = writeStore.birth
+				inheritedXAttr = writeStore.inheritedXAttr
+				dedupLogger.Debug("Final hash computed", "hash", fmt.Sprintf("%x", newHash))
 				// Get rid of hashmap entry
 				delete(hashHashMap, nodePath)
-                log.Println("Cleaned up byte buffer...")
+                dedupLogger.Debug("Cleaned up byte buffer...")
 			} else {
-				log.Println("NO AVAILABLE HASH, FILE MUST BE EMPTY!")
+				dedupLogger.Debug("NO AVAILABLE HASH, FILE MUST BE EMPTY!")
 			}
 		} else {
-			log.Println("No hashHashMapLock, how did this happen?")
+			dedupLogger.Debug("No hashHashMapLock, how did this happen?")
 		}
 		hashHashMapLock.Unlock()
-		log.Println("Released hashHashMapLock")
+		dedupLogger.Debug("Released hashHashMapLock")
 
 		// Check if n's attributes are default
 		hash := f.(*OptiFSFile).currentHash
 		ref := f.(*OptiFSFile).refNum
 
+		// Keep the version the file was before it was opened, if it changed
+		if previous := f.(*OptiFSFile).previous; previous != nil {
+			if (written || flags&syscall.O_TRUNC != 0) && newHash != metadata.ContentHashOf(hash) {
+				versions.Commit(nodePath, previous)
+			} else {
+				versions.Discard(previous)
+			}
+		}
+
 		// Keep the old metadata if it exists
 		err1, oldMetadata := metadata.LookupRegularFileMetadata(hash, ref)
-		log.Printf("Scanned for old metadata - %v\n", err1)
+		dedupLogger.Debug("Scanned for old metadata", "err", err1)
+
+		// Files the de-duplication policy excludes keep their own copy of the content, and an entry of
+		// their own, so they're never counted as (or linked to as) a copy of anything else
+		excluded := false
+		if !metadata.EmptyFileIdentifier(newHash) {
+			var st syscall.Stat_t
+			if syscall.Fstat(f.(*OptiFSFile).fdesc, &st) == nil && !shouldDeduplicate(n.RootNode.Path, nodePath, st.Size) {
+				dedupLogger.Debug("De-duplication policy excludes file, keeping its own copy")
+				excluded = true
+			}
+		}
 
 		// Check to see if it's unique
 		isUnique := metadata.IsContentHashUnique(newHash)
-		log.Printf("Is unique: {%v}\n", isUnique)
+		dedupLogger.Debug("Checked content", "unique", isUnique)
+		deduplicate := !isUnique && !excluded
+		// Only a file that's actually de-duplicated is a hit
+		switch {
+		case excluded:
+			dedupLookups.Inc("excluded")
+		case deduplicate:
+			dedupLookups.Inc("hit")
+		default:
+			dedupLookups.Inc("miss")
+		}
 
-		// If it's unique - CREATE a new MapEntry
-		if isUnique {
-			log.Println("File is unique, creating a new MapEntry...")
+		// The key the file's MapEntry is under, the hash unless it has an entry of its own
+		key := newHash
+		if excluded {
+			dedupLogger.Debug("Creating a MapEntry of its own...")
+			key, _ = metadata.CreatePrivateFileMapEntry(newHash)
+		} else if isUnique {
+			// If it's unique - CREATE a new MapEntry
+			dedupLogger.Debug("File is unique, creating a new MapEntry...")
 			metadata.CreateRegularFileMapEntry(newHash)
 		}
 
         // If it already exists, simply retrieve it
-		err2, entry := metadata.LookupRegularFileEntry(newHash)
+		err2, entry := metadata.LookupRegularFileEntry(key)
 		if err2 != fs.OK {
-			log.Println("MapEntry doesn't exist!")
+			dedupLogger.Debug("MapEntry doesn't exist!")
 			return fs.ToErrno(syscall.ENODATA) // return EAGAIN if we error here, not sure what is appropriate...
 		}
-		log.Println("Retrieved existing MapEntry...")
-		log.Printf("Entry index num: {%v}\n", entry.IndexCounter)
+		dedupLogger.Debug("Retrieved existing MapEntry...")
+		dedupLogger.Debug("Entry index num", "index", entry.IndexCounter)
+
+		// Nothing can move the content between tiers (emptying or refilling its files) while the
+		// file is linked to a copy of it
+		if deduplicate {
+			unlock := tier.LockContent(key)
+			defer unlock()
+		}
 
 		// Find an instance of a duplicate file incase we need to do de-duplication
 		// This needs to be performed before the creation of a new entry, as this gets the
@@ -1287,40 +1579,40 @@ func (n *OptiFSNode) Release(ctx context.Context, f fs.FileHandle) syscall.Errno
 
 		// Create a new MapEntryMetadata instance
 		newRef, fileMetadata := metadata.CreateRegularFileMetadata(entry)
-		log.Printf("Created a new MapEntryMetadata object at refnum {%v}\n", newRef)
+		dedupLogger.Debug("Created a new MapEntryMetadata object", "ref", newRef)
 		// Set the file handle's refnum to the entry
 
 		// Update our persistence hash
-		metadata.UpdateNodeInfo(nodePath, nil, nil, nil, &newHash, &newRef)
-		log.Println("Updated our persistent hash")
+		metadata.UpdateNodeInfo(nodePath, nil, nil, nil, &key, &newRef)
+		dedupLogger.Debug("Updated our persistent hash")
 
 		// Perform the deduplication
-		if !isUnique {
+		if deduplicate {
 
-			log.Println("Isn't unique, releasing filehandle...")
+			dedupLogger.Debug("Isn't unique, releasing filehandle...")
 			// If it's not unique, close the file - we're getting rid of it
 			f.(fs.FileReleaser).Release(ctx)
 
 			if rec == nil {
 				// Somehow we confirmed that it's not unique, but can't find the original content
-				log.Println("Cannot find the original file of duplicate content!")
+				dedupLogger.Error("Cannot find the original file of duplicate content!")
 				metadata.RemoveRegularFileMetadata(newHash, newRef)
 				return fs.ToErrno(syscall.ENOENT)
 			}
 
-			log.Println("Performing atomic linking to existing node on underlying filesystem")
+			dedupLogger.Debug("Performing atomic linking to existing node on underlying filesystem")
 
 			// Create a tmpFilename to perform all operations on
 			tmpFilePath := nodePath + "~(TMP)"
 			// Create a hardlink to tmpFileName
-			log.Printf("Creating hardlink in underlying filesystem at {%v}\n", tmpFilePath)
+			dedupLogger.Debug("Creating hardlink in underlying filesystem", "link", tmpFilePath)
 			linkErr := syscall.Link(rec.Path, tmpFilePath)
 			if linkErr != nil {
-				log.Printf("Failed to make temporary link - {%v} - exiting", linkErr)
+				dedupLogger.Error("Failed to make temporary link - exiting", "err", linkErr)
 				metadata.RemoveRegularFileMetadata(newHash, newRef)
 				return fs.ToErrno(syscall.ENOLINK)
 			}
-			log.Printf("Created temporary link at {%v}\n", tmpFilePath)
+			dedupLogger.Debug("Created temporary link", "link", tmpFilePath)
 
 			var st syscall.Stat_t
 			statErr := syscall.Lstat(tmpFilePath, &st)
@@ -1328,10 +1620,10 @@ func (n *OptiFSNode) Release(ctx context.Context, f fs.FileHandle) syscall.Errno
 				// Cleanup first
 				syscall.Unlink(tmpFilePath)
 				metadata.RemoveRegularFileMetadata(newHash, newRef)
-				log.Printf("Failed to stat link - {%v} - removing and exiting!\n", statErr)
+				dedupLogger.Error("Failed to stat link - removing and exiting!", "err", statErr)
 				return fs.ToErrno(syscall.ENOENT)
 			}
-			log.Println("Statted the temporary link!")
+			dedupLogger.Debug("Statted the temporary link!")
 
 			// Now rename the link onto the original file
 			renErr := syscall.Rename(tmpFilePath, nodePath)
@@ -1339,116 +1631,132 @@ func (n *OptiFSNode) Release(ctx context.Context, f fs.FileHandle) syscall.Errno
 				// Cleanup first
 				syscall.Unlink(tmpFilePath)
 				metadata.RemoveRegularFileMetadata(newHash, newRef)
-				log.Printf("Failed to overwrite the original file with link - {%v} - removing and exiting!\n", renErr)
+				dedupLogger.Error("Failed to overwrite the original file with link - removing and exiting!", "err", renErr)
 				return fs.ToErrno(syscall.EIO)
 			}
-			log.Println("Successfuly overwrote original file with temporary link file!")
+			dedupLogger.Debug("Successfuly overwrote original file with temporary link file!")
 
 			// Update custom metadata
 			if err1 == fs.OK {
 				metadata.MigrateDuplicateFileMetadata(oldMetadata, fileMetadata, &st)
 				metadata.RemoveRegularFileMetadata(newHash, newRef)
-				log.Println("Migrated old metadata over to new metadata")
+				dedupLogger.Debug("Migrated old metadata over to new metadata")
 			} else {
-				log.Println("No previous metadata available, creating a new file to simulate the new file metadata")
+				dedupLogger.Debug("No previous metadata available, creating a new file to simulate the new file metadata")
 				// Otherwise very cheeky operation - create a new file and copy the metadata to simulate the metadata
 				// of a new file
 				// Ensure we can create a file to copy the metadata from
 				spareTmpFilePath := nodePath + "~(SPARE)"
-				spareFd, spareErr := syscall.Open(spareTmpFilePath, syscall.O_CREAT|syscall.O_RDONLY, 0644)
+				spareMode := uint32(0644)
+				if creationMode != 0 {
+					spareMode = creationMode & 07777
+				}
+				spareFd, spareErr := syscall.Open(spareTmpFilePath, syscall.O_CREAT|syscall.O_RDONLY, spareMode)
 				if spareErr != nil {
-					log.Println("Failed to create new file - UH OH!")
+					dedupLogger.Error("Failed to create new file - UH OH!")
 					// TODO: figure out how to atomically revert from here or implement some kind of metadata
 					return fs.ToErrno(spareErr)
 				}
 				syscall.Close(spareFd)
-				log.Printf("Created new file at {%v}\n", spareTmpFilePath)
+				dedupLogger.Debug("Created new file", "file", spareTmpFilePath)
 
 				// Stat the file
 				var spareSt syscall.Stat_t
 				spareStatErr := syscall.Stat(spareTmpFilePath, &spareSt)
 				if spareStatErr != nil {
 					// Clean up
-					log.Println("Failed to stat new file - UH OH")
+					dedupLogger.Error("Failed to stat new file - UH OH")
 					syscall.Unlink(spareTmpFilePath)
 					// TODO: figure out how to atomically revert from here or implement some kind of metadata
 					return fs.ToErrno(spareStatErr)
 				}
-				log.Println("Performed stat on spare node")
+				dedupLogger.Debug("Performed stat on spare node")
 				syscall.Unlink(spareTmpFilePath)
-				log.Println("Closed and removed spare node")
+				dedupLogger.Debug("Closed and removed spare node")
 
 				// Now update the metadata using the newly created file's metadata
 				iErr := metadata.InitialiseNewDuplicateFileMetadata(fileMetadata, &spareSt, &st, nodePath, callerUid, callerGid)
 				if iErr != nil {
-					log.Println("Failed to apply new custom metadata - UH OH")
+					dedupLogger.Error("Failed to apply new custom metadata - UH OH")
 					// TODO: figure out how to atomically revert from here or implement some kind of metadata
 				}
-				log.Println("Succesfully created metadata for new file that was duplicate")
+				// The spare file's mode has the daemon's umask applied, use the requested one instead
+				applyCreationMode(fileMetadata, creationMode, inheritedXAttr, false)
+				// Born when it was created, not when the spare file was
+				if birth != (syscall.Timespec{}) {
+					metadata.UpdateBirthTime(fileMetadata, &birth, false)
+				}
+				dedupLogger.Debug("Succesfully created metadata for new file that was duplicate")
 			}
 
-			log.Println("Finished de-duplicating file!")
+			dedupLogger.Debug("Finished de-duplicating file!")
 
 			// Update the times
 			now := time.Now()
 			metadata.UpdateTime(fileMetadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, false)
-			log.Println("Updated timestamp for duplicate file metadata.")
+			dedupLogger.Debug("Updated timestamp for duplicate file metadata.")
 
-            log.Printf("SAVED %v SPACE!\n", st.Size)
+            dedupLogger.Info("De-duplicated file", "path", nodePath, "saved_bytes", st.Size)
+			dedupReclaimedBytes.Add(float64(st.Size))
 
 			return fs.OK
 
 		} else {
-			log.Println("Simply updating metadata, file is unique")
+			dedupLogger.Debug("Simply updating metadata, file is unique (or excluded from de-duplication)")
 
 			// Fill in the MapEntryMetadata object
 			var st syscall.Stat_t
 			serr := syscall.Fstat(f.(*OptiFSFile).fdesc, &st)
 			if serr != nil {
-				log.Println("Failed to stat the file")
+				dedupLogger.Debug("Failed to stat the file")
 				return fs.ToErrno(serr)
 			}
-			log.Println("Sucessfully statted the file!")
+			dedupLogger.Debug("Sucessfully statted the file!")
 
 			if err1 == fs.OK { // If we had old metadata, keep aspects of it
 				metadata.MigrateRegularFileMetadata(oldMetadata, fileMetadata, &st)
-				log.Println("Migrated old existing metadata over!")
+				dedupLogger.Debug("Migrated old existing metadata over!")
 			} else { // If we don't have old metadata, do a full copy of the underlying node's metadata
-                log.Println("Filling in brand new MapEntryMetadata struct...")
+                dedupLogger.Debug("Filling in brand new MapEntryMetadata struct...")
 				stableAttr := n.StableAttr()
 				metadata.FullMapEntryMetadataUpdate(fileMetadata, &st, &stableAttr, nodePath)
 				// Double check to force the owner to be correct
-				log.Printf("Forcing ownership on newfile, {%v} - {%v}\n", callerUid, callerGid)
+				dedupLogger.Debug("Forcing ownership on newfile", "uid", callerUid, "gid", callerGid)
 				metadata.UpdateOwner(fileMetadata, &callerUid, &callerGid, false)
-				log.Println("Performed full MapEntryMetadata update as previous metadata didn't exist!")
+				applyCreationMode(fileMetadata, creationMode, inheritedXAttr, false)
+				if birth != (syscall.Timespec{}) {
+					metadata.UpdateBirthTime(fileMetadata, &birth, false)
+				}
+				dedupLogger.Debug("Performed full MapEntryMetadata update as previous metadata didn't exist!")
 			}
 
-			log.Println("Closing the file now!")
+			dedupLogger.Debug("Closing the file now!")
 
 			// Update the times
 			now := time.Now()
 			metadata.UpdateTime(fileMetadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, false)
-			log.Println("Updated timestamp of unique file.")
+			dedupLogger.Debug("Updated timestamp of unique file.")
 
 			return f.(fs.FileReleaser).Release(ctx)
 		}
 	}
 
-	log.Println("RELEASE - EBADFD")
+	dedupLogger.Debug("RELEASE - EBADFD")
 
 	return syscall.EBADFD // bad file descriptor
 }
 
 func (n *OptiFSNode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
+	req := n.startRequest(ctx, "FSYNC")
+	defer req.done()
 
-	path := n.RPath()
-	log.Printf("FSYNC performed at {%v}\n", path)
+	req.Debug("FSYNC performed")
 
 	if f != nil {
 		// Check write permission
 		err, fileMetadata := metadata.LookupRegularFileMetadata(f.(*OptiFSFile).currentHash, f.(*OptiFSFile).refNum)
 		if err == fs.OK {
-			writePerm := permissions.CheckPermissions(ctx, fileMetadata, 1)
+			writePerm := permissions.CheckHandlePermissions(ctx, fileMetadata, 1)
 			if !writePerm {
 				return fs.ToErrno(syscall.EACCES)
 			}
@@ -1456,12 +1764,15 @@ func (n *OptiFSNode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) s
 
 		return f.(fs.FileFsyncer).Fsync(ctx, flags)
 	}
-	log.Println("FSYNC - EBADFD")
+	req.Debug("FSYNC - EBADFD")
 	return syscall.EBADFD // bad file descriptor
 }
 
 // gets the status' of locks on a node by passing it to the filehandle
 func (n *OptiFSNode) Getlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	req := n.startRequest(ctx, "GETLK")
+	defer req.done()
+
 	if f != nil {
 		return f.(fs.FileGetlker).Getlk(ctx, owner, lk, flags, out) // send it if filehandle exists
 	}
@@ -1470,6 +1781,9 @@ func (n *OptiFSNode) Getlk(ctx context.Context, f fs.FileHandle, owner uint64, l
 
 // gets a lock on a node by passing it to the filehandle, if it can't get the lock it fails
 func (n *OptiFSNode) Setlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	req := n.startRequest(ctx, "SETLK")
+	defer req.done()
+
 	if f != nil {
 		return f.(fs.FileSetlker).Setlk(ctx, owner, lk, flags) // send it if filehandle exists
 	}
@@ -1479,6 +1793,9 @@ func (n *OptiFSNode) Setlk(ctx context.Context, f fs.FileHandle, owner uint64, l
 // gets a lock on a node by passing it to the filehandle
 // if it can't get the lock then it waits for the lock to be obtainable
 func (n *OptiFSNode) Setlkw(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	req := n.startRequest(ctx, "SETLKW")
+	defer req.done()
+
 	if f != nil {
 		return f.(fs.FileSetlkwer).Setlkw(ctx, owner, lk, flags) // send it if filehandle exists
 	}
@@ -1487,8 +1804,33 @@ func (n *OptiFSNode) Setlkw(ctx context.Context, f fs.FileHandle, owner uint64,
 
 // Moves a node to a different directory. Change is only reflected in the filetree IFF returns fs.OK
 func (n *OptiFSNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	req := n.startRequest(ctx, "RENAME")
+	defer req.done()
+
+	if !beginOperation(ctx) {
+		return syscall.EROFS
+	}
+	defer endOperation()
+
+	// The control directory can't be moved, or replaced
+	if n.isControlDir(name) {
+		return syscall.EPERM
+	}
+	if dest, ok := newParent.(*OptiFSNode); ok && dest.isControlDir(newName) {
+		return syscall.EPERM
+	}
+
+	req.Debug("Entered RENAME")
 
-	log.Println("Entered RENAME")
+	// Only the flags renameat2 defines are supported, and an exchange can't be combined with the others
+	if flags&^(unix.RENAME_NOREPLACE|unix.RENAME_EXCHANGE|unix.RENAME_WHITEOUT) != 0 {
+		req.Debug("Unknown RENAME flags", "flags", fmt.Sprintf("%x", flags))
+		return fs.ToErrno(syscall.EINVAL)
+	}
+	if flags&unix.RENAME_EXCHANGE != 0 && flags&(unix.RENAME_NOREPLACE|unix.RENAME_WHITEOUT) != 0 {
+		req.Debug("RENAME_EXCHANGE can't be combined with other flags")
+		return fs.ToErrno(syscall.EINVAL)
+	}
 
 	// check if the user is allowed to rename a directory here (source and dest)
 	// i.e if either src/dest are in root, are they the sysadmin?
@@ -1500,7 +1842,7 @@ func (n *OptiFSNode) Rename(ctx context.Context, name string, newParent fs.Inode
 	// Check write and exec permissions of source and target directories
 	path := n.RPath()
 	err1, dir1Metadata := metadata.LookupDirMetadata(path)
-	err2, dir2Metadata := metadata.LookupDirMetadata(newParent.EmbeddedInode().Path(nil))
+	err2, dir2Metadata := metadata.LookupDirMetadata(filepath.Join(n.RootNode.Path, newParent.EmbeddedInode().Path(nil)))
 	if err1 == 0 {
 		hasWrite := permissions.CheckPermissions(ctx, dir1Metadata, 1)
 		if !hasWrite {
@@ -1522,85 +1864,104 @@ func (n *OptiFSNode) Rename(ctx context.Context, name string, newParent fs.Inode
 		}
 	}
 
-	log.Println("Have permission to rename in source and target directories!")
+	req.Debug("Have permission to rename in source and target directories!")
 
 	// Before moving, check whether it's a directory or not
 	originalPath := filepath.Join(n.RPath(), name)
 	newPath := filepath.Join(n.RootNode.Path, newParent.EmbeddedInode().Path(nil), newName)
-	lErr, lSIno, lSMode, lSGen, lMode, lIsDir, lHash, lRef := metadata.RetrieveNodeInfo(originalPath)
+	lErr, _, _, _, _, _, _, _ := metadata.RetrieveNodeInfo(originalPath)
 	if lErr != fs.OK {
-		log.Println("Entry doesn't exist in our persistent store - big error, why doesn't it??")
+		req.Error("Entry doesn't exist in our persistent store - big error, why doesn't it??")
 		return fs.ToErrno(syscall.ENOENT)
 	}
 
-	stable := &fs.StableAttr{Ino: lSIno, Mode: lSMode, Gen: lSGen}
+	// Respect the sticky bit of both directories - for the node being moved, and the node
+	// being replaced (if there is one)
+	if err1 == fs.OK {
+		oErr, ownerUid := lookupNodeOwner(originalPath)
+		if oErr != fs.OK {
+			return oErr
+		}
+		if !permissions.CheckStickyBit(ctx, dir1Metadata, ownerUid) {
+			req.Debug("Not allowed to move node - sticky bit!")
+			return fs.ToErrno(syscall.EPERM)
+		}
+	}
+	if err2 == fs.OK {
+		if oErr, ownerUid := lookupNodeOwner(newPath); oErr == fs.OK {
+			if !permissions.CheckStickyBit(ctx, dir2Metadata, ownerUid) {
+				req.Debug("Not allowed to replace node - sticky bit!")
+				return fs.ToErrno(syscall.EPERM)
+			}
+		}
+	}
+
+	// Nothing can be moved into another project, and when exchanging, that goes both ways
+	if errno := checkProjectMove(originalPath, newPath); errno != fs.OK {
+		return errno
+	}
+	if flags&unix.RENAME_EXCHANGE != 0 {
+		if errno := checkProjectMove(newPath, originalPath); errno != fs.OK {
+			return errno
+		}
+	}
 
 	var returnErr syscall.Errno
-	// IFF this operation is to be done atomically (which is a more delicate operation)
-	if flags&unix.RENAME_EXCHANGE != 0 {
-        log.Println("RENAME_EXCHANGE flag detected, performing atomic rename!")
-		returnErr = n.renameExchange(name, newParent, newName)
+	// IFF this operation has renameat2 flags (which is a more delicate operation)
+	if flags != 0 {
+        req.Debug("RENAME flags detected, performing renameat2!")
+		returnErr = n.renameat2(name, newParent, newName, flags)
 	} else {
-		// Regular rename operation if there's no RENAME_EXCHANGE flag (atomic), e.g. files between filesystems (VFS <-> Disk)
-        log.Println("No RENAME_EXCHANGE, simply passing rename syscall to underlying filesystem.")
+		// Regular rename operation if there are no flags, e.g. files between filesystems (VFS <-> Disk)
+        req.Debug("No RENAME flags, simply passing rename syscall to underlying filesystem.")
 		tmp := syscall.Rename(originalPath, newPath)
 		returnErr = fs.ToErrno(tmp)
-		log.Println("Performed normal rename")
+		req.Debug("Performed normal rename")
 	}
 
 	// Update our storages IFF we got fs.OK
-	if returnErr == fs.OK {
-		log.Println("Rename suceeded!")
-		// Remove the old entry
-		metadata.RemoveNodeInfo(originalPath)
-		log.Println("Removed old persistent entry")
-		if lIsDir { // If it's a directory
-			metadata.StoreDirInfo(newPath, stable, lMode)
-			// Copy the old metadata over since directory custom metadata is
-			// indexed by path
-			tmpErr, tmpMetadata := metadata.LookupDirMetadata(originalPath)
-			if tmpErr != 0 {
-				log.Println("PANIC AHHHHH")
-				return returnErr
-			}
-			metadataPointer := metadata.CreateDirEntry(newPath)
-			(*metadataPointer) = *tmpMetadata
-			// Delete old entry
-			metadata.RemoveDirEntry(originalPath)
-			log.Println("Updated new dir entry")
-		} else { // If it's a regfile
-			metadata.StoreRegFileInfo(newPath, stable, lMode, lHash, lRef)
-			log.Println("Updated new regfile entry")
-		}
+	if returnErr == fs.OK && flags&unix.RENAME_EXCHANGE != 0 {
+		// Both nodes still exist, they've just swapped places
+		req.Debug("Exchange suceeded!")
+		metadata.ExchangePaths(originalPath, newPath)
+		req.Debug("Exchanged persistent entries and custom metadata")
+	} else if returnErr == fs.OK {
+		// A whiteout left behind at the original path (RENAME_WHITEOUT) is picked up by LOOKUP
+		// like any other node that we don't have persistent data for
+		req.Debug("Rename suceeded!")
+		// Move the persistent entries and custom metadata, along with anything under a directory, so
+		// the node keeps its metadata (and its owner is still charged for it) at the new path
+		metadata.MovePath(originalPath, newPath)
+		req.Debug("Moved persistent entries and custom metadata")
 	}
 
 	// Now update both parent directories modified timestamps
 	now := time.Now()
 	if err1 == fs.OK {
 		metadata.UpdateTime(dir1Metadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, true)
-        log.Println("Updated source directory timestamps...")
+        req.Debug("Updated source directory timestamps...")
 	}
 	if err2 == fs.OK {
 		metadata.UpdateTime(dir2Metadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, true)
-        log.Println("Updated target directory timestamps...")
+        req.Debug("Updated target directory timestamps...")
 	}
 
 	return returnErr
 }
 
-// Handles the name exchange of two inodes
+// Handles a rename with renameat2 flags (RENAME_NOREPLACE, RENAME_EXCHANGE, RENAME_WHITEOUT)
 //
 // Adapted from github user Hanwen's go-fuse/fs/loopback.go implementation
-func (n *OptiFSNode) renameExchange(name string, newparent fs.InodeEmbedder, newName string) syscall.Errno {
+func (n *OptiFSNode) renameat2(name string, newparent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
 	// Open the directory of the current node
 
-	log.Println("in renameExchange, sensitive rename")
+	logger.Debug("in renameat2, sensitive rename")
 
 	path := n.RPath()
 
 	currDirFd, err := syscall.Open(path, syscall.O_DIRECTORY, 0)
 	if err != nil {
-		log.Printf("Error1 - %v\n", err)
+		logger.Debug("Couldn't open the source directory", "err", err)
 		return fs.ToErrno(err)
 	}
 	defer syscall.Close(currDirFd)
@@ -1609,61 +1970,49 @@ func (n *OptiFSNode) renameExchange(name string, newparent fs.InodeEmbedder, new
 	newParentDirPath := filepath.Join(n.RootNode.Path, newparent.EmbeddedInode().Path(nil))
 	newParentDirFd, err := syscall.Open(newParentDirPath, syscall.O_DIRECTORY, 0)
 	if err != nil {
-		log.Printf("Error2 - %v\n", err)
+		logger.Debug("Couldn't open the destination directory", "err", err)
 		return fs.ToErrno(err)
 	}
-	defer syscall.Close(currDirFd)
-	log.Println("Opened newParentDir")
-
-	inode := &n.Inode
-
-	// Check to see if the user is trying to move the root directory, and that the inode number
-	// is the same from the Fstat - ensuring the current directory hasn't been moved or modified.
-	//
-	// REMOVED: 'inode.StableAttr().Ino != n.RootNode.getStableAttr(&st, &path).Ino' in this check due to our
-	//          custom attribute storage making it inacurrate - Do we need to replace this?
-	if inode.Root() != inode {
-		// Return EBUSY if there is something amiss - suggesting the resource is busy
-		log.Println("Check 1 failed")
-		return syscall.EBUSY
-	}
-	log.Println("Check 1 suceeded")
-
-	// Check the status of the new parent directory
-	//if err := syscall.Fstat(newParentDirFd, &st); err != nil {
-	//	return fs.ToErrno(err)
-	//}
-	// As the additional check below was removed we don't need this, best to keep it irregardless though
-
-	newParentDirInode := newparent.EmbeddedInode()
-
-	// Ensure that the new directory isn't the root node, and that the inodes match up, same
-	// consistency checks as above
-	//
-	// REMOVED: 'newParentDirInode.StableAttr().Ino != n.RootNode.getStableAttr(&st, &newParentDirPath).Ino' in this check
-	//          due to our custom attribute storage making it inaccurate - Do we need to replace this?
-
-	if newParentDirInode.Root() != newParentDirInode {
-		log.Println("Check 2 failed")
-		return syscall.EBUSY
-	}
-	log.Println("Check 2 suceeded")
+	defer syscall.Close(newParentDirFd)
+	logger.Debug("Opened newParentDir")
 
 	// Perform the actual rename operation
 	// Use Renameat2, an advanced version of Rename which accepts flags, which itself is an
-	// extension of the rename syscall. Use RENAME_EXCHANGE as this forces the exchange to
-	// occur atomically - avoiding race conditions
-	result := fs.ToErrno(unix.Renameat2(currDirFd, name, newParentDirFd, newName, unix.RENAME_EXCHANGE))
-	log.Println("Performed renameat with RENAME_EXCHANGE flag")
+	// extension of the rename syscall. The flags are passed straight through, so the underlying
+	// filesystem performs the exchange/no-replace check atomically - avoiding race conditions
+	err = unix.Renameat2(currDirFd, name, newParentDirFd, newName, uint(flags))
+	logger.Debug("Performed renameat2", "flags", fmt.Sprintf("%x", flags), "err", err)
+
+	// Not every underlying filesystem supports RENAME_NOREPLACE, so emulate it if that's the case.
+	// This isn't atomic, but is the best that can be done
+	if err == syscall.EINVAL && flags == unix.RENAME_NOREPLACE {
+		logger.Debug("RENAME_NOREPLACE unsupported by underlying filesystem, emulating it")
+		var st unix.Stat_t
+		if statErr := unix.Fstatat(newParentDirFd, newName, &st, unix.AT_SYMLINK_NOFOLLOW); statErr == nil {
+			return fs.ToErrno(syscall.EEXIST)
+		}
+		err = unix.Renameat(currDirFd, name, newParentDirFd, newName)
+	}
 
-	return result
+	return fs.ToErrno(err)
 }
 
 // Creates a node that isn't a regular file/dir/node - like device nodes or pipes
 func (n *OptiFSNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	req := n.startRequest(ctx, "MKNOD")
+	defer req.done()
+
+	if !beginOperation(ctx) {
+		return nil, syscall.EROFS
+	}
+	defer endOperation()
+
+	if n.isControlDir(name) {
+		return nil, syscall.EEXIST
+	}
 
 	path := n.RPath()
-	log.Printf("MKNOD performed for {%v} by {%v}\n", name, path)
+	req.Debug("MKNOD performed", "name", name)
 
 	// check if the user is allowed to make a node here
 	// i.e if we are in root, are they the sysadmin?
@@ -1673,41 +2022,49 @@ func (n *OptiFSNode) Mknod(ctx context.Context, name string, mode uint32, dev ui
 	}
 
 	// Check the write and execute permissions of the parent directory
-    log.Println("Querying parent directory for custom metadata...")
+    req.Debug("Querying parent directory for custom metadata...")
 	err1, dirMetadata := metadata.LookupDirMetadata(path)
 	if err1 == fs.OK {
-        log.Println("Hit!")
+        req.Debug("Hit!")
 		hasWrite := permissions.CheckPermissions(ctx, dirMetadata, 1)
 		if !hasWrite {
-            log.Println("Don't have write permission.")
+            req.Debug("Don't have write permission.")
 			return nil, fs.ToErrno(syscall.EACCES)
 		}
 		hasExec := permissions.CheckPermissions(ctx, dirMetadata, 2)
 		if !hasExec {
-            log.Println("Don't have exec permission.")
+            req.Debug("Don't have exec permission.")
 			return nil, fs.ToErrno(syscall.EACCES)
 		}
-        log.Println("Allowed")
+        req.Debug("Allowed")
+	}
+
+	// The caller is charged for the new node
+	if errno := checkCreateQuota(ctx, dirMetadata); errno != fs.OK {
+		return nil, errno
 	}
 
 	// Create the path of the node to be created
 	nodePath := filepath.Join(path, name)
 	// Create the node
-    log.Println("Performing Mknod on underlying filesystem...")
+    req.Debug("Performing Mknod on underlying filesystem...")
 	if err := syscall.Mknod(nodePath, mode, int(dev)); err != nil {
-        log.Printf("Mknode failed - %v\n", err)
+        req.Debug("Mknode failed", "err", err)
 		return nil, fs.ToErrno(err)
 	}
 
-    log.Println("Statting underlying node to confirm existence...")
+	// Set the owner to the creator, respecting the parent's setgid bit
+	n.setOwner(ctx, nodePath, dirMetadata)
+
+    req.Debug("Statting underlying node to confirm existence...")
 	st := syscall.Stat_t{}
 	if err := syscall.Lstat(nodePath, &st); err != nil {
-        log.Println("Stat failed - removing node.")
+        req.Debug("Stat failed - removing node.")
 		// Kill the node if we can't Lstat it - something went wrong
 		syscall.Unlink(nodePath)
 		return nil, fs.ToErrno(err)
 	}
-    log.Println("Stat succeedefd!")
+    req.Debug("Stat succeedefd!")
 
 	// Handle the creation of a new node
 	oErr, oNode, _ := HandleNodeInstantiation(ctx, n, nodePath, name, &st, out, nil, nil)
@@ -1716,15 +2073,27 @@ func (n *OptiFSNode) Mknod(ctx context.Context, name string, mode uint32, dev ui
 	if err1 == fs.OK {
 		now := time.Now()
 		metadata.UpdateTime(dirMetadata, nil, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, &syscall.Timespec{Sec: now.Unix(), Nsec: int64(now.Nanosecond())}, true)
-        log.Println("Updated node timestamps...")
+        req.Debug("Updated node timestamps...")
 	}
 
-    log.Println("Mknod performed succesfully!")
+    req.Debug("Mknod performed succesfully!")
 	return oNode, oErr
 }
 
 // // Handles the creation of hardlinks
 func (n *OptiFSNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	req := n.startRequest(ctx, "LINK")
+	defer req.done()
+
+	if !beginOperation(ctx) {
+		return nil, syscall.EROFS
+	}
+	defer endOperation()
+
+	if n.isControlDir(name) {
+		return nil, syscall.EEXIST
+	}
+
 	// check if the user is allowed to link nodes here
 	// i.e if we are in root, are they the sysadmin?
 	err := n.IsAllowedTwoLocations(ctx, target)
@@ -1748,6 +2117,16 @@ func (n *OptiFSNode) Link(ctx context.Context, target fs.InodeEmbedder, name str
 	// Construct the full paths
 	sourcePath := filepath.Join(n.RootNode.Path, target.EmbeddedInode().Path(nil))
 	targetPath := filepath.Join(n.RPath(), name)
+
+	// Every link is another inode for the file's owner, its size is only charged once
+	if errno := checkProjectMove(sourcePath, targetPath); errno != fs.OK {
+		return nil, errno
+	}
+	if lErr, targetMetadata := lookupNodeMetadata(sourcePath); lErr == fs.OK {
+		if errno := checkQuota(ctx, targetMetadata.Uid, targetMetadata.Gid, metadata.ProjectOf(targetPath), metadata.Usage{Inodes: 1}); errno != fs.OK {
+			return nil, errno
+		}
+	}
 	if err := syscall.Link(sourcePath, targetPath); err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -1776,9 +2155,20 @@ func (n *OptiFSNode) Link(ctx context.Context, target fs.InodeEmbedder, name str
 }
 
 func (n *OptiFSNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	req := n.startRequest(ctx, "SYMLINK")
+	defer req.done()
+
+	if !beginOperation(ctx) {
+		return nil, syscall.EROFS
+	}
+	defer endOperation()
 
-	// Check write and execute permissions on the target directory
-	err1, dirMetadata := metadata.LookupDirMetadata(target)
+	if n.isControlDir(name) {
+		return nil, syscall.EEXIST
+	}
+
+	// Check write and execute permissions on the parent directory
+	err1, dirMetadata := metadata.LookupDirMetadata(n.RPath())
 	if err1 == fs.OK {
 		hasWrite := permissions.CheckPermissions(ctx, dirMetadata, 1)
 		if !hasWrite {
@@ -1790,6 +2180,11 @@ func (n *OptiFSNode) Symlink(ctx context.Context, target, name string, out *fuse
 		}
 	}
 
+	// The caller is charged for the new symlink
+	if errno := checkCreateQuota(ctx, dirMetadata); errno != fs.OK {
+		return nil, errno
+	}
+
 	// Construct the paths
 	sourcePath := filepath.Join(n.RootNode.Path, target)
 	targetPath := filepath.Join(n.RPath(), name)
@@ -1800,7 +2195,7 @@ func (n *OptiFSNode) Symlink(ctx context.Context, target, name string, out *fuse
 	}
 
 	// Set the owner to the creator
-	n.setOwner(ctx, targetPath)
+	n.setOwner(ctx, targetPath, dirMetadata)
 
 	st := syscall.Stat_t{}
 	if err := syscall.Lstat(targetPath, &st); err != nil {
@@ -1815,10 +2210,13 @@ func (n *OptiFSNode) Symlink(ctx context.Context, target, name string, out *fuse
 
 // Handles reading a symlink
 func (n *OptiFSNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
-	log.Println("Entered READLINK")
+	req := n.startRequest(ctx, "READLINK")
+	defer req.done()
+
+	req.Debug("Entered READLINK")
 	linkPath := n.RPath()
 
-	log.Printf("link path: %v\n", linkPath)
+	req.Debug("Reading link", "link", linkPath)
 
 	// Keep trying to read the link, doubling our buffler size each time
 	// 256 is just an arbitrary number that isn't necessarily too large,
@@ -1828,14 +2226,14 @@ func (n *OptiFSNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 		buffer := make([]byte, l)
 		sz, err := syscall.Readlink(linkPath, buffer)
 		if err != nil {
-			log.Printf("Readlink failed! - %v\n", err)
+			req.Debug("Readlink failed!", "err", err)
 			return nil, fs.ToErrno(err)
 		}
-		log.Printf("Read succesfully, sz: {%v}\n", sz)
+		req.Debug("Read succesfully", "size", sz)
 
 		// If we fit the data into the buffer, return it
 		if sz < len(buffer) {
-			log.Printf("Returning, buffer {%x}\n", buffer[:sz])
+			req.Debug("Returning", "buffer", fmt.Sprintf("%x", buffer[:sz]))
 			return buffer[:sz], fs.OK
 		}
 	}
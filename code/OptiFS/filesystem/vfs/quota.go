@@ -0,0 +1,110 @@
+// This file contains the quota checks made before anything is allocated, refusing with EDQUOT
+
+package vfs
+
+import (
+	"context"
+	"filesystem/metadata"
+	"filesystem/permissions"
+	"filesystem/quota"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Checks the user 'uid' and group 'gid' can be charged 'delta' more, and that 'project' can hold it.
+// The sysadmin is never refused by a user or group quota, but projects are limited whoever writes there.
+func checkQuota(ctx context.Context, uid uint32, gid uint32, project uint32, delta metadata.Usage) syscall.Errno {
+	if errno := quota.CheckProject(project, delta); errno != fs.OK {
+		logger.Debug("Refusing, over project quota", "project", project, "delta", delta)
+		return errno
+	}
+	if permissions.IsUserSysadmin(&ctx) {
+		return fs.OK
+	}
+	if errno := quota.Check(uid, gid, delta); errno != fs.OK {
+		logger.Debug("Refusing, over quota", "uid", uid, "gid", gid, "delta", delta)
+		return errno
+	}
+	return fs.OK
+}
+
+// Checks the caller can be charged for a new node in the directory with 'dirMetadata' (nil if it has
+// none), owned by them and by the group it would get, in the directory's project
+func checkCreateQuota(ctx context.Context, dirMetadata *metadata.MapEntryMetadata) syscall.Errno {
+	errno, uid, _ := permissions.GetUIDGID(ctx)
+	if errno != fs.OK {
+		return fs.OK
+	}
+	gid, _ := permissions.InheritGroup(ctx, dirMetadata)
+	var project uint32
+	if dirMetadata != nil {
+		project = dirMetadata.Project
+	}
+	return checkQuota(ctx, uid, gid, project, metadata.Usage{Inodes: 1})
+}
+
+// Checks the owner of the file at 'nodePath' can be charged for it growing to 'end' bytes. Until it's
+// first released the file has no custom metadata ('fileMetadata' is nil), and belongs to its creator.
+func checkGrowthQuota(ctx context.Context, nodePath string, fileMetadata *metadata.MapEntryMetadata, end int64) syscall.Errno {
+	var uid, gid uint32
+	var charged int64
+	if fileMetadata != nil {
+		uid, gid, charged = fileMetadata.Uid, fileMetadata.Gid, fileMetadata.Size
+	} else {
+		hashHashMapLock.RLock()
+		store, ok := hashHashMap[nodePath]
+		hashHashMapLock.RUnlock()
+		if ok {
+			uid, gid = store.uid, store.gid
+		} else if errno, callerUid, callerGid := permissions.GetUIDGID(ctx); errno == fs.OK {
+			uid, gid = callerUid, callerGid
+		} else {
+			return fs.OK
+		}
+	}
+
+	// Shrinking (or rewriting) what's already charged costs nothing, and until it's released it isn't
+	// known if the new content is shared, so growth is charged in full
+	growth := end - charged
+	if growth <= 0 {
+		return fs.OK
+	}
+	return checkQuota(ctx, uid, gid, metadata.ProjectOf(nodePath), metadata.Usage{Logical: growth, Physical: growth})
+}
+
+// Checks the new owner of a node with 'nodeMetadata' can be charged for it, when it's given to the
+// user 'uid' and/or the group 'gid' (nil if they aren't changing). Directories are only an inode.
+func checkChownQuota(ctx context.Context, nodeMetadata *metadata.MapEntryMetadata, uid *uint32, gid *uint32, isDir bool) syscall.Errno {
+	if permissions.IsUserSysadmin(&ctx) {
+		return fs.OK
+	}
+	delta := metadata.Usage{Inodes: 1}
+	if !isDir {
+		delta.Logical, delta.Physical = nodeMetadata.Size, nodeMetadata.Size
+	}
+	if uid != nil && *uid != nodeMetadata.Uid {
+		if errno := quota.CheckOwner(quota.Owner{Kind: quota.User, ID: *uid}, delta); errno != fs.OK {
+			return errno
+		}
+	}
+	if gid != nil && *gid != nodeMetadata.Gid {
+		if errno := quota.CheckOwner(quota.Owner{Kind: quota.Group, ID: *gid}, delta); errno != fs.OK {
+			return errno
+		}
+	}
+	return fs.OK
+}
+
+// Checks a node can be moved (or linked) from 'from' to 'to'. As with XFS, nothing can go into a
+// project from outside it, so it's copied instead and the copy is charged to the project (EXDEV).
+// Moving out of a project, to a directory that isn't in one, is fine.
+func checkProjectMove(from string, to string) syscall.Errno {
+	project := metadata.ProjectOf(filepath.Dir(to))
+	if project != 0 && project != metadata.ProjectOf(from) {
+		logger.Debug("Refusing to move into another project", "path", from, "new_path", to, "project", project)
+		return syscall.EXDEV
+	}
+	return fs.OK
+}
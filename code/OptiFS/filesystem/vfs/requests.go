@@ -0,0 +1,101 @@
+// This file contains the logging, metrics and auditing of FUSE requests
+
+package vfs
+
+import (
+	"context"
+	"filesystem/audit"
+	"filesystem/logging"
+	"filesystem/metrics"
+	"filesystem/permissions"
+	"log/slog"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Logs anything that isn't part of a request
+var logger = logging.For(logging.VFS)
+
+// Logs de-duplication, when files are released
+var dedupLogger = logging.For(logging.Dedup)
+
+// How many requests of each operation have been served, and how long they took
+var operationCount = metrics.NewCounter("optifs_fuse_operations", "FUSE requests served, by operation.", "op")
+var operationDurations = metrics.NewHistogram("optifs_fuse_operation_duration_seconds", "How long FUSE requests took to serve, by operation.", metrics.DurationBuckets, "op")
+
+// A request being served, its logger adds the operation, path and uid to every line
+type request struct {
+	*slog.Logger
+	op    string
+	start time.Time
+}
+
+// The path of a node, only worked out if something is logged
+type nodePath struct{ n *OptiFSNode }
+
+func (p nodePath) LogValue() slog.Value {
+	return slog.StringValue(p.n.RPath())
+}
+
+// Starts logging a request on the node
+func (n *OptiFSNode) startRequest(ctx context.Context, op string) *request {
+	return newRequest(ctx, op, logger.With("op", op, "path", nodePath{n}))
+}
+
+// Starts logging a request on an open file, which doesn't know its path
+func (f *OptiFSFile) startRequest(ctx context.Context, op string) *request {
+	return newRequest(ctx, op, logger.With("op", op))
+}
+
+func newRequest(ctx context.Context, op string, l *slog.Logger) *request {
+	if err, uid, _ := permissions.GetUIDGID(ctx); err == fs.OK {
+		l = l.With("uid", uid)
+	}
+	return &request{Logger: l, op: op, start: time.Now()}
+}
+
+// Logs and records how long the request took
+func (r *request) done() {
+	duration := time.Since(r.start)
+	operationCount.Inc(r.op)
+	operationDurations.Observe(duration.Seconds(), r.op)
+	r.Debug("Finished", "duration", duration)
+}
+
+// Records a change of mode or owner of the node at 'path' in the audit log
+func auditChange(ctx context.Context, kind string, path string, errno syscall.Errno, detail string) {
+	if audit.Enabled() {
+		audit.RecordContext(ctx, audit.Event{Type: kind, Path: path, Outcome: outcome(errno), Detail: errnoDetail(detail, errno)})
+	}
+}
+
+// Records removing the node at 'path' in the audit log
+func auditDelete(ctx context.Context, op string, path string, errno syscall.Errno) {
+	if audit.Enabled() {
+		audit.RecordContext(ctx, audit.Event{Type: audit.Delete, Op: op, Path: path, Outcome: outcome(errno), Detail: errnoDetail("", errno)})
+	}
+}
+
+// Gets the outcome of an operation from its errno
+func outcome(errno syscall.Errno) string {
+	switch errno {
+	case fs.OK:
+		return audit.Allowed
+	case syscall.EACCES, syscall.EPERM:
+		return audit.Denied
+	}
+	return audit.Failed
+}
+
+// Adds why an operation failed to the detail of its audit event
+func errnoDetail(detail string, errno syscall.Errno) string {
+	if errno == fs.OK {
+		return detail
+	}
+	if detail == "" {
+		return errno.Error()
+	}
+	return detail + ": " + errno.Error()
+}
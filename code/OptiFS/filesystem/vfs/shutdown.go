@@ -0,0 +1,178 @@
+// This file contains what the VFS needs to shut down gracefully - refusing new operations,
+// waiting for the ones in flight and finishing the de-duplication of files that are still open
+
+package vfs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Tracks the operations that change the filesystem, so shutting down can wait for them
+type operationGate struct {
+	mu       sync.Mutex
+	closed   bool
+	inFlight int
+	idle     chan struct{} // closed once the gate is closed and nothing is in flight
+}
+
+var operations = &operationGate{idle: make(chan struct{})}
+
+// Starts an operation that changes the filesystem. Returns false if the filesystem is shutting down,
+// or the caller can't change it (read-only or maintenance mode), in which case the operation mustn't go ahead.
+//
+// Every successful call must be matched with a call to endOperation.
+func beginOperation(ctx context.Context) bool {
+	if !writesAllowed(ctx) {
+		return false
+	}
+
+	operations.mu.Lock()
+	defer operations.mu.Unlock()
+
+	if operations.closed {
+		logger.Debug("Shutting down, refusing operation.")
+		return false
+	}
+	operations.inFlight++
+	return true
+}
+
+// Starts an operation that has to go ahead even while shutting down (e.g. RELEASE, as
+// the kernel doesn't retry it)
+func trackOperation() {
+	operations.mu.Lock()
+	defer operations.mu.Unlock()
+
+	operations.inFlight++
+}
+
+// Finishes an operation started with beginOperation or trackOperation
+func endOperation() {
+	operations.mu.Lock()
+	defer operations.mu.Unlock()
+
+	operations.inFlight--
+	if operations.closed && operations.inFlight == 0 {
+		operations.signalIdle()
+	}
+}
+
+// Closes the idle channel, if it hasn't been already
+func (g *operationGate) signalIdle() {
+	select {
+	case <-g.idle:
+	default:
+		close(g.idle)
+	}
+}
+
+// Whether the filesystem is shutting down
+func IsShuttingDown() bool {
+	operations.mu.Lock()
+	defer operations.mu.Unlock()
+
+	return operations.closed
+}
+
+// Stops the filesystem accepting operations that change it (they fail with EROFS), then waits up to
+// 'timeout' for the ones in flight to finish.
+//
+// Returns false if operations were still in flight when the timeout expired.
+func StopOperations(timeout time.Duration) bool {
+	operations.mu.Lock()
+	operations.closed = true
+	if operations.inFlight == 0 {
+		operations.signalIdle()
+	}
+	inFlight := operations.inFlight
+	operations.mu.Unlock()
+
+	logger.Info("Stopped accepting operations, waiting for the ones in flight", "in_flight", inFlight)
+
+	select {
+	case <-operations.idle:
+		logger.Debug("All operations finished.")
+		return true
+	case <-time.After(timeout):
+		logger.Debug("Timed out waiting for operations to finish!")
+		return false
+	}
+}
+
+// The files opened with write intent that haven't been released, with the node they belong to
+var openWriteFiles = make(map[*OptiFSFile]*OptiFSNode)
+
+// The files FinishOpenFiles released while shutting down, whose RELEASE from the kernel has nothing left to do
+var finishedWriteFiles = make(map[*OptiFSFile]bool)
+var openWriteFilesLock sync.Mutex
+
+// Checks if a file was opened with the intent of writing to it, meaning it has to go through
+// de-duplication when it's released
+func hasWriteIntent(flags uint32) bool {
+	return flags&syscall.O_WRONLY == syscall.O_WRONLY || flags&syscall.O_RDWR == syscall.O_RDWR ||
+		flags&syscall.O_CREAT == syscall.O_CREAT || flags&syscall.O_TRUNC == syscall.O_TRUNC ||
+		flags&syscall.O_APPEND == syscall.O_APPEND
+}
+
+// Remembers a file opened with write intent, so it can be finished off if we shut down before it's released
+func registerWriteFile(n *OptiFSNode, f *OptiFSFile) {
+	if n == nil || f == nil || !hasWriteIntent(f.flags) {
+		return
+	}
+
+	openWriteFilesLock.Lock()
+	defer openWriteFilesLock.Unlock()
+
+	openWriteFiles[f] = n
+}
+
+// Claims the release of a file for the kernel's RELEASE. Returns false if FinishOpenFiles
+// has already released it.
+func claimRelease(f *OptiFSFile) bool {
+	openWriteFilesLock.Lock()
+	defer openWriteFilesLock.Unlock()
+
+	delete(openWriteFiles, f)
+	if finishedWriteFiles[f] {
+		delete(finishedWriteFiles, f)
+		return false
+	}
+	return true
+}
+
+// Releases every file still open with write intent, so what was written to them is de-duplicated and
+// their metadata is created before the final save. Should only be called once operations are stopped.
+//
+// Returns how many files were released.
+func FinishOpenFiles() int {
+	// Claim every open file first, so a RELEASE arriving from the kernel meanwhile doesn't
+	// release it a second time
+	openWriteFilesLock.Lock()
+	files := openWriteFiles
+	openWriteFiles = make(map[*OptiFSFile]*OptiFSNode)
+	for f := range files {
+		finishedWriteFiles[f] = true
+	}
+	openWriteFilesLock.Unlock()
+
+	released := 0
+	for f, n := range files {
+		logger.Info("Finishing open file", "path", n.RPath())
+		errno := n.release(context.Background(), f)
+
+		// The kernel still holds the handle, make sure its descriptor is closed (and marked as
+		// such) so nothing it sends later uses a descriptor that's been reused
+		f.Release(context.Background())
+
+		if errno != 0 {
+			logger.Error("Failed to finish open file", "path", n.RPath(), "err", errno)
+			continue
+		}
+		released++
+	}
+
+	return released
+}
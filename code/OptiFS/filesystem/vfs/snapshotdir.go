@@ -0,0 +1,169 @@
+// This file contains the virtual /.snapshots directory, which shows every snapshot, read-only, as it was taken
+
+package vfs
+
+import (
+	"context"
+	"filesystem/content"
+	"filesystem/metadata"
+	"filesystem/permissions"
+	"filesystem/snapshot"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// The name of the snapshots directory in the root of the filesystem
+const SnapshotDirName = ".snapshots"
+
+// /.snapshots - a directory for every snapshot, named after it
+type snapshotsDirNode struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeGetattrer)((*snapshotsDirNode)(nil))
+var _ = (fs.NodeLookuper)((*snapshotsDirNode)(nil))
+var _ = (fs.NodeReaddirer)((*snapshotsDirNode)(nil))
+
+func (d *snapshotsDirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillControlAttr(&out.Attr, syscall.S_IFDIR|0555)
+	return fs.OK
+}
+
+func (d *snapshotsDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	snap := snapshot.Get(name)
+	if snap == nil || snap.Lookup("/") == nil {
+		return nil, syscall.ENOENT
+	}
+
+	root := &snapshotNode{snap: snap, node: snap.Lookup("/")}
+	root.fillAttr(&out.Attr)
+	return d.NewInode(ctx, root, fs.StableAttr{Mode: syscall.S_IFDIR}), fs.OK
+}
+
+func (d *snapshotsDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	var entries []fuse.DirEntry
+	for _, snap := range snapshot.List() {
+		entries = append(entries, fuse.DirEntry{Name: snap.Name, Mode: syscall.S_IFDIR})
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+// A file, directory or symlink in a snapshot. Permissions are checked against its metadata in the
+// snapshot, and nothing in it can be changed.
+type snapshotNode struct {
+	fs.Inode
+	snap *snapshot.Snapshot
+	node *snapshot.Node
+}
+
+var _ = (fs.NodeGetattrer)((*snapshotNode)(nil))
+var _ = (fs.NodeLookuper)((*snapshotNode)(nil))
+var _ = (fs.NodeReaddirer)((*snapshotNode)(nil))
+var _ = (fs.NodeOpener)((*snapshotNode)(nil))
+var _ = (fs.NodeReader)((*snapshotNode)(nil))
+var _ = (fs.NodeReadlinker)((*snapshotNode)(nil))
+var _ = (fs.NodeSetattrer)((*snapshotNode)(nil))
+
+// An open file in a snapshot or an old version of a file, reading from the content store
+type snapshotFileHandle struct {
+	file *os.File
+}
+
+var _ = (fs.FileReleaser)((*snapshotFileHandle)(nil))
+
+func (h *snapshotFileHandle) Release(ctx context.Context) syscall.Errno {
+	return fs.ToErrno(h.file.Close())
+}
+
+// Fills in the attributes of the node as they were in the snapshot
+func (s *snapshotNode) fillAttr(out *fuse.Attr) {
+	fillStoredAttr(out, &s.node.Metadata)
+}
+
+// Fills in the attributes kept with a node in a snapshot or an old version of a file
+func fillStoredAttr(out *fuse.Attr, attr *metadata.MapEntryMetadata) {
+	out.Mode = attr.Mode
+	out.Uid, out.Gid = attr.Uid, attr.Gid
+	out.Nlink = 1
+	out.Size = uint64(attr.Size)
+	out.Blocks = (out.Size + 511) / 512
+	out.Atime, out.Atimensec = uint64(attr.Atim.Sec), uint32(attr.Atim.Nsec)
+	out.Mtime, out.Mtimensec = uint64(attr.Mtim.Sec), uint32(attr.Mtim.Nsec)
+	out.Ctime, out.Ctimensec = uint64(attr.Ctim.Sec), uint32(attr.Ctim.Nsec)
+	if attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		out.Nlink = 2
+	}
+}
+
+func (s *snapshotNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	s.fillAttr(&out.Attr)
+	return fs.OK
+}
+
+func (s *snapshotNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !permissions.CheckPermissions(ctx, &s.node.Metadata, 2) { // Check exec permissions
+		return nil, syscall.EACCES
+	}
+
+	node := s.snap.Lookup(path.Join(s.node.Path, name))
+	if node == nil {
+		return nil, syscall.ENOENT
+	}
+
+	child := &snapshotNode{snap: s.snap, node: node}
+	child.fillAttr(&out.Attr)
+	return s.NewInode(ctx, child, fs.StableAttr{Mode: node.Metadata.Mode & syscall.S_IFMT}), fs.OK
+}
+
+func (s *snapshotNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if !permissions.CheckPermissions(ctx, &s.node.Metadata, 0) { // Check read permissions
+		return nil, syscall.EACCES
+	}
+
+	children := s.snap.Children(s.node.Path)
+	entries := make([]fuse.DirEntry, len(children))
+	for i, child := range children {
+		entries[i] = fuse.DirEntry{Name: path.Base(child.Path), Mode: child.Metadata.Mode}
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (s *snapshotNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if !permissions.CheckPermissions(ctx, &s.node.Metadata, 0) { // Check read permissions
+		return nil, 0, syscall.EACCES
+	}
+
+	file, err := os.Open(content.Path(s.node.Hash))
+	if err != nil {
+		logger.Error("Couldn't open snapshot content", "snapshot", s.snap.Name, "path", s.node.Path, "err", err)
+		return nil, 0, syscall.EIO
+	}
+	// The content never changes, so the kernel can keep it cached
+	return &snapshotFileHandle{file: file}, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+func (s *snapshotNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	handle, ok := f.(*snapshotFileHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return fuse.ReadResultFd(handle.file.Fd(), off, len(dest)), fs.OK
+}
+
+func (s *snapshotNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if s.node.Metadata.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return nil, syscall.EINVAL
+	}
+	return []byte(s.node.Target), fs.OK
+}
+
+func (s *snapshotNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return syscall.EROFS
+}
@@ -0,0 +1,118 @@
+// This file contains how STATFS reports the space the filesystem uses
+
+package vfs
+
+import (
+	"filesystem/metadata"
+	"filesystem/quota"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"syscall"
+)
+
+// StatfsMode decides whether STATFS reports the space actually used on the underlying filesystem,
+// or the space the files would take without de-duplication
+type StatfsMode int32
+
+const (
+	StatfsPhysical StatfsMode = iota // The underlying filesystem's figures, unchanged
+	StatfsLogical                    // Used space as the size of every file, free space scaled by the dedup ratio
+)
+
+var statfsMode atomic.Int32
+
+// Parses the name of a STATFS mode, as given to the mount options
+func ParseStatfsMode(name string) (StatfsMode, error) {
+	switch name {
+	case "physical":
+		return StatfsPhysical, nil
+	case "logical":
+		return StatfsLogical, nil
+	}
+	return StatfsPhysical, fmt.Errorf("unknown statfs mode {%v}", name)
+}
+
+func (m StatfsMode) String() string {
+	if m == StatfsLogical {
+		return "logical"
+	}
+	return "physical"
+}
+
+// Changes how STATFS reports space, from the next call onwards
+func SetStatfsMode(mode StatfsMode) {
+	statfsMode.Store(int32(mode))
+}
+
+// Gets how STATFS reports space
+func GetStatfsMode() StatfsMode {
+	return StatfsMode(statfsMode.Load())
+}
+
+// Converts the underlying filesystem's figures into logical terms, for capacity planning.
+//
+// Used space grows by what de-duplication is saving, and free space is scaled by the dedup
+// ratio - how much could be stored if new data de-duplicates as well as what's already there.
+func logicalStatfs(s *syscall.Statfs_t, stats metadata.DedupStatistics) {
+	if s.Bsize <= 0 || stats.PhysicalBytes == 0 {
+		return
+	}
+	bsize := uint64(s.Bsize)
+	ratio := stats.Ratio()
+
+	usedBlocks := s.Blocks - s.Bfree
+	if saved := stats.SavedBytes(); saved > 0 {
+		usedBlocks += uint64(saved) / bsize
+	}
+	s.Bfree = scaleBlocks(s.Bfree, ratio)
+	s.Bavail = scaleBlocks(s.Bavail, ratio)
+	s.Blocks = usedBlocks + s.Bfree
+}
+
+// Multiplies a number of blocks by the dedup ratio, without overflowing
+func scaleBlocks(blocks uint64, ratio float64) uint64 {
+	scaled := float64(blocks) * ratio
+	if scaled >= math.MaxUint64/2 {
+		return math.MaxUint64 / 2
+	}
+	return uint64(scaled)
+}
+
+// Reports the limits of the project 'status' is for instead of the whole filesystem, so df inside the
+// project shows how much it can still hold. Like XFS, the soft limit is used if there is one, otherwise
+// the hard limit, and the bytes limited are the ones the STATFS mode reports. Nothing more is free than
+// is free on the underlying filesystem.
+func projectStatfs(s *syscall.Statfs_t, status quota.Status, mode StatfsMode) {
+	bytes, usedBytes := quota.Physical, status.Usage.Physical
+	if mode == StatfsLogical {
+		bytes, usedBytes = quota.Logical, status.Usage.Logical
+	}
+	if limit := projectLimit(status.Quota.Limits[bytes]); limit > 0 && s.Bsize > 0 {
+		bsize := uint64(s.Bsize)
+		used := (uint64(max(usedBytes, 0)) + bsize - 1) / bsize
+		s.Blocks = uint64(limit) / bsize
+		free := uint64(0)
+		if s.Blocks > used {
+			free = s.Blocks - used
+		}
+		s.Bfree = min(free, s.Bfree)
+		s.Bavail = min(free, s.Bavail)
+	}
+	if limit := projectLimit(status.Quota.Limits[quota.Inodes]); limit > 0 {
+		s.Files = uint64(limit)
+		free := uint64(0)
+		if limit > status.Usage.Inodes {
+			free = uint64(limit - status.Usage.Inodes)
+		}
+		s.Ffree = min(free, s.Ffree)
+	}
+}
+
+// The limit STATFS reports for a project, 0 if there's none
+func projectLimit(limit quota.Limit) int64 {
+	if limit.Soft > 0 {
+		return limit.Soft
+	}
+	return limit.Hard
+}
@@ -0,0 +1,317 @@
+// This file contains the versions of files: the virtual /.versions directory, which shows every old
+// version of a file read-only, and the extended attribute that lists and restores them
+
+package vfs
+
+import (
+	"context"
+	"filesystem/audit"
+	"filesystem/content"
+	"filesystem/metadata"
+	"filesystem/permissions"
+	"filesystem/versions"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// The name of the versions directory in the root of the filesystem
+const VersionsDirName = ".versions"
+
+// How much of a version is written at once when it's restored
+const restoreChunkSize = 128 * 1024
+
+// Gets the path of the node inside the mount, as versions are kept by
+func (n *OptiFSNode) mountPath() string {
+	return "/" + n.Path(n.Root())
+}
+
+// Gets the versions extended attribute, one line per version of the file
+func (n *OptiFSNode) getVersionsXAttr(ctx context.Context, customMetadata *metadata.MapEntryMetadata, dest []byte) (uint32, syscall.Errno) {
+	if !permissions.CheckPermissions(ctx, customMetadata, 0) { // Check read permissions
+		return 0, syscall.EACCES
+	}
+
+	history := versions.List(n.mountPath())
+	if len(history) == 0 {
+		return 0, syscall.ENODATA
+	}
+
+	description := []byte(versions.Describe(history))
+	// Ensure the destination buffer is big enough, the caller will retry with the size returned
+	if len(dest) < len(description) {
+		return uint32(len(description)), syscall.ERANGE
+	}
+	copy(dest, description)
+	return uint32(len(description)), fs.OK
+}
+
+// Restores the content of the version named by 'value' ("restore <number>"). It's written the same as
+// any other write, so the file is de-duplicated and the version it replaces is kept in turn.
+func (n *OptiFSNode) restoreVersion(ctx context.Context, value []byte) syscall.Errno {
+	req := n.startRequest(ctx, "RESTOREVERSION")
+	defer req.done()
+
+	number, err := versions.ParseRestore(string(value))
+	if err != nil {
+		req.Debug("Invalid restore", "err", err)
+		return syscall.EINVAL
+	}
+	version := versions.Get(n.mountPath(), number)
+	if version == nil {
+		req.Debug("No such version", "version", number)
+		return syscall.EINVAL
+	}
+
+	// Held so the version's content isn't swept before it's open, once it is it can be read even if it's swept
+	release := content.Hold()
+	stored, err := os.Open(content.Path(version.Hash))
+	release()
+	if err != nil {
+		req.Error("Couldn't read version content", "version", number, "err", err)
+		return syscall.EIO
+	}
+	defer stored.Close()
+
+	// Written through the node itself, going through the kernel would wait on the lock it holds
+	// for this request. It's streamed a chunk at a time, rather than read into memory.
+	f, _, errno := n.Open(ctx, syscall.O_WRONLY|syscall.O_TRUNC)
+	if errno != fs.OK {
+		return errno
+	}
+	chunk := make([]byte, restoreChunkSize)
+	var off int64
+	for errno == fs.OK {
+		read, readErr := io.ReadFull(stored, chunk)
+		if read > 0 {
+			_, errno = n.Write(ctx, f, chunk[:read], off)
+			off += int64(read)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			req.Error("Couldn't read version content", "version", number, "err", readErr)
+			errno = syscall.EIO
+		}
+	}
+	if rerr := n.Release(ctx, f); errno == fs.OK {
+		errno = rerr
+	}
+	if errno != fs.OK {
+		req.Error("Couldn't restore version", "version", number, "err", errno)
+		return errno
+	}
+
+	// The file is given back the mode, owner and times it had, as its owner could set them
+	if errno := n.restoreVersionAttributes(ctx, version); errno != fs.OK {
+		req.Error("Couldn't restore version attributes", "version", number, "err", errno)
+		return errno
+	}
+
+	// Anything the kernel has cached of the file is now out of date
+	go n.NotifyContent(0, 0)
+	req.Info("Restored version", "version", number, "size", off)
+	return fs.OK
+}
+
+// Gives the file the mode, owner and times it had in 'version', once its content is restored. Only
+// the content is restored for someone who isn't the owner (or an admin of the file), as they couldn't
+// change these themselves.
+func (n *OptiFSNode) restoreVersionAttributes(ctx context.Context, version *versions.Version) syscall.Errno {
+	path := n.RPath()
+	err, _, _, _, _, _, hash, ref := metadata.RetrieveNodeInfo(path)
+	if err != fs.OK {
+		return fs.OK
+	}
+	err, fileMetadata := metadata.LookupRegularFileMetadata(hash, ref)
+	if err != fs.OK {
+		return fs.OK
+	}
+	if !permissions.IsOwner(ctx, fileMetadata) && !permissions.IsUserAdminOf(ctx, path) {
+		return fs.OK
+	}
+	saved := version.Metadata
+
+	mode := permissions.SanitiseSetgid(ctx, fileMetadata, fileMetadata.Mode&syscall.S_IFMT|saved.Mode&07777)
+	metadata.UpdateMode(fileMetadata, &mode, false)
+	permissions.UpdateACLMode(fileMetadata, mode, false)
+	auditChange(ctx, audit.Chmod, path, fs.OK, fmt.Sprintf("mode=%o", mode))
+
+	if saved.Uid != fileMetadata.Uid || saved.Gid != fileMetadata.Gid {
+		ownerDetail := fmt.Sprintf("uid=%d gid=%d", saved.Uid, saved.Gid)
+		// The owner it had is charged for the file again
+		if errno := checkChownQuota(ctx, fileMetadata, &saved.Uid, &saved.Gid, false); errno != fs.OK {
+			auditChange(ctx, audit.Chown, path, errno, ownerDetail)
+			return errno
+		}
+		metadata.UpdateOwner(fileMetadata, &saved.Uid, &saved.Gid, false)
+		auditChange(ctx, audit.Chown, path, fs.OK, ownerDetail)
+	}
+
+	metadata.UpdateTime(fileMetadata, &saved.Atim, &saved.Mtim, nil, false)
+	return fs.OK
+}
+
+// A directory in /.versions, mirroring a directory of the filesystem that has (or had) files with versions
+type versionsDirNode struct {
+	fs.Inode
+	rootPath string // the root of the underlying filesystem
+	rel      string // the path of the directory it mirrors, relative to the root
+}
+
+var _ = (fs.NodeGetattrer)((*versionsDirNode)(nil))
+var _ = (fs.NodeLookuper)((*versionsDirNode)(nil))
+var _ = (fs.NodeReaddirer)((*versionsDirNode)(nil))
+
+func (d *versionsDirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillControlAttr(&out.Attr, syscall.S_IFDIR|0555)
+	return fs.OK
+}
+
+// Checks the caller can search the directory it mirrors, if it still exists
+func (d *versionsDirNode) canSearch(ctx context.Context) bool {
+	if err, dirMetadata := metadata.LookupDirMetadata(filepath.Join(d.rootPath, d.rel)); err == fs.OK {
+		return permissions.CheckPermissions(ctx, dirMetadata, 2) // Check exec permissions
+	}
+	return true
+}
+
+// Gets the names of the files and directories directly under this one with versions
+func (d *versionsDirNode) children() map[string]bool {
+	prefix := strings.TrimSuffix(d.rel, "/") + "/"
+	children := make(map[string]bool) // true for files with versions
+	for _, rel := range versions.Paths() {
+		if !strings.HasPrefix(rel, prefix) {
+			continue
+		}
+		name, rest, nested := strings.Cut(strings.TrimPrefix(rel, prefix), "/")
+		if !nested {
+			children[name] = true
+		} else if rest != "" && !children[name] {
+			children[name] = false
+		}
+	}
+	return children
+}
+
+func (d *versionsDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !d.canSearch(ctx) {
+		return nil, syscall.EACCES
+	}
+
+	isFile, ok := d.children()[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	rel := path.Join(d.rel, name)
+	fillControlAttr(&out.Attr, syscall.S_IFDIR|0555)
+	if isFile {
+		return d.NewInode(ctx, &versionHistoryNode{rel: rel}, fs.StableAttr{Mode: syscall.S_IFDIR}), fs.OK
+	}
+	return d.NewInode(ctx, &versionsDirNode{rootPath: d.rootPath, rel: rel}, fs.StableAttr{Mode: syscall.S_IFDIR}), fs.OK
+}
+
+func (d *versionsDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if !d.canSearch(ctx) {
+		return nil, syscall.EACCES
+	}
+
+	var entries []fuse.DirEntry
+	for name := range d.children() {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: syscall.S_IFDIR})
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+// The versions of a file, named by their numbers
+type versionHistoryNode struct {
+	fs.Inode
+	rel string // the path of the file, relative to the root
+}
+
+var _ = (fs.NodeGetattrer)((*versionHistoryNode)(nil))
+var _ = (fs.NodeLookuper)((*versionHistoryNode)(nil))
+var _ = (fs.NodeReaddirer)((*versionHistoryNode)(nil))
+
+func (h *versionHistoryNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillControlAttr(&out.Attr, syscall.S_IFDIR|0555)
+	return fs.OK
+}
+
+func (h *versionHistoryNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	number, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	version := versions.Get(h.rel, number)
+	if version == nil {
+		return nil, syscall.ENOENT
+	}
+
+	fillStoredAttr(&out.Attr, &version.Metadata)
+	return h.NewInode(ctx, &versionFileNode{version: version}, fs.StableAttr{Mode: syscall.S_IFREG}), fs.OK
+}
+
+func (h *versionHistoryNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	history := versions.List(h.rel)
+	entries := make([]fuse.DirEntry, len(history))
+	for i, version := range history {
+		entries[i] = fuse.DirEntry{Name: strconv.FormatUint(version.Number, 10), Mode: syscall.S_IFREG}
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+// An old version of a file. Permissions are checked against the metadata it had, and it can't be changed.
+type versionFileNode struct {
+	fs.Inode
+	version *versions.Version
+}
+
+var _ = (fs.NodeGetattrer)((*versionFileNode)(nil))
+var _ = (fs.NodeOpener)((*versionFileNode)(nil))
+var _ = (fs.NodeReader)((*versionFileNode)(nil))
+var _ = (fs.NodeSetattrer)((*versionFileNode)(nil))
+
+func (v *versionFileNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillStoredAttr(&out.Attr, &v.version.Metadata)
+	return fs.OK
+}
+
+func (v *versionFileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if !permissions.CheckPermissions(ctx, &v.version.Metadata, 0) { // Check read permissions
+		return nil, 0, syscall.EACCES
+	}
+
+	file, err := os.Open(content.Path(v.version.Hash))
+	if err != nil {
+		// The version may have expired since it was looked up
+		logger.Debug("Couldn't open version content", "version", v.version.Number, "err", err)
+		return nil, 0, syscall.ENOENT
+	}
+	return &snapshotFileHandle{file: file}, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+func (v *versionFileNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	handle, ok := f.(*snapshotFileHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return fuse.ReadResultFd(handle.file.Fd(), off, len(dest)), fs.OK
+}
+
+func (v *versionFileNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return syscall.EROFS
+}
@@ -1,11 +1,21 @@
 package vfs
 
 import (
+	"context"
+	"filesystem/metadata"
+	"filesystem/permissions"
+	"filesystem/quota"
+	"filesystem/trash"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 // Unit test for NewOptiFSFile in file.go
@@ -83,3 +93,390 @@ func TestNewNode(t *testing.T) {
 		})
 	}
 }
+
+// Unit test for applyCreationMode in common.go
+func TestApplyCreationMode(t *testing.T) {
+	testcases := []struct {
+		name     string
+		initial  uint32
+		mode     uint32
+		isDir    bool
+		expected uint32
+	}{
+		{
+			name:     "Regular file keeps requested mode",
+			initial:  syscall.S_IFREG | 0644,
+			mode:     syscall.S_IFREG | 0600,
+			isDir:    false,
+			expected: syscall.S_IFREG | 0600,
+		},
+		{
+			name:     "Directory keeps special bits",
+			initial:  syscall.S_IFDIR | 0755,
+			mode:     syscall.S_IFDIR | syscall.S_ISVTX | 0777,
+			isDir:    true,
+			expected: syscall.S_IFDIR | syscall.S_ISVTX | 0777,
+		},
+		{
+			name:     "Unknown creation mode",
+			initial:  syscall.S_IFREG | 0644,
+			mode:     0,
+			isDir:    false,
+			expected: syscall.S_IFREG | 0644,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodeMetadata := &metadata.MapEntryMetadata{Mode: tc.initial, XAttr: map[string][]byte{}}
+			applyCreationMode(nodeMetadata, tc.mode, nil, tc.isDir)
+			if nodeMetadata.Mode != tc.expected {
+				t.Errorf("Expected %o, got %o", tc.expected, nodeMetadata.Mode)
+			}
+		})
+	}
+}
+
+// Unit test for StopOperations in shutdown.go
+func TestStopOperations(t *testing.T) {
+	defer func() { operations = &operationGate{idle: make(chan struct{})} }()
+
+	if !beginOperation(context.Background()) {
+		t.Fatalf("Expected an operation to begin before shutting down")
+	}
+
+	// The operation in flight holds up the shutdown
+	if StopOperations(10 * time.Millisecond) {
+		t.Errorf("Expected to time out with an operation in flight")
+	}
+	if beginOperation(context.Background()) {
+		t.Errorf("Expected new operations to be refused while shutting down")
+	}
+
+	// RELEASE still goes ahead
+	trackOperation()
+	endOperation()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		endOperation()
+	}()
+	if !StopOperations(time.Second) {
+		t.Errorf("Expected operations to drain")
+	}
+	if !IsShuttingDown() {
+		t.Errorf("Expected to be shutting down")
+	}
+}
+
+// Unit test for claimRelease and FinishOpenFiles in shutdown.go
+func TestClaimRelease(t *testing.T) {
+	readFile := &OptiFSFile{fdesc: -1, flags: syscall.O_RDONLY}
+	writeFile := &OptiFSFile{fdesc: -1, flags: syscall.O_WRONLY}
+
+	registerWriteFile(&OptiFSNode{}, readFile)
+	registerWriteFile(&OptiFSNode{}, writeFile)
+	if len(openWriteFiles) != 1 {
+		t.Fatalf("Expected only the file opened for writing to be registered, got %v", len(openWriteFiles))
+	}
+
+	// As if FinishOpenFiles had claimed it
+	openWriteFilesLock.Lock()
+	delete(openWriteFiles, writeFile)
+	finishedWriteFiles[writeFile] = true
+	openWriteFilesLock.Unlock()
+
+	if claimRelease(writeFile) {
+		t.Errorf("Expected a file finished while shutting down to not be released again")
+	}
+	if !claimRelease(writeFile) || !claimRelease(readFile) {
+		t.Errorf("Expected files that weren't finished to be released")
+	}
+	if len(openWriteFiles) != 0 || len(finishedWriteFiles) != 0 {
+		t.Errorf("Expected nothing left open, got %v open and %v finished", len(openWriteFiles), len(finishedWriteFiles))
+	}
+}
+
+// Unit test for the handlers of a file released while shutting down, in file.go
+func TestReleasedFile(t *testing.T) {
+	fd, err := syscall.Open(filepath.Join(t.TempDir(), "file"), syscall.O_CREAT|syscall.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := NewOptiFSFile(fd, fs.StableAttr{}, syscall.O_RDWR, [64]byte{}, 0)
+	if errno := file.Release(context.Background()); errno != fs.OK {
+		t.Fatalf("Expected the file to be released, got %v", errno)
+	}
+
+	if _, errno := file.Read(context.Background(), make([]byte, 1), 0); errno != syscall.EBADF {
+		t.Errorf("Expected READ to fail with EBADF, got %v", errno)
+	}
+	if errno := file.Fsync(context.Background(), 0); errno != syscall.EBADF {
+		t.Errorf("Expected FSYNC to fail with EBADF, got %v", errno)
+	}
+	if errno := file.Flush(context.Background()); errno != syscall.EBADF {
+		t.Errorf("Expected FLUSH to fail with EBADF, got %v", errno)
+	}
+	lock := &fuse.FileLock{Typ: syscall.F_RDLCK}
+	if errno := file.Getlk(context.Background(), 0, lock, 0, &fuse.FileLock{}); errno != syscall.EBADF {
+		t.Errorf("Expected GETLK to fail with EBADF, got %v", errno)
+	}
+	if errno := file.Setlk(context.Background(), 0, lock, 0); errno != syscall.EBADF {
+		t.Errorf("Expected SETLK to fail with EBADF, got %v", errno)
+	}
+	if errno := file.Setlkw(context.Background(), 0, lock, 0); errno != syscall.EBADF {
+		t.Errorf("Expected SETLKW to fail with EBADF, got %v", errno)
+	}
+}
+
+// Unit test for the allows method of DedupPolicy in dedup.go
+func TestDedupPolicy(t *testing.T) {
+	policy := DedupPolicy{
+		Enabled: true,
+		MinSize: 10,
+		Rules: []DedupRule{
+			{Path: "/scratch", Enabled: false},
+			{Path: "/scratch/keep", Enabled: true, MinSize: 0},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		path     string
+		size     int64
+		expected bool
+	}{
+		{"default policy", "/home/file", 100, true},
+		{"smaller than the minimum", "/home/file", 5, false},
+		{"excluded subtree", "/scratch/file", 100, false},
+		{"closest rule wins", "/scratch/keep/file", 1, true},
+		{"only whole directory names match", "/scratchpad/file", 100, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if allowed := policy.allows(tc.path, tc.size); allowed != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, allowed)
+			}
+		})
+	}
+
+	if !shouldDeduplicate("/under", "/under/home/file", 0) {
+		t.Errorf("Expected the default policy to de-duplicate everything")
+	}
+}
+
+// Unit test for hideControlDir in controldir.go
+func TestHideControlDir(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{ControlDirName, SnapshotDirName, VersionsDirName, trash.DirName, "visible"} {
+		if err := os.Mkdir(filepath.Join(root, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream, errno := hideControlDir(root)
+	if errno != fs.OK {
+		t.Fatalf("Couldn't list directory: %v", errno)
+	}
+	var names []string
+	for stream.HasNext() {
+		entry, _ := stream.Next()
+		names = append(names, entry.Name)
+	}
+	for _, name := range names {
+		if isHiddenName(name) {
+			t.Errorf("Expected {%v} to be hidden, got %v", name, names)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"visible"}) && !reflect.DeepEqual(names, []string{".", "..", "visible"}) {
+		t.Errorf("Expected the other entries to be listed, got %v", names)
+	}
+}
+
+// Unit test for the controlFileNode in controldir.go
+func TestControlFile(t *testing.T) {
+	original := permissions.ReplaceSysadmin(permissions.Sysadmin{UID: 0, GID: 1 << 30, Set: true})
+	defer permissions.ReplaceSysadmin(original)
+	user := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+
+	file := &controlFileNode{render: func(ctx context.Context) []byte { return []byte("contents") }}
+
+	if _, _, errno := file.Open(user, syscall.O_WRONLY); errno != syscall.EROFS {
+		t.Errorf("Expected EROFS opening for writing, got %v", errno)
+	}
+	handle, flags, errno := file.Open(user, syscall.O_RDONLY)
+	if errno != fs.OK || flags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Fatalf("Expected to open with direct IO, got %v (%v)", errno, flags)
+	}
+
+	dest := make([]byte, 4)
+	result, _ := file.Read(user, handle, dest, 2)
+	data, _ := result.Bytes(dest)
+	if string(data) != "nten" {
+		t.Errorf("Expected {nten}, got {%s}", data)
+	}
+	result, _ = file.Read(user, handle, dest, 100)
+	if data, _ := result.Bytes(dest); len(data) != 0 {
+		t.Errorf("Expected nothing past the end, got {%s}", data)
+	}
+
+	file.adminOnly = true
+	if _, _, errno := file.Open(user, syscall.O_RDONLY); errno != syscall.EACCES {
+		t.Errorf("Expected EACCES for an admin only file, got %v", errno)
+	}
+}
+
+// Unit test for renderUsage in controldir.go
+func TestRenderUsage(t *testing.T) {
+	original := permissions.ReplaceSysadmin(permissions.Sysadmin{UID: 0, GID: 1 << 30, Set: true})
+	defer permissions.ReplaceSysadmin(original)
+
+	user := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+	lines := strings.Split(strings.TrimSpace(string(renderUsage(user))), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "1000 ") {
+		t.Errorf("Expected a user to only see themselves, got %v", lines)
+	}
+}
+
+// Unit test for renderQuota in controldir.go
+func TestRenderQuota(t *testing.T) {
+	original := permissions.ReplaceSysadmin(permissions.Sysadmin{UID: 0, GID: 1 << 30, Set: true})
+	defer permissions.ReplaceSysadmin(original)
+
+	other := quota.Owner{Kind: quota.User, ID: 2000}
+	if err := quota.Set(other, quota.Inodes, quota.Limit{Hard: 10}); err != nil {
+		t.Fatal(err)
+	}
+	defer quota.Remove(other)
+
+	user := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+	lines := strings.Split(strings.TrimSpace(string(renderQuota(user))), "\n")
+	if len(lines) != 7 || !strings.HasPrefix(lines[1], "uid:1000 ") || !strings.HasPrefix(lines[4], "gid:1000 ") {
+		t.Errorf("Expected a user to only see their own quotas, got %v", lines)
+	}
+
+	admin := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 0, Gid: 0}})
+	lines = strings.Split(strings.TrimSpace(string(renderQuota(admin))), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "uid:2000 ") {
+		t.Errorf("Expected the sysadmin to see every quota, got %v", lines)
+	}
+}
+
+// Unit test for logicalStatfs in statfs.go
+func TestLogicalStatfs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		stats    metadata.DedupStatistics
+		expected syscall.Statfs_t // only Blocks, Bfree and Bavail are checked
+	}{
+		{"nothing stored", metadata.DedupStatistics{}, syscall.Statfs_t{Blocks: 1000, Bfree: 600, Bavail: 500}},
+		{"nothing shared", metadata.DedupStatistics{LogicalBytes: 4096, PhysicalBytes: 4096}, syscall.Statfs_t{Blocks: 1000, Bfree: 600, Bavail: 500}},
+		// 100 blocks saved, so 500 used logically, and free space doubles
+		{"half shared", metadata.DedupStatistics{LogicalBytes: 200 * 1024, PhysicalBytes: 100 * 1024}, syscall.Statfs_t{Blocks: 1700, Bfree: 1200, Bavail: 1000}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := syscall.Statfs_t{Bsize: 1024, Blocks: 1000, Bfree: 600, Bavail: 500}
+			logicalStatfs(&s, tc.stats)
+			if s.Blocks != tc.expected.Blocks || s.Bfree != tc.expected.Bfree || s.Bavail != tc.expected.Bavail {
+				t.Errorf("Expected blocks %v, free %v, available %v, got %v, %v, %v",
+					tc.expected.Blocks, tc.expected.Bfree, tc.expected.Bavail, s.Blocks, s.Bfree, s.Bavail)
+			}
+		})
+	}
+
+	for _, name := range []string{"physical", "logical"} {
+		if mode, err := ParseStatfsMode(name); err != nil || mode.String() != name {
+			t.Errorf("Expected {%v} to parse, got %v, %v", name, mode, err)
+		}
+	}
+	if _, err := ParseStatfsMode("compressed"); err == nil {
+		t.Errorf("Expected an unknown mode to fail")
+	}
+}
+
+// Unit test for projectStatfs in statfs.go
+func TestProjectStatfs(t *testing.T) {
+	status := quota.Status{Usage: metadata.Usage{Inodes: 40, Logical: 300 * 1024, Physical: 100*1024 + 1}}
+	status.Quota.Limits[quota.Physical] = quota.Limit{Hard: 400 * 1024}
+	status.Quota.Limits[quota.Logical] = quota.Limit{Soft: 200 * 1024, Hard: 400 * 1024}
+	status.Quota.Limits[quota.Inodes] = quota.Limit{Hard: 50}
+
+	testCases := []struct {
+		name     string
+		mode     StatfsMode
+		expected syscall.Statfs_t // only Blocks, Bfree, Bavail, Files and Ffree are checked
+	}{
+		// Part of a block is a whole block used
+		{"physical", StatfsPhysical, syscall.Statfs_t{Blocks: 400, Bfree: 299, Bavail: 299, Files: 50, Ffree: 10}},
+		// The soft limit is reported, and nothing is free once it's passed
+		{"logical over soft limit", StatfsLogical, syscall.Statfs_t{Blocks: 200, Bfree: 0, Bavail: 0, Files: 50, Ffree: 10}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := syscall.Statfs_t{Bsize: 1024, Blocks: 1000, Bfree: 600, Bavail: 500, Files: 1000, Ffree: 900}
+			projectStatfs(&s, status, tc.mode)
+			if s.Blocks != tc.expected.Blocks || s.Bfree != tc.expected.Bfree || s.Bavail != tc.expected.Bavail || s.Files != tc.expected.Files || s.Ffree != tc.expected.Ffree {
+				t.Errorf("Expected %+v, got %+v", tc.expected, s)
+			}
+		})
+	}
+
+	// Nothing more is free than the underlying filesystem has, and without limits nothing changes
+	s := syscall.Statfs_t{Bsize: 1024, Blocks: 1000, Bfree: 100, Bavail: 50, Files: 1000, Ffree: 5}
+	projectStatfs(&s, status, StatfsPhysical)
+	if s.Bfree != 100 || s.Bavail != 50 || s.Ffree != 5 {
+		t.Errorf("Expected the underlying free space, got %+v", s)
+	}
+	s = syscall.Statfs_t{Bsize: 1024, Blocks: 1000, Bfree: 100}
+	projectStatfs(&s, quota.Status{}, StatfsPhysical)
+	if s.Blocks != 1000 || s.Bfree != 100 {
+		t.Errorf("Expected no change without limits, got %+v", s)
+	}
+}
+
+// Unit test for writesAllowed in modes.go
+func TestWritesAllowed(t *testing.T) {
+	original := permissions.SysAdmin
+	defer func() {
+		permissions.SysAdmin = original
+		SetReadOnly(false)
+		SetMaintenance(false)
+	}()
+	permissions.SysAdmin = permissions.Sysadmin{UID: 0, GID: 1 << 30, Set: true}
+
+	user := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+	admin := fuse.NewContext(&fuse.Context{}, &fuse.Caller{Owner: fuse.Owner{Uid: 0, Gid: 0}})
+
+	testCases := []struct {
+		name        string
+		readOnly    bool
+		maintenance bool
+		user        bool // whether the user can write
+		admin       bool // whether the sysadmin can write
+	}{
+		{"read-write", false, false, true, true},
+		{"maintenance", false, true, false, true},
+		{"read-only", true, false, false, false},
+		{"read-only and maintenance", true, true, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SetReadOnly(tc.readOnly)
+			SetMaintenance(tc.maintenance)
+			if allowed := writesAllowed(user); allowed != tc.user {
+				t.Errorf("Expected a user to be allowed {%v}, got {%v}", tc.user, allowed)
+			}
+			if allowed := writesAllowed(admin); allowed != tc.admin {
+				t.Errorf("Expected the sysadmin to be allowed {%v}, got {%v}", tc.admin, allowed)
+			}
+		})
+	}
+
+	if !SetMaintenance(false) {
+		t.Errorf("Expected SetMaintenance to report maintenance was on")
+	}
+}